@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader carries the ID of a request. It is sent back with the
+// answer and logged with the request, so a problem a user reports can be
+// found in the log. A client or proxy may send its own ID in it.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of an ID a client sends.
+const maxRequestIDLength = 64
+
+// accessLog, set with -access-log, turns request logging on or off.
+var accessLog = true
+
+// validRequestID reports whether id, sent by a client, is safe to log and
+// send back: short, and letters, digits and -_. only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggedResponse records the status and size of an answer. It passes
+// flushing and hijacking through, for event streams and WebSockets.
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *loggedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withRequestLog gives every request h serves an ID, sends it back in
+// requestIDHeader and, with accessLog on, logs the request once it is
+// answered: ID, method, path, status, size, latency and client.
+func withRequestLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		if !accessLog {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		lw := &loggedResponse{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		log.Printf("%s %s %s %d %dB %s %s", id, r.Method, r.URL.Path, lw.status, lw.bytes, time.Since(start).Round(time.Microsecond), remoteHost(r))
+	})
+}
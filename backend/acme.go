@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ACME client (RFC 8555) that gets and renews the node's certificate
+// from a CA such as Let's Encrypt. It proves control of the domains with
+// the tls-alpn-01 challenge (RFC 8737), which the CA checks on port 443 of
+// each domain, so the API must be reachable there: -addr :443, or a port
+// 443 forwards to.
+
+// acmeALPNProto is the protocol the CA asks for when it checks a
+// tls-alpn-01 challenge.
+const acmeALPNProto = "acme-tls/1"
+
+var (
+	// acmeDomains, set with -acme-domains, are the names to get a
+	// certificate for. None disables ACME.
+	acmeDomains   []string
+	acmeEmail     = ""
+	acmeCacheDir  = "acme"
+	acmeDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+)
+
+const (
+	// acmeRenewBefore is how long before it expires a certificate is
+	// renewed.
+	acmeRenewBefore   = 30 * 24 * time.Hour
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryInterval = 10 * time.Minute
+	acmePollInterval  = 2 * time.Second
+	acmePollTimeout   = 2 * time.Minute
+)
+
+// oidACMEIdentifier is the certificate extension a tls-alpn-01 challenge
+// certificate carries the key authorization digest in.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+var errNoCertificate = errors.New("acme: no certificate has been obtained yet")
+
+// acmeProblem is an ACME error document (RFC 7807).
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p acmeProblem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	if p.Type != "" {
+		return p.Type
+	}
+	return fmt.Sprintf("status %d", p.Status)
+}
+
+type acmeDirectoryDoc struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type   string       `json:"type"`
+		URL    string       `json:"url"`
+		Token  string       `json:"token"`
+		Status string       `json:"status"`
+		Error  *acmeProblem `json:"error"`
+	} `json:"challenges"`
+}
+
+// acmeManager keeps a certificate for its domains, caching it and the
+// account key in cacheDir. Requests to the CA are only made from run, so
+// only the certificates handed to the TLS server need the lock.
+type acmeManager struct {
+	directoryURL string
+	cacheDir     string
+	email        string
+	domains      []string
+	client       *http.Client
+
+	accountKey *ecdsa.PrivateKey
+	dir        acmeDirectoryDoc
+	kid        string
+	nonce      string
+
+	mu         sync.Mutex
+	cert       *tls.Certificate
+	challenges map[string]*tls.Certificate
+}
+
+// newACMEManager loads the account key from cacheDir, making one if there
+// is none, and the certificate cached there if it covers domains.
+func newACMEManager(directoryURL, cacheDir, email string, domains []string) (*acmeManager, error) {
+	m := &acmeManager{
+		directoryURL: directoryURL,
+		cacheDir:     cacheDir,
+		email:        email,
+		domains:      domains,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		challenges:   make(map[string]*tls.Certificate),
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateECKey(filepath.Join(cacheDir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("acme account key: %w", err)
+	}
+	m.accountKey = key
+	cert, err := tls.LoadX509KeyPair(m.cachePath("certificate.pem"), m.cachePath("certificate.key"))
+	if err == nil && m.covers(&cert) {
+		m.cert = &cert
+	}
+	return m, nil
+}
+
+func (m *acmeManager) cachePath(name string) string {
+	return filepath.Join(m.cacheDir, name)
+}
+
+// covers reports whether cert is for every one of the domains.
+func (m *acmeManager) covers(cert *tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	cert.Leaf = leaf
+	for _, d := range m.domains {
+		if leaf.VerifyHostname(d) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadOrCreateECKey reads a PEM P-256 key from path, or makes and saves
+// one there if the file does not exist.
+func loadOrCreateECKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s holds no PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileSync(path, keyPEM, 0600)
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// getCertificate is the tls.Config hook: the CA checking a challenge gets
+// the challenge certificate, everyone else the current certificate.
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+		if c, ok := m.challenges[name]; ok {
+			return c, nil
+		}
+		return nil, fmt.Errorf("acme: no challenge is pending for %q", name)
+	}
+	if m.cert == nil {
+		return nil, errNoCertificate
+	}
+	return m.cert, nil
+}
+
+func (m *acmeManager) needsRenewal() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < acmeRenewBefore
+}
+
+// run gets a certificate if there is none, and renews it as it nears
+// expiry, for as long as the node runs.
+func (m *acmeManager) run() {
+	for {
+		wait := acmeCheckInterval
+		if m.needsRenewal() {
+			if err := m.obtain(); err != nil {
+				log.Printf("acme: getting a certificate for %s: %v", strings.Join(m.domains, ", "), err)
+				wait = acmeRetryInterval
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// obtain orders a certificate for the domains, answers the challenges for
+// them and, once the CA has issued it, caches and serves it.
+func (m *acmeManager) obtain() error {
+	if m.dir.NewOrder == "" {
+		resp, err := m.client.Get(m.directoryURL)
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&m.dir)
+		resp.Body.Close()
+		if err != nil || m.dir.NewOrder == "" {
+			return fmt.Errorf("acme: %s is not an ACME directory", m.directoryURL)
+		}
+	}
+	if m.kid == "" {
+		account := map[string]interface{}{"termsOfServiceAgreed": true}
+		if m.email != "" {
+			account["contact"] = []string{"mailto:" + m.email}
+		}
+		resp, _, err := m.post(m.dir.NewAccount, account)
+		if err != nil {
+			return fmt.Errorf("registering an account: %w", err)
+		}
+		m.kid = resp.Header.Get("Location")
+	}
+
+	ids := make([]map[string]string, len(m.domains))
+	for i, d := range m.domains {
+		ids[i] = map[string]string{"type": "dns", "value": d}
+	}
+	resp, body, err := m.post(m.dir.NewOrder, map[string]interface{}{"identifiers": ids})
+	if err != nil {
+		return fmt.Errorf("placing an order: %w", err)
+	}
+	orderURL := resp.Header.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return err
+	}
+	for _, authzURL := range order.Authorizations {
+		if err := m.authorize(authzURL); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	if _, _, err := m.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}); err != nil {
+		return fmt.Errorf("finalizing the order: %w", err)
+	}
+	if body, err = m.poll(orderURL); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &order); err != nil || order.Certificate == "" {
+		return fmt.Errorf("acme: order %s has no certificate", orderURL)
+	}
+	_, chainPEM, err := m.post(order.Certificate, nil)
+	if err != nil {
+		return fmt.Errorf("downloading the certificate: %w", err)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(chainPEM, keyPEM)
+	if err != nil || !m.covers(&cert) {
+		return fmt.Errorf("acme: the CA issued an unusable certificate: %v", err)
+	}
+	if err := writeFileSync(m.cachePath("certificate.key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileSync(m.cachePath("certificate.pem"), chainPEM, 0600); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	log.Printf("acme: got a certificate for %s, valid until %s", strings.Join(m.domains, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// authorize answers the tls-alpn-01 challenge of an authorization and
+// waits for the CA to accept it.
+func (m *acmeManager) authorize(authzURL string) error {
+	_, body, err := m.post(authzURL, nil)
+	if err != nil {
+		return err
+	}
+	var authz acmeAuthorization
+	if err := json.Unmarshal(body, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	for _, ch := range authz.Challenges {
+		if ch.Type != "tls-alpn-01" {
+			continue
+		}
+		cert, err := m.challengeCert(domain, ch.Token)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.challenges[domain] = cert
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.challenges, domain)
+			m.mu.Unlock()
+		}()
+		if _, _, err := m.post(ch.URL, struct{}{}); err != nil {
+			return fmt.Errorf("answering the challenge for %s: %w", domain, err)
+		}
+		if body, err = m.poll(authzURL); err != nil {
+			json.Unmarshal(body, &authz)
+			for _, c := range authz.Challenges {
+				if c.Error != nil {
+					return fmt.Errorf("the CA could not check %s: %v", domain, c.Error)
+				}
+			}
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("acme: the CA offers no tls-alpn-01 challenge for %s", domain)
+}
+
+// challengeCert makes the self-signed certificate that answers a
+// tls-alpn-01 challenge for domain.
+func (m *acmeManager) challengeCert(domain, token string) (*tls.Certificate, error) {
+	digest := sha256.Sum256([]byte(token + "." + m.thumbprint()))
+	ext, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(now.UnixNano()),
+		Subject:         pkix.Name{CommonName: domain},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(24 * time.Hour),
+		DNSNames:        []string{domain},
+		ExtraExtensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// poll fetches the order or authorization at u until it is no longer
+// pending or processing, and returns it.
+func (m *acmeManager) poll(u string) ([]byte, error) {
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		_, body, err := m.post(u, nil)
+		if err != nil {
+			return nil, err
+		}
+		var obj struct {
+			Status string       `json:"status"`
+			Error  *acmeProblem `json:"error"`
+		}
+		json.Unmarshal(body, &obj)
+		switch obj.Status {
+		case "pending", "processing":
+		case "valid", "ready":
+			return body, nil
+		default:
+			if obj.Error != nil {
+				return body, fmt.Errorf("acme: %s is %s: %v", u, obj.Status, obj.Error)
+			}
+			return body, fmt.Errorf("acme: %s is %s", u, obj.Status)
+		}
+		if time.Now().After(deadline) {
+			return body, fmt.Errorf("acme: %s is still %s after %s", u, obj.Status, acmePollTimeout)
+		}
+		time.Sleep(acmePollInterval)
+	}
+}
+
+// jwk is the account public key as a JWK, members in the order RFC 7638
+// hashes them in, which json.Marshal keeps for a map.
+func (m *acmeManager) jwk() map[string]string {
+	pub, err := m.accountKey.PublicKey.ECDH()
+	if err != nil {
+		return nil
+	}
+	// An uncompressed point: 0x04, then x and y.
+	point := pub.Bytes()[1:]
+	enc := base64.RawURLEncoding
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   enc.EncodeToString(point[:32]),
+		"y":   enc.EncodeToString(point[32:]),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of the account key, which key
+// authorizations end in.
+func (m *acmeManager) thumbprint() string {
+	data, _ := json.Marshal(m.jwk())
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// nextNonce returns the nonce the last response came with, or a new one.
+func (m *acmeManager) nextNonce() (string, error) {
+	if n := m.nonce; n != "" {
+		m.nonce = ""
+		return n, nil
+	}
+	resp, err := m.client.Head(m.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		return n, nil
+	}
+	return "", errors.New("acme: the CA sent no nonce")
+}
+
+// signJWS wraps payload in a JWS signed with the account key, as ACME
+// requests must be. An empty payload makes a POST-as-GET.
+func (m *acmeManager) signJWS(u, nonce string, payload []byte) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": u}
+	if m.kid != "" {
+		protected["kid"] = m.kid
+	} else {
+		protected["jwk"] = m.jwk()
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, m.accountKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return json.Marshal(map[string]string{
+		"protected": enc.EncodeToString(header),
+		"payload":   enc.EncodeToString(payload),
+		"signature": enc.EncodeToString(sig),
+	})
+}
+
+// post sends payload to u as a signed request, or a POST-as-GET if it is
+// nil, and returns the response and its body. An ACME error comes back as
+// an error. A rejected nonce is retried once with a fresh one.
+func (m *acmeManager) post(u string, payload interface{}) (*http.Response, []byte, error) {
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		nonce, err := m.nextNonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		jws, err := m.signJWS(u, nonce, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := m.client.Post(u, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		m.nonce = resp.Header.Get("Replay-Nonce")
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			p := acmeProblem{Status: resp.StatusCode}
+			json.Unmarshal(body, &p)
+			if p.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 1 {
+				continue
+			}
+			return resp, body, p
+		}
+		return resp, body, nil
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubCA is a minimal ACME server. It checks every JWS the way a CA
+// does, checks tls-alpn-01 challenges by connecting to challengeAddr and
+// issues certificates valid for validFor.
+type stubCA struct {
+	t             *testing.T
+	srv           *httptest.Server
+	challengeAddr string
+	validFor      time.Duration
+	badNonce      bool
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu          sync.Mutex
+	nonceSeq    int
+	nonces      map[string]bool
+	accounts    map[string]*ecdsa.PublicKey
+	thumbprint  string
+	newAccounts int
+	orders      int
+	challenges  int
+	token       string
+	domain      string
+	authzStatus string
+	orderStatus string
+	chainPEM    []byte
+}
+
+func newStubCA(t *testing.T) *stubCA {
+	ca := &stubCA{
+		t:        t,
+		nonces:   map[string]bool{},
+		accounts: map[string]*ecdsa.PublicKey{},
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caKey = key
+	ca.caCert, _ = x509.ParseCertificate(der)
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	return ca
+}
+
+func (ca *stubCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+func (ca *stubCA) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:" + typ, Detail: detail, Status: status})
+}
+
+func (ca *stubCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nonceSeq++
+	nonce := fmt.Sprint("nonce-", ca.nonceSeq)
+	ca.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(acmeDirectoryDoc{
+			NewNonce:   ca.url("/new-nonce"),
+			NewAccount: ca.url("/new-account"),
+			NewOrder:   ca.url("/new-order"),
+		})
+		return
+	case "/new-nonce":
+		return
+	}
+	payload, kid, err := ca.verifyJWS(r)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	if ca.badNonce {
+		ca.badNonce = false
+		ca.problem(w, http.StatusBadRequest, "badNonce", "nonce expired")
+		return
+	}
+	if kid == "" && r.URL.Path != "/new-account" {
+		ca.problem(w, http.StatusBadRequest, "malformed", "only new accounts may sign with a jwk")
+		return
+	}
+	switch r.URL.Path {
+	case "/new-account":
+		ca.newAccounts++
+		w.Header().Set("Location", ca.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/new-order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		if len(req.Identifiers) != 1 {
+			ca.problem(w, http.StatusBadRequest, "malformed", "want one identifier")
+			return
+		}
+		ca.orders++
+		ca.domain = req.Identifiers[0].Value
+		ca.token = fmt.Sprint("token-", ca.orders)
+		ca.authzStatus, ca.orderStatus, ca.chainPEM = "pending", "pending", nil
+		w.Header().Set("Location", ca.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		ca.writeOrder(w)
+	case "/order/1":
+		ca.writeOrder(w)
+	case "/authz/1":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     ca.authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": ca.domain},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": ca.url("/challenge/http"), "token": ca.token, "status": "pending"},
+				{"type": "tls-alpn-01", "url": ca.url("/challenge/1"), "token": ca.token, "status": "pending"},
+			},
+		})
+	case "/challenge/1":
+		ca.challenges++
+		if err := ca.checkALPN(); err != nil {
+			ca.t.Errorf("tls-alpn-01 challenge: %v", err)
+			ca.authzStatus = "invalid"
+		} else {
+			ca.authzStatus, ca.orderStatus = "valid", "ready"
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "processing"})
+	case "/finalize/1":
+		if ca.orderStatus != "ready" {
+			ca.problem(w, http.StatusForbidden, "orderNotReady", "order is "+ca.orderStatus)
+			return
+		}
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		if err := ca.issue(req.CSR); err != nil {
+			ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		ca.orderStatus = "valid"
+		ca.writeOrder(w)
+	case "/certificate/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.chainPEM)
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", r.URL.Path+" not found")
+	}
+}
+
+func (ca *stubCA) writeOrder(w http.ResponseWriter) {
+	order := acmeOrder{
+		Status:         ca.orderStatus,
+		Authorizations: []string{ca.url("/authz/1")},
+		Finalize:       ca.url("/finalize/1"),
+	}
+	if ca.orderStatus == "valid" {
+		order.Certificate = ca.url("/certificate/1")
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+// verifyJWS checks the signature, nonce and url of a request and returns
+// its payload and the account it was signed by, "" for a new account.
+func (ca *stubCA) verifyJWS(r *http.Request) ([]byte, string, error) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, "", err
+	}
+	enc := base64.RawURLEncoding
+	header, err := enc.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, "", err
+	}
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return nil, "", err
+	}
+	if protected.Alg != "ES256" {
+		return nil, "", fmt.Errorf("alg %q", protected.Alg)
+	}
+	if !ca.nonces[protected.Nonce] {
+		return nil, "", fmt.Errorf("nonce %q was not issued or was used", protected.Nonce)
+	}
+	delete(ca.nonces, protected.Nonce)
+	if protected.URL != ca.url(r.URL.Path) {
+		return nil, "", fmt.Errorf("url %q signed for a request to %s", protected.URL, r.URL.Path)
+	}
+	var key *ecdsa.PublicKey
+	switch {
+	case protected.Kid != "":
+		if key = ca.accounts[protected.Kid]; key == nil {
+			return nil, "", fmt.Errorf("unknown account %q", protected.Kid)
+		}
+	case protected.JWK != nil:
+		x, _ := enc.DecodeString(protected.JWK["x"])
+		y, _ := enc.DecodeString(protected.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	default:
+		return nil, "", fmt.Errorf("neither kid nor jwk")
+	}
+	sig, err := enc.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 {
+		return nil, "", fmt.Errorf("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, "", fmt.Errorf("bad signature")
+	}
+	if protected.Kid == "" {
+		ca.accounts[ca.url("/account/1")] = key
+		// RFC 7638: the required members, sorted, without whitespace.
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, protected.JWK["x"], protected.JWK["y"])))
+		ca.thumbprint = enc.EncodeToString(sum[:])
+	}
+	payload, err := enc.DecodeString(jws.Payload)
+	return payload, protected.Kid, err
+}
+
+// checkALPN connects to the node as a CA checking a tls-alpn-01 challenge
+// does and checks the certificate it is answered with.
+func (ca *stubCA) checkALPN() error {
+	conn, err := tls.Dial("tcp", ca.challengeAddr, &tls.Config{
+		ServerName:         ca.domain,
+		NextProtos:         []string{acmeALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeALPNProto {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != ca.domain {
+		return fmt.Errorf("challenge certificate for %v", cert.DNSNames)
+	}
+	want := sha256.Sum256([]byte(ca.token + "." + ca.thumbprint))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidACMEIdentifier) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+			return err
+		}
+		if !ext.Critical || !bytes.Equal(got, want[:]) {
+			return fmt.Errorf("wrong acmeIdentifier extension")
+		}
+		return nil
+	}
+	return fmt.Errorf("no acmeIdentifier extension")
+}
+
+// issue signs the certificate a base64url DER CSR asks for.
+func (ca *stubCA) issue(b64 string) error {
+	der, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != ca.domain {
+		return fmt.Errorf("csr for %v, order for %s", csr.DNSNames, ca.domain)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.orders + 1)),
+		Subject:      pkix.Name{CommonName: ca.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ca.validFor),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		return err
+	}
+	ca.chainPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+	return nil
+}
+
+// serveChallenges answers TLS connections with m's certificates, as the
+// node's HTTPS listener does.
+func serveChallenges(t *testing.T, m *acmeManager) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"http/1.1", acmeALPNProto},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestACMEObtainAndRenew(t *testing.T) {
+	const domain = "node.example"
+	ca := newStubCA(t)
+	defer ca.srv.Close()
+	cacheDir := t.TempDir()
+	m, err := newACMEManager(ca.url("/directory"), cacheDir, "ops@node.example", []string{domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := serveChallenges(t, m)
+	defer ln.Close()
+	ca.challengeAddr = ln.Addr().String()
+
+	if _, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != errNoCertificate {
+		t.Errorf("before obtaining: got %v, want errNoCertificate", err)
+	}
+	if !m.needsRenewal() {
+		t.Error("a manager without a certificate does not need one")
+	}
+
+	// A certificate about to expire, first, with a nonce the CA rejects.
+	ca.validFor = acmeRenewBefore / 2
+	ca.badNonce = true
+	if err := m.obtain(); err != nil {
+		t.Fatalf("obtaining: %v", err)
+	}
+	if ca.newAccounts != 1 || ca.challenges != 1 || m.kid != ca.url("/account/1") {
+		t.Errorf("%d accounts, %d challenges, kid %q after the first order", ca.newAccounts, ca.challenges, m.kid)
+	}
+	cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil || cert.Leaf.VerifyHostname(domain) != nil {
+		t.Fatalf("serving %v, %v after obtaining", cert, err)
+	}
+	if len(m.challenges) != 0 {
+		t.Error("challenge certificate kept after the authorization")
+	}
+	if !m.needsRenewal() {
+		t.Errorf("certificate valid until %s does not need renewing", cert.Leaf.NotAfter)
+	}
+
+	// Renewing reuses the account.
+	ca.validFor = 3 * acmeRenewBefore
+	if err := m.obtain(); err != nil {
+		t.Fatalf("renewing: %v", err)
+	}
+	if ca.newAccounts != 1 || ca.orders != 2 {
+		t.Errorf("%d accounts and %d orders after renewing, want 1 and 2", ca.newAccounts, ca.orders)
+	}
+	renewed, _ := m.getCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if renewed == cert || m.needsRenewal() {
+		t.Errorf("after renewing, serving a certificate valid until %s", renewed.Leaf.NotAfter)
+	}
+
+	// A restarted node picks up the cached account key and certificate.
+	again, err := newACMEManager(ca.url("/directory"), cacheDir, "", []string{domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.thumbprint() != m.thumbprint() {
+		t.Error("account key not reloaded from the cache")
+	}
+	if again.cert == nil || !again.cert.Leaf.NotAfter.Equal(renewed.Leaf.NotAfter) || again.needsRenewal() {
+		t.Error("renewed certificate not reloaded from the cache")
+	}
+	other, err := newACMEManager(ca.url("/directory"), cacheDir, "", []string{"other.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.cert != nil {
+		t.Error("cached certificate served for a domain it does not cover")
+	}
+}
+
+func TestACMEChallengeOnlyForALPN(t *testing.T) {
+	m := &acmeManager{challenges: map[string]*tls.Certificate{}}
+	m.accountKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c, err := m.challengeCert("node.example", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.challenges["node.example"] = c
+	acme := []string{acmeALPNProto}
+	if got, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "Node.Example.", SupportedProtos: acme}); err != nil || got != c {
+		t.Errorf("challenge hello: got %v, %v", got, err)
+	}
+	if _, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "other.example", SupportedProtos: acme}); err == nil {
+		t.Error("challenge certificate for a domain with no pending challenge")
+	}
+	if got, _ := m.getCertificate(&tls.ClientHelloInfo{ServerName: "node.example", SupportedProtos: []string{"h2", "http/1.1"}}); got == c {
+		t.Error("challenge certificate served to a browser")
+	}
+}
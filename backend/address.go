@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// historyEntry is one transaction touching an address.
+type historyEntry struct {
+	TxID        string      `json:"tx"`
+	BlockIndex  int         `json:"block_index"`
+	BlockHash   string      `json:"block_hash"`
+	Timestamp   int64       `json:"timestamp"`
+	Direction   string      `json:"direction"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// pageParams reads ?limit=&offset= with defaults and bounds.
+func pageParams(r *http.Request) (limit, offset int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// addressHistory lists every confirmed transaction sent from or received by
+// addr, oldest first. The caller must hold mutex.
+func addressHistory(addr string) []historyEntry {
+	var out []historyEntry
+	for _, h := range addrIndex[addr] {
+		b := blockchain[h]
+		for _, raw := range b.Transactions {
+			tx, ok := parseTransaction(raw)
+			if !ok || (tx.From != addr && tx.To != addr) {
+				continue
+			}
+			direction := "received"
+			switch {
+			case tx.From == addr && tx.To == addr:
+				direction = "self"
+			case tx.From == addr:
+				direction = "sent"
+			}
+			out = append(out, historyEntry{
+				TxID:        tx.id(),
+				BlockIndex:  b.Index,
+				BlockHash:   b.Hash,
+				Timestamp:   b.Timestamp,
+				Direction:   direction,
+				Transaction: tx,
+			})
+		}
+	}
+	return out
+}
+
+// handleAddress serves GET /address/{addr}/history?limit=&offset=.
+func handleAddress(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("address")
+	if err := validateAddress(addr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, offset := pageParams(r)
+	mutex.Lock()
+	history := addressHistory(addr)
+	mutex.Unlock()
+	total := len(history)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":      addr,
+		"total":        total,
+		"offset":       offset,
+		"limit":        limit,
+		"transactions": append([]historyEntry{}, history[offset:end]...),
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// The operations that need roleAdmin, such as managing keys and tokens,
+// adding and dropping peers, banning hosts and dropping pending
+// transactions, can be moved off the public API onto a listener of their
+// own with -admin-addr, typically bound to localhost or a management
+// network. The public API then only reads, takes transactions and mines.
+// Without -admin-addr they stay on the public API, behind the admin role.
+
+// adminAddr, set with -admin-addr, is the address of the admin listener;
+// empty serves admin operations on the public API.
+var adminAddr = ""
+
+// adminMux routes the admin listener.
+var adminMux = http.NewServeMux()
+
+// onAdminListener reports whether an operation of a route is served by the
+// admin listener instead of the public API.
+func onAdminListener(pattern string, op apiOp) bool {
+	return adminAddr != "" && requiredRole(pattern, op.Method) == roleAdmin
+}
+
+// checkAdminAddr refuses an admin listener anyone on the network could use:
+// one on a non-loopback address needs roles enforced, by API keys,
+// -admin-key or -jwt-secret.
+func checkAdminAddr() error {
+	if adminAddr == "" || authEnabled() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(adminAddr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("-admin-addr on a non-loopback address needs -admin-key, -jwt-secret or -api-keys")
+	}
+	return nil
+}
+
+// newAdminServer returns the admin listener's server. It is plain HTTP and
+// sends no CORS headers, as it is not meant for browsers.
+func newAdminServer() *http.Server {
+	return &http.Server{Addr: adminAddr, Handler: withRequestLog(adminMux), BaseContext: serverContext}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys are long-lived credentials, each with a role, for the role
+// checks in auth.go.
+
+// apiKeyHeader is the request header a key is sent in.
+const apiKeyHeader = "X-API-Key"
+
+var (
+	errBadAPIKey   = errors.New("unknown API key")
+	errKeyExists   = errors.New("a key with this name already exists")
+	errKeyNotFound = errors.New("no key with this name")
+)
+
+// adminKey, set with -admin-key, is a key with roleAdmin that is not kept
+// in the key file.
+var adminKey = ""
+
+// apiKey is a named key. Key is only set in the key file and in the answer
+// to the request that created it.
+type apiKey struct {
+	Name    string `json:"name"`
+	Key     string `json:"key,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Created int64  `json:"created"`
+}
+
+// role is the role of k. Keys from before roles may submit and mine, as
+// they could then.
+func (k apiKey) role() string {
+	if k.Role == "" {
+		return roleMiner
+	}
+	return k.Role
+}
+
+// apiKeyStore holds the keys by the SHA-256 of the key, and saves them to
+// path, if set, whenever they change.
+type apiKeyStore struct {
+	mu     sync.Mutex
+	path   string
+	byHash map[[32]byte]apiKey
+}
+
+var apiKeys = &apiKeyStore{byHash: make(map[[32]byte]apiKey)}
+
+// load reads the key file, a JSON array of {name, key}, and keeps path to
+// save to. A missing file is an empty one.
+func (s *apiKeyStore) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Name == "" || k.Key == "" || k.Name == "admin" {
+			return errors.New("every API key needs a name other than admin and a key")
+		}
+		if k.Role != "" && roleRanks[k.Role] == 0 {
+			return fmt.Errorf("API key %s has unknown role %q", k.Name, k.Role)
+		}
+		s.byHash[sha256.Sum256([]byte(k.Key))] = k
+	}
+	return nil
+}
+
+// save writes the keys back to the key file. The caller must hold s.mu.
+func (s *apiKeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	keys := make([]apiKey, 0, len(s.byHash))
+	for _, k := range s.byHash {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path, data, 0600)
+}
+
+func (s *apiKeyStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byHash)
+}
+
+// lookup returns the key a client presented, if it is one.
+func (s *apiKeyStore) lookup(key string) (apiKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[sha256.Sum256([]byte(key))]
+	return k, ok
+}
+
+// create makes a new random key under name.
+func (s *apiKeyStore) create(name, role string) (apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.byHash {
+		if k.Name == name {
+			return apiKey{}, errKeyExists
+		}
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return apiKey{}, err
+	}
+	k := apiKey{Name: name, Key: "mk_" + hex.EncodeToString(b), Role: role, Created: time.Now().Unix()}
+	s.byHash[sha256.Sum256([]byte(k.Key))] = k
+	return k, s.save()
+}
+
+// revoke removes the key under name.
+func (s *apiKeyStore) revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, k := range s.byHash {
+		if k.Name == name {
+			delete(s.byHash, h)
+			return s.save()
+		}
+	}
+	return errKeyNotFound
+}
+
+// list returns the keys by name, without the keys themselves.
+func (s *apiKeyStore) list() []apiKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]apiKey, 0, len(s.byHash))
+	for _, k := range s.byHash {
+		k.Key = ""
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+func isAdminKey(key string) bool {
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+// newKeyRequest is the body of POST /admin/keys.
+type newKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// handleAPIKeys serves /admin/keys for admins: GET lists the keys, POST
+// {name, role} creates one and answers with it, the only time it is shown,
+// and DELETE ?name= revokes one.
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		// Nobody could be told apart from an admin.
+		http.Error(w, "key management is disabled; start the node with -admin-key or -jwt-secret", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": apiKeys.list()})
+	case http.MethodPost:
+		var body newKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Name) == "" || body.Name == "admin" {
+			http.Error(w, "invalid body, expected {\"name\":\"...\",\"role\":\"...\"}", http.StatusBadRequest)
+			return
+		}
+		if body.Role != "" && roleRanks[body.Role] == 0 {
+			http.Error(w, "role must be reader, submitter, miner or admin", http.StatusBadRequest)
+			return
+		}
+		k, err := apiKeys.create(strings.TrimSpace(body.Name), body.Role)
+		if errors.Is(err, errKeyExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(k)
+	case http.MethodDelete:
+		err := apiKeys.revoke(r.URL.Query().Get("name"))
+		if errors.Is(err, errKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "key revoked"})
+	}
+}
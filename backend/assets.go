@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	txTypeAssetMint     = "asset_mint"
+	txTypeAssetTransfer = "asset_transfer"
+)
+
+// assetTransfer is one ownership change in an asset's provenance.
+type assetTransfer struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	BlockIndex int    `json:"block_index"`
+	TxID       string `json:"tx"`
+}
+
+// assetInfo is a unique asset identified by the hash of its content.
+type assetInfo struct {
+	ID        string          `json:"id"`
+	Owner     string          `json:"owner"`
+	Creator   string          `json:"creator"`
+	MintBlock int             `json:"mint_block"`
+	MintTxID  string          `json:"mint_tx"`
+	Transfers []assetTransfer `json:"transfers"`
+}
+
+// assets holds every minted asset as of the chain tip. It is guarded by
+// mutex.
+var assets = map[string]*assetInfo{}
+
+func validateAssetID(id string) error {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 32 {
+		return fmt.Errorf("invalid asset id %q: expected a hex SHA-256 content hash", id)
+	}
+	return nil
+}
+
+// applyAssetTx applies an asset transaction included at the given height.
+func applyAssetTx(tx Transaction, height int) {
+	switch tx.Type {
+	case txTypeAssetMint:
+		assets[tx.Asset] = &assetInfo{
+			ID:        tx.Asset,
+			Owner:     tx.From,
+			Creator:   tx.From,
+			MintBlock: height,
+			MintTxID:  tx.id(),
+			Transfers: []assetTransfer{},
+		}
+	case txTypeAssetTransfer:
+		a := assets[tx.Asset]
+		if a == nil {
+			return
+		}
+		a.Owner = tx.To
+		a.Transfers = append(a.Transfers, assetTransfer{
+			From:       tx.From,
+			To:         tx.To,
+			BlockIndex: height,
+			TxID:       tx.id(),
+		})
+	}
+}
+
+// checkAssetRules enforces that an asset is minted once and only moved by
+// its current owner, one pending transfer at a time.
+func checkAssetRules(tx Transaction, replacing *mempoolEntry) error {
+	switch tx.Type {
+	case txTypeAssetMint:
+		if assets[tx.Asset] != nil {
+			return fmt.Errorf("asset %s already minted", tx.Asset)
+		}
+		for _, e := range mempool.all() {
+			if e != replacing && e.structured && e.tx.Type == txTypeAssetMint && e.tx.Asset == tx.Asset {
+				return fmt.Errorf("asset %s is already pending mint", tx.Asset)
+			}
+		}
+	case txTypeAssetTransfer:
+		a := assets[tx.Asset]
+		if a == nil {
+			return fmt.Errorf("unknown asset %s", tx.Asset)
+		}
+		if a.Owner != tx.From {
+			return errors.New("sender does not own the asset")
+		}
+		for _, e := range mempool.all() {
+			if e != replacing && e.structured && e.tx.Type == txTypeAssetTransfer && e.tx.Asset == tx.Asset {
+				return fmt.Errorf("asset %s already has a pending transfer", tx.Asset)
+			}
+		}
+	}
+	return nil
+}
+
+func handleGetAsset(w http.ResponseWriter, r *http.Request) {
+	id := strings.ToLower(r.PathValue("id"))
+	mutex.Lock()
+	defer mutex.Unlock()
+	a := assets[id]
+	if a == nil {
+		http.Error(w, "asset not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(a)
+}
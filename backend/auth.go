@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Access to the API is by role. A caller authenticates with a bearer JWT
+// (see jwt.go) or an API key (see apikeys.go), either of which carries a
+// role, and each route lists the role its methods need. Roles are only
+// enforced once a key exists or -admin-key or -jwt-secret is set, so a node
+// configured with none of them behaves as before.
+
+// Roles, from least to most trusted. Each may do what those before it may.
+const (
+	roleReader    = "reader"
+	roleSubmitter = "submitter"
+	roleMiner     = "miner"
+	roleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{roleReader: 1, roleSubmitter: 2, roleMiner: 3, roleAdmin: 4}
+
+var (
+	errNoCredentials = errors.New("credentials are required: a bearer token or an " + apiKeyHeader + " header")
+	errBadAuthHeader = errors.New("the Authorization header must be a bearer token")
+	errForbidden     = errors.New("not allowed")
+)
+
+// authReads, set with -auth-reads, makes every route not in routeRoles or
+// peerRoutes need roleReader, instead of being public.
+var authReads = false
+
+// routeRoles maps route patterns to the role each method needs, "" for
+// none. "*" is every method not listed.
+var routeRoles = map[string]map[string]string{
+	"/tx":              {"*": roleSubmitter},
+	"/tx/":             {"POST": roleSubmitter},
+	"/mine":            {"*": roleMiner},
+	"/mine/bulk":       {"*": roleMiner},
+	"/mine/submit":     {"*": roleMiner},
+	"/miner/start":     {"*": roleMiner},
+	"/miner/stop":      {"*": roleMiner},
+	"/miner/benchmark": {"*": roleMiner},
+	"/pending/":        {"*": roleAdmin},
+	"/peers":           {"POST": roleAdmin, "DELETE": roleAdmin},
+	"/peers/bans":      {"POST": roleAdmin, "DELETE": roleAdmin},
+	"/admin/keys":      {"*": roleAdmin},
+	"/admin/tokens":    {"*": roleAdmin},
+	// Probes carry no credentials, so these stay open under -auth-reads.
+	"/healthz": {"*": ""},
+	"/readyz":  {"*": ""},
+}
+
+// peerRoutes are what other nodes call to sync and relay. Nodes carry no
+// credentials, so -auth-reads leaves these open.
+var peerRoutes = map[string]bool{
+	"/blocks":         true,
+	"/blocks/":        true,
+	"/blocks/compact": true,
+	"/headers":        true,
+	"/handshake":      true,
+	"/snapshot":       true,
+	"/peers/tx":       true,
+	"/peers/ws":       true,
+}
+
+// requiredRole is the role a method on a route needs, "" for none.
+func requiredRole(pattern, method string) string {
+	if roles, ok := routeRoles[pattern]; ok {
+		if role, ok := roles[method]; ok {
+			return role
+		}
+		if role, ok := roles["*"]; ok {
+			return role
+		}
+	}
+	if authReads && !peerRoutes[pattern] {
+		return roleReader
+	}
+	return ""
+}
+
+// authEnabled reports whether roles are being enforced.
+func authEnabled() bool {
+	return apiKeys.count() > 0 || adminKey != "" || jwtSecret != ""
+}
+
+// caller is who a request comes from: the client it is counted against by
+// the rate limits, who it authenticated as, and with what role. authErr is
+// why its credentials were refused, if they were.
+type caller struct {
+	client  string
+	name    string
+	role    string
+	authErr error
+}
+
+type callerKey struct{}
+
+// identify reads the credentials of r, a bearer token or an API key.
+func identify(r *http.Request) caller {
+	c := caller{client: remoteHost(r)}
+	if h := r.Header.Get("Authorization"); h != "" {
+		token := strings.TrimPrefix(h, "Bearer ")
+		if token == h {
+			c.authErr = errBadAuthHeader
+			return c
+		}
+		claims, err := parseJWT(token)
+		if err != nil {
+			c.authErr = err
+			return c
+		}
+		c.name, c.role = "jwt:"+claims.Subject, claims.Role
+	} else if key := r.Header.Get(apiKeyHeader); key != "" {
+		switch k, ok := apiKeys.lookup(key); {
+		case isAdminKey(key):
+			c.name, c.role = "admin", roleAdmin
+		case ok:
+			c.name, c.role = "key:"+k.Name, k.role()
+		default:
+			c.authErr = errBadAPIKey
+			return c
+		}
+	}
+	if c.name != "" {
+		c.client = c.name
+	}
+	return c
+}
+
+// withCaller records the caller of r in its context.
+func withCaller(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, identify(r)))
+}
+
+func callerOf(ctx context.Context) caller {
+	c, _ := ctx.Value(callerKey{}).(caller)
+	return c
+}
+
+// authorize returns the status and error to refuse the caller recorded in
+// ctx with, if it may not do what needs role.
+func authorize(ctx context.Context, role string) (int, error) {
+	if role == "" || !authEnabled() {
+		return 0, nil
+	}
+	c := callerOf(ctx)
+	switch {
+	case c.authErr != nil:
+		return http.StatusUnauthorized, c.authErr
+	case c.role == "":
+		return http.StatusUnauthorized, errNoCredentials
+	case roleRanks[c.role] < roleRanks[role]:
+		return http.StatusForbidden, fmt.Errorf("%w: this needs the %s role, %s has %s", errForbidden, role, c.name, c.role)
+	}
+	return 0, nil
+}
+
+// requireRole wraps the handler of a route so that each method is refused
+// to callers without the role requiredRole gives it. It runs inside
+// limitRequests, which records the caller.
+func requireRole(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status, err := authorize(r.Context(), requiredRole(pattern, r.Method)); err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		h(w, r)
+	}
+}
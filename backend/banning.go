@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Misbehavior scores. A host whose score reaches banThreshold is banned
+// for banDuration, after which it starts again from zero.
+const (
+	banThreshold      = 100
+	scoreInvalidBlock = 50
+	scoreInvalidTx    = 10
+)
+
+var banDuration = 24 * time.Hour
+
+var errPeerBanned = errors.New("peer is banned for misbehaving")
+
+// banEntry is the misbehavior record of one host.
+type banEntry struct {
+	Host        string `json:"host"`
+	Score       int    `json:"score"`
+	BannedUntil int64  `json:"banned_until,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// banList tracks misbehavior per host rather than per peer URL, so a
+// banned node cannot come back on another port.
+type banList struct {
+	mu    sync.Mutex
+	hosts map[string]*banEntry
+}
+
+var bans = &banList{hosts: map[string]*banEntry{}}
+
+// banned reports whether host is currently banned, forgetting bans that
+// have expired.
+func (l *banList) banned(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.hosts[host]
+	if !ok || e.BannedUntil == 0 {
+		return false
+	}
+	if time.Now().Unix() >= e.BannedUntil {
+		delete(l.hosts, host)
+		return false
+	}
+	return true
+}
+
+// misbehave adds score to host and bans it once the threshold is reached,
+// dropping its peers. It reports whether host is banned.
+func (l *banList) misbehave(host string, score int, reason string) bool {
+	if host == "" {
+		return false
+	}
+	l.mu.Lock()
+	e, ok := l.hosts[host]
+	if !ok {
+		e = &banEntry{Host: host}
+		l.hosts[host] = e
+	}
+	if e.BannedUntil != 0 {
+		l.mu.Unlock()
+		return true
+	}
+	e.Score += score
+	e.Reason = reason
+	if e.Score < banThreshold {
+		l.mu.Unlock()
+		return false
+	}
+	e.BannedUntil = time.Now().Add(banDuration).Unix()
+	banned := *e
+	l.mu.Unlock()
+
+	log.Printf("banning %s until %s: %s", host, time.Unix(banned.BannedUntil, 0).Format(time.RFC3339), reason)
+	peers.removeHost(host)
+	publishEvent("peer_banned", banned)
+	return true
+}
+
+func (l *banList) unban(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.hosts[host]; !ok {
+		return false
+	}
+	delete(l.hosts, host)
+	return true
+}
+
+// list returns the hosts with a score or a ban, sorted by host.
+func (l *banList) list() []banEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	out := make([]banEntry, 0, len(l.hosts))
+	for host, e := range l.hosts {
+		if e.BannedUntil != 0 && now >= e.BannedUntil {
+			delete(l.hosts, host)
+			continue
+		}
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// hostOf returns the host name of a peer URL.
+func hostOf(peer string) string {
+	u, err := url.Parse(peer)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// remoteHost returns the address a request came from.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// invalidBlock reports whether err, returned for a block from a peer,
+// shows the block itself to be invalid, as opposed to the peer merely
+// being on another branch, ahead of this node or running its clock ahead.
+func invalidBlock(err error) bool {
+	return err != nil && !errors.Is(err, errKnownBlock) && !errors.Is(err, errOrphanBlock) &&
+		!errors.Is(err, errBlockNotOnTip) && !errors.Is(err, errFutureBlock) &&
+		!errors.Is(err, errDeferredBlock)
+}
+
+// handleBans serves GET /peers/bans, the misbehavior scores and bans,
+// POST /peers/bans?host= to ban a host by hand and DELETE /peers/bans?host=
+// to lift a ban. A peer URL is taken as its host.
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		host := r.URL.Query().Get("host")
+		if strings.Contains(host, "://") {
+			host = hostOf(host)
+		}
+		if host == "" {
+			http.Error(w, "query param host required", http.StatusBadRequest)
+			return
+		}
+		reason := "banned by an operator"
+		if why := r.URL.Query().Get("reason"); why != "" {
+			reason += ": " + why
+		}
+		bans.misbehave(host, banThreshold, reason)
+	case http.MethodDelete:
+		if !bans.unban(r.URL.Query().Get("host")) {
+			http.Error(w, "unknown host", http.StatusNotFound)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"bans": bans.list()})
+}
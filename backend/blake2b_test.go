@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestBlake2bVectors(t *testing.T) {
+	block := make([]byte, 256)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	for _, c := range []struct {
+		name string
+		data []byte
+		size int
+		want string
+	}{
+		// RFC 7693, Appendix A.
+		{"abc", []byte("abc"), 64, "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"abc", []byte("abc"), 32, "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{"empty", nil, 64, "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{"empty", nil, 32, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		// Two full blocks, the last compressed as final.
+		{"0..255", block, 32, "39a7eb9fedc19aabc83425c6755dd90e6f9d0c804964a1f4aaeea3b9fb599835"},
+	} {
+		out := make([]byte, c.size)
+		blake2bSum(out, c.data)
+		if got := hex.EncodeToString(out); got != c.want {
+			t.Errorf("BLAKE2b-%d(%s) = %s, want %s", c.size*8, c.name, got, c.want)
+		}
+	}
+	sum := blake2b256([]byte("abc"))
+	if got := hex.EncodeToString(sum[:]); got != "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319" {
+		t.Errorf("blake2b256(abc) = %s", got)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// Block formats. Each block records the format its hash preimage is built
+// in.
+//
+// blockFormatText concatenates decimal numbers and strings, so different
+// field values can give the same preimage: index 12 with timestamp 3 reads
+// like index 1 with timestamp 23.
+//
+// blockFormatBinary writes numbers at fixed width, big-endian, and strings
+// and lists behind their uvarint length. The same encoding, with the hash,
+// signature and transactions added, carries blocks between nodes.
+const (
+	blockFormatText   = 0
+	blockFormatBinary = 1
+)
+
+// currentBlockFormat is the format new blocks are built in.
+const currentBlockFormat = blockFormatBinary
+
+// blockContentType and blockListContentType mark bodies holding one block
+// or a list of blocks in the binary encoding.
+const (
+	blockContentType     = "application/x-mesam-block"
+	blockListContentType = "application/x-mesam-blocks"
+)
+
+// maxEncodedBlock bounds a binary block body accepted from a peer.
+const maxEncodedBlock = 32 << 20
+
+var (
+	errBlockFormat = errors.New("unknown or downgraded block format")
+	errBadEncoding = errors.New("malformed binary block")
+)
+
+// checkBlockFormat rejects a block in an unknown format or an older one
+// than its parent's.
+func checkBlockFormat(prev, b Block) error {
+	if b.Format < blockFormatText || b.Format > currentBlockFormat {
+		return fmt.Errorf("%w: %d", errBlockFormat, b.Format)
+	}
+	if b.Format < prev.Format {
+		return fmt.Errorf("%w: %d after %d", errBlockFormat, b.Format, prev.Format)
+	}
+	return nil
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(dst, buf[:]...)
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(dst, buf[:]...)
+}
+
+func appendBytes(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func appendStrings(dst []byte, list []string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(list)))
+	for _, s := range list {
+		dst = appendBytes(dst, s)
+	}
+	return dst
+}
+
+// appendHeaderPrefix writes the header fields hashed before the nonce.
+func appendHeaderPrefix(dst []byte, b Block) []byte {
+	dst = append(dst, byte(b.Format))
+	dst = appendUint64(dst, uint64(b.Index))
+	dst = appendUint64(dst, uint64(b.Timestamp))
+	dst = appendBytes(dst, b.PrevHash)
+	return appendBytes(dst, b.MerkleRoot)
+}
+
+// appendHeaderSuffix writes the header fields hashed after the nonce, with
+// id as the chain id.
+func appendHeaderSuffix(dst []byte, b Block, id string) []byte {
+	dst = appendUint32(dst, uint32(b.Difficulty))
+	dst = appendUint32(dst, b.Bits)
+	dst = appendBytes(dst, b.Algorithm)
+	dst = appendBytes(dst, b.Consensus)
+	dst = appendStrings(dst, b.Authorities)
+	dst = appendBytes(dst, b.Signer)
+	dst = appendBytes(dst, id)
+	return binary.AppendUvarint(dst, uint64(b.MerkleVersion))
+}
+
+// binaryPreimage is hashPreimage for blocks in the binary format. The
+// nonce goes between the two parts as eight big-endian bytes.
+func binaryPreimage(b Block) (prefix, suffix string) {
+	return string(appendHeaderPrefix(nil, b)), string(appendHeaderSuffix(nil, b, hashChainID(b)))
+}
+
+// appendNonce writes nonce the way b's format hashes it.
+func appendNonce(dst []byte, b Block, nonce int64) []byte {
+	if b.Format == blockFormatBinary {
+		return appendUint64(dst, uint64(nonce))
+	}
+	return strconv.AppendInt(dst, nonce, 10)
+}
+
+// encodeBlock writes b in the binary encoding used between nodes. Blocks
+// in the text format are carried the same way; their format byte tells
+// the receiver how to hash them.
+func encodeBlock(b Block) []byte {
+	dst := appendHeaderPrefix(nil, b)
+	dst = appendUint64(dst, uint64(b.Nonce))
+	dst = appendHeaderSuffix(dst, b, b.ChainID)
+	dst = appendBytes(dst, b.Hash)
+	dst = appendBytes(dst, b.Signature)
+	return appendStrings(dst, b.Transactions)
+}
+
+// encodeBlocks writes blocks as a count followed by each encoded block
+// behind its length.
+func encodeBlocks(blocks []Block) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(blocks)))
+	for _, b := range blocks {
+		dst = appendBytes(dst, string(encodeBlock(b)))
+	}
+	return dst
+}
+
+type blockDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *blockDecoder) fail() {
+	if d.err == nil {
+		d.err = errBadEncoding
+	}
+	d.data = nil
+}
+
+func (d *blockDecoder) uint64() uint64 {
+	if len(d.data) < 8 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *blockDecoder) uint32() uint32 {
+	if len(d.data) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+func (d *blockDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *blockDecoder) bytes() string {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *blockDecoder) strings() []string {
+	n := d.uvarint()
+	// Every entry takes at least its length byte.
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	list := make([]string, n)
+	for i := range list {
+		list[i] = d.bytes()
+	}
+	return list
+}
+
+func (d *blockDecoder) block() Block {
+	var b Block
+	if len(d.data) == 0 {
+		d.fail()
+		return b
+	}
+	b.Format = int(d.data[0])
+	d.data = d.data[1:]
+	b.Index = int(d.uint64())
+	b.Timestamp = int64(d.uint64())
+	b.PrevHash = d.bytes()
+	b.MerkleRoot = d.bytes()
+	b.Nonce = int64(d.uint64())
+	b.Difficulty = int(d.uint32())
+	b.Bits = d.uint32()
+	b.Algorithm = d.bytes()
+	b.Consensus = d.bytes()
+	b.Authorities = d.strings()
+	b.Signer = d.bytes()
+	b.ChainID = d.bytes()
+	b.MerkleVersion = int(d.uvarint())
+	b.Hash = d.bytes()
+	b.Signature = d.bytes()
+	if b.Transactions = d.strings(); b.Transactions == nil {
+		b.Transactions = []string{}
+	}
+	return b
+}
+
+// decodeBlock reads a block written by encodeBlock.
+func decodeBlock(data []byte) (Block, error) {
+	d := &blockDecoder{data: data}
+	b := d.block()
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errBadEncoding
+	}
+	return b, d.err
+}
+
+// decodeBlocks reads a list written by encodeBlocks.
+func decodeBlocks(data []byte) ([]Block, error) {
+	d := &blockDecoder{data: data}
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		return nil, errBadEncoding
+	}
+	blocks := make([]Block, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		b, err := decodeBlock([]byte(d.bytes()))
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errBadEncoding
+	}
+	return blocks, d.err
+}
+
+// writeBlocks answers a request for blocks in the binary encoding if it
+// asked for it, and in JSON otherwise.
+func writeBlocks(w http.ResponseWriter, r *http.Request, blocks []Block) {
+	if r.Header.Get("Accept") == blockListContentType {
+		w.Header().Set("Content-Type", blockListContentType)
+		w.Write(encodeBlocks(blocks))
+		return
+	}
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// maxBlockBatchBytes bounds a peer's answer to a request for at most
+// syncBatchSize blocks: each block's transactions fit in maxBlockBytes,
+// or maxEncodedBlock when that is unlimited, and twice that leaves room
+// for headers and for JSON escaping every quote of a transaction.
+func maxBlockBatchBytes() int64 {
+	perBlock := int64(maxBlockBytes)
+	if perBlock == 0 {
+		perBlock = maxEncodedBlock
+	}
+	return 2 * perBlock * syncBatchSize
+}
+
+// readBlocks reads a peer's answer to a block request made with
+// getBlocks, in whichever encoding the peer chose.
+func readBlocks(resp *http.Response) ([]Block, error) {
+	limit := maxBlockBatchBytes()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("block batch larger than %d bytes", limit)
+	}
+	if resp.Header.Get("Content-Type") != blockListContentType {
+		var blocks []Block
+		if err := json.Unmarshal(data, &blocks); err != nil {
+			return nil, err
+		}
+		return blocks, nil
+	}
+	return decodeBlocks(data)
+}
+
+// getBlocks requests blocks from a peer, preferring the binary encoding.
+func getBlocks(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", blockListContentType)
+	return peerClient.Do(req)
+}
+
+// readBlock reads a block posted to this node as JSON or, with
+// blockContentType, in the binary encoding.
+func readBlock(r *http.Request) (Block, error) {
+	var b Block
+	if r.Header.Get("Content-Type") == blockContentType {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEncodedBlock+1))
+		if err != nil {
+			return b, err
+		}
+		if len(data) > maxEncodedBlock {
+			return b, errors.New("block too large")
+		}
+		return decodeBlock(data)
+	}
+	err := json.NewDecoder(r.Body).Decode(&b)
+	return b, err
+}
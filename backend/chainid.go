@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// newChainID is the chain ID recorded by a genesis block created by
+	// this node; when empty the network ID is used.
+	newChainID string
+	// chainID is the loaded chain's ID. Chains created before chain IDs
+	// have none, which leaves their hashes unchanged.
+	chainID string
+)
+
+// hashChainID is the chain ID a block's hash commits to: the genesis block
+// records it and every later block inherits it, so a block cannot be
+// replayed onto a chain with another ID.
+func hashChainID(b Block) string {
+	if b.Index == 0 {
+		return b.ChainID
+	}
+	return chainID
+}
+
+// checkChainID rejects IDs that could blur the boundary between the ID and
+// the data hashed after it.
+func checkChainID(id string) error {
+	if id == "" || len(id) > 64 {
+		return fmt.Errorf("chain id must be 1 to 64 characters")
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("chain id %q may only use letters, digits, '-', '_' and '.'", id)
+		}
+	}
+	return nil
+}
+
+// statsBlockWindow is how many of the latest blocks /stats averages the
+// block time over, so it follows the recent rate rather than the history.
+const statsBlockWindow = 100
+
+// handleStats serves GET /stats: the chain's identity and tip and the
+// node's counters, in one call for dashboards.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	height := len(blockchain) - 1
+	tip := blockchain[height]
+	stats := map[string]interface{}{
+		"chain_id":           chainID,
+		"network_id":         networkID,
+		"genesis_hash":       genesisHash,
+		"height":             height,
+		"latest_hash":        tip.Hash,
+		"latest_timestamp":   tip.Timestamp,
+		"total_transactions": len(txIndex),
+		"mempool_size":       mempool.len(),
+	}
+	if chainConsensus == consensusPoW {
+		stats["difficulty"] = difficultyOf(requiredTarget(len(blockchain)))
+	}
+	if n := min(height, statsBlockWindow); n > 0 {
+		stats["average_block_time"] = float64(tip.Timestamp-blockchain[height-n].Timestamp) / float64(n)
+	}
+	mutex.Unlock()
+	stats["peer_count"] = len(peers.list())
+	stats["uptime_seconds"] = int64(time.Since(processStart).Seconds())
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	errDifferentGenesis = errors.New("chain has a different genesis block")
+	errNotHeavier       = errors.New("chain does not have more work than the local chain")
+)
+
+// resolveMu lets only one resolution run at a time; peer announcements that
+// arrive meanwhile are covered by the one in progress.
+var resolveMu sync.Mutex
+
+// resolveResult reports the outcome of a longest-chain resolution.
+type resolveResult struct {
+	Replaced bool              `json:"replaced"`
+	Source   string            `json:"source,omitempty"`
+	Length   int               `json:"length"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// fetchChain downloads a peer's whole chain, syncBatchSize blocks at a
+// time so that no answer exceeds maxBlockBatchBytes. A batch that does not
+// follow on from the previous one, as when the peer reorganized meanwhile,
+// fails the download rather than counting against the peer.
+func fetchChain(peer string) ([]Block, error) {
+	var chain []Block
+	for {
+		blocks, err := fetchBlockRange(peer, len(chain), len(chain)+syncBatchSize-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) > 0 && len(blocks) > 0 && blocks[0].PrevHash != chain[len(chain)-1].Hash {
+			return nil, errors.New("peer chain changed while it was being downloaded")
+		}
+		chain = append(chain, blocks...)
+		if len(blocks) < syncBatchSize {
+			return chain, nil
+		}
+	}
+}
+
+// syncBatchSize is how many blocks syncFromPeer requests at a time.
+const syncBatchSize = 100
+
+// fetchBlockRange downloads a peer's blocks from height from to to
+// inclusive.
+func fetchBlockRange(peer string, from, to int) ([]Block, error) {
+	resp, err := getBlocks(fmt.Sprintf("%s/blocks?from=%d&to=%d", peer, from, to))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return readBlocks(resp)
+}
+
+// syncFromPeer downloads the blocks between the local tip and height from
+// peer in batches, checking each one before appending it. It returns
+// errBlockNotOnTip if the peer's chain forks from the local one.
+func syncFromPeer(peer string, height int) error {
+	for {
+		mutex.Lock()
+		from := len(blockchain)
+		mutex.Unlock()
+		if from > height {
+			return nil
+		}
+		to := from + syncBatchSize - 1
+		if to > height {
+			to = height
+		}
+		blocks, err := fetchBlockRange(peer, from, to)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return nil
+		}
+		if err := acceptPeerBatch(blocks); err != nil {
+			if invalidBlock(err) {
+				bans.misbehave(hostOf(peer), scoreInvalidBlock, "invalid "+err.Error())
+			}
+			return err
+		}
+	}
+}
+
+// acceptPeerBatch appends blocks synced from a peer in order, stopping at
+// the first that fails. A batch with more than maxBurstEvents events is
+// announced as a whole with one reorg event, like a chain replacement,
+// instead of block by block.
+func acceptPeerBatch(blocks []Block) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	events := 0
+	for _, b := range blocks {
+		events += blockEvents(b)
+	}
+	fork, oldTip := len(blockchain), getLastBlock().Hash
+	quietBlocks = events > maxBurstEvents
+	defer func() {
+		if quietBlocks && len(blockchain) > fork {
+			publishReorg(fork, oldTip, 0, 0, 0)
+		}
+		quietBlocks = false
+	}()
+	for _, b := range blocks {
+		if err := acceptPeerBlock(b); err != nil && !errors.Is(err, errKnownBlock) {
+			return fmt.Errorf("block %d: %w", b.Index, err)
+		}
+	}
+	return nil
+}
+
+// resolveChain catches up with the peer reporting the most chain work,
+// falling back to the next one if a peer fails. Blocks missing locally are
+// synced from the tip onwards; when a peer's chain forks from the local one,
+// or syncing leaves it with less work than the peer claimed, its whole
+// chain is fetched and adopted if it really has more work and is valid.
+func resolveChain() resolveResult {
+	resolveMu.Lock()
+	defer resolveMu.Unlock()
+
+	type candidate struct {
+		peer   string
+		height int
+		work   *big.Int
+	}
+	result := resolveResult{Errors: map[string]string{}}
+	var candidates []candidate
+	for _, peer := range peers.list() {
+		h, err := handshake(peer)
+		if err != nil {
+			result.Errors[peer] = err.Error()
+			continue
+		}
+		work, ok := new(big.Int).SetString(h.ChainWork, 16)
+		if !ok {
+			result.Errors[peer] = "invalid chain work"
+			continue
+		}
+		candidates = append(candidates, candidate{peer, h.Height, work})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].work.Cmp(candidates[j].work) > 0
+	})
+
+	mutex.Lock()
+	startTip := getLastBlock().Hash
+	mutex.Unlock()
+	for _, c := range candidates {
+		mutex.Lock()
+		local := chainWork(blockchain)
+		start := len(blockchain)
+		mutex.Unlock()
+		if c.work.Cmp(local) <= 0 {
+			result.Errors[c.peer] = errNotHeavier.Error()
+			continue
+		}
+		done := chainSync.begin(c.peer, c.height)
+		var err error
+		if c.height >= start {
+			sync := syncFromPeer
+			if syncMode == syncModeHeaders {
+				sync = syncHeadersFirst
+			}
+			err = sync(c.peer, c.height)
+		}
+		mutex.Lock()
+		behind := chainWork(blockchain).Cmp(c.work) < 0
+		mutex.Unlock()
+		if errors.Is(err, errBlockNotOnTip) || (err == nil && behind) {
+			err = adoptPeerChain(c.peer)
+		}
+		done()
+		if err != nil {
+			result.Errors[c.peer] = err.Error()
+			continue
+		}
+		result.Source = c.peer
+		break
+	}
+	mutex.Lock()
+	result.Replaced = getLastBlock().Hash != startTip
+	result.Length = len(blockchain)
+	mutex.Unlock()
+	if !result.Replaced {
+		result.Source = ""
+	}
+	return result
+}
+
+// adoptPeerChain fetches a peer's whole chain and replaces the local chain
+// with it.
+func adoptPeerChain(peer string) error {
+	chain, err := fetchChain(peer)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	err = replaceChain(chain)
+	mutex.Unlock()
+	if err != nil && !errors.Is(err, errDifferentGenesis) && !errors.Is(err, errNotHeavier) &&
+		!errors.Is(err, errReorgTooDeep) {
+		bans.misbehave(hostOf(peer), scoreInvalidBlock, "invalid chain: "+err.Error())
+	}
+	return err
+}
+
+// replaceChain adopts chain in place of the local chain if it shares the
+// genesis block, has more cumulative work and every block in it is valid.
+// Blocks are checked by replaying them onto the genesis block, so the
+// usual checks see the state of the candidate chain; on failure the local
+// chain and state are put back. Transactions of local blocks the new chain
+// abandons return to the mempool. A replacement that would publish more
+// than maxBurstEvents events publishes a single reorg event, with the new
+// tip, instead. The caller must hold mutex.
+func replaceChain(chain []Block) error {
+	if len(chain) == 0 || chain[0].Hash != blockchain[0].Hash {
+		return errDifferentGenesis
+	}
+	if chainWork(chain).Cmp(chainWork(blockchain)) <= 0 {
+		return errNotHeavier
+	}
+	if err := checkReorgDepth(forkPoint(blockchain, chain)); err != nil {
+		return err
+	}
+	old := blockchain
+	blockchain = chain[:1:1]
+	rebuildState()
+	for _, b := range chain[1:] {
+		if err := checkNextBlock(b); err != nil {
+			blockchain = old
+			rebuildState()
+			return fmt.Errorf("block %d: %w", b.Index, err)
+		}
+		blockchain = append(blockchain, b)
+		applyBlockState(b)
+	}
+	_ = saveBlockchain()
+	fork := forkPoint(old, blockchain)
+	restored, dropped := restoreAbandoned(old, fork)
+	// A long catch-up or reorg is announced by its reorg event alone:
+	// one event per block and transaction would overflow subscribers.
+	events := len(dropped)
+	for _, b := range blockchain[fork:] {
+		events += blockEvents(b)
+	}
+	coalesce := events > maxBurstEvents
+	if !coalesce {
+		for _, e := range dropped {
+			publishEvent("tx_dropped", e)
+		}
+	}
+	if fork < len(old) || coalesce {
+		publishReorg(fork, old[len(old)-1].Hash, len(old)-fork, restored, len(dropped))
+	}
+	if !coalesce {
+		for _, b := range blockchain[fork:] {
+			publishBlockEvents(b)
+		}
+	}
+	attachOrphans()
+	outstandingWork = map[string]*workUnit{}
+	return nil
+}
+
+// handleResolve serves GET /resolve, catching up with the valid chain with
+// the most work among the peers. replaced reports whether the local chain
+// changed.
+func handleResolve(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(resolveChain())
+}
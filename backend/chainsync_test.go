@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// stubPeer serves GET /blocks?from=&to= over chain, as a peer would.
+func stubPeer(chain []Block) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+		to, _ := strconv.Atoi(r.URL.Query().Get("to"))
+		to = min(to, len(chain)-1)
+		if from > to {
+			w.Write([]byte("[]"))
+			return
+		}
+		json.NewEncoder(w).Encode(chain[from : to+1])
+	}))
+}
+
+func TestFetchChainInBatches(t *testing.T) {
+	chain := make([]Block, 2*syncBatchSize+50)
+	for i := range chain {
+		chain[i] = Block{Index: i, Hash: fmt.Sprint("hash", i)}
+		if i > 0 {
+			chain[i].PrevHash = chain[i-1].Hash
+		}
+	}
+	peer := stubPeer(chain)
+	defer peer.Close()
+	got, err := fetchChain(peer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(chain) || got[len(got)-1].Hash != chain[len(chain)-1].Hash {
+		t.Errorf("fetched %d blocks, want %d", len(got), len(chain))
+	}
+}
+
+func TestFetchBlockRangeLimit(t *testing.T) {
+	defer func(n int) { maxBlockBytes = n }(maxBlockBytes)
+	maxBlockBytes = 1
+	big := []Block{{Index: 0, Hash: "hash", Transactions: []string{strings.Repeat("x", int(maxBlockBatchBytes()))}}}
+	peer := stubPeer(big)
+	defer peer.Close()
+	if _, err := fetchBlockRange(peer.URL, 0, 0); err == nil {
+		t.Error("oversized batch accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errCheckpointMismatch = errors.New("block conflicts with a checkpoint")
+	errReorgTooDeep       = errors.New("reorg would rewrite history before the latest checkpoint")
+)
+
+// checkpoint pins the hash of the block at a height. Blocks conflicting
+// with one are rejected whatever their work.
+type checkpoint struct {
+	Height int    `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// checkpoints holds the configured checkpoints, sorted by height.
+var checkpoints []checkpoint
+
+// parseCheckpoints parses a comma-separated list of height:hash pairs.
+func parseCheckpoints(s string) ([]checkpoint, error) {
+	var out []checkpoint
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		h, hash, ok := strings.Cut(part, ":")
+		height, err := strconv.Atoi(h)
+		if !ok || err != nil || height < 0 || hash == "" {
+			return nil, fmt.Errorf("invalid checkpoint %q, expected height:hash", part)
+		}
+		if seen[height] {
+			return nil, fmt.Errorf("duplicate checkpoint at height %d", height)
+		}
+		seen[height] = true
+		out = append(out, checkpoint{height, strings.ToLower(hash)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Height < out[j].Height })
+	return out, nil
+}
+
+// checkCheckpoint rejects b if a checkpoint pins a different block at its
+// height.
+func checkCheckpoint(b Block) error {
+	for _, c := range checkpoints {
+		if c.Height == b.Index && c.Hash != b.Hash {
+			return fmt.Errorf("%w at height %d", errCheckpointMismatch, c.Height)
+		}
+	}
+	return nil
+}
+
+// checkChainCheckpoints checks every checkpoint the chain has reached.
+func checkChainCheckpoints(chain []Block) error {
+	for _, c := range checkpoints {
+		if c.Height < len(chain) && chain[c.Height].Hash != c.Hash {
+			return fmt.Errorf("%w at height %d", errCheckpointMismatch, c.Height)
+		}
+	}
+	return nil
+}
+
+// checkReorgDepth refuses to switch away from the local chain at fork if
+// that drops a block at or below the latest checkpoint the local chain has
+// reached, or the snapshot it was fast-synced from. The caller must hold
+// mutex.
+func checkReorgDepth(fork int) error {
+	if snapshotApplies() && fork <= snapshotBase.Height {
+		return fmt.Errorf("%w at snapshot height %d", errReorgTooDeep, snapshotBase.Height)
+	}
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		if c := checkpoints[i]; c.Height < len(blockchain) {
+			if fork <= c.Height {
+				return fmt.Errorf("%w at height %d", errReorgTooDeep, c.Height)
+			}
+			return nil
+		}
+	}
+	return nil
+}
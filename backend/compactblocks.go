@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var errMissingTransactions = errors.New("block transactions missing from the mempool")
+
+// compactBlock announces a block by its header and transaction IDs, for
+// peers to rebuild from their mempools. Transactions peers are unlikely to
+// have, such as the coinbase, are sent in full in Prefilled, keyed by
+// their position in the block.
+type compactBlock struct {
+	Header    Block          `json:"header"`
+	TxIDs     []string       `json:"tx_ids"`
+	Prefilled map[int]string `json:"prefilled,omitempty"`
+}
+
+// compactBlockFor builds the compact form of b. Only transactions this
+// node relayed or received from the network are assumed to be known to
+// peers. It reports false when none are, as the full block is then no
+// larger.
+func compactBlockFor(b Block) (compactBlock, bool) {
+	c := compactBlock{Header: headerOf(b), TxIDs: make([]string, len(b.Transactions))}
+	left := 0
+	for i, raw := range b.Transactions {
+		c.TxIDs[i] = txID(raw)
+		if seenTxs.has(c.TxIDs[i]) {
+			left++
+			continue
+		}
+		if c.Prefilled == nil {
+			c.Prefilled = map[int]string{}
+		}
+		c.Prefilled[i] = raw
+	}
+	return c, left > 0
+}
+
+// reconstruct rebuilds the block from the prefilled transactions and the
+// mempool. The caller must hold mutex.
+func (c compactBlock) reconstruct() (Block, error) {
+	b := c.Header
+	b.Transactions = make([]string, len(c.TxIDs))
+	missing := 0
+	for i, id := range c.TxIDs {
+		if raw, ok := c.Prefilled[i]; ok {
+			b.Transactions[i] = raw
+		} else if e, ok := mempool.get(id); ok {
+			b.Transactions[i] = e.Transaction
+		} else {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return Block{}, fmt.Errorf("%w: %d of %d", errMissingTransactions, missing, len(c.TxIDs))
+	}
+	return b, nil
+}
+
+// receiveCompactBlock rebuilds a compact block from the mempool and
+// accepts it like a full one. It returns errMissingTransactions when the
+// full block has to be fetched instead.
+func receiveCompactBlock(c compactBlock, from string) error {
+	mutex.Lock()
+	h := c.Header
+	if h.Index >= 0 && h.Index < len(blockchain) && blockchain[h.Index].Hash == h.Hash {
+		mutex.Unlock()
+		return errKnownBlock
+	}
+	b, err := c.reconstruct()
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return receiveBlock(b, from)
+}
+
+// blockAt returns the block at height if its hash is hash.
+func blockAt(height int, hash string) (Block, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if height < 0 || height >= len(blockchain) || blockchain[height].Hash != hash || pruned(height) {
+		return Block{}, false
+	}
+	return blockchain[height], true
+}
+
+// sendBlock announces b to peer, compactly when the peer likely has its
+// transactions, and in full when it turns out not to.
+func sendBlock(peer string, b Block) error {
+	full := peerMessage{Type: "block", Block: &b}
+	c, ok := compactBlockFor(b)
+	if !ok {
+		return sendToPeer(peer, full, "/blocks", b)
+	}
+	err := sendToPeer(peer, peerMessage{Type: "cmpctblock", Compact: &c}, "/blocks/compact", c)
+	if errors.Is(err, errMissingTransactions) {
+		return sendToPeer(peer, full, "/blocks", b)
+	}
+	return err
+}
+
+// handleReceiveCompactBlock serves POST /blocks/compact, the compact form
+// of POST /blocks. If the block cannot be rebuilt from the mempool it
+// answers 412 and the sender posts the full block.
+func handleReceiveCompactBlock(w http.ResponseWriter, r *http.Request) {
+	if bans.banned(remoteHost(r)) {
+		http.Error(w, errPeerBanned.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkPeerRequest(r, false); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	var c compactBlock
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "invalid compact block", http.StatusBadRequest)
+		return
+	}
+	err := receiveCompactBlock(c, remoteHost(r))
+	if errors.Is(err, errMissingTransactions) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	writeBlockResult(w, c.Header, err)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	consensusPoW = "pow"
+	consensusPoA = "poa"
+)
+
+var (
+	// newChainConsensus and newChainAuthorities configure a genesis block
+	// created by this node. An existing chain keeps what its genesis
+	// records.
+	newChainConsensus   = consensusPoW
+	newChainAuthorities []string
+
+	// chainConsensus and chainAuthorities describe the loaded chain.
+	chainConsensus   = consensusPoW
+	chainAuthorities []string
+
+	// authorityKey is this node's block signing key in PoA mode.
+	authorityKey ed25519.PrivateKey
+)
+
+var (
+	errNotProofOfWork = errors.New("chain does not use proof of work")
+	errNotAuthority   = errors.New("node has no authority key for this chain")
+)
+
+// loadConsensus reads the consensus rules recorded in the genesis block.
+func loadConsensus(gen Block) error {
+	switch gen.Consensus {
+	case "", consensusPoW:
+		chainConsensus = consensusPoW
+	case consensusPoA, consensusPoS:
+		if len(gen.Authorities) == 0 {
+			return fmt.Errorf("%s genesis lists no authorities", gen.Consensus)
+		}
+		chainConsensus = gen.Consensus
+	default:
+		return fmt.Errorf("unknown consensus %q", gen.Consensus)
+	}
+	chainAuthorities = gen.Authorities
+	return nil
+}
+
+func isAuthority(pub string) bool {
+	for _, a := range chainAuthorities {
+		if a == pub {
+			return true
+		}
+	}
+	return false
+}
+
+// signBlock seals a candidate block on a PoA or PoS chain with this node's
+// key, which must belong to an authority or to the block's proof-of-stake
+// proposer. The caller must hold mutex.
+func signBlock(b Block) (Block, error) {
+	if authorityKey == nil {
+		return Block{}, errNotAuthority
+	}
+	pub := hex.EncodeToString(authorityKey.Public().(ed25519.PublicKey))
+	if err := checkSigner(b, pub); err != nil {
+		return Block{}, err
+	}
+	b.Signer = pub
+	b.Hash = computeHash(b)
+	hash, _ := hex.DecodeString(b.Hash)
+	b.Signature = hex.EncodeToString(ed25519.Sign(authorityKey, hash))
+	return b, nil
+}
+
+// checkSigner reports whether pub may seal b: any authority on a PoA
+// chain, only the drawn proposer on a PoS chain.
+func checkSigner(b Block, pub string) error {
+	if chainConsensus == consensusPoS {
+		proposer, ok := proposerFor(b.Index, b.PrevHash)
+		if !ok || proposer.PubKey != pub {
+			return fmt.Errorf("%w: proposer is %s", errNotProposer, proposer.Address)
+		}
+		return nil
+	}
+	if !isAuthority(pub) {
+		return errNotAuthority
+	}
+	return nil
+}
+
+// verifySeal checks a block's proof of work, or its signature on PoA and
+// PoS chains. The caller must hold mutex.
+func verifySeal(b Block) error {
+	if b.Hash != computeHash(b) {
+		return errors.New("hash does not match the block header")
+	}
+	if chainConsensus == consensusPoW {
+		if !hashMeetsTarget(b.Hash, blockTarget(b)) {
+			return errors.New("hash does not meet the target")
+		}
+		return nil
+	}
+	if err := checkSigner(b, b.Signer); err != nil {
+		return err
+	}
+	return verifySignature(b)
+}
+
+// verifySignature checks that Signer's signature covers the block hash,
+// without asking whether Signer may seal the block.
+func verifySignature(b Block) error {
+	pub, err := hex.DecodeString(b.Signer)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid signer key")
+	}
+	sig, err := hex.DecodeString(b.Signature)
+	hash, _ := hex.DecodeString(b.Hash)
+	if err != nil || !ed25519.Verify(pub, hash, sig) {
+		return errors.New("invalid block signature")
+	}
+	return nil
+}
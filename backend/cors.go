@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// corsPolicy is which browser origins may call the API, and how. It is
+// applied to every response by withCORS.
+type corsPolicy struct {
+	// origins are the allowed origins, such as https://explorer.example;
+	// "*" allows any. None turns CORS off.
+	origins     []string
+	methods     string
+	headers     string
+	credentials bool
+}
+
+// corsExposeHeaders are the response headers scripts may read.
+const corsExposeHeaders = "X-Total-Count, X-Request-ID, Deprecation, Link, Retry-After, ETag"
+
+var cors = corsPolicy{
+	origins: []string{"*"},
+	methods: "GET, POST, DELETE, OPTIONS",
+	headers: "Content-Type, X-API-Key, Authorization, If-None-Match",
+}
+
+// setOrigins sets the allowed origins from a comma-separated list.
+func (p *corsPolicy) setOrigins(list string) {
+	p.origins = nil
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			p.origins = append(p.origins, o)
+		}
+	}
+}
+
+func (p *corsPolicy) anyOrigin() bool {
+	for _, o := range p.origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	for _, o := range p.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// check refuses a policy browsers would not honour.
+func (p *corsPolicy) check() error {
+	if p.credentials && p.anyOrigin() {
+		return errors.New("-cors-credentials needs -cors-origins to list the origins, not *")
+	}
+	return nil
+}
+
+// withCORS applies cors to every request h serves, and answers OPTIONS
+// requests, preflight or not, itself, so handlers never see them. Requests
+// from origins the policy does not allow get no CORS headers, so browsers
+// keep their scripts from reading the answer.
+func withCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		options := r.Method == http.MethodOptions
+		preflight := options && r.Header.Get("Access-Control-Request-Method") != ""
+		hdr := w.Header()
+		if len(cors.origins) > 0 && !cors.anyOrigin() {
+			hdr.Add("Vary", "Origin")
+		}
+		if origin != "" && cors.allows(origin) {
+			if cors.anyOrigin() {
+				hdr.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				hdr.Set("Access-Control-Allow-Origin", origin)
+			}
+			if cors.credentials {
+				hdr.Set("Access-Control-Allow-Credentials", "true")
+			}
+			hdr.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			if preflight {
+				hdr.Set("Access-Control-Allow-Methods", cors.methods)
+				hdr.Set("Access-Control-Allow-Headers", cors.headers)
+				hdr.Set("Access-Control-Max-Age", "600")
+			}
+		}
+		if options {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	// retargetInterval is how many blocks pass between difficulty
+	// adjustments.
+	retargetInterval = 10
+	// targetBlockTime is the block spacing the adjustment aims for.
+	targetBlockTime = 30 * time.Second
+	// powLimit is the easiest target retargeting can reach, equivalent to a
+	// single leading zero hex digit.
+	powLimit = zerosTarget(1)
+	// minDifficulty is the fewest leading zero hex digits any block from
+	// minDifficultyHeight on must have, however easy the genesis target
+	// is or retargeting gets, so the chain cannot be rewritten for free.
+	minDifficulty = 3
+	// minDifficultyHeight is the height minDifficulty applies from. Blocks
+	// below it were mined before the rule existed and only need the
+	// retargeted target, so chains that already have them stay valid.
+	minDifficultyHeight = 1000
+	// devMode lifts minDifficulty, for local chains that should mine
+	// instantly. Deterministic mode implies it.
+	devMode = false
+)
+
+var errDifficultyTooLow = errors.New("difficulty below network difficulty")
+
+// zerosTarget converts the older leading-zero difficulty into the target it
+// is equivalent to: a hash has at least zeros leading zero hex digits
+// exactly when it is at most 2^(256-4*zeros)-1.
+func zerosTarget(zeros int) *big.Int {
+	t := new(big.Int).Lsh(big.NewInt(1), uint(256-4*zeros))
+	return t.Sub(t, big.NewInt(1))
+}
+
+// targetZeros is the number of leading zero hex digits every hash meeting
+// target has.
+func targetZeros(target *big.Int) int {
+	return (256 - target.BitLen()) / 4
+}
+
+// compactToTarget decodes the compact "bits" encoding: the high byte is the
+// length of the target in bytes and the low three bytes its most
+// significant digits.
+func compactToTarget(bits uint32) *big.Int {
+	size := uint(bits >> 24)
+	mantissa := big.NewInt(int64(bits & 0x007fffff))
+	if size <= 3 {
+		return mantissa.Rsh(mantissa, 8*(3-size))
+	}
+	return mantissa.Lsh(mantissa, 8*(size-3))
+}
+
+// targetToCompact encodes target in the compact form, dropping everything
+// below its three most significant bytes.
+func targetToCompact(target *big.Int) uint32 {
+	size := uint((target.BitLen() + 7) / 8)
+	var mantissa uint64
+	if size <= 3 {
+		mantissa = target.Uint64() << (8 * (3 - size))
+	} else {
+		mantissa = new(big.Int).Rsh(target, 8*(size-3)).Uint64()
+	}
+	// The top mantissa bit is a sign bit; shift it out of the way.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+	return uint32(size)<<24 | uint32(mantissa)
+}
+
+// blockTarget is the target a block's hash must not exceed. Blocks mined
+// before compact targets were introduced carry only a leading-zero
+// difficulty.
+func blockTarget(b Block) *big.Int {
+	if b.Bits != 0 {
+		return compactToTarget(b.Bits)
+	}
+	return zerosTarget(b.Difficulty)
+}
+
+// hashMeetsTarget reports whether a hex block hash is numerically at most
+// target.
+func hashMeetsTarget(hash string, target *big.Int) bool {
+	return len(hash) == 64 && hash <= fmt.Sprintf("%064x", target)
+}
+
+// difficultyOf expresses target as a multiple of the work needed at
+// powLimit.
+func difficultyOf(target *big.Int) float64 {
+	d, _ := new(big.Float).Quo(new(big.Float).SetInt(powLimit), new(big.Float).SetInt(target)).Float64()
+	return d
+}
+
+// blockWork is the work a block adds to its chain: the expected number of
+// hashes needed to meet its target, 2^256 / (target+1). Blocks sealed by a
+// signature count one each.
+func blockWork(b Block) *big.Int {
+	if b.Bits == 0 && b.Difficulty == 0 {
+		return big.NewInt(1)
+	}
+	space := new(big.Int).Lsh(big.NewInt(1), 256)
+	return space.Div(space, new(big.Int).Add(blockTarget(b), big.NewInt(1)))
+}
+
+// chainWork sums blockWork over a chain. The fork choice prefers the chain
+// with the most work over the longest one.
+func chainWork(chain []Block) *big.Int {
+	total := new(big.Int)
+	for _, b := range chain {
+		total.Add(total, blockWork(b))
+	}
+	return total
+}
+
+// requiredTarget returns the network target for the block at height, which
+// must be at most len(blockchain). Starting from the genesis target, every
+// retargetInterval blocks the target is scaled by how long the last interval
+// actually took relative to targetBlockTime, by at most a factor of four
+// either way and never above powLimit. Deterministic mode keeps the genesis
+// target. Outside dev mode, from minDifficultyHeight on, the target is
+// never easier than minDifficulty. The caller must hold mutex.
+func requiredTarget(height int) *big.Int {
+	return requiredTargetOf(blockchain, height)
+}
+
+// requiredTargetOf is requiredTarget computed over chain, which holds at
+// least the blocks below height, instead of the local blockchain.
+func requiredTargetOf(chain []Block, height int) *big.Int {
+	target := blockTarget(chain[0])
+	if retargetInterval <= 1 || deterministicMining {
+		return target
+	}
+	expected := int64(targetBlockTime/time.Second) * int64(retargetInterval-1)
+	if expected <= 0 {
+		return target
+	}
+	for h := retargetInterval; h <= height; h += retargetInterval {
+		actual := chain[h-1].Timestamp - chain[h-retargetInterval].Timestamp
+		if actual < expected/4 {
+			actual = expected / 4
+		}
+		if actual > expected*4 {
+			actual = expected * 4
+		}
+		target.Mul(target, big.NewInt(actual))
+		target.Div(target, big.NewInt(expected))
+		if target.Cmp(powLimit) > 0 {
+			target.Set(powLimit)
+		}
+		target = compactToTarget(targetToCompact(target))
+	}
+	if floor := zerosTarget(minDifficulty); !devMode && height >= minDifficultyHeight && target.Cmp(floor) > 0 {
+		target = compactToTarget(targetToCompact(floor))
+	}
+	return target
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestMinDifficultyActivation(t *testing.T) {
+	savedHeight, savedDev := minDifficultyHeight, devMode
+	defer func() { minDifficultyHeight, devMode = savedHeight, savedDev }()
+	devMode = false
+	chain := []Block{{Index: 0, Difficulty: 1}}
+	easy := blockTarget(chain[0])
+	floor := compactToTarget(targetToCompact(zerosTarget(minDifficulty)))
+
+	minDifficultyHeight = 5
+	if got := requiredTargetOf(chain, 1); got.Cmp(easy) != 0 {
+		t.Errorf("below the activation height: target %x, want the genesis target %x", got, easy)
+	}
+	if got := requiredTargetOf(chain, 5); got.Cmp(floor) != 0 {
+		t.Errorf("at the activation height: target %x, want the floor %x", got, floor)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Reads that only change when the chain or the mempool does carry a weak
+// ETag derived from the tip hash or the mempool's contents. A client
+// polling one of them sends the tag back in If-None-Match and gets an empty
+// 304 until something changed. Which operations do is set in the route
+// tables.
+
+// etagFunc computes the tag of the answer to r. The caller must hold mutex.
+type etagFunc func(r *http.Request) string
+
+// tipETag tags answers that follow from the chain: the tip hash commits to
+// every block below it, so it changes exactly when the chain does. The
+// binary encodings are tagged apart from JSON.
+func tipETag(r *http.Request) string {
+	tag := getLastBlock().Hash
+	if a := r.Header.Get("Accept"); a == blockContentType || a == blockListContentType {
+		tag += "-bin"
+	}
+	return `W/"` + tag + `"`
+}
+
+// mempoolETag tags answers that follow from the mempool.
+func mempoolETag(r *http.Request) string {
+	return `W/"mempool-` + mempool.digest() + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists tag, by the
+// weak comparison, or is *.
+func etagMatches(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// withETag tags the answers of h with etag, and answers 304 Not Modified
+// instead when the request already holds the current tag. The tag is taken
+// before h runs, so a change in between makes the tag older than the
+// answer, never newer, and the next poll fetches it again.
+func withETag(etag etagFunc, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		tag := etag(r)
+		mutex.Unlock()
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// eventLogSize bounds how many recent events are kept for clients that poll.
+const eventLogSize = 1000
+
+// Event is a notification about a change to the chain or the mempool.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// eventBuffer is how many events a subscriber may fall behind by before
+// it is dropped.
+const eventBuffer = 256
+
+// maxBurstEvents bounds the events one change to the chain publishes at
+// once, to half of eventBuffer, so that a burst published with mutex held
+// cannot cut off every subscriber by itself. Bigger bursts are coalesced:
+// a block with more transactions gets no tx_mined events, as its
+// block_added event carries them, and a chain replacement with more
+// events only publishes its reorg event.
+const maxBurstEvents = eventBuffer / 2
+
+// quietBlocks, while set, keeps appendBlock from publishing block events
+// for a batch of blocks that is announced as a whole with publishReorg.
+// It is guarded by mutex.
+var quietBlocks bool
+
+var (
+	eventsMutex = &sync.Mutex{}
+	eventLog    []Event
+	eventSeq    uint64
+	// eventSubs are the channels of clients streaming events.
+	eventSubs = map[chan Event]bool{}
+)
+
+// publishEvent records an event and hands it to every subscriber. It takes
+// its own lock, so it may be called with or without mutex held.
+func publishEvent(typ string, data interface{}) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	eventSeq++
+	e := Event{ID: eventSeq, Type: typ, Time: time.Now().Unix(), Data: data}
+	eventLog = append(eventLog, e)
+	if len(eventLog) > eventLogSize {
+		eventLog = eventLog[len(eventLog)-eventLogSize:]
+	}
+	for ch := range eventSubs {
+		select {
+		case ch <- e:
+		default:
+			// A subscriber this far behind is cut off rather than
+			// holding up the node; it can catch up from the log.
+			delete(eventSubs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribeEvents returns a channel receiving the events published after
+// the retained ones with an ID greater than since, which it starts with,
+// and a function to stop. The channel is closed when the subscriber is
+// stopped or falls too far behind.
+func subscribeEvents(since uint64) (<-chan Event, func()) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	var backlog []Event
+	for _, e := range eventLog {
+		if e.ID > since {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Event, eventBuffer+len(backlog))
+	for _, e := range backlog {
+		ch <- e
+	}
+	eventSubs[ch] = true
+	return ch, func() {
+		eventsMutex.Lock()
+		defer eventsMutex.Unlock()
+		if eventSubs[ch] {
+			delete(eventSubs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishBlockEvents announces a block appended to the chain and, unless
+// there are more than maxBurstEvents, the transactions it confirmed.
+func publishBlockEvents(b Block) {
+	publishEvent("block_added", b)
+	if blockEvents(b) > maxBurstEvents {
+		return
+	}
+	for _, raw := range b.Transactions {
+		publishEvent("tx_mined", map[string]interface{}{
+			"id":          txID(raw),
+			"block_index": b.Index,
+			"block_hash":  b.Hash,
+		})
+	}
+}
+
+// publishReorg announces that the chain changed from height fork on, from
+// the tip oldTip to the current one: abandoned blocks were replaced, and of
+// their transactions restored went back to the mempool while dropped
+// pending ones became invalid. The caller must hold mutex.
+func publishReorg(fork int, oldTip string, abandoned, restored, dropped int) {
+	publishEvent("reorg", map[string]interface{}{
+		"fork_height": fork,
+		"old_tip":     oldTip,
+		"new_tip":     getLastBlock().Hash,
+		"new_height":  len(blockchain) - 1,
+		"abandoned":   abandoned,
+		"added":       len(blockchain) - fork,
+		"restored":    restored,
+		"dropped":     dropped,
+	})
+}
+
+// blockEvents is how many events announce b in full.
+func blockEvents(b Block) int {
+	return 1 + len(b.Transactions)
+}
+
+// eventsSince returns the retained events with an ID greater than id.
+func eventsSince(id uint64) []Event {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	out := []Event{}
+	for _, e := range eventLog {
+		if e.ID > id {
+			out = append(out, e)
+		}
+	}
+	return out
+}
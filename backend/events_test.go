@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPublishBlockEventsCoalesces(t *testing.T) {
+	events, stop := subscribeEvents(eventSeq)
+	defer stop()
+	b := Block{Index: 1}
+	for i := 0; i < eventBuffer; i++ {
+		b.Transactions = append(b.Transactions, fmt.Sprintf("tx %d", i))
+	}
+	publishBlockEvents(b)
+	e, ok := <-events
+	if !ok || e.Type != "block_added" {
+		t.Fatalf("first event: got %v, %v, want block_added", e.Type, ok)
+	}
+	select {
+	case e, ok := <-events:
+		t.Fatalf("block of %d transactions published %q (open %v) after block_added", len(b.Transactions), e.Type, ok)
+	default:
+	}
+
+	small := Block{Index: 2, Transactions: []string{"a", "b"}}
+	publishBlockEvents(small)
+	for _, want := range []string{"block_added", "tx_mined", "tx_mined"} {
+		if e := <-events; e.Type != want {
+			t.Fatalf("small block: got %q, want %q", e.Type, want)
+		}
+	}
+}
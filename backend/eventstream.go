@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sseHeartbeat is how often an idle event stream sends a comment, so
+	// proxies keep it open and a dead client is noticed.
+	sseHeartbeat = 15 * time.Second
+	// sseRetryMs is how long a client should wait before reconnecting.
+	sseRetryMs = 3000
+)
+
+// eventFilter reads ?types=a,b into the set of event types a client wants;
+// nil means all of them.
+func eventFilter(r *http.Request) map[string]bool {
+	raw := r.URL.Query().Get("types")
+	if raw == "" {
+		return nil
+	}
+	types := map[string]bool{}
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+// handleEventSocket serves GET /ws, a WebSocket pushing every event as a
+// JSON text message: block_added, tx_added, tx_mined, reorg and the rest
+// of what /events/recent lists. ?types= limits the stream to some event
+// types and ?since= first replays the retained events after that ID, so a
+// client that lost its connection can resume. A client that stops reading
+// is disconnected.
+func handleEventSocket(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	types := eventFilter(r)
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+	events, stop := subscribeEvents(since)
+	defer stop()
+
+	// The client sends nothing but control frames; reading answers its
+	// pings and notices when it goes away.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := conn.readMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	go keepAlive(conn, done)
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if err := conn.writeMessage(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleEventStream serves GET /events, the event stream for clients that
+// cannot use WebSockets, as Server-Sent Events. Each event goes out under
+// its type with its ID, so a reconnecting browser sends Last-Event-ID and
+// resumes after the last event it saw, as long as the node still retains
+// it; ?since= does the same for other clients. ?types= filters as on /ws.
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if id, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		since = id
+	}
+	types := eventFilter(r)
+	events, stop := subscribeEvents(since)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMs)
+	flusher.Flush()
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
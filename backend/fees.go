@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// feeSampleBlocks is how many recent blocks the fee estimator looks at.
+const feeSampleBlocks = 20
+
+// feeTargets are the confirmation targets, in blocks, that estimates are
+// given for, with the percentile of recently paid fees each starts from.
+var feeTargets = []struct {
+	blocks     int
+	percentile float64
+}{
+	{1, 0.75},
+	{3, 0.5},
+	{6, 0.25},
+}
+
+// estimateFees suggests a fee per confirmation target. Each estimate starts
+// from a percentile of fees paid in recent blocks and is raised to outbid
+// the mempool transactions that would fill the blocks before the target,
+// using the average recent block size as capacity. The caller must hold
+// mutex.
+func estimateFees() map[string]int64 {
+	var paid []int64
+	var txCount, sampled int
+	for i := len(blockchain) - 1; i >= 0 && sampled < feeSampleBlocks; i-- {
+		sampled++
+		for _, raw := range blockchain[i].Transactions {
+			if tx, ok := parseTransaction(raw); ok && tx.From != "" {
+				paid = append(paid, tx.Fee)
+				txCount++
+			}
+		}
+	}
+	sort.Slice(paid, func(i, j int) bool { return paid[i] < paid[j] })
+
+	capacity := 1
+	if sampled > 0 && txCount/sampled > capacity {
+		capacity = txCount / sampled
+	}
+	queue := mempool.ordered()
+
+	out := map[string]int64{}
+	for _, t := range feeTargets {
+		var fee int64
+		if len(paid) > 0 {
+			fee = paid[int(t.percentile*float64(len(paid)-1))]
+		}
+		if ahead := t.blocks * capacity; len(queue) >= ahead {
+			if bid := queue[ahead-1].Fee + 1; bid > fee {
+				fee = bid
+			}
+		}
+		out[strconv.Itoa(t.blocks)] = fee
+	}
+	return out
+}
+
+func handleFeeEstimate(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"estimates":    estimateFees(),
+		"mempool_size": mempool.len(),
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// genesisConfig describes a chain's genesis block, read from the file
+// given with -genesis. The same file always yields the same genesis block,
+// so operators can share it instead of a blockchain.json.
+type genesisConfig struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+	// Difficulty is in leading zero hex digits; it defaults to
+	// defaultDifficulty.
+	Difficulty  *int                `json:"difficulty"`
+	ChainID     string              `json:"chain_id"`
+	Allocations []genesisAllocation `json:"allocations"`
+	// Hash, when set, pins the genesis hash the file must produce.
+	Hash string `json:"hash"`
+}
+
+// genesisAllocation is a premine: coins the genesis block pays to an
+// address.
+type genesisAllocation struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// configuredGenesis is the genesis block built from -genesis, if given.
+var configuredGenesis *Block
+
+var errGenesisMismatch = errors.New("genesis block does not match the configured genesis")
+
+// loadGenesisConfig reads and checks a genesis file.
+func loadGenesisConfig(path string) (genesisConfig, error) {
+	var c genesisConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Timestamp <= 0 {
+		return c, errors.New("genesis timestamp must be a positive unix time")
+	}
+	if c.Difficulty != nil && (*c.Difficulty < 0 || *c.Difficulty > 64) {
+		return c, errors.New("genesis difficulty must be 0 to 64 leading zero hex digits")
+	}
+	if c.Difficulty != nil && *c.Difficulty < minDifficulty && !devMode {
+		return c, fmt.Errorf("genesis difficulty %d is below the minimum %d; use -dev for an easier chain", *c.Difficulty, minDifficulty)
+	}
+	if c.ChainID != "" {
+		if err := checkChainID(c.ChainID); err != nil {
+			return c, err
+		}
+	}
+	var total int64
+	for _, a := range c.Allocations {
+		if err := validateAddress(a.Address); err != nil {
+			return c, fmt.Errorf("genesis allocation: %w", err)
+		}
+		if a.Amount <= 0 || a.Amount > math.MaxInt64-total {
+			return c, fmt.Errorf("genesis allocation to %s: amount must be positive and the total fit in 64 bits", a.Address)
+		}
+		total += a.Amount
+	}
+	if c.Hash != "" {
+		if _, err := hex.DecodeString(c.Hash); err != nil || len(c.Hash) != 64 {
+			return c, errors.New("genesis hash must be 64 hex digits")
+		}
+	}
+	return c, nil
+}
+
+// genesisFromConfig builds the genesis block c describes. The message is
+// its first transaction and each allocation a coinbase after it. The
+// proof of work is searched from nonce 0 on one thread so the hash only
+// depends on the file and the chain flags.
+func genesisFromConfig(c genesisConfig) (Block, error) {
+	message := c.Message
+	if message == "" {
+		message = RollNumber
+	}
+	txs := []string{message}
+	for i, a := range c.Allocations {
+		txs = append(txs, Transaction{
+			Type:       txTypeCoinbase,
+			To:         a.Address,
+			Amount:     a.Amount,
+			ExtraNonce: uint64(i),
+		}.encode())
+	}
+	difficulty := defaultDifficulty
+	if c.Difficulty != nil {
+		difficulty = *c.Difficulty
+	}
+	gen := Block{
+		Timestamp:     c.Timestamp,
+		Transactions:  txs,
+		Difficulty:    difficulty,
+		Bits:          targetToCompact(zerosTarget(difficulty)),
+		Algorithm:     chainHasher.Name(),
+		ChainID:       c.ChainID,
+		MerkleVersion: currentMerkleVersion,
+		Format:        currentBlockFormat,
+	}
+	if gen.ChainID == "" {
+		gen.ChainID = networkID
+	}
+	gen = sealGenesis(gen, true)
+	if c.Hash != "" && !strings.EqualFold(c.Hash, gen.Hash) {
+		return gen, fmt.Errorf("%w: file pins %s, it produces %s", errGenesisMismatch, c.Hash, gen.Hash)
+	}
+	return gen, nil
+}
+
+// solveSequential searches b's nonces in order from 0.
+func solveSequential(b Block) (Block, error) {
+	var target [32]byte
+	blockTarget(b).FillBytes(target[:])
+	search := newNonceSearch(b)
+	for nonce := int64(0); nonce < math.MaxInt64; nonce++ {
+		if sum := search(nonce); bytes.Compare(sum[:], target[:]) <= 0 {
+			b.Nonce = nonce
+			b.Hash = hex.EncodeToString(sum[:])
+			return b, nil
+		}
+	}
+	return b, errors.New("nonce space exhausted")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// seenTxCacheSize bounds how many transaction IDs the gossip layer
+// remembers.
+const seenTxCacheSize = 10000
+
+// seenCache remembers recently relayed transaction IDs so a transaction
+// travelling around a cycle of peers is dropped the second time it
+// arrives. The oldest IDs are forgotten first.
+type seenCache struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string
+}
+
+var seenTxs = &seenCache{ids: map[string]bool{}}
+
+func (c *seenCache) has(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ids[id]
+}
+
+// add records id and reports whether it was not seen before.
+func (c *seenCache) add(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids[id] {
+		return false
+	}
+	if len(c.order) >= seenTxCacheSize {
+		delete(c.ids, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.ids[id] = true
+	c.order = append(c.order, id)
+	return true
+}
+
+// relayedTx is the body of POST /peers/tx.
+type relayedTx struct {
+	Transaction string `json:"transaction"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+}
+
+// outboundTxs queues transactions for runTxRelay. Like blocks they are sent
+// one at a time, so a sender's transactions reach peers in nonce order.
+var outboundTxs = make(chan relayedTx, 1024)
+
+// relayTransaction queues a transaction this node admitted for its peers,
+// unless it has already been relayed.
+func relayTransaction(raw string, expiresAt int64) {
+	if seenTxs.add(txID(raw)) {
+		queueTx(relayedTx{Transaction: raw, ExpiresAt: expiresAt})
+	}
+}
+
+func queueTx(t relayedTx) {
+	select {
+	case outboundTxs <- t:
+	default:
+		log.Printf("relay queue full, dropping transaction %s", txID(t.Transaction))
+	}
+}
+
+// runTxRelay sends queued transactions to all peers.
+func runTxRelay() {
+	for t := range outboundTxs {
+		var wg sync.WaitGroup
+		for _, peer := range peers.list() {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				msg := peerMessage{Type: "tx", Tx: &t}
+				if err := sendToPeer(peer, msg, "/peers/tx", t); err != nil {
+					log.Printf("relay transaction to %s: %v", peer, err)
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
+
+// checkRelayedTx runs the stateless checks POST /tx applies to a
+// transaction given in its encoded form and returns the parsed
+// transaction, or nil for plain text.
+func checkRelayedTx(raw string) (*Transaction, error) {
+	tx, ok := parseTransaction(raw)
+	if !ok {
+		if strings.TrimSpace(raw) == "" {
+			return nil, errors.New("empty transaction")
+		}
+		return nil, validatePayload(raw, raw)
+	}
+	if err := tx.validateFields(); err != nil {
+		return nil, err
+	}
+	if err := validatePayload(tx.Data, raw); err != nil {
+		return nil, err
+	}
+	if tx.From != "" {
+		signed, err := tx.validSignatures()
+		if err != nil {
+			return nil, err
+		}
+		if tx.ownerAddress() != tx.From {
+			return nil, errors.New("from address does not match the listed public keys")
+		}
+		if signed < tx.Threshold {
+			return nil, errors.New("transaction is missing signatures")
+		}
+	}
+	return &tx, nil
+}
+
+var errTxSeen = errors.New("transaction already seen")
+
+// errNotPeer refuses a relayed transaction from a node this node has not
+// registered as a peer.
+var errNotPeer = errors.New("not a peer of this node")
+
+// receiveRelayedTx checks a transaction passed on by a peer like a
+// submission to /tx, admits it and relays it further. A transaction seen
+// before is ignored with errTxSeen. On failure it also returns the HTTP
+// status to report.
+func receiveRelayedTx(t relayedTx, from string) (*mempoolEntry, int, error) {
+	if seenTxs.has(txID(t.Transaction)) {
+		return nil, http.StatusOK, errTxSeen
+	}
+	tx, err := checkRelayedTx(t.Transaction)
+	if err != nil {
+		bans.misbehave(from, scoreInvalidTx, "invalid transaction: "+err.Error())
+		return nil, txErrorStatus(err), err
+	}
+	mutex.Lock()
+	entry, status, err := admitTransaction(t.Transaction, tx, t.ExpiresAt)
+	mutex.Unlock()
+	if err != nil {
+		return nil, status, err
+	}
+	// Only admitted transactions are remembered, so one rejected for now,
+	// e.g. for arriving ahead of its sender's previous nonce, can still be
+	// accepted when relayed again.
+	if seenTxs.add(entry.ID) {
+		queueTx(t)
+	}
+	return entry, 0, nil
+}
+
+// handleRelayedTx serves POST /peers/tx, through which peers pass on
+// transactions they admitted. Only registered peers on this chain may
+// relay; anyone else submits through POST /tx.
+func handleRelayedTx(w http.ResponseWriter, r *http.Request) {
+	if bans.banned(remoteHost(r)) {
+		http.Error(w, errPeerBanned.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkPeerRequest(r, true); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if !peers.hasHost(remoteHost(r)) {
+		http.Error(w, errNotPeer.Error(), http.StatusForbidden)
+		return
+	}
+	var body relayedTx
+	if maxTxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxTxBytes+txRequestOverhead))
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid body, expected {\"transaction\":\"...\"}", http.StatusBadRequest)
+		return
+	}
+	entry, status, err := receiveRelayedTx(body, remoteHost(r))
+	if errors.Is(err, errTxSeen) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "transaction added",
+		"id":      entry.ID,
+	})
+}
@@ -0,0 +1,1052 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// A small GraphQL endpoint for the explorer. It runs queries, with
+// aliases, arguments, variables and nested selections, against the schema
+// in gqlSchema; mutations, subscriptions, fragments and directives are not
+// supported. A query reads one consistent view of the chain and the
+// pending transactions, copied when it starts, so mutex is not held while
+// it runs. Account state and transaction lookups by ID take mutex briefly,
+// and account state is read when a query first asks for it, so it may
+// already include a block appended since the query started.
+
+const gqlSchema = `type Query {
+  height: Int!
+  block(index: Int, hash: String): Block
+  blocks(offset: Int = 0, limit: Int = 10, newestFirst: Boolean = false): [Block!]!
+  transaction(id: String!): Transaction
+  account(address: String!): Account
+  pending(limit: Int = 50): [Transaction!]!
+  peers: [Peer!]!
+}
+
+type Block {
+  index: Int!
+  timestamp: Int!
+  hash: String!
+  prevHash: String!
+  merkleRoot: String!
+  nonce: Int!
+  difficulty: Int!
+  bits: Int!
+  confirmations: Int!
+  pruned: Boolean!
+  transactionCount: Int!
+  transactions(offset: Int = 0, limit: Int = 100): [Transaction!]!
+  previous: Block
+}
+
+type Transaction {
+  id: String!
+  raw: String!
+  # "text" for a plain-text transaction, whose other fields are null.
+  type: String!
+  from: String
+  to: String
+  amount: Int
+  fee: Int
+  nonce: Int
+  data: String
+  # "confirmed" or "pending".
+  status: String!
+  confirmations: Int!
+  block: Block
+  sender: Account
+  recipient: Account
+}
+
+type Account {
+  address: String!
+  balance: Int!
+  nonce: Int!
+  stake: Int!
+  transactions(offset: Int = 0, limit: Int = 50): [Transaction!]!
+}
+
+type Peer {
+  url: String!
+  height: Int!
+  latencyMs: Float
+  lastSeen: Int
+  failures: Int!
+  linked: Boolean!
+}
+`
+
+// gqlMaxDepth bounds how deeply selections may nest, so a query cannot
+// walk account to transactions to account without end.
+const gqlMaxDepth = 10
+
+// gqlMaxFields bounds how many fields one query may resolve, counting
+// every field of every item of every list. Depth alone does not bound the
+// work: each level of lists multiplies it by up to maxPageLimit.
+const gqlMaxFields = 10000
+
+// gqlField is one field of a selection set.
+type gqlField struct {
+	alias string
+	name  string
+	args  map[string]interface{}
+	sel   []*gqlField
+}
+
+// gqlVar is a variable reference in an argument.
+type gqlVar string
+
+// gqlEnum is an enum value in an argument.
+type gqlEnum string
+
+// gqlOperation is a parsed query: its selection set and variable defaults.
+type gqlOperation struct {
+	name     string
+	sel      []*gqlField
+	defaults map[string]interface{}
+}
+
+// Lexer token kinds.
+const (
+	gqlEOF = iota
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+	gqlPunct
+)
+
+type gqlParser struct {
+	src  string
+	pos  int
+	kind int
+	text string
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+// next reads the next token, skipping whitespace, commas and comments.
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.kind, p.text = gqlEOF, ""
+		return nil
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind = gqlPunct
+	case strings.IndexByte("{}():$!=[]@", c) >= 0:
+		p.pos++
+		p.kind = gqlPunct
+	case isNameByte(c, true):
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos], false) {
+			p.pos++
+		}
+		p.kind = gqlName
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		p.kind = gqlInt
+		for p.pos < len(p.src) {
+			d := p.src[p.pos]
+			if d == '.' || d == 'e' || d == 'E' || (d == '+' || d == '-') && p.kind == gqlFloat {
+				p.kind = gqlFloat
+			} else if d < '0' || d > '9' {
+				break
+			}
+			p.pos++
+		}
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			return p.errorf("block strings are not supported")
+		}
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		p.pos++
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			return p.errorf("invalid string %s", p.src[start:p.pos])
+		}
+		p.kind, p.text = gqlString, s
+		return nil
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+	p.text = p.src[start:p.pos]
+	return nil
+}
+
+func (p *gqlParser) isPunct(s string) bool {
+	return p.kind == gqlPunct && p.text == s
+}
+
+// expect consumes the punctuator s.
+func (p *gqlParser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q, found %q", s, p.text)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.kind != gqlName {
+		return "", p.errorf("expected a name, found %q", p.text)
+	}
+	s := p.text
+	return s, p.next()
+}
+
+// parseGraphQL parses a document and returns the operation to run: the one
+// named operationName, or the only one.
+func parseGraphQL(src, operationName string) (*gqlOperation, error) {
+	p := &gqlParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var ops []*gqlOperation
+	for p.kind != gqlEOF {
+		op := &gqlOperation{defaults: map[string]interface{}{}}
+		if p.kind == gqlName {
+			switch p.text {
+			case "query":
+			case "mutation", "subscription":
+				return nil, fmt.Errorf("%s operations are not supported", p.text)
+			case "fragment":
+				return nil, errors.New("fragments are not supported")
+			default:
+				return nil, p.errorf("unexpected %q", p.text)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.kind == gqlName {
+				op.name = p.text
+				if err := p.next(); err != nil {
+					return nil, err
+				}
+			}
+			if p.isPunct("(") {
+				if err := p.parseVariableDefs(op.defaults); err != nil {
+					return nil, err
+				}
+			}
+		}
+		sel, err := p.parseSelectionSet(1)
+		if err != nil {
+			return nil, err
+		}
+		op.sel = sel
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("document has no operation")
+	}
+	for _, op := range ops {
+		if operationName != "" && op.name == operationName {
+			return op, nil
+		}
+	}
+	if operationName != "" {
+		return nil, fmt.Errorf("no operation named %q", operationName)
+	}
+	if len(ops) > 1 {
+		return nil, errors.New("operationName is required for a document with several operations")
+	}
+	return ops[0], nil
+}
+
+// parseVariableDefs reads ($name: Type = default, ...), keeping only the
+// defaults: arguments are checked when they are used.
+func (p *gqlParser) parseVariableDefs(defaults map[string]interface{}) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.isPunct(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if p.isPunct("=") {
+			if err := p.next(); err != nil {
+				return err
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return err
+			}
+			defaults[name] = v
+		}
+	}
+	return p.next()
+}
+
+func (p *gqlParser) skipType() error {
+	if p.isPunct("[") {
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.isPunct("!") {
+		return p.next()
+	}
+	return nil
+}
+
+func (p *gqlParser) parseSelectionSet(depth int) ([]*gqlField, error) {
+	if depth > gqlMaxDepth {
+		return nil, fmt.Errorf("query nests deeper than %d levels", gqlMaxDepth)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []*gqlField
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			return nil, errors.New("fragments are not supported")
+		}
+		f := &gqlField{args: map[string]interface{}{}}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		f.name = name
+		if p.isPunct(":") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			f.alias = name
+			if f.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("(") {
+			if err := p.parseArguments(f.args); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("@") {
+			return nil, errors.New("directives are not supported")
+		}
+		if p.isPunct("{") {
+			if f.sel, err = p.parseSelectionSet(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return fields, p.next()
+}
+
+func (p *gqlParser) parseArguments(args map[string]interface{}) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.isPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+		args[name] = v
+	}
+	return p.next()
+}
+
+func (p *gqlParser) parseValue() (interface{}, error) {
+	var v interface{}
+	switch {
+	case p.isPunct("$"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVar(name), err
+	case p.isPunct("["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.isPunct("]") {
+			item, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, p.next()
+	case p.kind == gqlInt || p.kind == gqlFloat:
+		var f float64
+		if _, err := fmt.Sscan(p.text, &f); err != nil {
+			return nil, p.errorf("invalid number %q", p.text)
+		}
+		v = f
+	case p.kind == gqlString:
+		v = p.text
+	case p.kind == gqlName:
+		switch p.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(p.text)
+		}
+	default:
+		return nil, p.errorf("expected a value, found %q", p.text)
+	}
+	return v, p.next()
+}
+
+// gqlMap is a result object, which keeps its fields in selection order.
+type gqlMap []gqlEntry
+
+type gqlEntry struct {
+	key string
+	val interface{}
+}
+
+func (m gqlMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range m {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.key)
+		v, err := json.Marshal(e.val)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlObject is a value of an object type in the schema.
+type gqlObject interface {
+	typename() string
+	// resolve returns the value of field f: a scalar, nil, a gqlObject or
+	// a []gqlObject.
+	resolve(x *gqlExec, f *gqlField) (interface{}, error)
+}
+
+// gqlExec runs one operation.
+type gqlExec struct {
+	vars   map[string]interface{}
+	errors []gqlError
+	// fields counts the fields resolved so far.
+	fields int
+	// chain, pending and prunedTo are the chain, the pending entries in
+	// mining order and the height below which blocks are headers only, as
+	// of the start. chain can be read without mutex: blocks are only ever
+	// appended past its end or the chain replaced, never overwritten.
+	chain    []Block
+	pending  []*mempoolEntry
+	prunedTo int
+	// peers is read before mutex is taken, as the peer set has its own
+	// lock.
+	peers []peerInfo
+	// accounts caches the state of the accounts asked for.
+	accounts map[string]gqlAccountState
+}
+
+// gqlAccountState is what the Account type reads from the chain state.
+type gqlAccountState struct {
+	balance int64
+	nonce   uint64
+	stake   int64
+}
+
+// account reads the state of addr, the first time under mutex.
+func (x *gqlExec) account(addr string) gqlAccountState {
+	if s, ok := x.accounts[addr]; ok {
+		return s
+	}
+	mutex.Lock()
+	s := gqlAccountState{balances[addr], accountNonces[addr], stakes[addr]}
+	mutex.Unlock()
+	x.accounts[addr] = s
+	return s
+}
+
+// confirmations counts the blocks from index up to the tip of x.chain.
+func (x *gqlExec) confirmations(index int) int {
+	return len(x.chain) - index
+}
+
+// findTx returns the transaction with the given ID, confirmed in x.chain
+// or pending.
+func (x *gqlExec) findTx(id string) (gqlTx, bool) {
+	mutex.Lock()
+	h, ok := txIndex[id]
+	mutex.Unlock()
+	if ok && h < len(x.chain) {
+		b := x.chain[h]
+		for _, raw := range b.Transactions {
+			if txID(raw) == id {
+				return gqlTx{raw: raw, block: &b}, true
+			}
+		}
+	}
+	for _, e := range x.pending {
+		if e.ID == id {
+			return gqlTx{raw: e.Transaction}, true
+		}
+	}
+	return gqlTx{}, false
+}
+
+func (x *gqlExec) selectFields(obj gqlObject, sel []*gqlField, path []interface{}) gqlMap {
+	out := make(gqlMap, 0, len(sel))
+	for _, f := range sel {
+		if x.fields++; x.fields > gqlMaxFields {
+			return out
+		}
+		key := f.name
+		if f.alias != "" {
+			key = f.alias
+		}
+		fieldPath := append(append([]interface{}{}, path...), key)
+		var val interface{}
+		if f.name == "__typename" {
+			val = obj.typename()
+		} else if v, err := obj.resolve(x, f); err != nil {
+			x.errors = append(x.errors, gqlError{err.Error(), fieldPath})
+		} else {
+			val = x.complete(v, f, obj, fieldPath)
+		}
+		out = append(out, gqlEntry{key, val})
+	}
+	return out
+}
+
+// complete turns a resolved value into its result, selecting the fields
+// of objects.
+func (x *gqlExec) complete(v interface{}, f *gqlField, parent gqlObject, path []interface{}) interface{} {
+	fail := func(format string, args ...interface{}) interface{} {
+		x.errors = append(x.errors, gqlError{fmt.Sprintf(format, args...), path})
+		return nil
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case gqlObject:
+		if f.sel == nil {
+			return fail("field %q of type %s must have a selection of subfields", f.name, v.typename())
+		}
+		return x.selectFields(v, f.sel, path)
+	case []gqlObject:
+		if f.sel == nil {
+			return fail("field %q is a list of objects and must have a selection of subfields", f.name)
+		}
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = x.selectFields(item, f.sel, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	default:
+		if f.sel != nil {
+			return fail("field %q is a scalar and takes no selection", f.name)
+		}
+		return v
+	}
+}
+
+// arg returns argument name of f with variables substituted, or nil.
+func (x *gqlExec) arg(f *gqlField, name string) interface{} {
+	v := f.args[name]
+	if ref, ok := v.(gqlVar); ok {
+		return x.vars[string(ref)]
+	}
+	return v
+}
+
+func (x *gqlExec) intArg(f *gqlField, name string, def int) (int, error) {
+	switch v := x.arg(f, name).(type) {
+	case nil:
+		return def, nil
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+			return 0, fmt.Errorf("argument %q must be an Int", name)
+		}
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("argument %q must be an Int", name)
+	}
+}
+
+func (x *gqlExec) stringArg(f *gqlField, name string) (string, bool, error) {
+	switch v := x.arg(f, name).(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	default:
+		return "", false, fmt.Errorf("argument %q must be a String", name)
+	}
+}
+
+func (x *gqlExec) boolArg(f *gqlField, name string, def bool) (bool, error) {
+	switch v := x.arg(f, name).(type) {
+	case nil:
+		return def, nil
+	case bool:
+		return v, nil
+	default:
+		return false, fmt.Errorf("argument %q must be a Boolean", name)
+	}
+}
+
+// pageArgs reads offset and limit, capping limit at maxPageLimit.
+func (x *gqlExec) pageArgs(f *gqlField, defLimit int) (offset, limit int, err error) {
+	if offset, err = x.intArg(f, "offset", 0); err != nil {
+		return 0, 0, err
+	}
+	if limit, err = x.intArg(f, "limit", defLimit); err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 || limit < 0 {
+		return 0, 0, errors.New("offset and limit must not be negative")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return offset, limit, nil
+}
+
+// page returns the bounds of the page of n items selected by offset and
+// limit.
+func page(n, offset, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + limit
+	if end > n {
+		end = n
+	}
+	return offset, end
+}
+
+func unknownField(typ string, f *gqlField) error {
+	return fmt.Errorf("cannot query field %q on type %s", f.name, typ)
+}
+
+type gqlQuery struct{}
+
+func (gqlQuery) typename() string { return "Query" }
+
+func (gqlQuery) resolve(x *gqlExec, f *gqlField) (interface{}, error) {
+	switch f.name {
+	case "height":
+		return len(x.chain) - 1, nil
+	case "block":
+		hash, byHash, err := x.stringArg(f, "hash")
+		if err != nil {
+			return nil, err
+		}
+		if byHash {
+			hash = strings.ToLower(hash)
+			for i := len(x.chain) - 1; i >= 0; i-- {
+				if x.chain[i].Hash == hash {
+					return gqlBlock{x.chain[i]}, nil
+				}
+			}
+			return nil, nil
+		}
+		index, err := x.intArg(f, "index", -1)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= len(x.chain) {
+			return nil, nil
+		}
+		return gqlBlock{x.chain[index]}, nil
+	case "blocks":
+		offset, limit, err := x.pageArgs(f, 10)
+		if err != nil {
+			return nil, err
+		}
+		newest, err := x.boolArg(f, "newestFirst", false)
+		if err != nil {
+			return nil, err
+		}
+		from, to := page(len(x.chain), offset, limit)
+		list := make([]gqlObject, 0, to-from)
+		for i := from; i < to; i++ {
+			h := i
+			if newest {
+				h = len(x.chain) - 1 - i
+			}
+			list = append(list, gqlBlock{x.chain[h]})
+		}
+		return list, nil
+	case "transaction":
+		id, _, err := x.stringArg(f, "id")
+		if err != nil {
+			return nil, err
+		}
+		if tx, ok := x.findTx(id); ok {
+			return tx, nil
+		}
+		return nil, nil
+	case "account":
+		addr, _, err := x.stringArg(f, "address")
+		if err != nil {
+			return nil, err
+		}
+		if err := validateAddress(addr); err != nil {
+			return nil, err
+		}
+		return gqlAccount(addr), nil
+	case "pending":
+		_, limit, err := x.pageArgs(f, 50)
+		if err != nil {
+			return nil, err
+		}
+		entries := x.pending
+		if len(entries) > limit {
+			entries = entries[:limit]
+		}
+		list := make([]gqlObject, len(entries))
+		for i, e := range entries {
+			list[i] = gqlTx{raw: e.Transaction}
+		}
+		return list, nil
+	case "peers":
+		list := make([]gqlObject, len(x.peers))
+		for i, p := range x.peers {
+			list[i] = gqlPeer(p)
+		}
+		return list, nil
+	}
+	return nil, unknownField("Query", f)
+}
+
+type gqlBlock struct{ b Block }
+
+func (gqlBlock) typename() string { return "Block" }
+
+func (o gqlBlock) resolve(x *gqlExec, f *gqlField) (interface{}, error) {
+	b := o.b
+	switch f.name {
+	case "index":
+		return b.Index, nil
+	case "timestamp":
+		return b.Timestamp, nil
+	case "hash":
+		return b.Hash, nil
+	case "prevHash":
+		return b.PrevHash, nil
+	case "merkleRoot":
+		return b.MerkleRoot, nil
+	case "nonce":
+		return b.Nonce, nil
+	case "difficulty":
+		return b.Difficulty, nil
+	case "bits":
+		return b.Bits, nil
+	case "confirmations":
+		return x.confirmations(b.Index), nil
+	case "pruned":
+		return b.Index > 0 && b.Index <= x.prunedTo, nil
+	case "transactionCount":
+		return len(b.Transactions), nil
+	case "transactions":
+		offset, limit, err := x.pageArgs(f, 100)
+		if err != nil {
+			return nil, err
+		}
+		from, to := page(len(b.Transactions), offset, limit)
+		list := make([]gqlObject, 0, to-from)
+		for _, raw := range b.Transactions[from:to] {
+			list = append(list, gqlTx{raw: raw, block: &b})
+		}
+		return list, nil
+	case "previous":
+		if b.Index == 0 || b.Index-1 >= len(x.chain) {
+			return nil, nil
+		}
+		return gqlBlock{x.chain[b.Index-1]}, nil
+	}
+	return nil, unknownField("Block", f)
+}
+
+// gqlTx is a transaction, confirmed in block or, if block is nil, pending.
+type gqlTx struct {
+	raw   string
+	block *Block
+}
+
+func (gqlTx) typename() string { return "Transaction" }
+
+func (o gqlTx) resolve(x *gqlExec, f *gqlField) (interface{}, error) {
+	tx, structured := parseTransaction(o.raw)
+	// Fields of a structured transaction are null for plain text.
+	field := func(v interface{}) (interface{}, error) {
+		if !structured {
+			return nil, nil
+		}
+		return v, nil
+	}
+	account := func(addr string) (interface{}, error) {
+		if !structured || addr == "" {
+			return nil, nil
+		}
+		return gqlAccount(addr), nil
+	}
+	switch f.name {
+	case "id":
+		return txID(o.raw), nil
+	case "raw":
+		return o.raw, nil
+	case "type":
+		if !structured {
+			return "text", nil
+		}
+		return tx.Type, nil
+	case "from":
+		return field(tx.From)
+	case "to":
+		return field(tx.To)
+	case "amount":
+		return field(tx.Amount)
+	case "fee":
+		return field(tx.Fee)
+	case "nonce":
+		return field(tx.Nonce)
+	case "data":
+		return field(tx.Data)
+	case "status":
+		if o.block == nil {
+			return "pending", nil
+		}
+		return "confirmed", nil
+	case "confirmations":
+		if o.block == nil {
+			return 0, nil
+		}
+		return x.confirmations(o.block.Index), nil
+	case "block":
+		if o.block == nil {
+			return nil, nil
+		}
+		return gqlBlock{*o.block}, nil
+	case "sender":
+		return account(tx.From)
+	case "recipient":
+		return account(tx.To)
+	}
+	return nil, unknownField("Transaction", f)
+}
+
+type gqlAccount string
+
+func (gqlAccount) typename() string { return "Account" }
+
+func (a gqlAccount) resolve(x *gqlExec, f *gqlField) (interface{}, error) {
+	addr := string(a)
+	switch f.name {
+	case "address":
+		return addr, nil
+	case "balance":
+		return x.account(addr).balance, nil
+	case "nonce":
+		return x.account(addr).nonce, nil
+	case "stake":
+		return x.account(addr).stake, nil
+	case "transactions":
+		offset, limit, err := x.pageArgs(f, 50)
+		if err != nil {
+			return nil, err
+		}
+		// Only the blocks addrIndex names are read, and only up to the
+		// end of the page.
+		mutex.Lock()
+		heights := append([]int(nil), addrIndex[addr]...)
+		mutex.Unlock()
+		list := []gqlObject{}
+		for _, h := range heights {
+			if h >= len(x.chain) || len(list) == limit {
+				break
+			}
+			b := x.chain[h]
+			for _, raw := range b.Transactions {
+				tx, ok := parseTransaction(raw)
+				if !ok || (tx.From != addr && tx.To != addr) || len(list) == limit {
+					continue
+				}
+				if offset > 0 {
+					offset--
+					continue
+				}
+				list = append(list, gqlTx{raw: raw, block: &b})
+			}
+		}
+		return list, nil
+	}
+	return nil, unknownField("Account", f)
+}
+
+type gqlPeer peerInfo
+
+func (gqlPeer) typename() string { return "Peer" }
+
+func (p gqlPeer) resolve(x *gqlExec, f *gqlField) (interface{}, error) {
+	switch f.name {
+	case "url":
+		return p.URL, nil
+	case "height":
+		return p.Height, nil
+	case "latencyMs":
+		if p.LastSeen == 0 {
+			return nil, nil
+		}
+		return p.LatencyMs, nil
+	case "lastSeen":
+		if p.LastSeen == 0 {
+			return nil, nil
+		}
+		return p.LastSeen, nil
+	case "failures":
+		return p.Failures, nil
+	case "linked":
+		return p.Linked, nil
+	}
+	return nil, unknownField("Peer", f)
+}
+
+// gqlRequest is a GraphQL request, the body of POST /graphql or the query
+// parameters of GET.
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// handleGraphQL serves POST /graphql {query, variables, operationName} and
+// GET /graphql?query=, answering {data, errors} as GraphQL servers do. GET
+// without a query returns the schema.
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var body gqlRequest
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if body.Query = q.Get("query"); body.Query == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, gqlSchema)
+			return
+		}
+		body.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &body.Variables); err != nil {
+				http.Error(w, "variables must be a JSON object", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Query == "" {
+			http.Error(w, "invalid body, expected {\"query\":\"...\"}", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	op, err := parseGraphQL(body.Query, body.OperationName)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []gqlError{{Message: err.Error()}}})
+		return
+	}
+	x := &gqlExec{vars: op.defaults, peers: peers.table(), accounts: map[string]gqlAccountState{}}
+	for k, v := range body.Variables {
+		x.vars[k] = v
+	}
+	mutex.Lock()
+	x.chain = blockchain[:len(blockchain):len(blockchain)]
+	x.pending = mempool.ordered()
+	if snapshotApplies() {
+		x.prunedTo = snapshotBase.Height
+	}
+	mutex.Unlock()
+	data := x.selectFields(gqlQuery{}, op.sel, nil)
+	if x.fields > gqlMaxFields {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []gqlError{{
+			Message: fmt.Sprintf("query resolves more than %d fields, ask for fewer or smaller pages", gqlMaxFields),
+		}}})
+		return
+	}
+	resp := map[string]interface{}{"data": data}
+	if len(x.errors) > 0 {
+		resp["errors"] = x.errors
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGraphQLFieldBudget(t *testing.T) {
+	chain := make([]Block, 50)
+	for i := range chain {
+		chain[i].Index = i
+		for j := 0; j < 300; j++ {
+			chain[i].Transactions = append(chain[i].Transactions, fmt.Sprintf("tx %d-%d", i, j))
+		}
+	}
+	run := func(query string) *gqlExec {
+		op, err := parseGraphQL(query, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := &gqlExec{vars: op.defaults, chain: chain, accounts: map[string]gqlAccountState{}}
+		x.selectFields(gqlQuery{}, op.sel, nil)
+		return x
+	}
+	if x := run("{ blocks(limit: 50) { transactions(limit: 100) { id } } }"); x.fields > gqlMaxFields || len(x.errors) > 0 {
+		t.Errorf("5051 fields: resolved %d, errors %v", x.fields, x.errors)
+	}
+	if x := run("{ blocks(limit: 50) { transactions(limit: 300) { id } } }"); x.fields <= gqlMaxFields {
+		t.Errorf("15051 fields: resolved %d, want the %d budget exceeded", x.fields, gqlMaxFields)
+	}
+}
+
+func TestGraphQLAccountTransactionsPage(t *testing.T) {
+	saved := addrIndex
+	defer func() { addrIndex = saved }()
+	addrIndex = map[string][]int{}
+	chain := make([]Block, 6)
+	for i := range chain {
+		chain[i] = Block{Index: i}
+		if i%2 == 1 {
+			chain[i].Transactions = []string{
+				Transaction{Type: txTypeTransfer, From: "alice", To: "bob", Nonce: uint64(i)}.encode(),
+				Transaction{Type: txTypeTransfer, From: "carol", To: "dave", Nonce: uint64(i)}.encode(),
+			}
+		}
+		indexBlockTxs(chain[i])
+	}
+	x := &gqlExec{chain: chain, accounts: map[string]gqlAccountState{}}
+	f := &gqlField{name: "transactions", args: map[string]interface{}{"offset": float64(1), "limit": float64(1)}}
+	v, err := gqlAccount("bob").resolve(x, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := v.([]gqlObject)
+	if len(list) != 1 || list[0].(gqlTx).block.Index != 3 {
+		t.Fatalf("second of bob's transactions: got %v, want the one in block 3", list)
+	}
+}
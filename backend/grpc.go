@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The gRPC API, the service in mesam.proto, served over cleartext HTTP/2
+// with net/http. Only what the four methods need of the protocol is
+// implemented: uncompressed messages, a status in the trailers and server
+// streaming.
+
+// grpcAddr is where the gRPC API listens; empty disables it.
+var grpcAddr = ""
+
+// grpcMaxMessage bounds a request message.
+const grpcMaxMessage = 4 << 20
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcStream writes response messages, flushing each so streamed blocks go
+// out as they come.
+type grpcStream struct {
+	w http.ResponseWriter
+}
+
+func (s grpcStream) send(msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := s.w.Write(append(prefix[:], msg...)); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+// grpcMethod handles one call: req is the request message and every
+// response message goes to out.
+type grpcMethod func(ctx context.Context, req []byte, out grpcStream) error
+
+var grpcMethods = map[string]grpcMethod{
+	"/mesam.Chain/SubmitTx":    grpcSubmitTx,
+	"/mesam.Chain/Mine":        grpcMine,
+	"/mesam.Chain/GetBlocks":   grpcGetBlocks,
+	"/mesam.Chain/WatchBlocks": grpcWatchBlocks,
+}
+
+// grpcRoles are the roles methods need, as routeRoles are for HTTP. The
+// others need roleReader with -auth-reads.
+var grpcRoles = map[string]string{
+	"/mesam.Chain/SubmitTx": roleSubmitter,
+	"/mesam.Chain/Mine":     roleMiner,
+}
+
+// readGRPCMessage reads the single request message of a call.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "request of %d bytes exceeds %d", size, grpcMaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	return msg, nil
+}
+
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.Header().Set("Content-Type", "application/grpc")
+	r = withCaller(r)
+	err := grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	role := grpcRoles[r.URL.Path]
+	if role == "" && authReads {
+		role = roleReader
+	}
+	if status, authErr := authorize(r.Context(), role); authErr != nil {
+		code := grpcPermissionDenied
+		if status == http.StatusUnauthorized {
+			code = grpcUnauthenticated
+		}
+		err = grpcErrorf(code, "%v", authErr)
+	} else if ok, wait := allowCall(r.Context(), requestLimiter); !ok {
+		err = grpcErrorf(grpcResourceExhausted, "%v", errRateLimited(wait))
+	} else if method, ok := grpcMethods[r.URL.Path]; ok {
+		var req []byte
+		if req, err = readGRPCMessage(r.Body); err == nil {
+			err = method(r.Context(), req, grpcStream{w})
+		}
+	}
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		var ge *grpcError
+		if errors.As(err, &ge) {
+			code = ge.code
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// newGRPCServer makes the server for the gRPC API on addr.
+func newGRPCServer(addr string) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(handleGRPC), BaseContext: serverContext}
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	// HTTP/1 stays on only to tell a client that it needs HTTP/2.
+	srv.Protocols.SetHTTP1(true)
+	return srv
+}
+
+// grpcSubmitTx adds a transaction to the mempool and relays it, as POST
+// /tx does for one that needs no more signatures.
+func grpcSubmitTx(ctx context.Context, req []byte, out grpcStream) error {
+	var tx *Transaction
+	var text string
+	err := parseProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			t, err := decodeProtoTransaction(f.b)
+			if err != nil {
+				return err
+			}
+			tx, text = &t, ""
+		case 2:
+			tx, text = nil, string(f.b)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if ok, wait := allowCall(ctx, txLimiter); !ok {
+		return grpcErrorf(grpcResourceExhausted, "%v", errRateLimited(wait))
+	}
+	entry, status, err := submitTransaction(tx, text)
+	if err != nil {
+		switch status {
+		case http.StatusConflict:
+			return grpcErrorf(grpcAlreadyExists, "%v", err)
+		case http.StatusTooManyRequests:
+			return grpcErrorf(grpcResourceExhausted, "%v", err)
+		case http.StatusPreconditionFailed:
+			return grpcErrorf(grpcFailedPrecondition, "%v", err)
+		}
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	return out.send(appendProtoString(nil, 1, entry.ID))
+}
+
+// grpcMine mines the pending transactions into a block, as POST /mine
+// does.
+func grpcMine(ctx context.Context, req []byte, out grpcStream) error {
+	var difficulty int
+	var miner string
+	err := parseProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			difficulty = int(int32(f.v))
+		case 2:
+			miner = strings.TrimSpace(string(f.b))
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if miner != "" {
+		if err := validateAddress(miner); err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+	}
+	if ok, wait := allowCall(ctx, mineLimiter); !ok {
+		return grpcErrorf(grpcResourceExhausted, "%v", errRateLimited(wait))
+	}
+	ctx, done := trackMining(ctx)
+	defer done()
+	block, err := mineFromMempool(ctx, difficulty, miner)
+	switch {
+	case errors.Is(err, errNothingToMine):
+		return grpcErrorf(grpcFailedPrecondition, "%v", err)
+	case errors.Is(err, errDifficultyTooLow):
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	case errors.Is(err, context.Canceled):
+		return grpcErrorf(grpcCanceled, "%v", err)
+	case errors.Is(err, errNotAuthority) || errors.Is(err, errNotProposer):
+		return grpcErrorf(grpcPermissionDenied, "%v", err)
+	case err != nil:
+		return err
+	}
+	return out.send(encodeProtoBlock(block))
+}
+
+// grpcGetBlocks streams a range of the chain.
+func grpcGetBlocks(ctx context.Context, req []byte, out grpcStream) error {
+	from, to := int64(0), int64(-1)
+	err := parseProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			from = int64(f.v)
+		case 2:
+			to = int64(f.v)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	mutex.Lock()
+	tip := int64(len(blockchain) - 1)
+	if to < 0 || to > tip {
+		to = tip
+	}
+	if from < 0 || from > tip {
+		mutex.Unlock()
+		return grpcErrorf(grpcNotFound, "from must be a height between 0 and %d", tip)
+	}
+	if prunedRange(int(from), int(to)) {
+		mutex.Unlock()
+		return grpcErrorf(grpcFailedPrecondition, "%v", errPruned)
+	}
+	var blocks []Block
+	if from <= to {
+		blocks = blockchain[from : to+1]
+	}
+	mutex.Unlock()
+	for _, b := range blocks {
+		if ctx.Err() != nil {
+			return grpcErrorf(grpcCanceled, "%v", ctx.Err())
+		}
+		if err := out.send(encodeProtoBlock(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grpcWatchBlocks streams blocks as they are appended until the client
+// goes away. A client that falls too far behind is cut off and should
+// catch up with GetBlocks.
+//
+// A reorg event may stand for blocks that got no block_added events of
+// their own, so on one the blocks from the fork on are read from the chain
+// and sent, and the block_added events of those that follow are skipped.
+func grpcWatchBlocks(ctx context.Context, req []byte, out grpcStream) error {
+	events, stop := subscribeEvents(math.MaxUint64)
+	defer stop()
+	// Send the headers now, so the client sees the call start before the
+	// first block.
+	out.w.(http.Flusher).Flush()
+	sent := -1
+	for {
+		var blocks []Block
+		select {
+		case <-ctx.Done():
+			return grpcErrorf(grpcCanceled, "%v", ctx.Err())
+		case e, ok := <-events:
+			if !ok {
+				return grpcErrorf(grpcResourceExhausted, "client fell behind the block stream")
+			}
+			switch data := e.Data.(type) {
+			case Block:
+				if e.Type == "block_added" && data.Index > sent {
+					blocks = []Block{data}
+				}
+			case map[string]interface{}:
+				if fork, ok := data["fork_height"].(int); ok && e.Type == "reorg" {
+					mutex.Lock()
+					if fork < len(blockchain) {
+						blocks = blockchain[fork:]
+					}
+					mutex.Unlock()
+				}
+			}
+		}
+		for _, b := range blocks {
+			if err := out.send(encodeProtoBlock(b)); err != nil {
+				return err
+			}
+			sent = b.Index
+		}
+	}
+}
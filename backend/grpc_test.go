@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// frameWriter hands each message a gRPC stream writes to frames.
+type frameWriter struct {
+	header http.Header
+	frames chan []byte
+}
+
+func (w frameWriter) Header() http.Header { return w.header }
+func (w frameWriter) WriteHeader(int)     {}
+func (w frameWriter) Flush()              {}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	w.frames <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestWatchBlocksSendsReorgBranch(t *testing.T) {
+	saved := blockchain
+	defer func() { blockchain = saved }()
+	blockchain = []Block{{Index: 0, Hash: "g"}, {Index: 1, Hash: "a1"}}
+
+	w := frameWriter{header: http.Header{}, frames: make(chan []byte, 16)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	subs := func() int {
+		eventsMutex.Lock()
+		defer eventsMutex.Unlock()
+		return len(eventSubs)
+	}
+	before := subs()
+	go func() { done <- grpcWatchBlocks(ctx, nil, grpcStream{w}) }()
+	for subs() == before {
+		time.Sleep(time.Millisecond)
+	}
+
+	publishEvent("block_added", blockchain[1])
+	// A coalesced reorg: the new branch gets no block_added events, only
+	// a later block does.
+	mutex.Lock()
+	blockchain = []Block{{Index: 0, Hash: "g"}, {Index: 1, Hash: "b1"}, {Index: 2, Hash: "b2"}}
+	publishEvent("reorg", map[string]interface{}{"fork_height": 1})
+	mutex.Unlock()
+	publishEvent("block_added", blockchain[1])
+	b3 := Block{Index: 3, Hash: "b3"}
+	publishEvent("block_added", b3)
+
+	for i, want := range []Block{{Index: 1, Hash: "a1"}, blockchain[1], blockchain[2], b3} {
+		select {
+		case got := <-w.frames:
+			if !bytes.Equal(got[5:], encodeProtoBlock(want)) {
+				t.Fatalf("message %d is not block %s", i, want.Hash)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d, block %s, not sent", i, want.Hash)
+		}
+	}
+	cancel()
+	<-done
+	if len(w.frames) != 0 {
+		t.Errorf("%d messages sent after the last block", len(w.frames))
+	}
+}
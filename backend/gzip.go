@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipResponses, set with -gzip, turns response compression on or off.
+var gzipResponses = true
+
+// gzipMinBytes is the smallest answer worth compressing; below it the gzip
+// header and the CPU cost outweigh the bytes saved.
+const gzipMinBytes = 1024
+
+var gzipWriters = sync.Pool{New: func() any {
+	gz, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return gz
+}}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, named
+// or through *, with a q-value above zero.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether answers of a content type are text, so gzip
+// pays off. Binary block encodings and gRPC frames are left alone, and
+// event streams are too, as each event must reach the client as it is sent.
+func compressible(contentType string) bool {
+	mt, _, _ := strings.Cut(contentType, ";")
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	switch {
+	case mt == "text/event-stream":
+		return false
+	case strings.HasPrefix(mt, "text/"), strings.HasSuffix(mt, "json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	return mt == "application/javascript" || mt == "application/xml"
+}
+
+// gzipResponse holds back the status and the first gzipMinBytes of an
+// answer until it knows whether to compress it, then writes through gz or
+// straight to the client.
+type gzipResponse struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponse) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.decide(false)
+	}
+}
+
+func (w *gzipResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= gzipMinBytes {
+			w.decide(true)
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the status and what is held back. large says whether the
+// answer is big enough to compress; its content type and any encoding the
+// handler set have the final say.
+func (w *gzipResponse) decide(large bool) {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	hdr := w.Header()
+	if hdr.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// Sniff now: once compressed, the body would sniff as gzip.
+		hdr.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if large && hdr.Get("Content-Encoding") == "" && compressible(hdr.Get("Content-Type")) {
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		if w.gz != nil {
+			w.gz.Write(w.buf)
+		} else {
+			w.ResponseWriter.Write(w.buf)
+		}
+	}
+	w.buf = nil
+}
+
+// close finishes the answer once the handler returns.
+func (w *gzipResponse) close() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			return
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// Flush sends what is held back, so a handler that flushes an answer in
+// parts gets each part to the client, compressed or not.
+func (w *gzipResponse) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) >= gzipMinBytes)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	return hj.Hijack()
+}
+
+func (w *gzipResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withGzip compresses the text answers of h, JSON above all, for clients
+// that send Accept-Encoding: gzip. Peers syncing with Go's HTTP client ask
+// for gzip and decompress by themselves. HEAD requests and WebSocket
+// upgrades pass straight through.
+func withGzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !gzipResponses || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponse{ResponseWriter: w}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// protocolVersion is the version of the node-to-node protocol. Nodes only
+// peer with nodes speaking the same version.
+const protocolVersion = 2
+
+var (
+	// networkID names the network this node belongs to, so demo networks
+	// sharing a genesis block can still be kept apart.
+	networkID = "mesam-devnet"
+	// genesisHash is the hash of the loaded chain's genesis block, set
+	// once at startup.
+	genesisHash string
+)
+
+var errIncompatiblePeer = errors.New("peer is on a different chain")
+
+// hello is what nodes exchange in the handshake.
+type hello struct {
+	Version     int    `json:"version"`
+	NetworkID   string `json:"network_id"`
+	GenesisHash string `json:"genesis_hash"`
+	ChainID     string `json:"chain_id"`
+	Height      int    `json:"height"`
+	// ChainWork is the peer's cumulative chain work in hex.
+	ChainWork string `json:"chain_work"`
+	// NodeID tells one run of a node from another.
+	NodeID string `json:"node_id,omitempty"`
+}
+
+// check reports why a node sending h cannot be peered with, if it cannot.
+func (h hello) check() error {
+	switch {
+	case h.Version != protocolVersion:
+		return fmt.Errorf("%w: protocol version %d, want %d", errIncompatiblePeer, h.Version, protocolVersion)
+	case h.NetworkID != networkID:
+		return fmt.Errorf("%w: network %q, want %q", errIncompatiblePeer, h.NetworkID, networkID)
+	case h.GenesisHash != genesisHash:
+		return fmt.Errorf("%w: genesis %s, want %s", errIncompatiblePeer, h.GenesisHash, genesisHash)
+	case h.ChainID != chainID:
+		return fmt.Errorf("%w: chain id %q, want %q", errIncompatiblePeer, h.ChainID, chainID)
+	}
+	return nil
+}
+
+// Every request to a peer carries this node's identity in these headers.
+const (
+	headerProtocolVersion = "X-Protocol-Version"
+	headerNetworkID       = "X-Network-Id"
+	headerGenesisHash     = "X-Genesis-Hash"
+	headerChainID         = "X-Chain-Id"
+)
+
+func setHelloHeaders(h http.Header) {
+	h.Set(headerProtocolVersion, fmt.Sprint(protocolVersion))
+	h.Set(headerNetworkID, networkID)
+	h.Set(headerGenesisHash, genesisHash)
+	h.Set(headerChainID, chainID)
+}
+
+// helloTransport adds the identity headers to outgoing peer requests.
+type helloTransport struct {
+	base http.RoundTripper
+}
+
+func (t helloTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	setHelloHeaders(r.Header)
+	return t.base.RoundTrip(r)
+}
+
+// checkPeerRequest rejects a request from a node on another chain. With
+// require unset, requests without identity headers, e.g. from curl, are let
+// through.
+func checkPeerRequest(r *http.Request, require bool) error {
+	if r.Header.Get(headerGenesisHash) == "" && !require {
+		return nil
+	}
+	var version int
+	fmt.Sscan(r.Header.Get(headerProtocolVersion), &version)
+	return hello{
+		Version:     version,
+		NetworkID:   r.Header.Get(headerNetworkID),
+		GenesisHash: r.Header.Get(headerGenesisHash),
+		ChainID:     r.Header.Get(headerChainID),
+	}.check()
+}
+
+// handshake fetches a peer's hello and checks that it is on this node's
+// chain.
+func handshake(peer string) (hello, error) {
+	h, err := fetchHello(peer)
+	if err != nil {
+		return hello{}, err
+	}
+	return h, h.check()
+}
+
+func fetchHello(peer string) (hello, error) {
+	resp, err := peerClient.Get(peer + "/handshake")
+	if err != nil {
+		return hello{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return hello{}, fmt.Errorf("handshake status %d", resp.StatusCode)
+	}
+	var h hello
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return hello{}, err
+	}
+	return h, nil
+}
+
+// handleHandshake serves GET /handshake with this node's hello.
+func handleHandshake(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	height := len(blockchain) - 1
+	work := chainWork(blockchain)
+	mutex.Unlock()
+	json.NewEncoder(w).Encode(hello{
+		Version:     protocolVersion,
+		NetworkID:   networkID,
+		GenesisHash: genesisHash,
+		ChainID:     chainID,
+		Height:      height,
+		ChainWork:   work.Text(16),
+		NodeID:      nodeID,
+	})
+}
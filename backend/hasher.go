@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// Hasher is the hash function a chain uses for proof of work. Transaction
+// IDs and merkle roots always use SHA-256.
+type Hasher interface {
+	Name() string
+	Sum(data []byte) [32]byte
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string             { return "sha256" }
+func (sha256Hasher) Sum(data []byte) [32]byte { return sha256.Sum256(data) }
+
+type sha256dHasher struct{}
+
+func (sha256dHasher) Name() string { return "sha256d" }
+func (sha256dHasher) Sum(data []byte) [32]byte {
+	first := sha256.Sum256(data)
+	return sha256.Sum256(first[:])
+}
+
+type blake2bHasher struct{}
+
+func (blake2bHasher) Name() string             { return "blake2b" }
+func (blake2bHasher) Sum(data []byte) [32]byte { return blake2b256(data) }
+
+var hashers = map[string]Hasher{}
+
+func init() {
+	for _, h := range []Hasher{sha256Hasher{}, sha256dHasher{}, blake2bHasher{}} {
+		hashers[h.Name()] = h
+	}
+}
+
+var (
+	// powAlgorithm is the proof-of-work hash a new genesis block is created
+	// with. An existing chain keeps the algorithm recorded in its genesis.
+	powAlgorithm = "sha256"
+	// chainHasher is the proof-of-work hash of the loaded chain.
+	chainHasher Hasher = sha256Hasher{}
+)
+
+// hasherFor looks up a hasher by name. Chains created before the algorithm
+// was recorded use single SHA-256.
+func hasherFor(name string) (Hasher, error) {
+	if name == "" {
+		return sha256Hasher{}, nil
+	}
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q (have %v)", name, hasherNames())
+	}
+	return h, nil
+}
+
+func hasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for n := range hashers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func powHash(record string) string {
+	sum := chainHasher.Sum([]byte(record))
+	return hex.EncodeToString(sum[:])
+}
+
+// prefixHasher is implemented by hashers that can hash in steps, letting
+// the mining loop hash the parts of the header before the nonce only once.
+type prefixHasher interface {
+	Hasher
+	newDigest() hash.Hash
+	finish(first [32]byte) [32]byte
+}
+
+func (sha256Hasher) newDigest() hash.Hash            { return sha256.New() }
+func (sha256Hasher) finish(first [32]byte) [32]byte  { return first }
+func (sha256dHasher) newDigest() hash.Hash           { return sha256.New() }
+func (sha256dHasher) finish(first [32]byte) [32]byte { return sha256.Sum256(first[:]) }
+
+// newNonceSearch returns a function computing b's proof-of-work hash for a
+// given nonce, equal to computeHash with that nonce. For SHA-256 hashers the
+// digest state after the part of the header before the nonce is saved once
+// and restored for every nonce; other hashers rehash the whole header but
+// still skip rebuilding it as a string. The function reuses buffers and
+// must not be shared between goroutines.
+func newNonceSearch(b Block) func(nonce int64) [32]byte {
+	prefix, suffix := hashPreimage(b)
+	buf := []byte(prefix)
+	ph, ok := chainHasher.(prefixHasher)
+	if !ok {
+		return func(nonce int64) [32]byte {
+			buf = appendNonce(buf[:len(prefix)], b, nonce)
+			buf = append(buf, suffix...)
+			return chainHasher.Sum(buf)
+		}
+	}
+	d := ph.newDigest()
+	d.Write(buf)
+	midstate, _ := d.(encoding.BinaryMarshaler).MarshalBinary()
+	restore := d.(encoding.BinaryUnmarshaler)
+	tail := make([]byte, 0, 32+len(suffix))
+	return func(nonce int64) [32]byte {
+		restore.UnmarshalBinary(midstate)
+		tail = appendNonce(tail[:0], b, nonce)
+		tail = append(tail, suffix...)
+		d.Write(tail)
+		var sum [32]byte
+		d.Sum(sum[:0])
+		return ph.finish(sum)
+	}
+}
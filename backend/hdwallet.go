@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultHDPath is the account path child addresses are derived under; the
+// address index is appended as a final hardened component.
+const defaultHDPath = "m/44'/1'/0'/0'"
+
+// hardenedOffset marks a hardened child index. Ed25519 derivation
+// (SLIP-0010) only supports hardened children.
+const hardenedOffset = 0x80000000
+
+var (
+	bip39Words = strings.Fields(bip39English)
+	bip39Index = func() map[string]int {
+		m := make(map[string]int, len(bip39Words))
+		for i, w := range bip39Words {
+			m[w] = i
+		}
+		return m
+	}()
+)
+
+// newMnemonic returns a fresh BIP-0039 mnemonic of 12 or 24 words.
+func newMnemonic(words int) (string, error) {
+	var bits int
+	switch words {
+	case 12:
+		bits = 128
+	case 24:
+		bits = 256
+	default:
+		return "", errors.New("mnemonic must have 12 or 24 words")
+	}
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return entropyToMnemonic(entropy), nil
+}
+
+// entropyToMnemonic appends the SHA-256 checksum bits to the entropy and
+// maps each 11-bit group to a word.
+func entropyToMnemonic(entropy []byte) string {
+	csBits := len(entropy) * 8 / 32
+	sum := sha256.Sum256(entropy)
+	n := new(big.Int).SetBytes(entropy)
+	n.Lsh(n, uint(csBits))
+	n.Or(n, big.NewInt(int64(sum[0]>>(8-csBits))))
+
+	count := (len(entropy)*8 + csBits) / 11
+	words := make([]string, count)
+	mask := big.NewInt(2047)
+	for i := count - 1; i >= 0; i-- {
+		words[i] = bip39Words[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 11)
+	}
+	return strings.Join(words, " ")
+}
+
+// validateMnemonic checks that every word is in the wordlist and that the
+// checksum matches.
+func validateMnemonic(mnemonic string) error {
+	words := strings.Fields(mnemonic)
+	if len(words) != 12 && len(words) != 24 {
+		return errors.New("mnemonic must have 12 or 24 words")
+	}
+	n := new(big.Int)
+	for _, w := range words {
+		i, ok := bip39Index[w]
+		if !ok {
+			return fmt.Errorf("unknown mnemonic word %q", w)
+		}
+		n.Lsh(n, 11)
+		n.Or(n, big.NewInt(int64(i)))
+	}
+	csBits := len(words) * 11 / 33
+	cs := new(big.Int).And(n, big.NewInt(int64(1<<csBits-1))).Int64()
+	n.Rsh(n, uint(csBits))
+	entropy := make([]byte, csBits*4)
+	n.FillBytes(entropy)
+	sum := sha256.Sum256(entropy)
+	if int64(sum[0]>>(8-csBits)) != cs {
+		return errors.New("mnemonic checksum mismatch")
+	}
+	return nil
+}
+
+// mnemonicSeed stretches a mnemonic and optional passphrase into the 64-byte
+// BIP-0039 seed.
+func mnemonicSeed(mnemonic, passphrase string) ([]byte, error) {
+	normalized := strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key(sha512.New, normalized, []byte("mnemonic"+passphrase), 2048, 64)
+}
+
+// deriveHDKey walks a SLIP-0010 ed25519 path such as m/44'/1'/0'/0'/3' from
+// the seed and returns the private key at its end. Every component must be
+// hardened.
+func deriveHDKey(seed []byte, path string) (ed25519.PrivateKey, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) == 0 || parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path %q must start with m", path)
+	}
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed)
+	I := mac.Sum(nil)
+	key, chain := I[:32], I[32:]
+	for _, p := range parts[1:] {
+		if !strings.HasSuffix(p, "'") {
+			return nil, fmt.Errorf("path component %q must be hardened", p)
+		}
+		i, err := strconv.ParseUint(strings.TrimSuffix(p, "'"), 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path component %q", p)
+		}
+		data := make([]byte, 37)
+		copy(data[1:33], key)
+		binary.BigEndian.PutUint32(data[33:], uint32(i)+hardenedOffset)
+		mac := hmac.New(sha512.New, chain)
+		mac.Write(data)
+		I := mac.Sum(nil)
+		key, chain = I[:32], I[32:]
+	}
+	return ed25519.NewKeyFromSeed(key), nil
+}
+
+// hdAccount is one derived child key.
+type hdAccount struct {
+	Path       string `json:"path"`
+	Address    string `json:"address"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+}
+
+func deriveHDAccount(seed []byte, path string) (hdAccount, error) {
+	priv, err := deriveHDKey(seed, path)
+	if err != nil {
+		return hdAccount{}, err
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	return hdAccount{
+		Path:       path,
+		Address:    addressFromPubKey(pub),
+		PublicKey:  hex.EncodeToString(pub),
+		PrivateKey: hex.EncodeToString(priv.Seed()),
+	}, nil
+}
+
+// handleNewHDWallet serves POST /wallet/new?hd=true[&words=24]: a fresh
+// mnemonic together with its first child address.
+func handleNewHDWallet(w http.ResponseWriter, r *http.Request) {
+	words := 12
+	if v := r.URL.Query().Get("words"); v != "" {
+		words, _ = strconv.Atoi(v)
+	}
+	mnemonic, err := newMnemonic(words)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seed, err := mnemonicSeed(mnemonic, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account, err := deriveHDAccount(seed, defaultHDPath+"/0'")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mnemonic": mnemonic,
+		"account":  account,
+	})
+}
+
+// deriveRequest is the body of POST /wallet/derive.
+type deriveRequest struct {
+	Mnemonic   string `json:"mnemonic"`
+	Passphrase string `json:"passphrase"`
+	Path       string `json:"path"`
+	Index      uint32 `json:"index"`
+	Count      int    `json:"count"`
+}
+
+// handleDeriveWallet derives child accounts from a mnemonic. With "path" it
+// derives exactly that key; otherwise it derives "count" addresses starting
+// at "index" under the default account path.
+func handleDeriveWallet(w http.ResponseWriter, r *http.Request) {
+	var body deriveRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body, expected {\"mnemonic\":\"...\"}", http.StatusBadRequest)
+		return
+	}
+	if err := validateMnemonic(body.Mnemonic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seed, err := mnemonicSeed(body.Mnemonic, body.Passphrase)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var paths []string
+	if body.Path != "" {
+		paths = []string{body.Path}
+	} else {
+		if body.Count <= 0 {
+			body.Count = 1
+		}
+		if body.Count > 100 {
+			http.Error(w, "count must be at most 100", http.StatusBadRequest)
+			return
+		}
+		for i := 0; i < body.Count; i++ {
+			paths = append(paths, fmt.Sprintf("%s/%d'", defaultHDPath, body.Index+uint32(i)))
+		}
+	}
+	accounts := make([]hdAccount, 0, len(paths))
+	for _, p := range paths {
+		account, err := deriveHDAccount(seed, p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		accounts = append(accounts, account)
+	}
+	json.NewEncoder(w).Encode(accounts)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	syncModeBlocks  = "blocks"
+	syncModeHeaders = "headers"
+
+	// headerBatchSize is how many headers are requested at a time.
+	headerBatchSize = 2000
+	// syncBodyWorkers is how many block ranges are downloaded in parallel
+	// once the headers are known.
+	syncBodyWorkers = 4
+)
+
+var errHeaderMismatch = errors.New("block does not match its header")
+
+// syncMode selects how resolveChain catches up with a peer: block by
+// block, or headers first with block bodies fetched in parallel.
+var syncMode = syncModeBlocks
+
+// headerOf strips a block down to its header. The merkle root still
+// commits to the transactions, so the hash can be checked without them.
+func headerOf(b Block) Block {
+	b.Transactions = nil
+	return b
+}
+
+// handleGetHeaders serves GET /headers[?from=N][&to=M], the block headers
+// from height N to M inclusive.
+func handleGetHeaders(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	blocks, err := heightRange(r.URL.Query())
+	headers := make([]Block, len(blocks))
+	for i, b := range blocks {
+		headers[i] = headerOf(b)
+	}
+	mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(headers)
+}
+
+func fetchHeaders(peer string, from, to int) ([]Block, error) {
+	resp, err := peerClient.Get(fmt.Sprintf("%s/headers?from=%d&to=%d", peer, from, to))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var headers []Block
+	if err := json.NewDecoder(resp.Body).Decode(&headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// checkHeader checks that h links to the last entry of chain and carries a
+// valid seal: enough proof of work for the target chain implies, or an
+// authority's signature. Whether a proof-of-stake signer was the drawn
+// proposer depends on state and is left to the full block check.
+func checkHeader(chain []Block, h Block) error {
+	prev := chain[len(chain)-1]
+	if h.PrevHash != prev.Hash {
+		return errBlockNotOnTip
+	}
+	if h.Index != prev.Index+1 {
+		return errUnexpectedIndex
+	}
+	if err := checkCheckpoint(h); err != nil {
+		return err
+	}
+	if err := checkBlockTime(chain, h); err != nil {
+		return err
+	}
+	if err := checkMerkleVersion(prev, h); err != nil {
+		return err
+	}
+	if err := checkBlockFormat(prev, h); err != nil {
+		return err
+	}
+	if h.Algorithm != "" || h.Consensus != "" || len(h.Authorities) > 0 || h.ChainID != "" {
+		return errors.New("only the genesis block may set chain parameters")
+	}
+	if h.Hash != computeHash(h) {
+		return errors.New("hash does not match the block header")
+	}
+	switch chainConsensus {
+	case consensusPoW:
+		target := blockTarget(h)
+		if !hashMeetsTarget(h.Hash, target) {
+			return errors.New("hash does not meet the target")
+		}
+		if target.Cmp(requiredTargetOf(chain, h.Index)) > 0 {
+			return errDifficultyTooLow
+		}
+		return nil
+	case consensusPoA:
+		if !isAuthority(h.Signer) {
+			return errNotAuthority
+		}
+	}
+	return verifySignature(h)
+}
+
+// syncHeadersFirst catches up with peer up to height by first downloading
+// and checking every missing header, then fetching the block bodies in
+// parallel ranges and appending them in order. Each body must match its
+// header before the usual block checks run. It returns errBlockNotOnTip if
+// the peer's chain forks from the local one.
+func syncHeadersFirst(peer string, height int) error {
+	mutex.Lock()
+	view := append([]Block(nil), blockchain...)
+	mutex.Unlock()
+	start := len(view)
+	for len(view) <= height {
+		to := len(view) + headerBatchSize - 1
+		if to > height {
+			to = height
+		}
+		headers, err := fetchHeaders(peer, len(view), to)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 {
+			break
+		}
+		for _, h := range headers {
+			if err := checkHeader(view, h); err != nil {
+				if invalidBlock(err) {
+					bans.misbehave(hostOf(peer), scoreInvalidBlock, fmt.Sprintf("invalid header %d: %v", h.Index, err))
+				}
+				return fmt.Errorf("header %d: %w", h.Index, err)
+			}
+			view = append(view, h)
+		}
+	}
+	headers := view[start:]
+	if len(headers) == 0 {
+		return nil
+	}
+
+	type bodies struct {
+		blocks []Block
+		err    error
+	}
+	chunks := (len(headers) + syncBatchSize - 1) / syncBatchSize
+	results := make([]chan bodies, chunks)
+	for i := range results {
+		results[i] = make(chan bodies, 1)
+	}
+	jobs := make(chan int)
+	for w := 0; w < syncBodyWorkers; w++ {
+		go func() {
+			for i := range jobs {
+				from := i * syncBatchSize
+				to := from + syncBatchSize
+				if to > len(headers) {
+					to = len(headers)
+				}
+				blocks, err := fetchBlockRange(peer, headers[from].Index, headers[to-1].Index)
+				if err == nil {
+					err = matchHeaders(blocks, headers[from:to])
+				}
+				results[i] <- bodies{blocks, err}
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < chunks; i++ {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var failed error
+	for i := 0; i < chunks; i++ {
+		res := <-results[i]
+		if failed != nil {
+			continue
+		}
+		if res.err != nil {
+			failed = res.err
+			if errors.Is(res.err, errHeaderMismatch) {
+				bans.misbehave(hostOf(peer), scoreInvalidBlock, res.err.Error())
+			}
+			continue
+		}
+		failed = acceptPeerBatch(res.blocks)
+		if invalidBlock(failed) {
+			bans.misbehave(hostOf(peer), scoreInvalidBlock, "invalid "+failed.Error())
+		}
+	}
+	return failed
+}
+
+// matchHeaders checks that downloaded blocks are the ones the headers
+// describe.
+func matchHeaders(blocks, headers []Block) error {
+	if len(blocks) != len(headers) {
+		return fmt.Errorf("%w: peer sent %d blocks for %d headers", errHeaderMismatch, len(blocks), len(headers))
+	}
+	for i, b := range blocks {
+		if b.Hash != headers[i].Hash || blockMerkleRoot(b) != headers[i].MerkleRoot {
+			return fmt.Errorf("%w: block %d", errHeaderMismatch, headers[i].Index)
+		}
+	}
+	return nil
+}
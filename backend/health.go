@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// /healthz and /readyz are for load balancers and Kubernetes probes.
+// /healthz answers as long as the process serves requests at all, so a
+// failing one means the node should be restarted; /readyz says whether it
+// should be sent traffic: its chain is loaded, it can write to disk, it is
+// not far behind a peer it is syncing from and it is not shutting down.
+
+// readyMaxLag is how many blocks behind the peer it is syncing from the
+// node may be and still be ready. Catching up with a block or two is
+// routine and should not take a node out of rotation.
+const readyMaxLag = 10
+
+// processStart is when the node started, for the uptimes it reports.
+var processStart = time.Now()
+
+// syncProgress tracks the syncs in progress, so /readyz knows how far
+// behind the node is.
+type syncProgress struct {
+	mu     sync.Mutex
+	active int
+	peer   string
+	target int
+}
+
+var chainSync syncProgress
+
+// begin records a sync from peer up to height target. The function it
+// returns records its end.
+func (s *syncProgress) begin(peer string, target int) func() {
+	s.mu.Lock()
+	s.active++
+	if target > s.target {
+		s.peer, s.target = peer, target
+	}
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		if s.active--; s.active == 0 {
+			s.peer, s.target = "", 0
+		}
+		s.mu.Unlock()
+	}
+}
+
+// status returns the peer being synced from and the height it is synced
+// towards, or "" when nothing is syncing.
+func (s *syncProgress) status() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer, s.target
+}
+
+// healthCheck is the outcome of one readiness check.
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// liveness is the answer to GET /healthz.
+type liveness struct {
+	Status        string `json:"status"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// readiness is the answer to GET /readyz.
+type readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// checkStorage makes sure the chain file is there and its directory can
+// still be written to, as the next block needs it to be.
+func checkStorage() error {
+	if _, err := os.Stat(blockchainFile); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(blockchainFile), ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// handleHealthz serves GET /healthz.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(liveness{Status: "ok", UptimeSeconds: int64(time.Since(processStart).Seconds())})
+}
+
+// handleReadyz serves GET /readyz: 200 when every check passes, 503 and
+// the failing checks otherwise.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	height := len(blockchain) - 1
+	var tip string
+	if height >= 0 {
+		tip = blockchain[height].Hash
+	}
+	mutex.Unlock()
+
+	checks := map[string]healthCheck{}
+	if height < 0 {
+		checks["chain"] = healthCheck{Detail: "no chain loaded"}
+	} else {
+		checks["chain"] = healthCheck{OK: true, Detail: fmt.Sprintf("height %d, tip %s", height, tip)}
+	}
+	if err := checkStorage(); err != nil {
+		checks["storage"] = healthCheck{Detail: err.Error()}
+	} else {
+		checks["storage"] = healthCheck{OK: true}
+	}
+	switch peer, target := chainSync.status(); {
+	case peer != "" && target-height > readyMaxLag:
+		checks["sync"] = healthCheck{Detail: fmt.Sprintf("syncing from %s: height %d of %d", peer, height, target)}
+	case peer != "":
+		checks["sync"] = healthCheck{OK: true, Detail: fmt.Sprintf("catching up with %s: height %d of %d", peer, height, target)}
+	default:
+		checks["sync"] = healthCheck{OK: true}
+	}
+	if serverCtx.Err() != nil {
+		checks["shutdown"] = healthCheck{Detail: "shutting down"}
+	} else {
+		checks["shutdown"] = healthCheck{OK: true}
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness{Ready: ready, Checks: checks})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// maxMiningJobs bounds how many finished jobs are remembered.
+const maxMiningJobs = 100
+
+type attemptsKey struct{}
+
+// withAttemptCounter makes mineBlock add the hashes it tries to n, as well
+// as to any counters ctx already carries.
+func withAttemptCounter(ctx context.Context, n *int64) context.Context {
+	counters := append([]*int64{n}, attemptCounters(ctx)...)
+	return context.WithValue(ctx, attemptsKey{}, counters)
+}
+
+func attemptCounters(ctx context.Context) []*int64 {
+	counters, _ := ctx.Value(attemptsKey{}).([]*int64)
+	return counters
+}
+
+// miningJob is a block being mined in the background on behalf of an
+// asynchronous POST /mine.
+type miningJob struct {
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	Difficulty int    `json:"difficulty,omitempty"`
+	Miner      string `json:"miner,omitempty"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	Block      *Block `json:"block,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	attempts int64
+	started  time.Time
+	finished time.Time
+}
+
+var (
+	jobsMutex sync.Mutex
+	jobs      = map[string]*miningJob{}
+	jobOrder  []string
+)
+
+// startMiningJob mines the mempool in the background and returns the job
+// tracking it. DELETE /mine cancels it like any other mining attempt.
+func startMiningJob(difficulty int, miner string) *miningJob {
+	b := make([]byte, 8)
+	rand.Read(b)
+	now := time.Now()
+	job := &miningJob{
+		ID:         hex.EncodeToString(b),
+		Status:     jobRunning,
+		Difficulty: difficulty,
+		Miner:      miner,
+		StartedAt:  now.Unix(),
+		started:    now,
+	}
+	jobsMutex.Lock()
+	jobs[job.ID] = job
+	jobOrder = append(jobOrder, job.ID)
+	for len(jobOrder) > maxMiningJobs {
+		if old := jobs[jobOrder[0]]; old.Status == jobRunning {
+			break
+		}
+		delete(jobs, jobOrder[0])
+		jobOrder = jobOrder[1:]
+	}
+	jobsMutex.Unlock()
+
+	go func() {
+		ctx, done := trackMining(withAttemptCounter(context.Background(), &job.attempts))
+		block, err := mineFromMempool(ctx, difficulty, miner)
+		done()
+		jobsMutex.Lock()
+		defer jobsMutex.Unlock()
+		job.finished = time.Now()
+		job.FinishedAt = job.finished.Unix()
+		switch {
+		case err == nil:
+			job.Status = jobSucceeded
+			job.Block = &block
+		case errors.Is(err, context.Canceled):
+			job.Status = jobCanceled
+			job.Error = err.Error()
+		default:
+			job.Status = jobFailed
+			job.Error = err.Error()
+		}
+	}()
+	return job
+}
+
+// report returns the job with its live attempt count and hash rate. The
+// caller must hold jobsMutex.
+func (j *miningJob) report() map[string]interface{} {
+	attempts := atomic.LoadInt64(&j.attempts)
+	end := j.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	rate := 0.0
+	if elapsed := end.Sub(j.started).Seconds(); elapsed > 0 {
+		rate = float64(attempts) / elapsed
+	}
+	return map[string]interface{}{
+		"job":       j,
+		"attempts":  attempts,
+		"hash_rate": rate,
+	}
+}
+
+// handleMiningJob serves GET /mine/jobs/{id}.
+func handleMiningJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job, ok := jobs[id]
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(job.report())
+}
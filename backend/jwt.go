@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtSecret, set with -jwt-secret, is the HS256 key bearer tokens are
+// signed with. Empty disables tokens.
+var jwtSecret = ""
+
+// defaultTokenTTL is how long a token from POST /admin/tokens lasts unless
+// the request says otherwise.
+const defaultTokenTTL = 24 * time.Hour
+
+var (
+	errBadToken     = errors.New("invalid bearer token")
+	errTokenExpired = errors.New("bearer token has expired")
+)
+
+// jwtClaims are the claims a token is read for. Expiry and not-before are
+// checked when present; tokens the node issues always have an expiry.
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+func jwtSignature(signingInput string) []byte {
+	mac := hmac.New(sha256.New, []byte(jwtSecret))
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// signJWT encodes and signs claims as an HS256 token.
+func signJWT(claims jwtClaims) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	return input + "." + enc.EncodeToString(jwtSignature(input)), nil
+}
+
+// parseJWT checks a token's signature, times and role and returns its
+// claims. Only HS256 is accepted, so a token cannot pick a weaker
+// algorithm, or none, for itself.
+func parseJWT(token string) (jwtClaims, error) {
+	var claims jwtClaims
+	if jwtSecret == "" {
+		return claims, fmt.Errorf("%w: tokens are not enabled on this node", errBadToken)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errBadToken
+	}
+	enc := base64.RawURLEncoding
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, jwtSignature(parts[0]+"."+parts[1])) {
+		return claims, errBadToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return claims, errBadToken
+	}
+	data, err = enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return claims, errBadToken
+	}
+	now := time.Now().Unix()
+	switch {
+	case claims.ExpiresAt != 0 && now >= claims.ExpiresAt:
+		return claims, errTokenExpired
+	case claims.NotBefore != 0 && now < claims.NotBefore:
+		return claims, fmt.Errorf("%w: not valid yet", errBadToken)
+	case roleRanks[claims.Role] == 0:
+		return claims, fmt.Errorf("%w: unknown role %q", errBadToken, claims.Role)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: no subject", errBadToken)
+	}
+	return claims, nil
+}
+
+// tokenRequest is the body of POST /admin/tokens.
+type tokenRequest struct {
+	Subject    string `json:"subject"`
+	Role       string `json:"role"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+// handleIssueToken serves POST /admin/tokens {subject, role, ttl_seconds},
+// signing a token for someone, such as a student given submit access to a
+// demo node.
+func handleIssueToken(w http.ResponseWriter, r *http.Request) {
+	if jwtSecret == "" {
+		http.Error(w, "tokens are disabled; start the node with -jwt-secret", http.StatusNotFound)
+		return
+	}
+	var body tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Subject) == "" {
+		http.Error(w, "invalid body, expected {\"subject\":\"...\",\"role\":\"...\"}", http.StatusBadRequest)
+		return
+	}
+	if roleRanks[body.Role] == 0 {
+		http.Error(w, "role must be reader, submitter, miner or admin", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultTokenTTL
+	if body.TTLSeconds < 0 {
+		http.Error(w, "ttl_seconds must not be negative", http.StatusBadRequest)
+		return
+	} else if body.TTLSeconds > 0 {
+		ttl = time.Duration(body.TTLSeconds) * time.Second
+	}
+	now := time.Now()
+	claims := jwtClaims{
+		Subject:   strings.TrimSpace(body.Subject),
+		Role:      body.Role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	token, err := signJWT(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"subject":    claims.Subject,
+		"role":       claims.Role,
+		"expires_at": claims.ExpiresAt,
+	})
+}
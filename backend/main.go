@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +31,7 @@ const (
 	BlockchainName = "Mesam Blockchain" 
 	RollNumber     = "i22-1304"         
 	blockchainFile = "blockchain.json"
+	mempoolFile    = "mempool.json"
 )
 
 type Block struct {
@@ -30,15 +43,62 @@ type Block struct {
 	Hash         string   `json:"hash"`
 	Nonce        int64    `json:"nonce"`
 	Difficulty   int      `json:"difficulty"`
+	// Bits is the compact-encoded target. Older blocks leave it zero and
+	// are checked against Difficulty leading zeros instead.
+	Bits uint32 `json:"bits,omitempty"`
+	// MerkleVersion is the merkle tree version MerkleRoot was built with.
+	// Older blocks leave it zero, the legacy tree.
+	MerkleVersion int `json:"merkle_version,omitempty"`
+	// Format is the encoding of the hash preimage, see blockcodec.go.
+	// Older blocks leave it zero, the text format.
+	Format int `json:"format,omitempty"`
+	// Algorithm names the chain's proof-of-work hash. Only the genesis
+	// block records it.
+	Algorithm string `json:"algorithm,omitempty"`
+	// ChainID names the chain; only the genesis block records it, but
+	// every block hash commits to it.
+	ChainID string `json:"chain_id,omitempty"`
+	// Consensus and Authorities are also recorded only by the genesis
+	// block. Blocks of a PoA chain are sealed by Signer's Signature over
+	// Hash instead of by proof of work.
+	Consensus   string   `json:"consensus,omitempty"`
+	Authorities []string `json:"authorities,omitempty"`
+	Signer      string   `json:"signer,omitempty"`
+	Signature   string   `json:"signature,omitempty"`
 }
 
 var (
 	blockchain          []Block
-	pendingTransactions []string
+	mempool             = newMempool()
 	mutex               = &sync.Mutex{}
 	defaultDifficulty   = 4
+	blockReward         = int64(50)
+	// miningWorkers is how many goroutines search for a nonce in parallel.
+	miningWorkers = runtime.NumCPU()
+	// deterministicMining makes a chain reproducible for tests and demos: a
+	// new genesis needs no work, block timestamps advance by exactly
+	// targetBlockTime and the nonce search runs on a single worker, so the
+	// same transactions always produce the same blocks.
+	deterministicMining = false
 )
 
+// deterministicGenesisTime is the genesis timestamp in deterministic mode.
+const deterministicGenesisTime = 1700000000
+
+// blockTimestamp is the timestamp for a block following prev, the current
+// time unless that is before the median time past the block must not
+// precede. The caller must hold mutex.
+func blockTimestamp(prev Block) int64 {
+	if deterministicMining {
+		return prev.Timestamp + int64(targetBlockTime/time.Second)
+	}
+	now := time.Now().Unix()
+	if mtp := medianTimePast(blockchain, prev.Index+1); now < mtp {
+		return mtp
+	}
+	return now
+}
+
 func sha256hex(s string) string {
 	h := sha256.Sum256([]byte(s))
 	return hex.EncodeToString(h[:])
@@ -68,44 +128,168 @@ func computeMerkleRoot(txs []string) string {
 	return layer[0]
 }
 
-func computeHash(b Block) string {
-	record := strconv.Itoa(b.Index) +
+// hashPreimage splits the string a block hash is computed over into the
+// parts before and after the nonce.
+func hashPreimage(b Block) (prefix, suffix string) {
+	if b.Format == blockFormatBinary {
+		return binaryPreimage(b)
+	}
+	prefix = strconv.Itoa(b.Index) +
 		strconv.FormatInt(b.Timestamp, 10) +
 		b.PrevHash +
-		b.MerkleRoot +
-		strconv.FormatInt(b.Nonce, 10) +
-		strconv.Itoa(b.Difficulty)
-	return sha256hex(record)
+		b.MerkleRoot
+	suffix = strconv.Itoa(b.Difficulty)
+	if b.Bits != 0 {
+		suffix += strconv.FormatUint(uint64(b.Bits), 10)
+	}
+	suffix += b.Algorithm + b.Consensus + strings.Join(b.Authorities, ",") + b.Signer
+	if id := hashChainID(b); id != "" {
+		suffix += "/" + id
+	}
+	if b.MerkleVersion != merkleVersionLegacy {
+		suffix += "#" + strconv.Itoa(b.MerkleVersion)
+	}
+	return prefix, suffix
 }
 
-func mineBlock(b Block, stopAfterMs int64) (Block, error) {
-	prefix := strings.Repeat("0", b.Difficulty)
-	start := time.Now()
-	var nonce int64
-	for {
-		b.Nonce = nonce
-		hash := computeHash(b)
-		if strings.HasPrefix(hash, prefix) {
-			b.Hash = hash
-			return b, nil
-		}
-		nonce++
-		if stopAfterMs > 0 && time.Since(start) > time.Duration(stopAfterMs)*time.Millisecond {
-			return b, fmt.Errorf("mining timed out after %d ms (last nonce %d)", stopAfterMs, nonce)
+func computeHash(b Block) string {
+	prefix, suffix := hashPreimage(b)
+	return powHash(string(appendNonce([]byte(prefix), b, b.Nonce)) + suffix)
+}
+
+// mineBlock searches for a nonce that brings the block hash under its
+// target. The nonce space is interleaved across miningWorkers goroutines and
+// all of them stop as soon as one succeeds or ctx is done. Hashes tried are
+// added to the node total and to the context's attempt counters.
+func mineBlock(ctx context.Context, b Block, stopAfterMs int64) (Block, error) {
+	var target [32]byte
+	blockTarget(b).FillBytes(target[:])
+	attempts := attemptCounters(ctx)
+	workers := miningWorkers
+	if workers < 1 || deterministicMining {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if stopAfterMs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(stopAfterMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	type result struct {
+		block Block
+		err   error
+	}
+	results := make(chan result, workers)
+	for i := 0; i < workers; i++ {
+		go func(b Block, nonce int64) {
+			start, sinceRoll := nonce, int64(0)
+			var throttle *miningThrottle
+			if throttled() {
+				throttle = newMiningThrottle(workers)
+			}
+			search := newNonceSearch(b)
+			for tries := 0; ; tries++ {
+				if tries%1024 == 0 && tries > 0 {
+					countHashes(attempts, 1024)
+					if throttle != nil {
+						throttle.pause(ctx, 1024)
+					}
+					if ctx.Err() != nil {
+						results <- result{err: ctx.Err()}
+						return
+					}
+				}
+				if sum := search(nonce); bytes.Compare(sum[:], target[:]) <= 0 {
+					countHashes(attempts, int64(tries%1024+1))
+					b.Nonce = nonce
+					b.Hash = hex.EncodeToString(sum[:])
+					results <- result{block: b}
+					return
+				}
+				nonce += int64(workers)
+				sinceRoll++
+				if sinceRoll >= nonceRollInterval || nonce > math.MaxInt64-int64(workers) {
+					rollBlock(&b)
+					search = newNonceSearch(b)
+					nonce, sinceRoll = start, 0
+				}
+			}
+		}(b, int64(i))
+	}
+	res := <-results
+	if errors.Is(res.err, context.DeadlineExceeded) {
+		res.err = fmt.Errorf("mining timed out after %d ms", stopAfterMs)
+	}
+	return res.block, res.err
+}
+
+// nonceRollInterval is how many nonces a mining worker tries before it
+// changes the rest of the header and starts over.
+var nonceRollInterval = int64(1) << 32
+
+// rollBlock changes a block being mined so its nonce space can be searched
+// again: the extra nonce in the coinbase is bumped when there is one,
+// otherwise the timestamp is moved forward.
+func rollBlock(b *Block) {
+	if len(b.Transactions) > 0 {
+		if cb, ok := parseTransaction(b.Transactions[0]); ok && cb.Type == txTypeCoinbase {
+			cb.ExtraNonce++
+			b.Transactions = append([]string{cb.encode()}, b.Transactions[1:]...)
+			b.MerkleRoot = blockMerkleRoot(*b)
+			return
 		}
 	}
+	if now := time.Now().Unix(); now > b.Timestamp && !deterministicMining {
+		b.Timestamp = now
+	} else {
+		b.Timestamp++
+	}
 }
 
 func createGenesisBlock() Block {
 	gen := Block{
-		Index:        0,
-		Timestamp:    time.Now().Unix(),
-		Transactions: []string{RollNumber}, 
-		PrevHash:     "",
-		Difficulty:   defaultDifficulty,
-	}
-	gen.MerkleRoot = computeMerkleRoot(gen.Transactions)
-	mined, err := mineBlock(gen, 0)
+		Index:         0,
+		Timestamp:     time.Now().Unix(),
+		Transactions:  []string{RollNumber}, 
+		PrevHash:      "",
+		Difficulty:    defaultDifficulty,
+		Bits:          targetToCompact(zerosTarget(defaultDifficulty)),
+		Algorithm:     chainHasher.Name(),
+		ChainID:       newChainID,
+		MerkleVersion: currentMerkleVersion,
+		Format:        currentBlockFormat,
+	}
+	if gen.ChainID == "" {
+		gen.ChainID = networkID
+	}
+	if deterministicMining {
+		gen.Timestamp = deterministicGenesisTime
+		gen.Difficulty = 0
+		gen.Bits = targetToCompact(zerosTarget(0))
+	}
+	return sealGenesis(gen, false)
+}
+
+// sealGenesis fills in the merkle root and seals gen: with the configured
+// authorities or validators, or with proof of work, searched in nonce
+// order when sequential is set.
+func sealGenesis(gen Block, sequential bool) Block {
+	gen.MerkleRoot = blockMerkleRoot(gen)
+	if newChainConsensus == consensusPoA || newChainConsensus == consensusPoS {
+		// Authorities or validators seal the blocks after genesis; the
+		// genesis block itself is trusted as configured.
+		gen.Consensus = newChainConsensus
+		gen.Authorities = newChainAuthorities
+		gen.Difficulty, gen.Bits = 0, 0
+		gen.Hash = computeHash(gen)
+		return gen
+	}
+	mine := func(b Block) (Block, error) { return mineBlock(context.Background(), b, 0) }
+	if sequential {
+		mine = solveSequential
+	}
+	mined, err := mine(gen)
 	if err != nil {
 		gen.Nonce = 0
 		gen.Hash = computeHash(gen)
@@ -119,153 +303,1053 @@ func saveBlockchain() error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(blockchainFile, data, 0644)
+	return writeFileSync(blockchainFile, data, 0644)
+}
+
+// writeFileSync replaces path with data durably: it writes a temporary file
+// beside it, syncs it to disk and renames it over path, so a crash or power
+// loss leaves either the old file or the new one, never half of one.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The rename is only durable once the directory is synced too.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
 }
 
 func loadBlockchain() error {
 	if _, err := os.Stat(blockchainFile); os.IsNotExist(err) {
-		gen := createGenesisBlock()
+		h, err := hasherFor(powAlgorithm)
+		if err != nil {
+			return err
+		}
+		chainHasher = h
+		var gen Block
+		if configuredGenesis != nil {
+			gen = *configuredGenesis
+		} else {
+			gen = createGenesisBlock()
+		}
+		if err := loadConsensus(gen); err != nil {
+			return err
+		}
+		chainID = gen.ChainID
 		blockchain = []Block{gen}
+		rebuildState()
 		return saveBlockchain()
 	}
 	data, err := ioutil.ReadFile(blockchainFile)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, &blockchain)
+	if err := json.Unmarshal(data, &blockchain); err != nil {
+		return err
+	}
+	h, err := hasherFor(blockchain[0].Algorithm)
+	if err != nil {
+		return err
+	}
+	chainHasher = h
+	if err := loadConsensus(blockchain[0]); err != nil {
+		return err
+	}
+	chainID = blockchain[0].ChainID
+	if err := loadSnapshot(); err != nil {
+		return err
+	}
+	rebuildState()
+	return nil
+}
+
+// findConfirmedTx locates a transaction in the chain and returns its block
+// and position within that block. The caller must hold mutex.
+func findConfirmedTx(id string) (Block, int, bool) {
+	h, ok := txIndex[id]
+	if !ok || h >= len(blockchain) {
+		return Block{}, 0, false
+	}
+	b := blockchain[h]
+	for i, tx := range b.Transactions {
+		if txID(tx) == id {
+			return b, i, true
+		}
+	}
+	return Block{}, 0, false
+}
+
+// confirmations counts the blocks from blockIndex up to the tip; the block
+// containing a transaction is its first confirmation.
+func confirmations(blockIndex int) int {
+	return len(blockchain) - blockIndex
 }
 
 func getLastBlock() Block {
 	return blockchain[len(blockchain)-1]
 }
 
-func addBlock(transactions []string, difficulty int) (Block, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// maxRebases is how many times addBlock rebuilds a block whose tip moved
+// while it was being mined before giving up.
+const maxRebases = 3
+
+var errStaleTip = errors.New("chain tip kept moving while mining")
+
+// miningMutex serializes addBlock, so blocks are mined one at a time while
+// mutex is free for other requests.
+var miningMutex sync.Mutex
+
+// addBlock mines and appends a block in three stages: build a candidate on
+// the current tip, mine it without holding mutex, then append it only if it
+// still extends the tip. A block that went stale is rebuilt on the new tip
+// without any transactions confirmed in the meantime. A difficulty of 0
+// mines at the network target; a leading-zero difficulty easier than it is
+// rejected.
+func addBlock(ctx context.Context, transactions []string, difficulty int, miner string, fees int64) (Block, error) {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return Block{}, err
+		}
+		mutex.Lock()
+		candidate, err := newCandidate(transactions, difficulty, miner, fees)
+		if err == nil && chainConsensus != consensusPoW {
+			candidate, err = signBlock(candidate)
+		}
+		mutex.Unlock()
+		if err != nil {
+			return Block{}, err
+		}
+
+		mined := candidate
+		if chainConsensus == consensusPoW {
+			var hashes int64
+			start := time.Now()
+			if mined, err = mineBlock(withAttemptCounter(ctx, &hashes), candidate, 0); err != nil {
+				return Block{}, err
+			}
+			recordSolve(mined, time.Since(start), atomic.LoadInt64(&hashes))
+		}
+
+		mutex.Lock()
+		if mined.PrevHash == getLastBlock().Hash {
+			if err := validateBlock(getLastBlock(), mined); err != nil {
+				mutex.Unlock()
+				return Block{}, fmt.Errorf("mined block is invalid: %w", err)
+			}
+			appendBlock(mined)
+			mutex.Unlock()
+			return mined, nil
+		}
+		transactions, fees = unconfirmedSince(transactions, candidate.Index)
+		mutex.Unlock()
+		if attempt >= maxRebases {
+			return Block{}, errStaleTip
+		}
+	}
+}
+
+// unconfirmedSince drops the transactions included in blocks from height
+// on and returns the rest with their fees. The caller must hold mutex.
+func unconfirmedSince(transactions []string, height int) ([]string, int64) {
+	if height > len(blockchain) {
+		height = len(blockchain)
+	}
+	confirmed := map[string]bool{}
+	for _, b := range blockchain[height:] {
+		for _, raw := range b.Transactions {
+			confirmed[txID(raw)] = true
+		}
+	}
+	kept := []string{}
+	var fees int64
+	for _, raw := range transactions {
+		if confirmed[txID(raw)] {
+			continue
+		}
+		kept = append(kept, raw)
+		if tx, ok := parseTransaction(raw); ok {
+			fees += tx.Fee
+		}
+	}
+	return kept, fees
+}
+
+// newCandidate builds the unmined block that would follow the tip. The
+// caller must hold mutex.
+func newCandidate(transactions []string, difficulty int, miner string, fees int64) (Block, error) {
 	prev := getLastBlock()
-	newBlock := Block{
-		Index:        prev.Index + 1,
-		Timestamp:    time.Now().Unix(),
-		Transactions: transactions,
-		PrevHash:     prev.Hash,
-		Difficulty:   difficulty,
-	}
-	newBlock.MerkleRoot = computeMerkleRoot(newBlock.Transactions)
-	mined, err := mineBlock(newBlock, 0)
-	if err != nil {
-		return Block{}, err
+	target := requiredTarget(prev.Index + 1)
+	if chainConsensus != consensusPoW {
+		target = nil
+	} else if difficulty > 0 {
+		requested := compactToTarget(targetToCompact(zerosTarget(difficulty)))
+		if requested.Cmp(target) > 0 {
+			return Block{}, fmt.Errorf("%w: %d leading zeros is easier than bits %08x",
+				errDifficultyTooLow, difficulty, targetToCompact(target))
+		}
+		target = requested
+	}
+	if miner != "" {
+		transactions = append([]string{newCoinbase(miner, prev.Index+1, fees)}, transactions...)
 	}
-	blockchain = append(blockchain, mined)
+	b := Block{
+		Index:         prev.Index + 1,
+		Timestamp:     blockTimestamp(prev),
+		Transactions:  transactions,
+		PrevHash:      prev.Hash,
+		MerkleVersion: currentMerkleVersion,
+		Format:        currentBlockFormat,
+	}
+	if target != nil {
+		b.Difficulty = targetZeros(target)
+		b.Bits = targetToCompact(target)
+	}
+	b.MerkleRoot = blockMerkleRoot(b)
+	return b, nil
+}
+
+// appendBlock adds a mined block to the chain, drops what it confirmed
+// from the mempool, persists it and announces it to peers. The caller must
+// hold mutex.
+func appendBlock(b Block) {
+	blockchain = append(blockchain, b)
+	applyBlockState(b)
+	mempool.removeConfirmed(b)
 	_ = saveBlockchain()
-	return mined, nil
+	if !quietBlocks {
+		publishBlockEvents(b)
+	}
+	broadcastBlock(b)
+}
+
+var errNothingToMine = errors.New("no pending transactions to mine")
+
+// mineFromMempool moves as many pending transactions as fit in one block
+// into a new block mined at difficulty, paying the coinbase to miner if
+// set. On failure the transactions go back to the mempool.
+func mineFromMempool(ctx context.Context, difficulty int, miner string) (Block, error) {
+	mutex.Lock()
+	expirePending()
+	if mempool.len() == 0 {
+		mutex.Unlock()
+		return Block{}, errNothingToMine
+	}
+	entries := mempool.take(maxBlockTxs, maxBlockBytes)
+	mutex.Unlock()
+	if len(entries) == 0 {
+		return Block{}, errNothingToMine
+	}
+
+	var fees int64
+	txs := make([]string, len(entries))
+	for i, e := range entries {
+		txs[i] = e.Transaction
+		fees += e.Fee
+	}
+	block, err := addBlock(ctx, txs, difficulty, miner, fees)
+	if err != nil {
+		mutex.Lock()
+		mempool.restore(entries)
+		mutex.Unlock()
+		return Block{}, fmt.Errorf("mining failed: %w", err)
+	}
+	mutex.Lock()
+	if mempool.len() > 0 {
+		// Let the auto-miner pick up what did not fit.
+		notifyMempool()
+	}
+	mutex.Unlock()
+	return block, nil
 }
 
-func enableCORS(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+var (
+	miningMu      sync.Mutex
+	miningSeq     uint64
+	miningCancels = map[uint64]context.CancelFunc{}
+)
+
+// trackMining derives a context for a mining attempt that cancelMining can
+// abort. The returned function must be called once the attempt is over.
+func trackMining(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	miningMu.Lock()
+	miningSeq++
+	id := miningSeq
+	miningCancels[id] = cancel
+	miningMu.Unlock()
+	return ctx, func() {
+		miningMu.Lock()
+		delete(miningCancels, id)
+		miningMu.Unlock()
+		cancel()
+	}
+}
+
+// cancelMining aborts every mining attempt in progress and reports how many
+// there were.
+func cancelMining() int {
+	miningMu.Lock()
+	defer miningMu.Unlock()
+	n := len(miningCancels)
+	for id, cancel := range miningCancels {
+		cancel()
+		delete(miningCancels, id)
+	}
+	return n
 }
 
+// txRequest is the body of POST /tx: a plain-text transaction in data, or
+// a structured one.
+type txRequest struct {
+	Type   string `json:"type"`
+	Data   string `json:"data"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int64  `json:"amount"`
+	Fee    int64  `json:"fee"`
+	Nonce  uint64 `json:"nonce"`
+	Symbol string `json:"symbol"`
+	Supply int64  `json:"supply"`
+	Asset  string `json:"asset"`
+
+	Payload     string `json:"payload"`
+	ContentType string `json:"content_type"`
+
+	PubKeys    []string      `json:"pubkeys"`
+	Threshold  int           `json:"threshold"`
+	Signatures []TxSignature `json:"signatures"`
+
+	ExpiresAt  int64 `json:"expires_at"`
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+// txRequestOverhead is how much bigger than the transaction it describes a
+// txRequest or relayedTx may be: a body carries its own fields, such as
+// ttl_seconds, and may be indented, while the transaction is encoded
+// compactly. The encoded transaction must still fit in maxTxBytes.
+const txRequestOverhead = 1024
+
 func handleAddTx(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	if r.Method == http.MethodOptions {
+	var body txRequest
+	if maxTxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxTxBytes+txRequestOverhead))
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid body, expected {\"data\":\"...\"}", http.StatusBadRequest)
 		return
 	}
-	type req struct {
-		Data string `json:"data"`
+	expiresAt := body.ExpiresAt
+	if body.TTLSeconds > 0 {
+		expiresAt = time.Now().Unix() + body.TTLSeconds
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		http.Error(w, "expires_at is in the past", http.StatusBadRequest)
+		return
 	}
-	var body req
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Data) == "" {
+	raw := body.Data
+	var tx *Transaction
+	if body.From != "" {
+		if body.Type == "" {
+			body.Type = txTypeTransfer
+		}
+		if body.Type == txTypeTokenCreate && body.Supply != 0 {
+			body.Amount = body.Supply
+		}
+		if len(body.PubKeys) == 0 {
+			http.Error(w, "transaction must list the sender's public keys", http.StatusBadRequest)
+			return
+		}
+		tx = &Transaction{
+			Type:   body.Type,
+			From:   body.From,
+			To:     body.To,
+			Amount: body.Amount,
+			Fee:    body.Fee,
+			Nonce:  body.Nonce,
+			Symbol: body.Symbol,
+			Asset:  strings.ToLower(body.Asset),
+			Data:   body.Data,
+
+			Payload:     body.Payload,
+			ContentType: body.ContentType,
+
+			PubKeys:    body.PubKeys,
+			Threshold:  body.Threshold,
+			Signatures: body.Signatures,
+
+			ExpiresAt: expiresAt,
+		}
+		if tx.Threshold == 0 {
+			tx.Threshold = len(tx.PubKeys)
+		}
+		if err := tx.validateFields(); err != nil {
+			http.Error(w, err.Error(), txErrorStatus(err))
+			return
+		}
+		raw = tx.encode()
+	} else if body.Payload != "" {
+		tx = &Transaction{
+			Type:        txTypeData,
+			Data:        body.Data,
+			Payload:     body.Payload,
+			ContentType: body.ContentType,
+		}
+		if err := tx.validateFields(); err != nil {
+			http.Error(w, err.Error(), txErrorStatus(err))
+			return
+		}
+		raw = tx.encode()
+	} else if strings.TrimSpace(body.Data) == "" {
 		http.Error(w, "invalid body, expected {\"data\":\"...\"}", http.StatusBadRequest)
 		return
+	} else if _, ok := parseTransaction(body.Data); ok {
+		http.Error(w, "data must not be an encoded transaction", http.StatusBadRequest)
+		return
+	}
+	if err := validatePayload(body.Data, raw); err != nil {
+		http.Error(w, err.Error(), txErrorStatus(err))
+		return
 	}
+
+	if tx != nil && tx.From != "" {
+		signed, err := tx.checkSigners()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if signed < tx.Threshold {
+			mutex.Lock()
+			err := awaitSignatures(*tx)
+			mutex.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"message":           "transaction awaiting signatures",
+				"id":                tx.id(),
+				"signatures":        signed,
+				"signatures_needed": tx.Threshold,
+			})
+			return
+		}
+	}
+
 	mutex.Lock()
-	pendingTransactions = append(pendingTransactions, body.Data)
+	entry, status, err := admitTransaction(raw, tx, expiresAt)
+	if err != nil {
+		mutex.Unlock()
+		http.Error(w, err.Error(), status)
+		return
+	}
+	pending := mempool.transactions()
 	mutex.Unlock()
+	relayTransaction(entry.Transaction, expiresAt)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":              "transaction added",
-		"pending_transactions": pendingTransactions,
+		"id":                   entry.ID,
+		"pending_transactions": pending,
 	})
 }
 
-func handleMine(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	if r.Method == http.MethodOptions {
+// txErrorStatus maps a transaction validation error to its HTTP status.
+func txErrorStatus(err error) int {
+	if errors.Is(err, errTxTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// admitTransaction runs the mempool admission checks and adds the
+// transaction, returning the HTTP status to report on failure. tx is nil
+// for plain-text transactions; account checks apply when it has a sender.
+// A transaction reusing the nonce of a pending one replaces it if it pays
+// a higher fee. The caller must hold mutex.
+func admitTransaction(raw string, tx *Transaction, expiresAt int64) (*mempoolEntry, int, error) {
+	if err := checkNotConfirmed(txID(raw)); err != nil {
+		return nil, http.StatusConflict, err
+	}
+	if tx != nil && tx.From != "" {
+		replaced := mempool.findNonce(tx.From, tx.Nonce)
+		if replaced != nil {
+			if replaced.ID == tx.id() {
+				return replaced, 0, nil
+			}
+			if tx.Fee <= replaced.Fee {
+				return nil, http.StatusBadRequest, fmt.Errorf("replacement must pay a fee higher than %d", replaced.Fee)
+			}
+		} else if err := checkNonce(*tx); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := checkBalance(*tx, replaced); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := checkTokenRules(*tx, replaced); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := checkStakeRules(*tx, replaced); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if err := checkAssetRules(*tx, replaced); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if replaced != nil {
+			mempool.remove(replaced.ID)
+			publishEvent("tx_replaced", map[string]interface{}{
+				"replaced":    replaced,
+				"replacement": tx.id(),
+			})
+		}
+	}
+	entry, err := mempool.admit(raw, expiresAt)
+	if err != nil {
+		return nil, http.StatusTooManyRequests, err
+	}
+	publishEvent("tx_added", entry)
+	return entry, 0, nil
+}
+
+// submitTransaction checks and admits a transaction handed to one of the
+// RPC interfaces, then relays it, returning the HTTP status that fits a
+// failure. tx must carry every signature it needs already; without it,
+// text is a plain-text transaction. The caller must not hold mutex.
+func submitTransaction(tx *Transaction, text string) (*mempoolEntry, int, error) {
+	raw, data := text, text
+	var expiresAt int64
+	switch {
+	case tx != nil:
+		if tx.Type == "" {
+			tx.Type = txTypeTransfer
+		}
+		tx.Asset = strings.ToLower(tx.Asset)
+		if tx.Type != txTypeData && len(tx.PubKeys) == 0 {
+			return nil, http.StatusBadRequest, errors.New("transaction must list the sender's public keys")
+		}
+		if tx.Threshold == 0 {
+			tx.Threshold = len(tx.PubKeys)
+		}
+		if tx.ExpiresAt != 0 && tx.ExpiresAt <= time.Now().Unix() {
+			return nil, http.StatusBadRequest, errors.New("expires_at is in the past")
+		}
+		if err := tx.validateFields(); err != nil {
+			return nil, txErrorStatus(err), err
+		}
+		raw, data, expiresAt = tx.encode(), tx.Data, tx.ExpiresAt
+		if tx.From != "" {
+			signed, err := tx.checkSigners()
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			if signed < tx.Threshold {
+				return nil, http.StatusPreconditionFailed, fmt.Errorf("%d of %d required signatures; collect the rest with POST /tx/%s/sign", signed, tx.Threshold, tx.id())
+			}
+		}
+	case strings.TrimSpace(text) == "":
+		return nil, http.StatusBadRequest, errors.New("a transaction or text is required")
+	default:
+		if _, ok := parseTransaction(text); ok {
+			return nil, http.StatusBadRequest, errors.New("text must not be an encoded transaction")
+		}
+	}
+	if err := validatePayload(data, raw); err != nil {
+		return nil, txErrorStatus(err), err
+	}
+	mutex.Lock()
+	entry, status, err := admitTransaction(raw, tx, expiresAt)
+	mutex.Unlock()
+	if err != nil {
+		return nil, status, err
+	}
+	relayTransaction(entry.Transaction, expiresAt)
+	return entry, 0, nil
+}
+
+// txStatus is where a transaction stands, as GET /tx/{id} reports it.
+type txStatus struct {
+	ID            string `json:"id"`
+	Transaction   string `json:"transaction"`
+	Status        string `json:"status"`
+	BlockIndex    *int   `json:"block_index,omitempty"`
+	BlockHash     string `json:"block_hash,omitempty"`
+	Confirmations int    `json:"confirmations"`
+}
+
+func handleGetTx(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if b, pos, ok := findConfirmedTx(id); ok {
+		index := b.Index
+		json.NewEncoder(w).Encode(txStatus{
+			ID:            id,
+			Transaction:   b.Transactions[pos],
+			Status:        "confirmed",
+			BlockIndex:    &index,
+			BlockHash:     b.Hash,
+			Confirmations: confirmations(b.Index),
+		})
+		return
+	}
+	if tx, ok := awaitingSignatures[id]; ok {
+		json.NewEncoder(w).Encode(txStatus{
+			ID:          id,
+			Transaction: tx.encode(),
+			Status:      "awaiting_signatures",
+		})
 		return
 	}
-	type req struct {
-		Difficulty int   `json:"difficulty"`
-		TimeoutMs  int64 `json:"timeout_ms"`
+	if e, ok := mempool.get(id); ok {
+		json.NewEncoder(w).Encode(txStatus{
+			ID:          id,
+			Transaction: e.Transaction,
+			Status:      "pending",
+		})
+		return
 	}
-	var body req
-	body.Difficulty = defaultDifficulty
+	http.Error(w, "transaction not found", http.StatusNotFound)
+}
+
+// mineRequest is the body of POST /mine; every field is optional.
+type mineRequest struct {
+	Difficulty int    `json:"difficulty"`
+	TimeoutMs  int64  `json:"timeout_ms"`
+	Miner      string `json:"miner"`
+	Async      bool   `json:"async"`
+}
+
+func handleMine(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		handleCancelMine(w, r)
+		return
+	}
+	var body mineRequest
 	body.TimeoutMs = 0
 	_ = json.NewDecoder(r.Body).Decode(&body)
+	body.Miner = strings.TrimSpace(body.Miner)
+	if body.Miner != "" {
+		if err := validateAddress(body.Miner); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	mutex.Lock()
-	if len(pendingTransactions) == 0 {
-		mutex.Unlock()
-		http.Error(w, "no pending transactions to mine", http.StatusBadRequest)
+	if body.Async || r.URL.Query().Get("async") == "true" {
+		job := startMiningJob(body.Difficulty, body.Miner)
+		w.WriteHeader(http.StatusAccepted)
+		jobsMutex.Lock()
+		json.NewEncoder(w).Encode(job.report())
+		jobsMutex.Unlock()
 		return
 	}
-	txs := make([]string, len(pendingTransactions))
-	copy(txs, pendingTransactions)
-	pendingTransactions = []string{}
-	mutex.Unlock()
 
-	block, err := addBlock(txs, body.Difficulty)
+	// A client that disconnects cancels its mining attempt.
+	ctx, done := trackMining(r.Context())
+	defer done()
+	block, err := mineFromMempool(ctx, body.Difficulty, body.Miner)
+	if errors.Is(err, errNothingToMine) || errors.Is(err, errDifficultyTooLow) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errNotAuthority) || errors.Is(err, errNotProposer) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(w, "mining failed: "+err.Error(), http.StatusInternalServerError)
-		mutex.Lock()
-		pendingTransactions = append(pendingTransactions, txs...)
-		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	json.NewEncoder(w).Encode(block)
 }
 
-func handleGetBlocks(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	if r.Method == http.MethodOptions {
+// maxBulkBlocks caps how many blocks one POST /mine/bulk may mine.
+const maxBulkBlocks = 100
+
+// bulkMineRequest is the body of POST /mine/bulk.
+type bulkMineRequest struct {
+	Count      int    `json:"count"`
+	Difficulty int    `json:"difficulty"`
+	Miner      string `json:"miner"`
+}
+
+// handleBulkMine serves POST /mine/bulk {count, difficulty, miner}: it mines
+// count consecutive blocks, taking pending transactions while there are
+// any and mining empty blocks after that.
+func handleBulkMine(w http.ResponseWriter, r *http.Request) {
+	var body bulkMineRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body, expected {\"count\":N}", http.StatusBadRequest)
 		return
 	}
+	if body.Count < 1 || body.Count > maxBulkBlocks {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxBulkBlocks), http.StatusBadRequest)
+		return
+	}
+	body.Miner = strings.TrimSpace(body.Miner)
+	if body.Miner != "" {
+		if err := validateAddress(body.Miner); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, done := trackMining(r.Context())
+	defer done()
+	blocks := []Block{}
+	var err error
+	for len(blocks) < body.Count {
+		var b Block
+		b, err = mineFromMempool(ctx, body.Difficulty, body.Miner)
+		if errors.Is(err, errNothingToMine) {
+			b, err = addBlock(ctx, []string{}, body.Difficulty, body.Miner, 0)
+		}
+		if err != nil {
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	if err != nil && len(blocks) == 0 {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := map[string]interface{}{
+		"mined":  len(blocks),
+		"blocks": blocks,
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleCancelMine serves DELETE /mine, aborting mining in progress. The
+// transactions of an aborted block go back to the mempool.
+func handleCancelMine(w http.ResponseWriter, r *http.Request) {
+	n := cancelMining()
+	if n == 0 {
+		http.Error(w, "no mining in progress", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "mining canceled",
+		"canceled": n,
+	})
+}
+
+// handleTxReceipt reports where a mined transaction was included. The
+// confirmation count is recomputed from the current tip on every request.
+func handleTxReceipt(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
 	mutex.Lock()
 	defer mutex.Unlock()
-	json.NewEncoder(w).Encode(blockchain)
+	b, pos, ok := findConfirmedTx(id)
+	if !ok {
+		if _, pending := mempool.get(id); pending {
+			http.Error(w, "transaction not yet mined", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            id,
+		"block_hash":    b.Hash,
+		"block_index":   b.Index,
+		"position":      pos,
+		"confirmations": confirmations(b.Index),
+		"chain_height":  len(blockchain) - 1,
+	})
 }
 
-func handleGetPending(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	if r.Method == http.MethodOptions {
+// handleTxData serves a transaction's binary payload with its declared
+// content type. Plain-text transactions are served as text. Anyone can
+// submit a payload, so it is served as a download the browser may not
+// sniff: a payload declared as HTML never runs as a page of this origin.
+func handleTxData(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	mutex.Lock()
+	raw := ""
+	if b, pos, ok := findConfirmedTx(id); ok {
+		raw = b.Transactions[pos]
+	} else if e, ok := mempool.get(id); ok {
+		raw = e.Transaction
+	}
+	mutex.Unlock()
+	if raw == "" {
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	tx, structured := parseTransaction(raw)
+	if !structured {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, raw)
+		return
+	}
+	if tx.Payload == "" {
+		http.Error(w, "transaction has no payload", http.StatusNotFound)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(tx.Payload)
+	if err != nil {
+		http.Error(w, "stored payload is corrupt", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", tx.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", txID(raw)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// handleGetBlocks serves GET /blocks[?from=N][&to=M], the whole chain or
+// the blocks from height N to M inclusive, or a page of the chain with
+// limit, offset or since_hash. X-Total-Count carries the chain length.
+func handleGetBlocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		handleReceiveBlock(w, r)
 		return
 	}
+	q := r.URL.Query()
 	mutex.Lock()
 	defer mutex.Unlock()
-	json.NewEncoder(w).Encode(pendingTransactions)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(blockchain)))
+	if q.Get("limit") != "" || q.Get("offset") != "" || q.Get("since_hash") != "" {
+		writeBlockPage(w, r)
+		return
+	}
+	if q.Get("from") == "" && q.Get("to") == "" {
+		if prunedRange(0, len(blockchain)-1) {
+			http.Error(w, errPruned.Error(), http.StatusGone)
+			return
+		}
+		writeBlocks(w, r, blockchain)
+		return
+	}
+	blocks, err := heightRange(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(blocks) > 0 && prunedRange(blocks[0].Index, blocks[len(blocks)-1].Index) {
+		http.Error(w, errPruned.Error(), http.StatusGone)
+		return
+	}
+	writeBlocks(w, r, blocks)
 }
 
-func handleSearch(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	if r.Method == http.MethodOptions {
+// blockPage is one page of the chain, oldest block first.
+type blockPage struct {
+	Total  int     `json:"total"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+	Blocks []Block `json:"blocks"`
+}
+
+// writeBlockPage answers GET /blocks?limit=&offset=, where offset counts
+// from genesis, and GET /blocks?since_hash=, the blocks after the one with
+// that hash, which a client that has seen the chain up to it polls for new
+// blocks. A since_hash the chain no longer holds, say after a reorg, is
+// not found and the client must start over. The caller must hold mutex.
+func writeBlockPage(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	if since := r.URL.Query().Get("since_hash"); since != "" {
+		b, ok := blockByHash(strings.ToLower(since))
+		if !ok {
+			http.Error(w, "since_hash is not a block in the chain", http.StatusNotFound)
+			return
+		}
+		offset += b.Index + 1
+	}
+	total := len(blockchain)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	if offset < end && prunedRange(offset, end-1) {
+		http.Error(w, errPruned.Error(), http.StatusGone)
 		return
 	}
+	json.NewEncoder(w).Encode(blockPage{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Blocks: append([]Block{}, blockchain[offset:end]...),
+	})
+}
+
+// handleBlockPath serves the operations on one block. Verifying is routed
+// as /blocks/{index}/{check}, because /blocks/{index}/verify would clash
+// with /blocks/hash/{hash} over /blocks/hash/verify.
+func handleBlockPath(w http.ResponseWriter, r *http.Request) {
+	switch r.PathValue("check") {
+	case "":
+		handleGetBlock(w, r)
+	case "verify":
+		handleVerifyBlock(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// blockByHash returns the block with the given hash, looking back from the
+// tip. The caller must hold mutex.
+func blockByHash(hash string) (Block, bool) {
+	for i := len(blockchain) - 1; i >= 0; i-- {
+		if blockchain[i].Hash == hash {
+			return blockchain[i], true
+		}
+	}
+	return Block{}, false
+}
+
+// handleGetBlock serves GET /blocks/{index} and GET /blocks/hash/{hash},
+// one block in the encoding the request accepts.
+func handleGetBlock(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	var b Block
+	var ok bool
+	if hash := r.PathValue("hash"); hash != "" {
+		b, ok = blockByHash(strings.ToLower(hash))
+	} else if index, err := strconv.Atoi(r.PathValue("index")); err == nil && index >= 0 && index < len(blockchain) {
+		b, ok = blockchain[index], true
+	}
+	mutex.Unlock()
+	if !ok {
+		http.Error(w, "block not found", http.StatusNotFound)
+		return
+	}
+	writeBlock(w, r, b)
+}
+
+// handleLatestBlock serves GET /blocks/latest, the tip, for clients that
+// poll it rather than download the whole chain.
+func handleLatestBlock(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	b := getLastBlock()
+	mutex.Unlock()
+	writeBlock(w, r, b)
+}
+
+// handleHeight serves GET /height: the height and hash of the tip, the
+// cheapest way to tell whether the chain has moved.
+func handleHeight(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	b := getLastBlock()
+	mutex.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"height": b.Index, "hash": b.Hash})
+}
+
+// writeBlock sends b in the encoding the request accepts.
+func writeBlock(w http.ResponseWriter, r *http.Request, b Block) {
+	if r.Header.Get("Accept") == blockContentType {
+		w.Header().Set("Content-Type", blockContentType)
+		w.Write(encodeBlock(b))
+		return
+	}
+	json.NewEncoder(w).Encode(b)
+}
+
+// heightRange returns the blocks selected by the from and to query
+// parameters, both inclusive and defaulting to the whole chain. A range
+// starting past the tip is empty. The caller must hold mutex.
+func heightRange(q url.Values) ([]Block, error) {
+	from, to := 0, len(blockchain)-1
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil || from < 0 {
+			return nil, errors.New("invalid from")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil || to < from {
+			return nil, errors.New("invalid to, must be at least from")
+		}
+	}
+	if to > len(blockchain)-1 {
+		to = len(blockchain) - 1
+	}
+	if from > to {
+		return []Block{}, nil
+	}
+	return blockchain[from : to+1], nil
+}
+
+func handleGetPending(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if r.URL.Query().Get("verbose") == "true" {
+		json.NewEncoder(w).Encode(mempool.ordered())
+		return
+	}
+	json.NewEncoder(w).Encode(mempool.transactions())
+}
+
+func handleRecentEvents(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	json.NewEncoder(w).Encode(eventsSince(since))
+}
+
+// searchMatch is a transaction GET /search found.
+type searchMatch struct {
+	BlockIndex  int    `json:"block_index"`
+	Transaction string `json:"transaction"`
+	Hash        string `json:"block_hash"`
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query().Get("q")
 	if strings.TrimSpace(q) == "" {
 		http.Error(w, "query param q required", http.StatusBadRequest)
 		return
 	}
-	type match struct {
-		BlockIndex  int    `json:"block_index"`
-		Transaction string `json:"transaction"`
-		Hash        string `json:"block_hash"`
-	}
-	var results []match
+	// Addresses match transactions that send to or from them exactly rather
+	// than by substring.
+	isAddress := validateAddress(q) == nil
+	var results []searchMatch
 	mutex.Lock()
 	for _, b := range blockchain {
 		for _, tx := range b.Transactions {
-			if strings.Contains(strings.ToLower(tx), strings.ToLower(q)) {
-				results = append(results, match{
+			var hit bool
+			if isAddress {
+				parsed, ok := parseTransaction(tx)
+				hit = ok && (parsed.From == q || parsed.To == q)
+			} else {
+				hit = strings.Contains(strings.ToLower(tx), strings.ToLower(q))
+			}
+			if hit {
+				results = append(results, searchMatch{
 					BlockIndex:  b.Index,
 					Transaction: tx,
 					Hash:        b.Hash,
@@ -278,34 +1362,314 @@ func handleSearch(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleInfo(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
+	mutex.Lock()
 	info := map[string]interface{}{
-		"name":   BlockchainName,
-		"height": len(blockchain) - 1,
+		"name":       BlockchainName,
+		"height":     len(blockchain) - 1,
+		"consensus":  chainConsensus,
+		"chain_work": chainWork(blockchain).Text(16),
 	}
+	if chainConsensus != consensusPoW {
+		info["authorities"] = chainAuthorities
+	} else {
+		target := requiredTarget(len(blockchain))
+		info["difficulty"] = difficultyOf(target)
+		info["bits"] = fmt.Sprintf("%08x", targetToCompact(target))
+		info["target_block_time"] = targetBlockTime.Seconds()
+		info["retarget_interval"] = retargetInterval
+		info["pow_algorithm"] = chainHasher.Name()
+	}
+	mutex.Unlock()
 	json.NewEncoder(w).Encode(info)
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
-	enableCORS(w)
-	fmt.Fprintf(w, "%s API\nAvailable endpoints:\n/info\n/tx\n/mine\n/blocks\n/pending\n/search?q=...\n", BlockchainName)
+	fmt.Fprintf(w, "%s API\nAvailable endpoints, under /v1 (the same paths without /v1 are deprecated aliases):\n/info\n/tx\n/tx/{id}\n/tx/{id}/sign\n/tx/{id}/receipt\n/tx/{id}/data\n/proof/{id}\n/proof?block=N&index=I\n/proof/verify (POST {transaction, path, merkle_root})\n/mine[?async=true] (POST, DELETE to cancel)\n/mine/jobs/{id}\n/mine/bulk\n/mine/work[?miner=]\n/mine/submit\n/mine/template?max_txs=N\n/miner/start\n/miner/stop\n/miner/status\n/miner/benchmark\n/miner/stats\n/blocks[?from=N&to=M | ?limit=&offset= | ?since_hash=] (POST to announce a block)\n/blocks/compact (POST, header and transaction ids)\n/blocks/stream[?from=N&to=M] (newline-delimited JSON)\n/blocks/latest\n/blocks/{index}\n/blocks/hash/{hash}\n/blocks/{index}/verify\n/peers (GET, POST, DELETE ?url=)\n/peers/tx (POST, relayed transactions)\n/peers/ws (WebSocket peer link)\n/peers/bans (GET, POST ?host=&reason=, DELETE ?host=)\n/resolve\n/orphans\n/headers?from=N&to=M\n/handshake\n/height\n/healthz\n/readyz\n/stats\n/stats/timeseries[?hours=N&days=M]\n/snapshot\n/validate[?download=true]\n/pending[?verbose=true]\n/fees/estimate\n/pending/{id} (DELETE)\n/search?q=...\n/graphql (POST {query, variables}; GET for the schema)\n/rpc (POST, JSON-RPC 2.0, batches allowed)\n/balance/{address}[?height=N]\n/address/{address}/history?limit=&offset=\n/tokens/{symbol}\n/assets/{id}\n/tokens/{symbol}/balance/{address}[?height=N]\n/wallet/new[?hd=true]\n/wallet/derive\n/events/recent?since=...\n/ws[?since=ID&types=block_added,...] (WebSocket event stream)\n/events[?since=ID&types=...] (Server-Sent Events, resumes from Last-Event-ID)\n/export/transactions.csv[?from=N&to=M]\n/validators\n/supply\n/openapi.json\n/docs\n/admin/keys (GET, POST {name, role}, DELETE ?name=; admin only)\n/admin/tokens (POST {subject, role, ttl_seconds}; admin only)\n", BlockchainName)
 }
 
 func main() {
+	addr := ":8080"
+	flag.Int64Var(&blockReward, "reward", blockReward, "coins paid to the miner of each block before any halving")
+	flag.IntVar(&halvingInterval, "halving-interval", halvingInterval, "blocks between block reward halvings (0 = never)")
+	flag.IntVar(&miningWorkers, "mining-workers", miningWorkers, "goroutines used to search for a nonce")
+	flag.BoolVar(&devMode, "dev", devMode, "dev mode: allow blocks easier than -min-difficulty")
+	flag.IntVar(&minDifficulty, "min-difficulty", minDifficulty, "fewest leading zero hex digits a block may have outside dev mode")
+	flag.IntVar(&minDifficultyHeight, "min-difficulty-height", minDifficultyHeight, "height from which -min-difficulty applies; all nodes of a chain must agree on it")
+	flag.BoolVar(&deterministicMining, "deterministic", deterministicMining, "reproducible chains for tests: no genesis work, fixed block spacing, single-threaded nonce search")
+	flag.IntVar(&miningCPUPercent, "mining-cpu", miningCPUPercent, "approximate share of each worker's core to use while mining, in percent")
+	flag.IntVar(&miningHashRate, "mining-hashrate", miningHashRate, "maximum hashes per second across all workers (0 = unlimited)")
+	flag.DurationVar(&autoMineInterval, "auto-mine", autoMineInterval, "mine a block from the mempool every interval (0 = off)")
+	flag.BoolVar(&autoMineEmpty, "auto-mine-empty", autoMineEmpty, "with -auto-mine, also mine empty blocks when nothing is pending")
+	flag.IntVar(&retargetInterval, "retarget-interval", retargetInterval, "blocks between difficulty adjustments")
+	flag.DurationVar(&targetBlockTime, "target-block-time", targetBlockTime, "block time difficulty adjustment aims for")
+	flag.IntVar(&maxBlockTxs, "max-block-txs", maxBlockTxs, "maximum pending transactions per block (0 = unlimited)")
+	flag.IntVar(&maxBlockBytes, "max-block-bytes", maxBlockBytes, "maximum encoded transaction bytes per block (0 = unlimited)")
+	flag.IntVar(&mempoolMaxSize, "mempool-max", mempoolMaxSize, "maximum number of pending transactions (0 = unlimited)")
+	flag.DurationVar(&mempoolSweepInterval, "mempool-sweep", mempoolSweepInterval, "how often expired pending transactions are dropped")
+	flag.IntVar(&maxAwaitingSignatures, "multisig-max", maxAwaitingSignatures, "maximum number of transactions awaiting signatures (0 = unlimited)")
+	flag.DurationVar(&awaitingSignaturesTTL, "multisig-ttl", awaitingSignaturesTTL, "how long a transaction may wait for signatures")
+	flag.StringVar(&mempoolEvictPolicy, "mempool-evict", mempoolEvictPolicy, "eviction policy when the mempool is full: fee, oldest or none")
+	flag.IntVar(&maxTxBytes, "max-tx-bytes", maxTxBytes, "maximum encoded transaction size in bytes (0 = unlimited)")
+	flag.IntVar(&maxPayloadBytes, "max-payload-bytes", maxPayloadBytes, "maximum decoded binary payload size in bytes (0 = unlimited)")
+	flag.StringVar(&powAlgorithm, "pow-hash", powAlgorithm, "proof-of-work hash for a new chain: sha256, sha256d or blake2b")
+	flag.StringVar(&newChainID, "chain-id", newChainID, "chain id for a new chain (default: the network id)")
+	flag.StringVar(&newChainConsensus, "consensus", newChainConsensus, "consensus for a new chain: pow, poa or pos")
+	authorities := flag.String("authorities", "", "comma-separated authority public keys for a new poa chain, or bootstrap validators for pos")
+	authoritySeed := flag.String("authority-key", "", "hex ed25519 seed this node signs poa or pos blocks with")
+	flag.StringVar(&addr, "addr", addr, "address the HTTP API listens on")
+	flag.StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "PEM certificate (chain) file to serve the HTTP API over HTTPS with; reloaded when it changes")
+	flag.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "PEM private key file for -tls-cert")
+	domainList := flag.String("acme-domains", "", "comma-separated domains to get a certificate for from -acme-directory and serve HTTPS with; the CA checks them on port 443")
+	flag.StringVar(&acmeEmail, "acme-email", acmeEmail, "contact address for the ACME account, where the CA sends expiry notices")
+	flag.StringVar(&acmeCacheDir, "acme-cache", acmeCacheDir, "directory the ACME account key and certificate are kept in")
+	flag.StringVar(&acmeDirectory, "acme-directory", acmeDirectory, "ACME directory URL, such as Let's Encrypt staging for testing")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long in-flight requests may run after SIGINT or SIGTERM before the node saves its state and exits")
+	flag.BoolVar(&accessLog, "access-log", accessLog, "log every API request with its request ID, status and latency")
+	flag.BoolVar(&gzipResponses, "gzip", gzipResponses, "gzip JSON and other text answers for clients that accept it")
+	corsOrigins := flag.String("cors-origins", "*", "comma-separated origins browsers may call the API from, * for any; empty turns CORS off")
+	flag.StringVar(&cors.methods, "cors-methods", cors.methods, "methods allowed in CORS requests")
+	flag.StringVar(&cors.headers, "cors-headers", cors.headers, "request headers allowed in CORS requests")
+	flag.BoolVar(&cors.credentials, "cors-credentials", cors.credentials, "let browsers send cookies and HTTP auth with CORS requests; needs -cors-origins to list origins")
+	flag.StringVar(&adminAddr, "admin-addr", adminAddr, "address of a separate listener for the admin-role operations, such as 127.0.0.1:8090; they then leave the public API")
+	flag.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "address the gRPC API (mesam.proto) listens on; empty disables it")
+	apiKeyPath := flag.String("api-keys", "", "JSON file of {name, key, role} API keys; /admin/keys changes are saved to it")
+	flag.StringVar(&adminKey, "admin-key", adminKey, "API key with the admin role, which may call every endpoint and manage keys and tokens")
+	flag.StringVar(&jwtSecret, "jwt-secret", jwtSecret, "HS256 secret bearer tokens are signed with; enables tokens and POST /admin/tokens")
+	flag.BoolVar(&authReads, "auth-reads", authReads, "require the reader role for reads too, except the endpoints peers sync from")
+	flag.Float64Var(&requestLimiter.rate, "rate-limit", requestLimiter.rate, "API requests per second each client IP may make (0 = unlimited)")
+	flag.Float64Var(&requestLimiter.burst, "rate-burst", requestLimiter.burst, "API requests a client IP may make at once before -rate-limit applies")
+	flag.Float64Var(&txLimiter.rate, "tx-rate", txLimiter.rate, "transaction submissions per second each client IP may make (0 = unlimited)")
+	flag.Float64Var(&txLimiter.burst, "tx-burst", txLimiter.burst, "transaction submissions a client IP may make at once before -tx-rate applies")
+	flag.Float64Var(&mineLimiter.rate, "mine-rate", mineLimiter.rate, "mining requests per second each client IP may make (0 = unlimited)")
+	flag.Float64Var(&mineLimiter.burst, "mine-burst", mineLimiter.burst, "mining requests a client IP may make at once before -mine-rate applies")
+	flag.Float64Var(&relayLimiter.rate, "relay-rate", relayLimiter.rate, "transactions per second each peer may relay (0 = unlimited)")
+	flag.Float64Var(&relayLimiter.burst, "relay-burst", relayLimiter.burst, "transactions a peer may relay at once before -relay-rate applies")
+	flag.DurationVar(&peerCheckInterval, "peer-check-interval", peerCheckInterval, "how often peers are health checked (0 = never)")
+	flag.IntVar(&peerMaxFailures, "peer-max-failures", peerMaxFailures, "consecutive failed health checks before a peer is dropped (0 = never drop)")
+	flag.DurationVar(&peerExchangeInterval, "peer-exchange-interval", peerExchangeInterval, "how often peers are asked for their peers (0 = never)")
+	flag.IntVar(&peerExchangeTarget, "peer-exchange-target", peerExchangeTarget, "how many peers to look for through peer exchange")
+	flag.StringVar(&networkID, "network-id", networkID, "network this node joins; peers must use the same id")
+	flag.StringVar(&syncMode, "sync-mode", syncMode, "how to catch up with peers: blocks, or headers to fetch headers first and bodies in parallel")
+	flag.DurationVar(&maxFutureBlockTime, "max-future-block-time", maxFutureBlockTime, "how far ahead of this node's clock a block timestamp may be")
+	flag.DurationVar(&banDuration, "ban-duration", banDuration, "how long a misbehaving peer host stays banned")
+	checkpointList := flag.String("checkpoints", "", "comma-separated height:hash pairs the chain must contain")
+	discover := flag.Bool("mdns", false, "find peers on the local network with multicast DNS")
+	seedMode := flag.Bool("seed", false, "run as a seed node that only keeps a list of nodes for others to find")
+	flag.DurationVar(&seedEntryTTL, "seed-ttl", seedEntryTTL, "how long a seed node keeps a node that has not been seen (0 = until health checks drop it)")
+	spvMode := flag.Bool("spv", false, "run as an SPV node that keeps only headers and checks transactions with merkle proofs from -peers")
+	seeds := flag.String("seeds", "", "comma-separated seed node URLs to register with and find peers through")
+	publicURL := flag.String("public-url", "", "URL other nodes reach this node's API at, announced to seed nodes (default: this host at the -addr port)")
+	snapshotPeer := flag.String("snapshot-from", "", "trusted peer URL a new node fast-syncs from, taking its state snapshot instead of replaying the chain")
+	bootstrap := flag.String("peers", "", "comma-separated peer URLs to connect to and sync with at startup")
+	auditPath := flag.String("audit", "", "write a JSON audit report of the stored chain to this file (- for stdout) and exit, non-zero if it breaks a rule")
+	genesisPath := flag.String("genesis", "", "JSON file describing the genesis block of a new chain; a stored chain must start with it")
+	schemaPath := flag.String("tx-schema", "", "JSON schema file that transaction data must satisfy")
+	flag.Parse()
+	cors.setOrigins(*corsOrigins)
+	if err := cors.check(); err != nil {
+		log.Fatal(err)
+	}
+	if *seedMode {
+		log.Fatal(runSeedNode(addr))
+	}
+	switch mempoolEvictPolicy {
+	case evictLowestFee, evictOldest, evictNone:
+	default:
+		log.Fatal("unknown mempool eviction policy: ", mempoolEvictPolicy)
+	}
+	if deterministicMining {
+		devMode = true
+	}
+	if minDifficulty < 1 || minDifficulty > 64 {
+		log.Fatal("min difficulty must be 1 to 64 leading zero hex digits")
+	}
+	if minDifficultyHeight < 0 {
+		log.Fatal("min difficulty height must not be negative")
+	}
+	for _, d := range strings.Split(*domainList, ",") {
+		if d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), "."); d != "" {
+			acmeDomains = append(acmeDomains, d)
+		}
+	}
+	if err := checkTLSFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if tlsEnabled() && *discover {
+		log.Fatal("-mdns announces a plain HTTP port, so it cannot be used with HTTPS")
+	}
+	if tlsEnabled() && *seeds != "" && *publicURL == "" {
+		log.Fatal("with HTTPS, set -public-url to the https:// URL to announce to seed nodes")
+	}
+	if *apiKeyPath != "" {
+		if err := apiKeys.load(*apiKeyPath); err != nil {
+			log.Fatal("Failed to load API keys: ", err)
+		}
+	}
+	if err := checkAdminAddr(); err != nil {
+		log.Fatal(err)
+	}
+	for _, l := range []*rateLimiter{requestLimiter, txLimiter, mineLimiter, relayLimiter} {
+		if l.rate < 0 || l.burst < 0 {
+			log.Fatal("rate limits must not be negative")
+		}
+	}
+	if syncMode != syncModeBlocks && syncMode != syncModeHeaders {
+		log.Fatal("unknown sync mode: ", syncMode)
+	}
+	if newChainID != "" {
+		if err := checkChainID(newChainID); err != nil {
+			log.Fatal(err)
+		}
+	}
+	parsed, err := parseCheckpoints(*checkpointList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	checkpoints = parsed
+	if *spvMode {
+		log.Fatal(runSPVNode(addr, strings.Split(*bootstrap, ",")))
+	}
+	if *schemaPath != "" {
+		schema, err := loadSchema(*schemaPath)
+		if err != nil {
+			log.Fatal("Failed to load transaction schema:", err)
+		}
+		txDataSchema = schema
+	}
+
+	if *authorities != "" {
+		newChainAuthorities = strings.Split(*authorities, ",")
+	}
+	if *authoritySeed != "" {
+		seed, err := hex.DecodeString(*authoritySeed)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatal("authority key must be a hex ed25519 seed")
+		}
+		authorityKey = ed25519.NewKeyFromSeed(seed)
+	}
+
+	if *genesisPath != "" {
+		cfg, err := loadGenesisConfig(*genesisPath)
+		if err != nil {
+			log.Fatal("Failed to load genesis config: ", err)
+		}
+		h, err := hasherFor(powAlgorithm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chainHasher = h
+		gen, err := genesisFromConfig(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("configured genesis %s", gen.Hash)
+		configuredGenesis = &gen
+	}
 	if err := loadBlockchain(); err != nil {
 		log.Fatal("Failed to load blockchain:", err)
 	}
+	genesisHash = blockchain[0].Hash
+	if configuredGenesis != nil && genesisHash != configuredGenesis.Hash {
+		log.Fatalf("%s holds genesis %s, but the configured genesis is %s: %v", blockchainFile, genesisHash, configuredGenesis.Hash, errGenesisMismatch)
+	}
+	if *auditPath != "" {
+		if err := writeAuditReport(*auditPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := checkChainCheckpoints(blockchain); err != nil {
+		log.Fatal("Loaded blockchain does not match checkpoints: ", err)
+	}
 	fmt.Println(BlockchainName, "loaded. Current height:", len(blockchain)-1)
+	mutex.Lock()
+	kept, dropped, err := loadMempool()
+	mutex.Unlock()
+	if err != nil {
+		log.Fatal("Failed to load mempool: ", err)
+	}
+	if kept+dropped > 0 {
+		log.Printf("restored %d pending transactions from %s, dropped %d no longer valid", kept, mempoolFile, dropped)
+	}
+	go runMempoolJanitor(mempoolSweepInterval)
+	go runHashRateSampler()
+	go runBroadcaster()
+	go runTxRelay()
+	if peerCheckInterval > 0 {
+		go runPeerHealthChecks(peerCheckInterval)
+	}
+	if peerExchangeInterval > 0 {
+		go runPeerExchange(peerExchangeInterval)
+	}
+	if *snapshotPeer != "" && len(blockchain) == 1 {
+		u, err := normalizePeerURL(*snapshotPeer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := fastSync(u); err != nil {
+				log.Printf("fast sync from %s: %v", u, err)
+			}
+		}()
+	}
+	if *bootstrap != "" {
+		go bootstrapPeers(strings.Split(*bootstrap, ","))
+	}
+	if *seeds != "" {
+		if *publicURL != "" {
+			if _, err := normalizePeerURL(*publicURL); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go joinViaSeeds(strings.Split(*seeds, ","), *publicURL, addr)
+	}
+	if *discover {
+		go func() {
+			if err := runMDNS(addr); err != nil {
+				log.Printf("mdns discovery stopped: %v", err)
+			}
+		}()
+	}
+	if autoMineInterval > 0 {
+		backgroundMiner.start("", 0, autoMineInterval, autoMineEmpty)
+	}
 
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/info", handleInfo)
-	http.HandleFunc("/tx", handleAddTx)
-	http.HandleFunc("/mine", handleMine)
-	http.HandleFunc("/blocks", handleGetBlocks)
-	http.HandleFunc("/pending", handleGetPending)
-	http.HandleFunc("/search", handleSearch)
+	registerRoutes()
 
-	addr := ":8080"
-	fmt.Printf("Listening on %s\n", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	srv := &http.Server{Addr: addr, Handler: withRequestLog(withCORS(withGzip(http.DefaultServeMux))), BaseContext: serverContext}
+	servers := []*http.Server{srv}
+	if grpcAddr != "" {
+		grpcSrv := newGRPCServer(grpcAddr)
+		servers = append(servers, grpcSrv)
+		go func() {
+			log.Printf("gRPC API listening on %s", grpcAddr)
+			if err := grpcSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if adminAddr != "" {
+		adminSrv := newAdminServer()
+		servers = append(servers, adminSrv)
+		go func() {
+			log.Printf("admin API listening on %s", adminAddr)
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		awaitShutdown(servers...)
+		close(stopped)
+	}()
+	if tlsEnabled() {
+		fmt.Printf("Listening on %s (HTTPS)\n", addr)
+	} else {
+		fmt.Printf("Listening on %s\n", addr)
+	}
+	if err := serveHTTP(srv); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nodes find each other on the local network with multicast DNS (RFC 6762)
+// service discovery: each node answers queries for mdnsService with a
+// record pointing at its own instance, whose SRV record carries the API
+// port and whose TXT record carries the network ID and genesis hash.
+const (
+	mdnsService = "_mesam._tcp.local."
+	// mdnsQueryInterval is how often a node asks for other nodes, so that
+	// nodes started later are found too.
+	mdnsQueryInterval = 30 * time.Second
+	mdnsTTL           = 120
+
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+	// dnsCacheFlush marks a record as the only one of its name and type.
+	dnsCacheFlush = 0x8000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type dnsRecord struct {
+	name string
+	typ  uint16
+	data []byte
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes the possibly compressed name at off in msg and returns
+// it along with the offset just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("dns name out of bounds")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("bad dns name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("dns label out of bounds")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parseDNS returns the question names and the resource records of msg,
+// answers and additional records alike.
+func parseDNS(msg []byte) (response bool, questions []string, records []dnsRecord, err error) {
+	if len(msg) < 12 {
+		return false, nil, nil, errors.New("short dns message")
+	}
+	response = msg[2]&0x80 != 0
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return false, nil, nil, errors.New("bad dns question")
+		}
+		if binary.BigEndian.Uint16(msg[next:]) == dnsTypePTR {
+			questions = append(questions, strings.ToLower(name))
+		}
+		off = next + 4
+	}
+	for i := 0; i < rr; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return false, nil, nil, errors.New("bad dns record")
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		n := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+n > len(msg) {
+			return false, nil, nil, errors.New("dns record out of bounds")
+		}
+		records = append(records, dnsRecord{strings.ToLower(name), typ, msg[start : start+n]})
+		off = start + n
+	}
+	return response, questions, records, nil
+}
+
+func appendRecord(b []byte, name string, typ, class uint16, data []byte) []byte {
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, mdnsTTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// mdnsQuery asks for every node on the local network.
+func mdnsQuery() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = appendName(b, mdnsService)
+	b = binary.BigEndian.AppendUint16(b, dnsTypePTR)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN)
+}
+
+// mdnsAnswer announces this node as instance, with its API on port.
+func mdnsAnswer(instance string, port int) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[2:], 0x8400)
+	binary.BigEndian.PutUint16(b[6:], 3)
+	b = appendRecord(b, mdnsService, dnsTypePTR, dnsClassIN, appendName(nil, instance))
+
+	srv := binary.BigEndian.AppendUint16(make([]byte, 4), uint16(port))
+	srv = appendName(srv, strings.TrimSuffix(instance, mdnsService)+"local.")
+	b = appendRecord(b, instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, srv)
+
+	var txt []byte
+	for _, kv := range []string{"network=" + networkID, "genesis=" + genesisHash} {
+		txt = append(txt, byte(len(kv)))
+		txt = append(txt, kv...)
+	}
+	return appendRecord(b, instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, txt)
+}
+
+// mdnsNode is another node described by an answer.
+type mdnsNode struct {
+	port int
+	txt  map[string]string
+}
+
+// mdnsNodes collects the nodes an answer describes, keyed by instance name.
+func mdnsNodes(records []dnsRecord) map[string]*mdnsNode {
+	nodes := map[string]*mdnsNode{}
+	node := func(name string) *mdnsNode {
+		if nodes[name] == nil {
+			nodes[name] = &mdnsNode{txt: map[string]string{}}
+		}
+		return nodes[name]
+	}
+	for _, r := range records {
+		if !strings.HasSuffix(r.name, "."+mdnsService) {
+			continue
+		}
+		switch r.typ {
+		case dnsTypeSRV:
+			if len(r.data) >= 6 {
+				node(r.name).port = int(binary.BigEndian.Uint16(r.data[4:]))
+			}
+		case dnsTypeTXT:
+			n := node(r.name)
+			for d := r.data; len(d) > 0 && int(d[0]) < len(d); d = d[1+d[0]:] {
+				if k, v, ok := strings.Cut(string(d[1:1+d[0]]), "="); ok {
+					n.txt[k] = v
+				}
+			}
+		}
+	}
+	return nodes
+}
+
+// runMDNS answers discovery queries for this node, whose API listens on
+// addr, and adds the nodes on the same chain that it hears about as peers.
+func runMDNS(addr string) error {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return fmt.Errorf("mdns: cannot advertise port %q", p)
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	instance := strings.ToLower("mesam-"+hex.EncodeToString(id)) + "." + mdnsService
+
+	listener, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	answer := mdnsAnswer(instance, port)
+	sender.WriteTo(answer, mdnsGroup)
+	go func() {
+		for {
+			sender.WriteTo(mdnsQuery(), mdnsGroup)
+			time.Sleep(mdnsQueryInterval)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		response, questions, records, err := parseDNS(buf[:n])
+		if err != nil {
+			continue
+		}
+		if !response {
+			for _, q := range questions {
+				if q == mdnsService {
+					sender.WriteTo(answer, mdnsGroup)
+					break
+				}
+			}
+			continue
+		}
+		for name, node := range mdnsNodes(records) {
+			if name == instance || node.port == 0 || node.txt["network"] != networkID ||
+				node.txt["genesis"] != genesisHash {
+				continue
+			}
+			go discoverPeer(fmt.Sprintf("http://%s", net.JoinHostPort(from.IP.String(), strconv.Itoa(node.port))))
+		}
+	}
+}
+
+// discoverPeer adds a node found on the local network as a peer once it
+// passes the handshake, and syncs with it.
+func discoverPeer(u string) {
+	if bans.banned(hostOf(u)) {
+		return
+	}
+	for _, known := range peers.list() {
+		if known == u {
+			return
+		}
+	}
+	start := time.Now()
+	h, err := handshake(u)
+	if err != nil {
+		return
+	}
+	if peers.add(u) {
+		log.Printf("discovered peer %s", u)
+		peers.recordCheck(u, h.Height, time.Since(start), nil)
+		resolveChain()
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	evictLowestFee = "fee"
+	evictOldest    = "oldest"
+	evictNone      = "none"
+)
+
+var (
+	// maxBlockTxs and maxBlockBytes cap how many pending transactions, and
+	// how many encoded bytes of them, go into one block; 0 disables a cap.
+	maxBlockTxs   = 500
+	maxBlockBytes = 1 << 20
+
+	mempoolMaxSize       = 5000
+	mempoolEvictPolicy   = evictLowestFee
+	mempoolSweepInterval = 10 * time.Second
+)
+
+var errMempoolFull = errors.New("mempool is full")
+
+// mempoolEntry is a pending transaction together with the metadata used to
+// prioritize it.
+type mempoolEntry struct {
+	ID          string `json:"id"`
+	Transaction string `json:"transaction"`
+	Fee         int64  `json:"fee"`
+	AddedAt     int64  `json:"added_at"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+
+	tx         Transaction
+	structured bool
+	seq        uint64
+}
+
+// Mempool holds pending transactions. Transactions are handed out highest
+// fee first, oldest first among equal fees, while transactions from the
+// same sender always stay in nonce order. Entries taken for a block being
+// mined are reserved until the block is appended or mining fails, so
+// admission still counts them. It is guarded by mutex.
+type Mempool struct {
+	entries  map[string]*mempoolEntry
+	reserved map[string]*mempoolEntry
+	seq      uint64
+}
+
+func newMempool() *Mempool {
+	return &Mempool{entries: map[string]*mempoolEntry{}, reserved: map[string]*mempoolEntry{}}
+}
+
+// sender is the account a pending transaction spends from, or "" for
+// transactions that have none.
+func (e *mempoolEntry) sender() string {
+	if e.structured {
+		return e.tx.From
+	}
+	return ""
+}
+
+func (m *Mempool) len() int {
+	return len(m.entries)
+}
+
+// digest is a hash of the entries and the order they arrived in, which is
+// all the mining order depends on. It changes whenever the mempool does.
+func (m *Mempool) digest() string {
+	ids := make([]string, 0, len(m.entries))
+	for id := range m.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s:%d\n", id, m.entries[id].seq)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// all returns the pending and the reserved entries, which together spend
+// from their senders' nonces and balances.
+func (m *Mempool) all() []*mempoolEntry {
+	out := make([]*mempoolEntry, 0, len(m.entries)+len(m.reserved))
+	for _, e := range m.entries {
+		out = append(out, e)
+	}
+	for _, e := range m.reserved {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (m *Mempool) get(id string) (*mempoolEntry, bool) {
+	e, ok := m.entries[id]
+	return e, ok
+}
+
+// add places a transaction in the pool and returns its entry. A non-zero
+// expiresAt is the unix time after which the janitor drops it.
+func (m *Mempool) add(raw string, expiresAt int64) *mempoolEntry {
+	e := &mempoolEntry{
+		ID:          txID(raw),
+		Transaction: raw,
+		AddedAt:     time.Now().Unix(),
+		ExpiresAt:   expiresAt,
+	}
+	e.tx, e.structured = parseTransaction(raw)
+	if e.structured {
+		e.Fee = e.tx.Fee
+	}
+	m.insert(e)
+	notifyMempool()
+	return e
+}
+
+// mempoolSignal wakes the auto-miner when transactions arrive.
+var mempoolSignal = make(chan struct{}, 1)
+
+func notifyMempool() {
+	select {
+	case mempoolSignal <- struct{}{}:
+	default:
+	}
+}
+
+// admit adds a transaction, evicting another one according to the eviction
+// policy when the pool is at capacity. Resubmitting a pending transaction
+// returns the existing entry.
+func (m *Mempool) admit(raw string, expiresAt int64) (*mempoolEntry, error) {
+	if e, ok := m.entries[txID(raw)]; ok {
+		return e, nil
+	}
+	if mempoolMaxSize > 0 && len(m.entries) >= mempoolMaxSize {
+		fee, from := int64(0), ""
+		if tx, ok := parseTransaction(raw); ok {
+			fee, from = tx.Fee, tx.From
+		}
+		victim := m.evictionCandidate(from)
+		if victim == nil || (mempoolEvictPolicy == evictLowestFee && victim.Fee >= fee) {
+			return nil, errMempoolFull
+		}
+		m.remove(victim.ID)
+	}
+	return m.add(raw, expiresAt), nil
+}
+
+// evictionCandidate picks the entry the eviction policy would drop to make
+// room for a transaction from sender. Only the highest-nonce transaction of
+// each sender is eligible, so eviction never leaves a nonce gap behind, and
+// none of sender's own, whose chain the incoming transaction extends.
+func (m *Mempool) evictionCandidate(sender string) *mempoolEntry {
+	if mempoolEvictPolicy == evictNone {
+		return nil
+	}
+	tails := map[string]*mempoolEntry{}
+	var candidates []*mempoolEntry
+	for _, e := range m.entries {
+		if e.sender() == "" {
+			candidates = append(candidates, e)
+			continue
+		}
+		if sender != "" && e.tx.From == sender {
+			continue
+		}
+		if t, ok := tails[e.tx.From]; !ok || e.tx.Nonce > t.tx.Nonce {
+			tails[e.tx.From] = e
+		}
+	}
+	for _, e := range tails {
+		candidates = append(candidates, e)
+	}
+	var victim *mempoolEntry
+	for _, e := range candidates {
+		if victim == nil {
+			victim = e
+			continue
+		}
+		switch mempoolEvictPolicy {
+		case evictOldest:
+			if e.seq < victim.seq {
+				victim = e
+			}
+		default:
+			if e.Fee < victim.Fee || (e.Fee == victim.Fee && e.seq > victim.seq) {
+				victim = e
+			}
+		}
+	}
+	return victim
+}
+
+func (m *Mempool) insert(e *mempoolEntry) {
+	if e.seq == 0 {
+		m.seq++
+		e.seq = m.seq
+	}
+	m.entries[e.ID] = e
+}
+
+// restore puts previously taken entries back, keeping their original age.
+// Entries a block confirmed meanwhile, or whose nonce it used up, are
+// dropped instead.
+func (m *Mempool) restore(entries []*mempoolEntry) {
+	for _, e := range entries {
+		if _, ok := m.reserved[e.ID]; !ok {
+			continue
+		}
+		delete(m.reserved, e.ID)
+		if _, confirmed := txIndex[e.ID]; confirmed {
+			continue
+		}
+		if e.sender() != "" && e.tx.Nonce < accountNonces[e.tx.From] {
+			continue
+		}
+		m.insert(e)
+	}
+}
+
+func (m *Mempool) remove(id string) {
+	delete(m.entries, id)
+}
+
+// removeConfirmed drops the pending and reserved entries a block
+// confirmed, along with those whose nonce it used up. appendBlock calls it
+// for every block, mined here or received from a peer.
+func (m *Mempool) removeConfirmed(b Block) {
+	for _, raw := range b.Transactions {
+		m.remove(txID(raw))
+		delete(m.reserved, txID(raw))
+	}
+	for _, pool := range []map[string]*mempoolEntry{m.entries, m.reserved} {
+		for id, e := range pool {
+			if e.sender() != "" && e.tx.Nonce < accountNonces[e.tx.From] {
+				delete(pool, id)
+			}
+		}
+	}
+}
+
+// findNonce returns the pending transaction from sender with the given nonce.
+func (m *Mempool) findNonce(from string, nonce uint64) *mempoolEntry {
+	for _, e := range m.entries {
+		if e.sender() == from && e.tx.Nonce == nonce {
+			return e
+		}
+	}
+	return nil
+}
+
+// cancel removes an entry along with any later-nonce transactions from the
+// same sender, which could no longer be mined without it.
+func (m *Mempool) cancel(e *mempoolEntry) []*mempoolEntry {
+	dropped := []*mempoolEntry{e}
+	if e.sender() != "" {
+		for _, other := range m.entries {
+			if other != e && other.sender() == e.sender() && other.tx.Nonce > e.tx.Nonce {
+				dropped = append(dropped, other)
+			}
+		}
+	}
+	for _, d := range dropped {
+		m.remove(d.ID)
+	}
+	return dropped
+}
+
+// expire removes entries whose expiry time is at or before now, along with
+// later-nonce transactions from the same sender that could no longer be
+// mined.
+func (m *Mempool) expire(now int64) []*mempoolEntry {
+	cutoff := map[string]uint64{}
+	var dropped []*mempoolEntry
+	for _, e := range m.entries {
+		if e.ExpiresAt == 0 || e.ExpiresAt > now {
+			continue
+		}
+		if e.sender() != "" {
+			if n, ok := cutoff[e.tx.From]; !ok || e.tx.Nonce < n {
+				cutoff[e.tx.From] = e.tx.Nonce
+			}
+			continue
+		}
+		dropped = append(dropped, e)
+	}
+	for _, e := range m.entries {
+		if e.sender() != "" {
+			if n, ok := cutoff[e.tx.From]; ok && e.tx.Nonce >= n {
+				dropped = append(dropped, e)
+			}
+		}
+	}
+	for _, e := range dropped {
+		m.remove(e.ID)
+	}
+	return dropped
+}
+
+// handleCancelPending serves DELETE /pending/{id}, dropping a pending
+// transaction (and later ones that depend on it) or one awaiting signatures.
+func handleCancelPending(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := awaitingSignatures[id]; ok {
+		delete(awaitingSignatures, id)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":   "transaction cancelled",
+			"cancelled": []string{id},
+		})
+		return
+	}
+	e, ok := mempool.get(id)
+	if !ok {
+		http.Error(w, "transaction not pending", http.StatusNotFound)
+		return
+	}
+	var ids []string
+	for _, d := range mempool.cancel(e) {
+		ids = append(ids, d.ID)
+		publishEvent("tx_cancelled", d)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "transaction cancelled",
+		"cancelled": ids,
+	})
+}
+
+// expirePending drops expired transactions, pending or awaiting
+// signatures, and announces each one with a tx_expired event. The caller
+// must hold mutex.
+func expirePending() {
+	now := time.Now().Unix()
+	for _, e := range mempool.expire(now) {
+		publishEvent("tx_expired", e)
+	}
+	for _, s := range expireAwaiting(now) {
+		publishEvent("tx_expired", s)
+	}
+}
+
+// runMempoolJanitor periodically drops expired transactions.
+func runMempoolJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		mutex.Lock()
+		expirePending()
+		mutex.Unlock()
+	}
+}
+
+// saveMempool writes the pending transactions to mempoolFile, so that they
+// survive a restart. The caller must hold mutex.
+func saveMempool() error {
+	data, err := json.MarshalIndent(mempool.ordered(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(mempoolFile, data, 0644)
+}
+
+// loadMempool admits the transactions saved in mempoolFile again, keeping
+// their age. They are checked against the current state like any other,
+// so those that were confirmed, expired or made invalid meanwhile are
+// dropped. It returns how many were kept and how many dropped. The caller
+// must hold mutex.
+func loadMempool() (int, int, error) {
+	data, err := ioutil.ReadFile(mempoolFile)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var saved []mempoolEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, 0, err
+	}
+	now := time.Now().Unix()
+	kept := 0
+	for _, e := range saved {
+		if e.ExpiresAt != 0 && e.ExpiresAt <= now {
+			continue
+		}
+		var tx *Transaction
+		if t, ok := parseTransaction(e.Transaction); ok {
+			tx = &t
+		}
+		if entry, _, err := admitTransaction(e.Transaction, tx, e.ExpiresAt); err == nil {
+			entry.AddedAt = e.AddedAt
+			kept++
+		}
+	}
+	return kept, len(saved) - kept, nil
+}
+
+// take moves the entries selectBlock picks from the pool to the reserved
+// ones, where they stay until removeConfirmed or restore.
+func (m *Mempool) take(maxTxs, maxBytes int) []*mempoolEntry {
+	selected := m.selectBlock(maxTxs, maxBytes)
+	for _, e := range selected {
+		m.remove(e.ID)
+		m.reserved[e.ID] = e
+	}
+	return selected
+}
+
+// selectBlock returns entries in priority order until maxTxs entries or
+// maxBytes encoded bytes are reached; 0 disables either cap. A transaction
+// that does not fit in the remaining space is left for a later block,
+// along with its sender's later-nonce transactions.
+func (m *Mempool) selectBlock(maxTxs, maxBytes int) []*mempoolEntry {
+	var selected []*mempoolEntry
+	skipped := map[string]bool{}
+	size := 0
+	for _, e := range m.ordered() {
+		if maxTxs > 0 && len(selected) >= maxTxs {
+			break
+		}
+		if from := e.sender(); from != "" && skipped[from] {
+			continue
+		}
+		if maxBytes > 0 && size+len(e.Transaction) > maxBytes {
+			if from := e.sender(); from != "" {
+				skipped[from] = true
+			}
+			continue
+		}
+		size += len(e.Transaction)
+		selected = append(selected, e)
+	}
+	return selected
+}
+
+// transactions returns the raw pending transactions in priority order.
+func (m *Mempool) transactions() []string {
+	ordered := m.ordered()
+	out := make([]string, len(ordered))
+	for i, e := range ordered {
+		out[i] = e.Transaction
+	}
+	return out
+}
+
+// ordered returns every entry in the order it would be mined.
+func (m *Mempool) ordered() []*mempoolEntry {
+	// Transactions with a sender only become eligible once the sender's
+	// lower nonces have been picked, so queue them per sender and release
+	// them one by one.
+	queues := map[string][]*mempoolEntry{}
+	ready := &entryHeap{}
+	for _, e := range m.entries {
+		if e.sender() != "" {
+			queues[e.tx.From] = append(queues[e.tx.From], e)
+		} else {
+			*ready = append(*ready, e)
+		}
+	}
+	for from, q := range queues {
+		sort.Slice(q, func(i, j int) bool { return q[i].tx.Nonce < q[j].tx.Nonce })
+		*ready = append(*ready, q[0])
+		queues[from] = q[1:]
+	}
+	heap.Init(ready)
+
+	out := make([]*mempoolEntry, 0, len(m.entries))
+	for ready.Len() > 0 {
+		e := heap.Pop(ready).(*mempoolEntry)
+		out = append(out, e)
+		if e.sender() != "" {
+			if q := queues[e.tx.From]; len(q) > 0 {
+				heap.Push(ready, q[0])
+				queues[e.tx.From] = q[1:]
+			}
+		}
+	}
+	return out
+}
+
+// entryHeap is a max-heap of entries by fee, then by age.
+type entryHeap []*mempoolEntry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].Fee != h[j].Fee {
+		return h[i].Fee > h[j].Fee
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h entryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(*mempoolEntry)) }
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
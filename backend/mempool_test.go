@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestEvictionCandidateSparesSender(t *testing.T) {
+	m := newMempool()
+	for _, e := range []*mempoolEntry{
+		{ID: "a0", Fee: 1, tx: Transaction{From: "alice", Nonce: 0}, structured: true},
+		{ID: "a1", Fee: 1, tx: Transaction{From: "alice", Nonce: 1}, structured: true},
+		{ID: "b0", Fee: 5, tx: Transaction{From: "bob", Nonce: 0}, structured: true},
+	} {
+		m.insert(e)
+	}
+	if got := m.evictionCandidate(""); got == nil || got.ID != "a1" {
+		t.Fatalf("evictionCandidate(\"\") = %v, want a1", got)
+	}
+	if got := m.evictionCandidate("alice"); got == nil || got.ID != "b0" {
+		t.Fatalf("evictionCandidate(alice) = %v, want b0", got)
+	}
+	m.remove("b0")
+	if got := m.evictionCandidate("alice"); got != nil {
+		t.Fatalf("evictionCandidate(alice) = %v with only alice pending, want nil", got)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Merkle tree versions. Each block records the version its merkle root was
+// built with.
+//
+// merkleVersionLegacy hashes the hex strings of child hashes concatenated
+// and pairs an odd node out with itself. Leaves and inner nodes are hashed
+// alike, so a 64-byte transaction can pass for an inner node, and a list
+// ending in a repeated transaction has the same root as one without it.
+//
+// merkleVersionTagged hashes raw bytes with a 0x00 prefix for leaves and
+// 0x01 for inner nodes, and moves an odd node out up a level unchanged.
+const (
+	merkleVersionLegacy = 0
+	merkleVersionTagged = 1
+)
+
+// currentMerkleVersion is the version new blocks are built with.
+const currentMerkleVersion = merkleVersionTagged
+
+var errMerkleVersion = errors.New("unknown or downgraded merkle version")
+
+const (
+	merkleLeafTag  = 0x00
+	merkleInnerTag = 0x01
+)
+
+// merkleLeafHash is the hex hash of a transaction as a tree leaf.
+func merkleLeafHash(version int, tx string) string {
+	if version == merkleVersionLegacy {
+		return sha256hex(tx)
+	}
+	h := sha256.Sum256(append([]byte{merkleLeafTag}, tx...))
+	return hex.EncodeToString(h[:])
+}
+
+var errMerkleHash = errors.New("merkle hash is not hex")
+
+// merkleNodeHash is the hex hash of an inner node over its children's hex
+// hashes. Tagged trees hash the children's bytes, so both must be hex.
+func merkleNodeHash(version int, left, right string) (string, error) {
+	if version == merkleVersionLegacy {
+		return sha256hex(left + right), nil
+	}
+	l, err := hex.DecodeString(left)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", errMerkleHash, left)
+	}
+	r, err := hex.DecodeString(right)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", errMerkleHash, right)
+	}
+	h := sha256.Sum256(append(append([]byte{merkleInnerTag}, l...), r...))
+	return hex.EncodeToString(h[:]), nil
+}
+
+// merkleLayer hashes one level of the tree into the next. Its nodes are
+// hashes built here, always hex, so merkleNodeHash cannot fail on them.
+func merkleLayer(version int, layer []string) []string {
+	var next []string
+	for i := 0; i < len(layer); i += 2 {
+		switch {
+		case i+1 < len(layer):
+			h, _ := merkleNodeHash(version, layer[i], layer[i+1])
+			next = append(next, h)
+		case version == merkleVersionLegacy:
+			h, _ := merkleNodeHash(version, layer[i], layer[i])
+			next = append(next, h)
+		default:
+			next = append(next, layer[i])
+		}
+	}
+	return next
+}
+
+// merkleRoot builds the merkle root of txs with the given tree version.
+func merkleRoot(version int, txs []string) string {
+	if version == merkleVersionLegacy || len(txs) == 0 {
+		return computeMerkleRoot(txs)
+	}
+	layer := make([]string, len(txs))
+	for i, t := range txs {
+		layer[i] = merkleLeafHash(version, t)
+	}
+	for len(layer) > 1 {
+		layer = merkleLayer(version, layer)
+	}
+	return layer[0]
+}
+
+// blockMerkleRoot recomputes b's merkle root with the version it records.
+func blockMerkleRoot(b Block) string {
+	return merkleRoot(b.MerkleVersion, b.Transactions)
+}
+
+// checkMerkleVersion rejects a block built with an unknown merkle version
+// or an older one than its parent's, so a chain cannot drop back to the
+// legacy tree once it has moved on.
+func checkMerkleVersion(prev, b Block) error {
+	if b.MerkleVersion < merkleVersionLegacy || b.MerkleVersion > currentMerkleVersion {
+		return fmt.Errorf("%w: %d", errMerkleVersion, b.MerkleVersion)
+	}
+	if b.MerkleVersion < prev.MerkleVersion {
+		return fmt.Errorf("%w: %d after %d", errMerkleVersion, b.MerkleVersion, prev.MerkleVersion)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// proofStep is one level of a merkle audit path: the sibling hash and
+// which side of the running hash it goes on.
+type proofStep struct {
+	Hash string `json:"hash"`
+	Side string `json:"side"`
+}
+
+// merkleProof is what a client needs to check that a transaction is in a
+// block: hashing the leaf up the path must give the block's merkle root.
+type merkleProof struct {
+	TxID        string `json:"txid"`
+	Transaction string `json:"transaction"`
+	BlockIndex  int    `json:"block_index"`
+	BlockHash   string `json:"block_hash"`
+	Position    int    `json:"position"`
+	Leaf        string `json:"leaf"`
+	MerkleRoot  string `json:"merkle_root"`
+	// MerkleVersion is the tree version of the block, see merkle.go.
+	MerkleVersion int         `json:"merkle_version"`
+	Path          []proofStep `json:"path"`
+}
+
+// merklePath returns the audit path for the transaction at pos in a tree of
+// the given version. A legacy tree pairs an odd node out with itself; a
+// tagged tree moves it up unchanged, which takes no step.
+func merklePath(version int, txs []string, pos int) []proofStep {
+	layer := make([]string, len(txs))
+	for i, t := range txs {
+		layer[i] = merkleLeafHash(version, t)
+	}
+	path := []proofStep{}
+	for len(layer) > 1 {
+		switch {
+		case pos%2 == 1:
+			path = append(path, proofStep{layer[pos-1], "left"})
+		case pos+1 < len(layer):
+			path = append(path, proofStep{layer[pos+1], "right"})
+		case version == merkleVersionLegacy:
+			path = append(path, proofStep{layer[pos], "right"})
+		}
+		layer = merkleLayer(version, layer)
+		pos /= 2
+	}
+	return path
+}
+
+// VerifyMerkleProof reports whether hashing the transaction tx up path, in
+// a tree of the given merkle version, gives root, that is whether the
+// audit path proves tx is in a block with that merkle root. It fails with
+// errMerkleHash if a hash on the path cannot be hashed at all.
+func VerifyMerkleProof(version int, tx string, path []proofStep, root string) (bool, error) {
+	if version < merkleVersionLegacy || version > currentMerkleVersion {
+		return false, nil
+	}
+	h := merkleLeafHash(version, tx)
+	for _, step := range path {
+		var err error
+		switch step.Side {
+		case "left":
+			h, err = merkleNodeHash(version, step.Hash, h)
+		case "right":
+			h, err = merkleNodeHash(version, h, step.Hash)
+		default:
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return h == root, nil
+}
+
+func proofFor(b Block, pos int) merkleProof {
+	raw := b.Transactions[pos]
+	return merkleProof{
+		TxID:          txID(raw),
+		Transaction:   raw,
+		BlockIndex:    b.Index,
+		BlockHash:     b.Hash,
+		Position:      pos,
+		Leaf:          merkleLeafHash(b.MerkleVersion, raw),
+		MerkleRoot:    b.MerkleRoot,
+		MerkleVersion: b.MerkleVersion,
+		Path:          merklePath(b.MerkleVersion, b.Transactions, pos),
+	}
+}
+
+// handleProof serves GET /proof/{txid} and GET /proof?block=N&index=I, the
+// merkle audit path of a confirmed transaction.
+func handleProof(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if id := r.PathValue("id"); id != "" {
+		b, pos, ok := findConfirmedTx(id)
+		if !ok {
+			http.Error(w, "transaction not found in the chain", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(proofFor(b, pos))
+		return
+	}
+	height, err := strconv.Atoi(r.URL.Query().Get("block"))
+	if err != nil || height < 0 || height >= len(blockchain) {
+		http.Error(w, "block must be a height in the chain", http.StatusBadRequest)
+		return
+	}
+	if pruned(height) {
+		http.Error(w, errPruned.Error(), http.StatusGone)
+		return
+	}
+	b := blockchain[height]
+	pos, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil || pos < 0 || pos >= len(b.Transactions) {
+		http.Error(w, "index must be a transaction position in the block", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(proofFor(b, pos))
+}
+
+// proofVerifyRequest is the body of POST /proof/verify.
+type proofVerifyRequest struct {
+	Transaction string      `json:"transaction"`
+	Path        []proofStep `json:"path"`
+	MerkleRoot  string      `json:"merkle_root"`
+	// MerkleVersion defaults to the legacy tree.
+	MerkleVersion int `json:"merkle_version"`
+}
+
+// handleProofVerify serves POST /proof/verify {transaction, path,
+// merkle_root[, merkle_version]}, checking an inclusion proof without
+// needing the block.
+func handleProofVerify(w http.ResponseWriter, r *http.Request) {
+	var body proofVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.MerkleRoot == "" {
+		http.Error(w, "invalid body, expected {\"transaction\",\"path\",\"merkle_root\"}", http.StatusBadRequest)
+		return
+	}
+	valid, err := VerifyMerkleProof(body.MerkleVersion, body.Transaction, body.Path, body.MerkleRoot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"txid":  txID(body.Transaction),
+		"valid": valid,
+	})
+}
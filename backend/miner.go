@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// autoMinerPoll is how often the auto-miner rechecks the mempool when no new
+// transaction has woken it, e.g. after a failed attempt.
+const autoMinerPoll = 5 * time.Second
+
+var (
+	// autoMineInterval and autoMineEmpty start the scheduled auto-miner at
+	// boot when the interval is positive.
+	autoMineInterval time.Duration
+	autoMineEmpty    bool
+)
+
+// autoMiner mines blocks in the background. Without an interval it mines
+// whenever the mempool has transactions; with one it mines at most one block
+// per interval, and optionally an empty block when nothing is pending. Its
+// fields are guarded by its own lock, not mutex.
+type autoMiner struct {
+	mu          sync.Mutex
+	running     bool
+	cancel      context.CancelFunc
+	miner       string
+	difficulty  int
+	interval    time.Duration
+	mineEmpty   bool
+	startedAt   int64
+	blocksMined int
+	lastBlock   *Block
+	lastError   string
+}
+
+var backgroundMiner = &autoMiner{}
+
+func (m *autoMiner) start(miner string, difficulty int, interval time.Duration, mineEmpty bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return errors.New("miner already running")
+	}
+	m.running = true
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.miner = miner
+	m.difficulty = difficulty
+	m.interval = interval
+	m.mineEmpty = mineEmpty
+	m.startedAt = time.Now().Unix()
+	m.blocksMined = 0
+	m.lastError = ""
+	go m.run(ctx)
+	return nil
+}
+
+func (m *autoMiner) halt() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return errors.New("miner not running")
+	}
+	// Canceling also aborts a block that is being mined.
+	m.cancel()
+	m.running = false
+	return nil
+}
+
+func (m *autoMiner) run(ctx context.Context) {
+	m.mu.Lock()
+	miner, difficulty, interval, mineEmpty := m.miner, m.difficulty, m.interval, m.mineEmpty
+	m.mu.Unlock()
+	// A scheduled miner ignores mempool wakeups so blocks keep a steady
+	// cadence.
+	wake := mempoolSignal
+	poll := autoMinerPoll
+	if interval > 0 {
+		wake = nil
+		poll = interval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+		attempt, done := trackMining(ctx)
+		block, err := mineFromMempool(attempt, difficulty, miner)
+		if errors.Is(err, errNothingToMine) && mineEmpty {
+			block, err = addBlock(attempt, nil, difficulty, miner, 0)
+		}
+		done()
+		if errors.Is(err, errNothingToMine) || ctx.Err() != nil {
+			continue
+		}
+		m.mu.Lock()
+		if err != nil {
+			m.lastError = err.Error()
+		} else {
+			m.blocksMined++
+			m.lastBlock = &block
+			m.lastError = ""
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *autoMiner) status() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[string]interface{}{
+		"running":      m.running,
+		"miner":        m.miner,
+		"difficulty":   m.difficulty,
+		"interval_s":   m.interval.Seconds(),
+		"mine_empty":   m.mineEmpty,
+		"started_at":   m.startedAt,
+		"blocks_mined": m.blocksMined,
+		"last_block":   m.lastBlock,
+		"last_error":   m.lastError,
+	}
+}
+
+// minerStartRequest is the body of POST /miner/start; every field is
+// optional.
+type minerStartRequest struct {
+	Difficulty int     `json:"difficulty"`
+	Miner      string  `json:"miner"`
+	IntervalS  float64 `json:"interval_s"`
+	MineEmpty  bool    `json:"mine_empty"`
+}
+
+func handleMinerStart(w http.ResponseWriter, r *http.Request) {
+	var body minerStartRequest
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	body.Miner = strings.TrimSpace(body.Miner)
+	if body.Miner != "" {
+		if err := validateAddress(body.Miner); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.IntervalS < 0 || (body.MineEmpty && body.IntervalS == 0) {
+		http.Error(w, "interval_s must be positive, and is required with mine_empty", http.StatusBadRequest)
+		return
+	}
+	interval := time.Duration(body.IntervalS * float64(time.Second))
+	if err := backgroundMiner.start(body.Miner, body.Difficulty, interval, body.MineEmpty); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(backgroundMiner.status())
+}
+
+func handleMinerStop(w http.ResponseWriter, r *http.Request) {
+	if err := backgroundMiner.halt(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(backgroundMiner.status())
+}
+
+func handleMinerStatus(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(backgroundMiner.status())
+}
+
+// benchmarkRequest is the body of POST /miner/benchmark.
+type benchmarkRequest struct {
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// handleMinerBenchmark serves POST /miner/benchmark {duration_ms}. It runs
+// the proof-of-work loop against an unreachable target for the given time
+// and reports the hash rate along with the expected time to mine a block at
+// the network target and at each leading-zero difficulty.
+func handleMinerBenchmark(w http.ResponseWriter, r *http.Request) {
+	body := benchmarkRequest{DurationMs: 2000}
+	// The body is optional; without one the defaults apply.
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid body, expected {\"duration_ms\"}", http.StatusBadRequest)
+		return
+	}
+	if body.DurationMs <= 0 || body.DurationMs > 30000 {
+		http.Error(w, "duration_ms must be between 1 and 30000", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	tip := getLastBlock()
+	network := requiredTarget(len(blockchain))
+	mutex.Unlock()
+	// Difficulty 64 only accepts an all-zero hash, so the loop runs for the
+	// whole duration.
+	b := Block{
+		Index:         tip.Index + 1,
+		Timestamp:     time.Now().Unix(),
+		Transactions:  []string{"benchmark"},
+		PrevHash:      tip.Hash,
+		Difficulty:    64,
+		MerkleVersion: currentMerkleVersion,
+		Format:        currentBlockFormat,
+	}
+	b.MerkleRoot = blockMerkleRoot(b)
+	var hashes int64
+	ctx := withAttemptCounter(r.Context(), &hashes)
+	start := time.Now()
+	mineBlock(ctx, b, body.DurationMs)
+	elapsed := time.Since(start).Seconds()
+
+	rate := float64(atomic.LoadInt64(&hashes)) / elapsed
+	workers := miningWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	estimates := map[string]float64{}
+	for zeros := 1; zeros <= 8; zeros++ {
+		estimates[strconv.Itoa(zeros)] = expectedHashes(zerosTarget(zeros)) / rate
+	}
+	result := map[string]interface{}{
+		"duration_ms":           int64(elapsed * 1000),
+		"hashes":                atomic.LoadInt64(&hashes),
+		"workers":               workers,
+		"hash_rate":             rate,
+		"hash_rate_per_core":    rate / float64(workers),
+		"algorithm":             chainHasher.Name(),
+		"seconds_by_difficulty": estimates,
+	}
+	if chainConsensus == consensusPoW {
+		result["network_block_seconds"] = expectedHashes(network) / rate
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// expectedHashes is the average number of hashes needed to find one at or
+// below target.
+func expectedHashes(target *big.Int) float64 {
+	space := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), 256))
+	f, _ := space.Quo(space, new(big.Float).SetInt(new(big.Int).Add(target, big.NewInt(1)))).Float64()
+	return f
+}
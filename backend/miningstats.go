@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxSolveRecords is how many recent block solves /miner/stats lists.
+	maxSolveRecords = 50
+	// hashRateWindow is how far back the current hash rate looks.
+	hashRateWindow = 10 * time.Second
+)
+
+// totalHashes counts every hash the node has tried since it started.
+var totalHashes int64
+
+// countHashes adds n tried hashes to the node total and to each counter.
+func countHashes(counters []*int64, n int64) {
+	atomic.AddInt64(&totalHashes, n)
+	for _, c := range counters {
+		atomic.AddInt64(c, n)
+	}
+}
+
+// solveRecord describes one block this node mined.
+type solveRecord struct {
+	Height     int     `json:"height"`
+	Difficulty int     `json:"difficulty"`
+	Bits       string  `json:"bits"`
+	Seconds    float64 `json:"seconds"`
+	Hashes     int64   `json:"hashes"`
+	MinedAt    int64   `json:"mined_at"`
+}
+
+type solveTotals struct {
+	Blocks  int     `json:"blocks"`
+	Seconds float64 `json:"total_seconds"`
+}
+
+var (
+	statsMutex  sync.Mutex
+	solves      = []solveRecord{}
+	solvesByBit = map[string]*solveTotals{}
+	rateSamples []rateSample
+)
+
+type rateSample struct {
+	at     time.Time
+	hashes int64
+}
+
+// recordSolve notes a block this node finished mining.
+func recordSolve(b Block, took time.Duration, hashes int64) {
+	rec := solveRecord{
+		Height:     b.Index,
+		Difficulty: b.Difficulty,
+		Bits:       fmt.Sprintf("%08x", targetToCompact(blockTarget(b))),
+		Seconds:    took.Seconds(),
+		Hashes:     hashes,
+		MinedAt:    time.Now().Unix(),
+	}
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	solves = append(solves, rec)
+	if len(solves) > maxSolveRecords {
+		solves = solves[len(solves)-maxSolveRecords:]
+	}
+	t := solvesByBit[rec.Bits]
+	if t == nil {
+		t = &solveTotals{}
+		solvesByBit[rec.Bits] = t
+	}
+	t.Blocks++
+	t.Seconds += rec.Seconds
+}
+
+// runHashRateSampler samples totalHashes every second so the current hash
+// rate can be computed over hashRateWindow.
+func runHashRateSampler() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		statsMutex.Lock()
+		rateSamples = append(rateSamples, rateSample{at: now, hashes: atomic.LoadInt64(&totalHashes)})
+		for len(rateSamples) > 1 && now.Sub(rateSamples[0].at) > hashRateWindow {
+			rateSamples = rateSamples[1:]
+		}
+		statsMutex.Unlock()
+	}
+}
+
+// handleMinerStats serves GET /miner/stats.
+func handleMinerStats(w http.ResponseWriter, r *http.Request) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	rate := 0.0
+	if n := len(rateSamples); n > 1 {
+		first, last := rateSamples[0], rateSamples[n-1]
+		rate = float64(last.hashes-first.hashes) / last.at.Sub(first.at).Seconds()
+	}
+	byBits := map[string]interface{}{}
+	for bits, t := range solvesByBit {
+		byBits[bits] = map[string]interface{}{
+			"blocks":          t.Blocks,
+			"average_seconds": t.Seconds / float64(t.Blocks),
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total_hashes":  atomic.LoadInt64(&totalHashes),
+		"hash_rate":     rate,
+		"by_difficulty": byBits,
+		"recent_solves": solves,
+	})
+}
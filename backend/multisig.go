@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TxSignature is an ed25519 signature over a transaction's signing hash.
+type TxSignature struct {
+	PubKey    string `json:"pubkey"`
+	Signature string `json:"signature"`
+}
+
+var (
+	// maxAwaitingSignatures bounds how many transactions wait for
+	// signatures at once; 0 disables the cap.
+	maxAwaitingSignatures = 1000
+	// awaitingSignaturesTTL is how long a transaction waits for signatures
+	// unless it expires sooner.
+	awaitingSignaturesTTL = 24 * time.Hour
+)
+
+var errTooManyAwaiting = errors.New("too many transactions awaiting signatures")
+
+// awaitingTx is a multisig transaction waiting for signatures, and the unix
+// time after which the janitor drops it.
+type awaitingTx struct {
+	Transaction
+	expiresAt int64
+}
+
+// awaitingSignatures holds multisig transactions that do not yet carry
+// enough signatures to enter the mempool, keyed by transaction ID. It is
+// guarded by mutex.
+var awaitingSignatures = map[string]awaitingTx{}
+
+// awaitSignatures keeps tx until it has enough signatures, refusing it
+// while maxAwaitingSignatures others are waiting. The caller must hold
+// mutex.
+func awaitSignatures(tx Transaction) error {
+	id := tx.id()
+	if _, ok := awaitingSignatures[id]; !ok && maxAwaitingSignatures > 0 && len(awaitingSignatures) >= maxAwaitingSignatures {
+		return errTooManyAwaiting
+	}
+	expiresAt := time.Now().Add(awaitingSignaturesTTL).Unix()
+	if tx.ExpiresAt != 0 && tx.ExpiresAt < expiresAt {
+		expiresAt = tx.ExpiresAt
+	}
+	awaitingSignatures[id] = awaitingTx{tx, expiresAt}
+	return nil
+}
+
+// expireAwaiting drops transactions that waited for signatures past their
+// expiry and returns them. The caller must hold mutex.
+func expireAwaiting(now int64) []txStatus {
+	var dropped []txStatus
+	for id, a := range awaitingSignatures {
+		if a.expiresAt <= now {
+			delete(awaitingSignatures, id)
+			dropped = append(dropped, txStatus{ID: id, Transaction: a.encode(), Status: "awaiting_signatures"})
+		}
+	}
+	return dropped
+}
+
+// validSignatures checks the key set and every attached signature, and
+// returns how many distinct listed keys have signed.
+func (tx Transaction) validSignatures() (int, error) {
+	if tx.Threshold < 1 || tx.Threshold > len(tx.PubKeys) {
+		return 0, fmt.Errorf("threshold must be between 1 and %d", len(tx.PubKeys))
+	}
+	listed := map[string]ed25519.PublicKey{}
+	for _, k := range tx.PubKeys {
+		b, err := hex.DecodeString(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return 0, fmt.Errorf("invalid public key %q", k)
+		}
+		if listed[k] != nil {
+			return 0, fmt.Errorf("duplicate public key %q", k)
+		}
+		listed[k] = ed25519.PublicKey(b)
+	}
+	hash := tx.signingHash()
+	signed := map[string]bool{}
+	for _, sig := range tx.Signatures {
+		key := listed[sig.PubKey]
+		if key == nil {
+			return 0, fmt.Errorf("signature from unlisted key %q", sig.PubKey)
+		}
+		if signed[sig.PubKey] {
+			return 0, fmt.Errorf("duplicate signature from %q", sig.PubKey)
+		}
+		s, err := hex.DecodeString(sig.Signature)
+		if err != nil || !ed25519.Verify(key, hash, s) {
+			return 0, fmt.Errorf("invalid signature from %q", sig.PubKey)
+		}
+		signed[sig.PubKey] = true
+	}
+	return len(signed), nil
+}
+
+var errWrongSigner = errors.New("from address does not match the listed public keys")
+
+// checkSigners checks tx's signatures and that its keys control its
+// sender, and returns how many of the keys have signed.
+func (tx Transaction) checkSigners() (int, error) {
+	signed, err := tx.validSignatures()
+	if err != nil {
+		return 0, err
+	}
+	if tx.ownerAddress() != tx.From {
+		return 0, errWrongSigner
+	}
+	return signed, nil
+}
+
+// handleSignTx attaches a signature to a transaction awaiting signatures and
+// moves it to the mempool once the threshold is reached.
+func handleSignTx(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var sig TxSignature
+	if err := json.NewDecoder(r.Body).Decode(&sig); err != nil || sig.PubKey == "" || sig.Signature == "" {
+		http.Error(w, "invalid body, expected {\"pubkey\":\"...\",\"signature\":\"...\"}", http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	tx, ok := awaitingSignatures[id]
+	if !ok {
+		http.Error(w, "no transaction awaiting signatures with that id", http.StatusNotFound)
+		return
+	}
+	tx.Signatures = append(append([]TxSignature{}, tx.Signatures...), sig)
+	signed, err := tx.validSignatures()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if signed < tx.Threshold {
+		awaitingSignatures[id] = tx
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":           "signature added",
+			"id":                id,
+			"signatures":        signed,
+			"signatures_needed": tx.Threshold,
+		})
+		return
+	}
+	entry, status, err := admitTransaction(tx.encode(), &tx.Transaction, tx.ExpiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	delete(awaitingSignatures, id)
+	relayTransaction(entry.Transaction, tx.ExpiresAt)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "transaction added",
+		"id":      entry.ID,
+	})
+}
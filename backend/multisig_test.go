@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAwaitSignaturesBoundedAndExpiring(t *testing.T) {
+	defer func(max int, ttl time.Duration) {
+		maxAwaitingSignatures, awaitingSignaturesTTL = max, ttl
+		awaitingSignatures = map[string]awaitingTx{}
+	}(maxAwaitingSignatures, awaitingSignaturesTTL)
+	awaitingSignatures = map[string]awaitingTx{}
+	maxAwaitingSignatures, awaitingSignaturesTTL = 2, time.Hour
+
+	now := time.Now().Unix()
+	first := Transaction{Type: txTypeTransfer, From: "a", Nonce: 0}
+	soon := Transaction{Type: txTypeTransfer, From: "a", Nonce: 1, ExpiresAt: now + 60}
+	if err := awaitSignatures(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := awaitSignatures(soon); err != nil {
+		t.Fatal(err)
+	}
+	if err := awaitSignatures(Transaction{Type: txTypeTransfer, From: "a", Nonce: 2}); !errors.Is(err, errTooManyAwaiting) {
+		t.Errorf("third transaction: got %v, want errTooManyAwaiting", err)
+	}
+	if err := awaitSignatures(first); err != nil {
+		t.Errorf("updating a waiting transaction: %v", err)
+	}
+
+	if dropped := expireAwaiting(now + 61); len(dropped) != 1 || dropped[0].ID != soon.id() {
+		t.Errorf("expired %v, want only the transaction with its own expiry", dropped)
+	}
+	if dropped := expireAwaiting(now + 3601); len(dropped) != 1 || dropped[0].ID != first.id() {
+		t.Errorf("expired %v, want the transaction past the TTL", dropped)
+	}
+}
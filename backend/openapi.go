@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The HTTP API is described once, in a route table per version. The mux is
+// registered from the tables and /openapi.json and /docs are generated from
+// them, so a route cannot be served without being documented.
+
+// apiParam is a path or query parameter of an operation.
+type apiParam struct {
+	Name        string
+	In          string // "path" or "query"
+	Type        string // a JSON Schema type
+	Description string
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{name, "path", "string", description}
+}
+
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{name, "query", typ, description}
+}
+
+// apiOneOf documents a body that takes one of several shapes.
+type apiOneOf []interface{}
+
+// apiOp is one operation. Body and Response are zero values of the Go types
+// the handler decodes and encodes, and their schemas are read off them by
+// reflection. A nil Response is a JSON object of no fixed shape.
+type apiOp struct {
+	Method string
+	Path   string // in OpenAPI form, e.g. /tx/{id}
+	// Mux is the mux path, when registering Path would clash with another
+	// operation. The handler then checks what its wildcards matched.
+	Mux     string
+	Summary string
+	Params  []apiParam
+	Body    interface{}
+	// Response is sent with Status, 200 if zero, as ContentType,
+	// application/json if empty.
+	Response    interface{}
+	ContentType string
+	Status      int
+	// ETag, when set, tags the answers, so a request with the current tag
+	// in If-None-Match gets 304 (see etag.go).
+	ETag etagFunc
+}
+
+// apiRoute is a handler and the operations it serves, each registered on
+// the mux at its method and path. Pattern names the route for its roles
+// and rate limits.
+type apiRoute struct {
+	Pattern string
+	Handler http.HandlerFunc
+	Ops     []apiOp
+}
+
+// apiVersion is a version of the API: the routes served under its path
+// prefix.
+type apiVersion struct {
+	Prefix string
+	Routes []apiRoute
+}
+
+// apiVersions lists every version served, oldest first. A new version gets
+// its own route table, sharing handlers with the previous one where
+// nothing changed, and the old versions keep being served as they were.
+var apiVersions []apiVersion
+
+// legacyAPI is the version the unversioned paths are deprecated aliases
+// of. They predate /v1, and the frontend and older peers still use them.
+var legacyAPI apiVersion
+
+var v1Routes []apiRoute
+
+func init() {
+	heightParam := queryParam("height", "integer", "answer as of this block height instead of the tip")
+	v1Routes = []apiRoute{
+		{"/", handleRoot, []apiOp{
+			{Method: "GET", Path: "/", Summary: "List the endpoints", ContentType: "text/plain"},
+		}},
+		{"/info", handleInfo, []apiOp{
+			{Method: "GET", Path: "/info", Summary: "Chain parameters and the current tip", ETag: tipETag},
+		}},
+		{"/tx", handleAddTx, []apiOp{
+			{Method: "POST", Path: "/tx", Summary: "Submit a transaction; 202 if it still needs signatures", Body: txRequest{}, Status: http.StatusCreated},
+		}},
+		{"/tx/", handleGetTx, []apiOp{
+			{Method: "GET", Path: "/tx/{id}", Summary: "Where a transaction stands", Params: []apiParam{pathParam("id", "transaction ID")}, Response: txStatus{}},
+		}},
+		{"/tx/", handleSignTx, []apiOp{
+			{Method: "POST", Path: "/tx/{id}/sign", Summary: "Add a signature to a multisig transaction", Params: []apiParam{pathParam("id", "transaction ID")}, Body: TxSignature{}},
+		}},
+		{"/tx/", handleTxReceipt, []apiOp{
+			{Method: "GET", Path: "/tx/{id}/receipt", Summary: "The outcome of a confirmed transaction", Params: []apiParam{pathParam("id", "transaction ID")}},
+		}},
+		{"/tx/", handleTxData, []apiOp{
+			{Method: "GET", Path: "/tx/{id}/data", Summary: "The payload of a data transaction, served as its content type", Params: []apiParam{pathParam("id", "transaction ID")}, ContentType: "*/*"},
+		}},
+		{"/proof", handleProof, []apiOp{
+			{Method: "GET", Path: "/proof", Summary: "Merkle proof for a transaction by position", Params: []apiParam{
+				queryParam("block", "integer", "block height"),
+				queryParam("index", "integer", "position of the transaction in the block"),
+			}, Response: merkleProof{}},
+		}},
+		{"/proof/", handleProof, []apiOp{
+			{Method: "GET", Path: "/proof/{id}", Summary: "Merkle proof for a confirmed transaction", Params: []apiParam{pathParam("id", "transaction ID")}, Response: merkleProof{}},
+		}},
+		{"/proof/verify", handleProofVerify, []apiOp{
+			{Method: "POST", Path: "/proof/verify", Summary: "Check a merkle proof against a root", Body: proofVerifyRequest{}},
+		}},
+		{"/mine", handleMine, []apiOp{
+			{Method: "POST", Path: "/mine", Summary: "Mine the pending transactions into a block; with async, start a job and answer 202", Params: []apiParam{
+				queryParam("async", "boolean", "mine in the background and return the job"),
+			}, Body: mineRequest{}, Response: Block{}},
+			{Method: "DELETE", Path: "/mine", Summary: "Cancel mining in progress"},
+		}},
+		{"/mine/jobs/", handleMiningJob, []apiOp{
+			{Method: "GET", Path: "/mine/jobs/{id}", Summary: "State of a background mining job", Params: []apiParam{pathParam("id", "job ID")}},
+		}},
+		{"/mine/bulk", handleBulkMine, []apiOp{
+			{Method: "POST", Path: "/mine/bulk", Summary: "Mine several blocks in a row", Body: bulkMineRequest{}},
+		}},
+		{"/mine/work", handleGetWork, []apiOp{
+			{Method: "GET", Path: "/mine/work", Summary: "A work unit for an external miner", Params: []apiParam{
+				queryParam("miner", "string", "address to pay the block reward to"),
+				queryParam("difficulty", "integer", "leading zero hex digits to require instead of the network target"),
+			}},
+		}},
+		{"/mine/template", handleBlockTemplate, []apiOp{
+			{Method: "GET", Path: "/mine/template", Summary: "A block template of the best-paying pending transactions", Params: []apiParam{
+				queryParam("max_txs", "integer", "most transactions to include"),
+			}},
+		}},
+		{"/mine/submit", handleSubmitWork, []apiOp{
+			{Method: "POST", Path: "/mine/submit", Summary: "Submit a solved work unit", Body: workSubmission{}, Response: Block{}},
+		}},
+		{"/miner/start", handleMinerStart, []apiOp{
+			{Method: "POST", Path: "/miner/start", Summary: "Start the background miner", Body: minerStartRequest{}},
+		}},
+		{"/miner/stop", handleMinerStop, []apiOp{
+			{Method: "POST", Path: "/miner/stop", Summary: "Stop the background miner"},
+		}},
+		{"/miner/status", handleMinerStatus, []apiOp{
+			{Method: "GET", Path: "/miner/status", Summary: "State of the background miner"},
+		}},
+		{"/miner/benchmark", handleMinerBenchmark, []apiOp{
+			{Method: "POST", Path: "/miner/benchmark", Summary: "Measure the hash rate of this node", Body: benchmarkRequest{}},
+		}},
+		{"/miner/stats", handleMinerStats, []apiOp{
+			{Method: "GET", Path: "/miner/stats", Summary: "Blocks mined, solve times and hash rate"},
+		}},
+		{"/blocks", handleGetBlocks, []apiOp{
+			{Method: "GET", Path: "/blocks", Summary: "The chain, a height range of it, or a page of it; the X-Total-Count header carries the chain length", Params: []apiParam{
+				queryParam("from", "integer", "first height"),
+				queryParam("to", "integer", "last height"),
+				queryParam("limit", "integer", "page size"),
+				queryParam("offset", "integer", "first height of the page"),
+				queryParam("since_hash", "string", "start the page after the block with this hash"),
+			}, Response: apiOneOf{[]Block{}, blockPage{}}, ETag: tipETag},
+			{Method: "POST", Path: "/blocks", Summary: "Announce a block, as JSON or application/x-mesam-block", Body: Block{}},
+		}},
+		{"/blocks/compact", handleReceiveCompactBlock, []apiOp{
+			{Method: "POST", Path: "/blocks/compact", Summary: "Announce a block by header and transaction IDs", Body: compactBlock{}},
+		}},
+		{"/blocks/stream", handleBlockStream, []apiOp{
+			{Method: "GET", Path: "/blocks/stream", Summary: "Blocks as newline-delimited JSON, streamed as they are read; ends early at a reorg", Params: []apiParam{
+				queryParam("from", "integer", "first height"),
+				queryParam("to", "integer", "last height"),
+			}, ContentType: ndjsonContentType},
+		}},
+		{"/blocks/latest", handleLatestBlock, []apiOp{
+			{Method: "GET", Path: "/blocks/latest", Summary: "The tip block", Response: Block{}, ETag: tipETag},
+		}},
+		{"/height", handleHeight, []apiOp{
+			{Method: "GET", Path: "/height", Summary: "The height and hash of the tip", ETag: tipETag},
+		}},
+		{"/blocks/", handleBlockPath, []apiOp{
+			{Method: "GET", Path: "/blocks/{index}", Summary: "A block by height", Params: []apiParam{pathParam("index", "block height")}, Response: Block{}, ETag: tipETag},
+			{Method: "GET", Path: "/blocks/hash/{hash}", Summary: "A block by hash", Params: []apiParam{pathParam("hash", "block hash")}, Response: Block{}, ETag: tipETag},
+			{Method: "GET", Path: "/blocks/{index}/verify", Mux: "/blocks/{index}/{check}", Summary: "Recompute the hash and merkle root of a block", Params: []apiParam{pathParam("index", "block height")}, Response: blockAudit{}, ETag: tipETag},
+		}},
+		{"/pending", handleGetPending, []apiOp{
+			{Method: "GET", Path: "/pending", Summary: "The mempool, as raw transactions or, verbose, as entries in mining order", Params: []apiParam{
+				queryParam("verbose", "boolean", "return mempool entries with fees and arrival times"),
+			}, Response: apiOneOf{[]string{}, []mempoolEntry{}}, ETag: mempoolETag},
+		}},
+		{"/pending/", handleCancelPending, []apiOp{
+			{Method: "DELETE", Path: "/pending/{id}", Summary: "Drop a transaction from the mempool", Params: []apiParam{pathParam("id", "transaction ID")}},
+		}},
+		{"/fees/estimate", handleFeeEstimate, []apiOp{
+			{Method: "GET", Path: "/fees/estimate", Summary: "Fee rates likely to get into the next blocks"},
+		}},
+		{"/search", handleSearch, []apiOp{
+			{Method: "GET", Path: "/search", Summary: "Confirmed transactions containing a string or touching an address", Params: []apiParam{
+				queryParam("q", "string", "text or address to look for"),
+			}, Response: []searchMatch{}},
+		}},
+		{"/graphql", handleGraphQL, []apiOp{
+			{Method: "POST", Path: "/graphql", Summary: "Run a GraphQL query", Body: gqlRequest{}},
+			{Method: "GET", Path: "/graphql", Summary: "The GraphQL schema, or with query, run that query", Params: []apiParam{
+				queryParam("query", "string", "the query"),
+				queryParam("variables", "string", "variables as a JSON object"),
+				queryParam("operationName", "string", "operation to run"),
+			}, ContentType: "text/plain"},
+		}},
+		{"/rpc", handleRPC, []apiOp{
+			{Method: "POST", Path: "/rpc", Summary: "JSON-RPC 2.0 call or batch; 204 if every call is a notification", Body: apiOneOf{rpcRequest{}, []rpcRequest{}}, Response: apiOneOf{rpcResponse{}, []rpcResponse{}}},
+		}},
+		{"/balance/", handleGetBalance, []apiOp{
+			{Method: "GET", Path: "/balance/{address}", Summary: "Balance and nonce of an account", Params: []apiParam{pathParam("address", "account address"), heightParam}, ETag: tipETag},
+		}},
+		{"/address/", handleAddress, []apiOp{
+			{Method: "GET", Path: "/address/{address}/history", Summary: "Transactions touching an account, newest first", Params: []apiParam{
+				pathParam("address", "account address"),
+				queryParam("limit", "integer", "page size"),
+				queryParam("offset", "integer", "entries to skip"),
+			}, ETag: tipETag},
+		}},
+		{"/tokens/", handleTokens, []apiOp{
+			{Method: "GET", Path: "/tokens/{symbol}", Summary: "A token", Params: []apiParam{pathParam("symbol", "token symbol")}, Response: tokenInfo{}, ETag: tipETag},
+			{Method: "GET", Path: "/tokens/{symbol}/balance/{address}", Summary: "Token balance of an account", Params: []apiParam{
+				pathParam("symbol", "token symbol"),
+				pathParam("address", "account address"),
+				heightParam,
+			}, ETag: tipETag},
+		}},
+		{"/assets/", handleGetAsset, []apiOp{
+			{Method: "GET", Path: "/assets/{id}", Summary: "A non-fungible asset and its history", Params: []apiParam{pathParam("id", "asset ID")}, Response: assetInfo{}, ETag: tipETag},
+		}},
+		{"/wallet/new", handleNewWallet, []apiOp{
+			{Method: "POST", Path: "/wallet/new", Summary: "Generate a key pair, or with hd, a mnemonic", Params: []apiParam{
+				queryParam("hd", "boolean", "generate a BIP-39 mnemonic and its first account"),
+			}},
+		}},
+		{"/wallet/derive", handleDeriveWallet, []apiOp{
+			{Method: "POST", Path: "/wallet/derive", Summary: "Derive accounts from a mnemonic", Body: deriveRequest{}, Response: []hdAccount{}},
+		}},
+		{"/events/recent", handleRecentEvents, []apiOp{
+			{Method: "GET", Path: "/events/recent", Summary: "Recent events after an ID", Params: []apiParam{
+				queryParam("since", "integer", "last event ID seen"),
+			}, Response: []Event{}},
+		}},
+		{"/ws", handleEventSocket, []apiOp{
+			{Method: "GET", Path: "/ws", Summary: "WebSocket stream of events as JSON messages", Params: []apiParam{
+				queryParam("since", "integer", "replay the events after this ID first"),
+				queryParam("types", "string", "comma-separated event types to send"),
+			}, Status: http.StatusSwitchingProtocols},
+		}},
+		{"/events", handleEventStream, []apiOp{
+			{Method: "GET", Path: "/events", Summary: "Server-Sent Events stream of events, resuming from Last-Event-ID", Params: []apiParam{
+				queryParam("since", "integer", "replay the events after this ID first"),
+				queryParam("types", "string", "comma-separated event types to send"),
+			}, ContentType: "text/event-stream"},
+		}},
+		{"/export/transactions.csv", handleExportTransactions, []apiOp{
+			{Method: "GET", Path: "/export/transactions.csv", Summary: "The transactions of a height range as CSV, one row each", Params: []apiParam{
+				queryParam("from", "integer", "first height"),
+				queryParam("to", "integer", "last height"),
+			}, ContentType: "text/csv", ETag: tipETag},
+		}},
+		{"/validators", handleValidators, []apiOp{
+			{Method: "GET", Path: "/validators", Summary: "Staked validators and the next proposer", ETag: tipETag},
+		}},
+		{"/supply", handleSupply, []apiOp{
+			{Method: "GET", Path: "/supply", Summary: "Coins issued so far and the issuance schedule", ETag: tipETag},
+		}},
+		{"/peers", handlePeers, []apiOp{
+			{Method: "GET", Path: "/peers", Summary: "The peer table with health data"},
+			{Method: "POST", Path: "/peers", Summary: "Add peers after a handshake", Body: addPeersRequest{}},
+			{Method: "DELETE", Path: "/peers", Summary: "Remove a peer", Params: []apiParam{queryParam("url", "string", "peer URL")}},
+		}},
+		{"/peers/tx", handleRelayedTx, []apiOp{
+			{Method: "POST", Path: "/peers/tx", Summary: "Receive a transaction relayed by a peer", Body: relayedTx{}},
+		}},
+		{"/peers/ws", handlePeerLink, []apiOp{
+			{Method: "GET", Path: "/peers/ws", Summary: "WebSocket link between peers", Status: http.StatusSwitchingProtocols},
+		}},
+		{"/peers/bans", handleBans, []apiOp{
+			{Method: "GET", Path: "/peers/bans", Summary: "Banned peer hosts"},
+			{Method: "POST", Path: "/peers/bans", Summary: "Ban a host for the ban duration, dropping its peers", Params: []apiParam{
+				queryParam("host", "string", "host to ban"),
+				queryParam("reason", "string", "why, for the ban list"),
+			}},
+			{Method: "DELETE", Path: "/peers/bans", Summary: "Lift a ban", Params: []apiParam{queryParam("host", "string", "banned host")}},
+		}},
+		{"/resolve", handleResolve, []apiOp{
+			{Method: "GET", Path: "/resolve", Summary: "Switch to the peers' chain if it has more work", Response: resolveResult{}},
+		}},
+		{"/orphans", handleOrphans, []apiOp{
+			{Method: "GET", Path: "/orphans", Summary: "Blocks held until their parent arrives", Response: []Block{}},
+		}},
+		{"/headers", handleGetHeaders, []apiOp{
+			{Method: "GET", Path: "/headers", Summary: "Block headers of a height range", Params: []apiParam{
+				queryParam("from", "integer", "first height"),
+				queryParam("to", "integer", "last height"),
+			}, Response: []Block{}, ETag: tipETag},
+		}},
+		{"/handshake", handleHandshake, []apiOp{
+			{Method: "GET", Path: "/handshake", Summary: "What this node tells peers about itself", Response: hello{}},
+		}},
+		{"/healthz", handleHealthz, []apiOp{
+			{Method: "GET", Path: "/healthz", Summary: "Liveness: 200 while the process serves requests", Response: liveness{}},
+		}},
+		{"/readyz", handleReadyz, []apiOp{
+			{Method: "GET", Path: "/readyz", Summary: "Readiness: chain loaded, storage writable, not syncing far behind a peer; 503 with the failing checks if not", Response: readiness{}},
+		}},
+		{"/stats", handleStats, []apiOp{
+			{Method: "GET", Path: "/stats", Summary: "Chain identity and tip, difficulty, transaction, mempool and peer counts, uptime and average block time in seconds"},
+		}},
+		{"/stats/timeseries", handleTimeseries, []apiOp{
+			{Method: "GET", Path: "/stats/timeseries", Summary: "Blocks per hour, and transactions and difficulty per day, for charts", Params: []apiParam{
+				queryParam("hours", "integer", "hours of blocks per hour, 24 by default"),
+				queryParam("days", "integer", "days of transactions and difficulty per day, 30 by default"),
+			}, Response: chainTimeseries{}},
+		}},
+		{"/snapshot", handleSnapshot, []apiOp{
+			{Method: "GET", Path: "/snapshot", Summary: "The account state at the tip, for fast sync", Response: chainState{}},
+		}},
+		{"/validate", handleValidate, []apiOp{
+			{Method: "GET", Path: "/validate", Summary: "Audit the whole chain", Params: []apiParam{
+				queryParam("download", "boolean", "send the report as a file attachment"),
+			}, Response: validationReport{}},
+		}},
+		{"/admin/keys", handleAPIKeys, []apiOp{
+			{Method: "GET", Path: "/admin/keys", Summary: "List the API keys by name and role; admin only"},
+			{Method: "POST", Path: "/admin/keys", Summary: "Create an API key with a role, shown only in this answer; admin only", Body: newKeyRequest{}, Response: apiKey{}, Status: http.StatusCreated},
+			{Method: "DELETE", Path: "/admin/keys", Summary: "Revoke an API key; admin only", Params: []apiParam{queryParam("name", "string", "key name")}},
+		}},
+		{"/admin/tokens", handleIssueToken, []apiOp{
+			{Method: "POST", Path: "/admin/tokens", Summary: "Sign a bearer token with a role; admin only", Body: tokenRequest{}, Status: http.StatusCreated},
+		}},
+		{"/openapi.json", handleOpenAPI, []apiOp{
+			{Method: "GET", Path: "/openapi.json", Summary: "This description of the API, as OpenAPI 3"},
+		}},
+		{"/docs", handleDocs, []apiOp{
+			{Method: "GET", Path: "/docs", Summary: "This description of the API, as a web page", ContentType: "text/html"},
+		}},
+	}
+	apiVersions = []apiVersion{{Prefix: "/v1", Routes: v1Routes}}
+	legacyAPI = apiVersions[0]
+}
+
+type apiVersionKey struct{}
+
+// apiVersionOf returns the version a request was routed to.
+func apiVersionOf(r *http.Request) apiVersion {
+	if v, ok := r.Context().Value(apiVersionKey{}).(apiVersion); ok {
+		return v
+	}
+	return legacyAPI
+}
+
+// probeRoutes are the health probes. Probes are unversioned by convention,
+// so their unversioned paths are not deprecated.
+var probeRoutes = map[string]bool{"/healthz": true, "/readyz": true}
+
+// registerRoutes serves each version under its prefix on the default mux,
+// and the routes of legacyAPI at their unversioned paths as well. Those
+// answers, but for probeRoutes, carry a Deprecation header and a Link to
+// the versioned path. Operations onAdminListener are served the same way
+// on adminMux instead.
+func registerRoutes() {
+	for _, v := range apiVersions {
+		public, admin := http.NewServeMux(), http.NewServeMux()
+		for _, rt := range v.Routes {
+			if len(rt.Ops) == 0 {
+				log.Fatalf("route %s%s has no documented operations", v.Prefix, rt.Pattern)
+			}
+			for _, op := range rt.Ops {
+				mux := public
+				if onAdminListener(rt.Pattern, op) {
+					mux = admin
+				}
+				mux.HandleFunc(op.muxPattern(), limitRequests(rt.Pattern, requireRole(rt.Pattern, op.handler(rt.Handler))))
+			}
+		}
+		serveVersion(http.DefaultServeMux, v, public)
+		serveVersion(adminMux, v, admin)
+	}
+	for _, rt := range legacyAPI.Routes {
+		for _, op := range rt.Ops {
+			root := http.DefaultServeMux
+			if onAdminListener(rt.Pattern, op) {
+				root = adminMux
+			}
+			handler := limitRequests(rt.Pattern, requireRole(rt.Pattern, op.handler(rt.Handler)))
+			if probeRoutes[rt.Pattern] {
+				root.HandleFunc(op.muxPattern(), handler)
+				continue
+			}
+			root.HandleFunc(op.muxPattern(), func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Deprecation", "true")
+				w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", legacyAPI.Prefix, r.URL.Path))
+				handler(w, r)
+			})
+		}
+	}
+}
+
+// serveVersion serves mux, the routes of v, under v's prefix on root.
+func serveVersion(root *http.ServeMux, v apiVersion, mux *http.ServeMux) {
+	// Handlers parse their paths unversioned, so the prefix is stripped.
+	versioned := http.StripPrefix(v.Prefix, mux)
+	root.HandleFunc(v.Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		versioned.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	})
+}
+
+// handler is the route handler h as op serves it, tagged if op has ETag.
+func (op apiOp) handler(h http.HandlerFunc) http.HandlerFunc {
+	if op.ETag == nil {
+		return h
+	}
+	return withETag(op.ETag, h)
+}
+
+// muxPattern is the ServeMux pattern of op. Its path parameters are mux
+// wildcards, which handlers read with r.PathValue, and a request for the
+// path with another method gets 405. The root matches only itself, not
+// every path.
+func (op apiOp) muxPattern() string {
+	switch {
+	case op.Mux != "":
+		return op.Method + " " + op.Mux
+	case op.Path == "/":
+		return op.Method + " /{$}"
+	}
+	return op.Method + " " + op.Path
+}
+
+// apiSchemas collects the named types an OpenAPI document refers to, by
+// type name.
+type apiSchemas map[string]interface{}
+
+func (s apiSchemas) of(v interface{}) interface{} {
+	if alts, ok := v.(apiOneOf); ok {
+		list := make([]interface{}, len(alts))
+		for i, alt := range alts {
+			list[i] = s.of(alt)
+		}
+		return map[string]interface{}{"oneOf": list}
+	}
+	if v == nil {
+		return map[string]interface{}{"type": "object"}
+	}
+	return s.typeSchema(reflect.TypeOf(v))
+}
+
+func (s apiSchemas) typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		if _, seen := s[t.Name()]; !seen {
+			// Claim the name first, so a type that refers to itself ends.
+			s[t.Name()] = nil
+			s[t.Name()] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// An interface{} field holds any JSON value.
+	return map[string]interface{}{}
+}
+
+// structSchema describes the JSON encoding of a struct, following its json
+// tags.
+func (s apiSchemas) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, v := range s.structSchema(f.Type)["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.typeSchema(f.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// operationID names an operation for client generators, e.g. getTxById
+// for GET /tx/{id}.
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "{") {
+			id += "By"
+			part = strings.Trim(part, "{}")
+		}
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool { return r == '_' || r == '.' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	if id == strings.ToLower(method) {
+		id += "Root"
+	}
+	return id
+}
+
+func (op apiOp) status() int {
+	if op.Status == 0 {
+		return http.StatusOK
+	}
+	return op.Status
+}
+
+func (op apiOp) contentType() string {
+	if op.ContentType == "" {
+		return "application/json"
+	}
+	return op.ContentType
+}
+
+// openAPISpec builds the OpenAPI 3 document for a version.
+func openAPISpec(v apiVersion) map[string]interface{} {
+	schemas := apiSchemas{}
+	paths := map[string]map[string]interface{}{}
+	for _, rt := range v.Routes {
+		for _, op := range rt.Ops {
+			operation := map[string]interface{}{
+				"summary":     op.Summary,
+				"operationId": operationID(op.Method, op.Path),
+			}
+			if role := requiredRole(rt.Pattern, op.Method); role != "" {
+				operation["security"] = []interface{}{
+					map[string]interface{}{"bearer": []string{}},
+					map[string]interface{}{"apiKey": []string{}},
+				}
+				operation["x-required-role"] = role
+			}
+			if onAdminListener(rt.Pattern, op) {
+				operation["x-listener"] = "admin"
+			}
+			if len(op.Params) > 0 {
+				var params []interface{}
+				for _, p := range op.Params {
+					params = append(params, map[string]interface{}{
+						"name":        p.Name,
+						"in":          p.In,
+						"required":    p.In == "path",
+						"description": p.Description,
+						"schema":      map[string]interface{}{"type": p.Type},
+					})
+				}
+				operation["parameters"] = params
+			}
+			if op.Body != nil {
+				operation["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": schemas.of(op.Body)},
+					},
+				}
+			}
+			response := map[string]interface{}{"description": http.StatusText(op.status())}
+			switch {
+			case op.status() == http.StatusSwitchingProtocols:
+			case op.contentType() == "application/json":
+				response["content"] = map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.of(op.Response)},
+				}
+			default:
+				response["content"] = map[string]interface{}{
+					op.contentType(): map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				}
+			}
+			responses := map[string]interface{}{
+				strconv.Itoa(op.status()): response,
+				"default":                 map[string]interface{}{"$ref": "#/components/responses/Error"},
+			}
+			if op.ETag != nil {
+				responses["304"] = map[string]interface{}{"description": "Not modified since the ETag sent in If-None-Match"}
+			}
+			operation["responses"] = responses
+			if paths[op.Path] == nil {
+				paths[op.Path] = map[string]interface{}{}
+			}
+			paths[op.Path][strings.ToLower(op.Method)] = operation
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   BlockchainName + " API",
+			"version": strings.TrimPrefix(v.Prefix, "/"),
+		},
+		"servers": []interface{}{map[string]interface{}{"url": v.Prefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "The request failed; the body is the reason as plain text",
+					"content": map[string]interface{}{
+						"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// handleOpenAPI serves GET /openapi.json, the description of the version
+// it is requested under.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(openAPISpec(apiVersionOf(r)))
+}
+
+// apiTypeName is how /docs names the type of a body.
+func apiTypeName(v interface{}) string {
+	if alts, ok := v.(apiOneOf); ok {
+		names := make([]string, len(alts))
+		for i, alt := range alts {
+			names[i] = apiTypeName(alt)
+		}
+		return strings.Join(names, " or ")
+	}
+	if v == nil {
+		return "object"
+	}
+	return strings.ReplaceAll(reflect.TypeOf(v).String(), "main.", "")
+}
+
+// handleDocs serves GET /docs, the API description as a web page: every
+// operation, then the schemas of the types they use.
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	v := apiVersionOf(r)
+	esc := html.EscapeString
+	var b strings.Builder
+	title := esc(BlockchainName + " API " + strings.TrimPrefix(v.Prefix, "/"))
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n", title)
+	b.WriteString("<style>body{font-family:sans-serif;max-width:60em;margin:auto;padding:1em}" +
+		"section{border-top:1px solid #ccc;padding:.5em 0}code,pre{background:#f4f4f4}" +
+		".method{display:inline-block;min-width:4.5em;font-weight:bold}" +
+		"table{border-collapse:collapse}td{padding:.1em .8em .1em 0;vertical-align:top}</style></head><body>\n")
+	fmt.Fprintf(&b, "<h1>%s</h1>\n<p>The machine-readable description is at <a href=\"%[2]s/openapi.json\">%[2]s/openapi.json</a>. "+
+		"Errors are sent as plain text with a 4xx or 5xx status.</p>\n", title, v.Prefix)
+	for _, rt := range v.Routes {
+		for _, op := range rt.Ops {
+			fmt.Fprintf(&b, "<section id=\"%s\"><h3><span class=\"method\">%s</span><code>%s</code></h3>\n<p>%s</p>\n",
+				operationID(op.Method, op.Path), op.Method, esc(v.Prefix+op.Path), esc(op.Summary))
+			if len(op.Params) > 0 {
+				b.WriteString("<table>\n")
+				for _, p := range op.Params {
+					fmt.Fprintf(&b, "<tr><td><code>%s</code></td><td>%s %s</td><td>%s</td></tr>\n", esc(p.Name), p.In, p.Type, esc(p.Description))
+				}
+				b.WriteString("</table>\n")
+			}
+			if role := requiredRole(rt.Pattern, op.Method); role != "" {
+				fmt.Fprintf(&b, "<p>Needs the %s role, from a bearer token or an API key in the %s header.</p>\n", role, apiKeyHeader)
+			}
+			if onAdminListener(rt.Pattern, op) {
+				b.WriteString("<p>Served on the admin listener, not the public API.</p>\n")
+			}
+			if op.Body != nil {
+				fmt.Fprintf(&b, "<p>Body: <code>%s</code></p>\n", esc(apiTypeName(op.Body)))
+			}
+			response := op.contentType()
+			if op.contentType() == "application/json" {
+				response = apiTypeName(op.Response)
+			}
+			if op.status() == http.StatusSwitchingProtocols {
+				response = "WebSocket upgrade"
+			}
+			if op.ETag != nil {
+				b.WriteString("<p>Sends an ETag; while nothing changed, If-None-Match with it gets 304.</p>\n")
+			}
+			fmt.Fprintf(&b, "<p>%d: <code>%s</code></p></section>\n", op.status(), esc(response))
+		}
+	}
+	schemas := openAPISpec(v)["components"].(map[string]interface{})["schemas"].(apiSchemas)
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("<h2>Schemas</h2>\n")
+	for _, name := range names {
+		data, _ := json.MarshalIndent(schemas[name], "", "  ")
+		fmt.Fprintf(&b, "<section id=\"schema-%s\"><h3>%s</h3><pre>%s</pre></section>\n", name, name, esc(string(data)))
+	}
+	b.WriteString("</body></html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
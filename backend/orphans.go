@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// maxOrphans bounds the orphan pool; the oldest orphan is dropped first.
+const maxOrphans = 100
+
+const (
+	// maxDeferredBlocks bounds how many blocks ahead of this node's clock
+	// wait to be received again.
+	maxDeferredBlocks = 100
+	// maxBlockDeferral is the longest such a block is waited for.
+	maxBlockDeferral = 10 * time.Minute
+)
+
+var (
+	errOrphanBlock   = errors.New("parent block unknown, kept as orphan while syncing ancestors")
+	errDeferredBlock = errors.New("block timestamp is ahead of this node's clock, kept until it is not")
+)
+
+// deferredBlocks holds the hashes of the blocks deferBlock is waiting on.
+// It is guarded by mutex.
+var deferredBlocks = map[string]bool{}
+
+// deferBlock receives b from host from again once its timestamp is within
+// maxFutureBlockTime of this node's clock, and reports whether it will. A
+// block that would have to wait longer than maxBlockDeferral, or arrives
+// while maxDeferredBlocks are waiting, is dropped. The caller must hold
+// mutex.
+func deferBlock(b Block, from string) bool {
+	if deferredBlocks[b.Hash] {
+		return true
+	}
+	wait := time.Until(time.Unix(b.Timestamp, 0).Add(-maxFutureBlockTime)) + time.Second
+	if wait > maxBlockDeferral || len(deferredBlocks) >= maxDeferredBlocks {
+		return false
+	}
+	deferredBlocks[b.Hash] = true
+	time.AfterFunc(wait, func() {
+		mutex.Lock()
+		delete(deferredBlocks, b.Hash)
+		mutex.Unlock()
+		receiveBlock(b, from)
+	})
+	return true
+}
+
+// orphanPool holds blocks received ahead of their parent, in arrival order,
+// until the missing ancestors have been synced. It is guarded by mutex.
+type orphanPool struct {
+	blocks map[string]Block
+	order  []string
+}
+
+var orphans = &orphanPool{blocks: map[string]Block{}}
+
+func (p *orphanPool) add(b Block) {
+	if _, ok := p.blocks[b.Hash]; ok {
+		return
+	}
+	if len(p.order) >= maxOrphans {
+		p.remove(p.order[0])
+	}
+	p.blocks[b.Hash] = b
+	p.order = append(p.order, b.Hash)
+}
+
+func (p *orphanPool) remove(hash string) {
+	if _, ok := p.blocks[hash]; !ok {
+		return
+	}
+	delete(p.blocks, hash)
+	for i, h := range p.order {
+		if h == hash {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// childOf returns the earliest received orphan whose parent is hash.
+func (p *orphanPool) childOf(hash string) (Block, bool) {
+	for _, h := range p.order {
+		if b := p.blocks[h]; b.PrevHash == hash {
+			return b, true
+		}
+	}
+	return Block{}, false
+}
+
+// list returns the orphans in arrival order.
+func (p *orphanPool) list() []Block {
+	out := make([]Block, 0, len(p.order))
+	for _, h := range p.order {
+		out = append(out, p.blocks[h])
+	}
+	return out
+}
+
+// checkOrphan runs the checks that do not need the block's parent, so the
+// pool cannot be filled with blocks that could never be valid. The caller
+// must hold mutex.
+func checkOrphan(b Block) error {
+	if err := checkCheckpoint(b); err != nil {
+		return err
+	}
+	if err := checkMerkleVersion(Block{}, b); err != nil {
+		return err
+	}
+	if err := checkBlockFormat(Block{}, b); err != nil {
+		return err
+	}
+	if b.MerkleRoot != blockMerkleRoot(b) {
+		return errMerkleMismatch
+	}
+	if b.Hash != computeHash(b) {
+		return errors.New("hash does not match the block header")
+	}
+	if chainConsensus == consensusPoW && !hashMeetsTarget(b.Hash, blockTarget(b)) {
+		return errors.New("hash does not meet the target")
+	}
+	return nil
+}
+
+// attachOrphans appends every orphan that now extends the tip, following
+// chains of orphans, and drops the ones that turn out invalid. The caller
+// must hold mutex.
+func attachOrphans() {
+	for {
+		b, ok := orphans.childOf(getLastBlock().Hash)
+		if !ok {
+			return
+		}
+		orphans.remove(b.Hash)
+		if err := checkNextBlock(b); err != nil {
+			continue
+		}
+		appendBlock(b)
+	}
+}
+
+// handleOrphans serves GET /orphans, the blocks waiting for their parent.
+func handleOrphans(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	json.NewEncoder(w).Encode(orphans.list())
+}
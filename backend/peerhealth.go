@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// peerCheckInterval is how often every peer is pinged; 0 disables the
+	// checks.
+	peerCheckInterval = 30 * time.Second
+	// peerMaxFailures is how many checks in a row a peer may fail before
+	// it is dropped.
+	peerMaxFailures = 3
+)
+
+// runPeerHealthChecks repeats the handshake with every peer each interval,
+// recording latency, last-seen time and height. Peers that keep failing,
+// or turn out to be on another chain, are dropped.
+func runPeerHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for _, peer := range peers.list() {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				start := time.Now()
+				h, err := handshake(peer)
+				failures := peers.recordCheck(peer, h.Height, time.Since(start), err)
+				if errors.Is(err, errIncompatiblePeer) {
+					log.Printf("dropping peer %s: %v", peer, err)
+					peers.remove(peer)
+				} else if peerMaxFailures > 0 && failures >= peerMaxFailures {
+					log.Printf("dropping peer %s after %d failed checks: %v", peer, failures, err)
+					peers.remove(peer)
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// peerPingInterval is how often an idle link is pinged, so a dead
+	// connection is noticed and replaced.
+	peerPingInterval = 30 * time.Second
+	// peerLinkMinBackoff and peerLinkMaxBackoff bound the wait between
+	// reconnection attempts, which doubles after each failure.
+	peerLinkMinBackoff = time.Second
+	peerLinkMaxBackoff = time.Minute
+)
+
+// peerMessage is what nodes push to each other over a WebSocket link.
+type peerMessage struct {
+	Type    string        `json:"type"`
+	Block   *Block        `json:"block,omitempty"`
+	Compact *compactBlock `json:"compact,omitempty"`
+	Tx      *relayedTx    `json:"tx,omitempty"`
+	// Height and Hash name the block a "getblock" message asks for.
+	Height int    `json:"height,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// peerLink keeps a WebSocket connection open to one peer, dialing it again
+// with backoff whenever it drops.
+type peerLink struct {
+	peer string
+	stop chan struct{}
+
+	mu   sync.Mutex
+	conn *wsConn
+}
+
+var (
+	linksMu sync.Mutex
+	links   = map[string]*peerLink{}
+)
+
+func startPeerLink(peer string) {
+	linksMu.Lock()
+	defer linksMu.Unlock()
+	if _, ok := links[peer]; ok {
+		return
+	}
+	l := &peerLink{peer: peer, stop: make(chan struct{})}
+	links[peer] = l
+	go l.run()
+}
+
+func stopPeerLink(peer string) {
+	linksMu.Lock()
+	l, ok := links[peer]
+	delete(links, peer)
+	linksMu.Unlock()
+	if !ok {
+		return
+	}
+	close(l.stop)
+	if c := l.current(); c != nil {
+		c.close()
+	}
+}
+
+// linkTo returns the open connection to peer, if any.
+func linkTo(peer string) *wsConn {
+	linksMu.Lock()
+	l, ok := links[peer]
+	linksMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return l.current()
+}
+
+func (l *peerLink) current() *wsConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn
+}
+
+func (l *peerLink) set(c *wsConn) {
+	l.mu.Lock()
+	l.conn = c
+	l.mu.Unlock()
+}
+
+func (l *peerLink) run() {
+	wsURL := "ws" + strings.TrimPrefix(l.peer, "http") + "/peers/ws"
+	header := http.Header{}
+	setHelloHeaders(header)
+	backoff := peerLinkMinBackoff
+	for {
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		conn, err := dialWebSocket(wsURL, header, peerTimeout)
+		if err != nil {
+			select {
+			case <-l.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > peerLinkMaxBackoff {
+				backoff = peerLinkMaxBackoff
+			}
+			continue
+		}
+		backoff = peerLinkMinBackoff
+		l.set(conn)
+		done := make(chan struct{})
+		go keepAlive(conn, done)
+		readPeerMessages(conn, hostOf(l.peer))
+		close(done)
+		l.set(nil)
+		conn.close()
+	}
+}
+
+// keepAlive pings conn until done is closed or a ping fails, in which case
+// the connection is closed so its reader gives up.
+func keepAlive(conn *wsConn, done chan struct{}) {
+	ticker := time.NewTicker(peerPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.ping(); err != nil {
+				conn.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// readPeerMessages handles messages from host's conn until it fails,
+// closes, goes quiet for two ping intervals or host gets banned.
+func readPeerMessages(conn *wsConn, host string) {
+	conn.readTimeout = 2 * peerPingInterval
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			return
+		}
+		var msg peerMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch {
+		case msg.Type == "block" && msg.Block != nil:
+			receiveBlock(*msg.Block, host)
+		case msg.Type == "cmpctblock" && msg.Compact != nil:
+			h := msg.Compact.Header
+			if errors.Is(receiveCompactBlock(*msg.Compact, host), errMissingTransactions) {
+				writePeerMessage(conn, peerMessage{Type: "getblock", Height: h.Index, Hash: h.Hash})
+			}
+		case msg.Type == "getblock":
+			if b, ok := blockAt(msg.Height, msg.Hash); ok {
+				writePeerMessage(conn, peerMessage{Type: "block", Block: &b})
+			}
+		case msg.Type == "tx" && msg.Tx != nil:
+			receiveRelayedTx(*msg.Tx, host)
+		}
+		if bans.banned(host) {
+			return
+		}
+	}
+}
+
+func writePeerMessage(conn *wsConn, msg peerMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return conn.writeMessage(data)
+}
+
+// sendToPeer pushes msg over the WebSocket link to peer when one is open,
+// and otherwise posts v to path over plain HTTP. A 412 answer, from a peer
+// unable to rebuild a compact block, is returned as errMissingTransactions.
+func sendToPeer(peer string, msg peerMessage, path string, v interface{}) error {
+	if conn := linkTo(peer); conn != nil {
+		if err := writePeerMessage(conn, msg); err == nil {
+			return nil
+		}
+		// Unblock the link's reader so it reconnects.
+		conn.conn.Close()
+	}
+	status, err := postToPeer(peer, path, v)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusPreconditionFailed {
+		return errMissingTransactions
+	}
+	if status >= 300 {
+		return fmt.Errorf("status %d", status)
+	}
+	return nil
+}
+
+// handlePeerLink serves GET /peers/ws, the WebSocket endpoint other nodes
+// keep open to push blocks and transactions. Only nodes identifying as
+// being on this chain may connect.
+func handlePeerLink(w http.ResponseWriter, r *http.Request) {
+	if bans.banned(remoteHost(r)) {
+		http.Error(w, errPeerBanned.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkPeerRequest(r, true); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+	readPeerMessages(conn, remoteHost(r))
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peerTimeout bounds every request made to another node.
+const peerTimeout = 5 * time.Second
+
+var peerClient = &http.Client{
+	Timeout:   peerTimeout,
+	Transport: helloTransport{http.DefaultTransport},
+}
+
+// peerInfo is what a node knows about one peer. The health fields are
+// updated by runPeerHealthChecks.
+type peerInfo struct {
+	URL       string  `json:"url"`
+	AddedAt   int64   `json:"added_at"`
+	LastSeen  int64   `json:"last_seen,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Height    int     `json:"height"`
+	Failures  int     `json:"failures"`
+	Linked    bool    `json:"linked"`
+}
+
+// peerSet holds the nodes this node exchanges blocks with, keyed by base
+// URL. It has its own lock so that talking to peers never waits on mutex.
+type peerSet struct {
+	mu    sync.Mutex
+	peers map[string]*peerInfo
+}
+
+var peers = &peerSet{peers: map[string]*peerInfo{}}
+
+// add registers a peer, opening a link to it, and reports whether it was
+// new.
+func (p *peerSet) add(u string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.peers[u]; ok {
+		return false
+	}
+	p.peers[u] = &peerInfo{URL: u, AddedAt: time.Now().Unix(), Height: -1}
+	startPeerLink(u)
+	return true
+}
+
+func (p *peerSet) remove(u string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.peers[u]; !ok {
+		return false
+	}
+	delete(p.peers, u)
+	stopPeerLink(u)
+	return true
+}
+
+// removeHost drops every peer on host.
+func (p *peerSet) removeHost(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for u := range p.peers {
+		if hostOf(u) == host {
+			delete(p.peers, u)
+			stopPeerLink(u)
+		}
+	}
+}
+
+// list returns the registered peer URLs in sorted order.
+func (p *peerSet) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]string, 0, len(p.peers))
+	for u := range p.peers {
+		out = append(out, u)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// hasHost reports whether addr, the address a request came from, is that
+// of a registered peer. Peers registered by name are resolved.
+func (p *peerSet) hasHost(addr string) bool {
+	p.mu.Lock()
+	hosts := make([]string, 0, len(p.peers))
+	for u := range p.peers {
+		hosts = append(hosts, hostOf(u))
+	}
+	p.mu.Unlock()
+	for _, h := range hosts {
+		if h == addr {
+			return true
+		}
+		ips, _ := net.LookupHost(h)
+		for _, ip := range ips {
+			if ip == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// table returns a copy of every peer's record, sorted by URL.
+func (p *peerSet) table() []peerInfo {
+	p.mu.Lock()
+	out := make([]peerInfo, 0, len(p.peers))
+	for _, info := range p.peers {
+		out = append(out, *info)
+	}
+	p.mu.Unlock()
+	for i := range out {
+		out[i].Linked = linkTo(out[i].URL) != nil
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+// recordCheck stores the outcome of a health check and reports how many
+// checks in a row the peer has now failed.
+func (p *peerSet) recordCheck(u string, height int, latency time.Duration, err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.peers[u]
+	if !ok {
+		return 0
+	}
+	if err != nil {
+		info.Failures++
+		return info.Failures
+	}
+	info.Failures = 0
+	info.LastSeen = time.Now().Unix()
+	info.LatencyMs = float64(latency.Microseconds()) / 1000
+	info.Height = height
+	return 0
+}
+
+// normalizePeerURL checks that raw is an http(s) base URL and strips any
+// trailing slash, so the same node is not registered twice.
+func normalizePeerURL(raw string) (string, error) {
+	raw = strings.TrimRight(strings.TrimSpace(raw), "/")
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid peer url %q", raw)
+	}
+	return raw, nil
+}
+
+// postToPeer sends v as JSON to path on peer and returns the response
+// status.
+func postToPeer(peer, path string, v interface{}) (int, error) {
+	contentType := "application/json"
+	data, err := json.Marshal(v)
+	if b, ok := v.(Block); ok {
+		contentType, data = blockContentType, encodeBlock(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp, err := peerClient.Post(peer+path, contentType, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// outboundBlocks queues blocks for runBroadcaster. A peer only accepts a
+// block on top of its tip, so blocks are announced one at a time in the
+// order they were appended.
+var outboundBlocks = make(chan Block, 256)
+
+// broadcastBlock queues a block to be announced to every peer. If the
+// queue is full the block is dropped; peers catch up when they resolve.
+func broadcastBlock(b Block) {
+	select {
+	case outboundBlocks <- b:
+	default:
+		log.Printf("broadcast queue full, dropping block %d", b.Index)
+	}
+}
+
+// runBroadcaster sends queued blocks to all peers in parallel, finishing
+// one block before starting the next. Peers that already have a block
+// answer without relaying it further.
+func runBroadcaster() {
+	for b := range outboundBlocks {
+		var wg sync.WaitGroup
+		for _, peer := range peers.list() {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				if err := sendBlock(peer, b); err != nil {
+					log.Printf("broadcast block %d to %s: %v", b.Index, peer, err)
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
+
+var (
+	errKnownBlock      = errors.New("block already in chain")
+	errBlockNotOnTip   = errors.New("block does not extend the tip")
+	errMerkleMismatch  = errors.New("merkle root does not match the transactions")
+	errUnexpectedIndex = errors.New("block index does not follow its parent")
+)
+
+// acceptPeerBlock checks a block received from another node against the
+// tip and appends it, followed by any orphans waiting for it. The caller
+// must hold mutex.
+func acceptPeerBlock(b Block) error {
+	if b.Index >= 0 && b.Index < len(blockchain) && blockchain[b.Index].Hash == b.Hash {
+		return errKnownBlock
+	}
+	if err := checkNextBlock(b); err != nil {
+		return err
+	}
+	appendBlock(b)
+	attachOrphans()
+	outstandingWork = map[string]*workUnit{}
+	return nil
+}
+
+// checkNextBlock checks that b validly extends the current tip. The caller
+// must hold mutex.
+func checkNextBlock(b Block) error {
+	return validateBlock(getLastBlock(), b)
+}
+
+// receiveBlock accepts a block announced by a peer. A block from beyond the
+// next height, whose parent this node therefore lacks, is kept in the
+// orphan pool while the node syncs the missing ancestors from its peers in
+// the background; errOrphanBlock is returned then. A block on a fork below
+// the tip is rejected, but it may come from a branch with more work, so the
+// node resolves against its peers for that too. A block too far ahead of
+// this node's clock, which may only be behind, is received again once it
+// is not, and errDeferredBlock is returned. An invalid block counts
+// against from, the host that sent it.
+func receiveBlock(b Block, from string) error {
+	mutex.Lock()
+	err := acceptPeerBlock(b)
+	fork := false
+	if errors.Is(err, errBlockNotOnTip) {
+		if sealErr := checkOrphan(b); sealErr != nil {
+			err = sealErr
+		} else if b.Index >= len(blockchain) {
+			orphans.add(b)
+			err = errOrphanBlock
+		} else {
+			fork = true
+		}
+	}
+	if errors.Is(err, errFutureBlock) && deferBlock(b, from) {
+		err = errDeferredBlock
+	}
+	mutex.Unlock()
+	if errors.Is(err, errOrphanBlock) || fork {
+		go resolveChain()
+	}
+	if invalidBlock(err) {
+		bans.misbehave(from, scoreInvalidBlock, "invalid block: "+err.Error())
+	}
+	return err
+}
+
+// handleReceiveBlock serves POST /blocks, through which peers announce
+// newly mined blocks. An accepted block is relayed to this node's own
+// peers.
+func handleReceiveBlock(w http.ResponseWriter, r *http.Request) {
+	if bans.banned(remoteHost(r)) {
+		http.Error(w, errPeerBanned.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkPeerRequest(r, false); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	b, err := readBlock(r)
+	if err != nil {
+		http.Error(w, "invalid block", http.StatusBadRequest)
+		return
+	}
+	writeBlockResult(w, b, receiveBlock(b, remoteHost(r)))
+}
+
+// writeBlockResult answers a peer that announced b with the outcome of
+// receiving it.
+func writeBlockResult(w http.ResponseWriter, b Block, err error) {
+	switch {
+	case errors.Is(err, errKnownBlock):
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": err.Error()})
+		return
+	case errors.Is(err, errOrphanBlock), errors.Is(err, errDeferredBlock):
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": err.Error()})
+		return
+	case errors.Is(err, errBlockNotOnTip):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "block accepted",
+		"index":   b.Index,
+		"hash":    b.Hash,
+	})
+}
+
+// addPeersRequest is the body of POST /peers, one URL or several.
+type addPeersRequest struct {
+	URL  string   `json:"url"`
+	URLs []string `json:"urls"`
+}
+
+// handlePeers serves GET /peers, the peer table with health data, as well
+// as POST /peers {url} or {urls} and DELETE /peers?url=. A peer is only
+// added after a handshake shows it is on the same chain.
+func handlePeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body addPeersRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body, expected {\"url\":\"http://host:port\"}", http.StatusBadRequest)
+			return
+		}
+		if body.URL != "" {
+			body.URLs = append(body.URLs, body.URL)
+		}
+		if len(body.URLs) == 0 {
+			http.Error(w, "no peer url given", http.StatusBadRequest)
+			return
+		}
+		var normalized []string
+		var hellos []hello
+		var latencies []time.Duration
+		for _, raw := range body.URLs {
+			u, err := normalizePeerURL(raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if bans.banned(hostOf(u)) {
+				http.Error(w, u+": "+errPeerBanned.Error(), http.StatusForbidden)
+				return
+			}
+			start := time.Now()
+			h, err := handshake(u)
+			if errors.Is(err, errIncompatiblePeer) {
+				http.Error(w, u+": "+err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, u+": handshake failed: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			normalized = append(normalized, u)
+			hellos = append(hellos, h)
+			latencies = append(latencies, time.Since(start))
+		}
+		for i, u := range normalized {
+			peers.add(u)
+			peers.recordCheck(u, hellos[i].Height, latencies[i], nil)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		u, err := normalizePeerURL(r.URL.Query().Get("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !peers.remove(u) {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"peers": peers.table()})
+}
+
+// bootstrapAttempts is how many times a bootstrap peer is tried before it
+// is given up on, waiting a little longer after each failure.
+const bootstrapAttempts = 5
+
+// bootstrapPeers registers the configured peers once they answer the
+// handshake and then syncs with them.
+func bootstrapPeers(urls []string) {
+	connectPeers(urls)
+	if len(peers.list()) > 0 {
+		resolveChain()
+	}
+}
+
+// connectPeers registers each of urls once it answers the handshake,
+// retrying with backoff.
+func connectPeers(urls []string) {
+	var wg sync.WaitGroup
+	for _, raw := range urls {
+		u, err := normalizePeerURL(raw)
+		if err != nil {
+			log.Printf("bootstrap peer: %v", err)
+			continue
+		}
+		if bans.banned(hostOf(u)) {
+			log.Printf("bootstrap peer %s: %v", u, errPeerBanned)
+			continue
+		}
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			wait := peerLinkMinBackoff
+			for attempt := 1; ; attempt++ {
+				start := time.Now()
+				h, err := handshake(u)
+				if err == nil {
+					peers.add(u)
+					peers.recordCheck(u, h.Height, time.Since(start), nil)
+					return
+				}
+				if errors.Is(err, errIncompatiblePeer) || attempt == bootstrapAttempts {
+					log.Printf("bootstrap peer %s: %v", u, err)
+					return
+				}
+				time.Sleep(wait)
+				wait *= 2
+			}
+		}(u)
+	}
+	wg.Wait()
+}
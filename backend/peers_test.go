@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestPeerSetHasHost(t *testing.T) {
+	p := &peerSet{peers: map[string]*peerInfo{
+		"http://localhost:3001": {},
+		"http://10.0.0.2:3001":  {},
+	}}
+	for addr, want := range map[string]bool{
+		"127.0.0.1": true,
+		"10.0.0.2":  true,
+		"10.0.0.3":  false,
+	} {
+		if got := p.hasHost(addr); got != want {
+			t.Errorf("hasHost(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
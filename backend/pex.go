@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Peer exchange spreads the peer table across the network: every
+// peerExchangeInterval, a node with fewer than peerExchangeTarget peers
+// asks each of its peers for theirs with GET /peers and adds the nodes it
+// did not know that pass the handshake. Starting from one bootstrap peer,
+// a seed node or a neighbour found with mDNS, a node so finds the rest of
+// the network by itself, and blocks and transactions then travel over the
+// persistent links it opens to them.
+
+var (
+	// peerExchangeInterval is how often peers are asked for their peers;
+	// 0 disables peer exchange.
+	peerExchangeInterval = time.Minute
+	// peerExchangeTarget is how many peers peer exchange looks for. A
+	// node that has as many asks no further.
+	peerExchangeTarget = 8
+)
+
+const (
+	// maxExchangedPeers bounds how many addresses are taken from one
+	// peer's answer.
+	maxExchangedPeers = 100
+	// maxPeerTableBytes bounds the size of a peer's answer.
+	maxPeerTableBytes = 1 << 20
+)
+
+// nodeID is random in every run and sent in the hello, so that a node
+// given its own address by a peer recognizes it.
+var nodeID = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// runPeerExchange exchanges peers every interval.
+func runPeerExchange(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		exchangePeers()
+	}
+}
+
+// exchangePeers asks every peer for its peer table and adds the nodes on
+// this chain it did not know, until there are peerExchangeTarget peers,
+// then syncs with the new ones. Nodes the answering peer has failed to
+// reach, banned hosts and this node itself are skipped.
+func exchangePeers() {
+	known := peers.list()
+	if len(known) == 0 || len(known) >= peerExchangeTarget {
+		return
+	}
+	tried := map[string]bool{}
+	for _, u := range known {
+		tried[u] = true
+	}
+	added := 0
+	for _, peer := range known {
+		candidates, err := fetchPeerTable(peer)
+		if err != nil {
+			continue
+		}
+		for _, u := range candidates {
+			if len(known)+added >= peerExchangeTarget {
+				break
+			}
+			if tried[u] || bans.banned(hostOf(u)) {
+				continue
+			}
+			tried[u] = true
+			start := time.Now()
+			h, err := handshake(u)
+			if err != nil || h.NodeID == nodeID {
+				continue
+			}
+			if peers.add(u) {
+				log.Printf("found peer %s through %s", u, peer)
+				peers.recordCheck(u, h.Height, time.Since(start), nil)
+				added++
+			}
+		}
+	}
+	if added > 0 {
+		resolveChain()
+	}
+}
+
+// fetchPeerTable returns the URLs of the peers a peer can currently reach.
+func fetchPeerTable(peer string) ([]string, error) {
+	resp, err := peerClient.Get(peer + "/peers")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body struct {
+		Peers []peerInfo `json:"peers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPeerTableBytes)).Decode(&body); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, p := range body.Peers {
+		if len(out) == maxExchangedPeers {
+			break
+		}
+		if p.Failures > 0 {
+			continue
+		}
+		if u, err := normalizePeerURL(p.URL); err == nil {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
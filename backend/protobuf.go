@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A hand-written encoding of the protobuf messages in mesam.proto, enough
+// for the gRPC API without generated code.
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errBadProto = errors.New("malformed protobuf message")
+
+func appendProtoTag(dst []byte, field, wire int) []byte {
+	return binary.AppendUvarint(dst, uint64(field)<<3|uint64(wire))
+}
+
+// appendProtoVarint writes a varint field, leaving out the default zero
+// as proto3 does. Negative numbers take ten bytes, as for int32 and int64.
+func appendProtoVarint(dst []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return dst
+	}
+	dst = appendProtoTag(dst, field, wireVarint)
+	return binary.AppendUvarint(dst, v)
+}
+
+func appendProtoBytes(dst []byte, field int, b []byte) []byte {
+	dst = appendProtoTag(dst, field, wireBytes)
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// appendProtoString writes a string field, leaving out the empty string.
+func appendProtoString(dst []byte, field int, s string) []byte {
+	if s == "" {
+		return dst
+	}
+	return appendProtoBytes(dst, field, []byte(s))
+}
+
+// appendProtoStrings writes every entry of a repeated string field.
+func appendProtoStrings(dst []byte, field int, list []string) []byte {
+	for _, s := range list {
+		dst = appendProtoBytes(dst, field, []byte(s))
+	}
+	return dst
+}
+
+// protoField is one decoded field: its number and wire type, and its value
+// in v for varints or b for length-delimited fields.
+type protoField struct {
+	num  int
+	wire int
+	v    uint64
+	b    []byte
+}
+
+// parseProto calls fn on each field of a message in order. Fields of
+// fixed-width types are skipped, as no message here uses them.
+func parseProto(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errBadProto
+		}
+		data = data[n:]
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.v, n = binary.Uvarint(data); n <= 0 {
+				return errBadProto
+			}
+			data = data[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errBadProto
+			}
+			f.b = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errBadProto
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return errBadProto
+			}
+			data = data[4:]
+			continue
+		default:
+			return errBadProto
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeProtoBlock(b Block) []byte {
+	var dst []byte
+	dst = appendProtoVarint(dst, 1, uint64(b.Index))
+	dst = appendProtoVarint(dst, 2, uint64(b.Timestamp))
+	dst = appendProtoStrings(dst, 3, b.Transactions)
+	dst = appendProtoString(dst, 4, b.MerkleRoot)
+	dst = appendProtoString(dst, 5, b.PrevHash)
+	dst = appendProtoString(dst, 6, b.Hash)
+	dst = appendProtoVarint(dst, 7, uint64(b.Nonce))
+	dst = appendProtoVarint(dst, 8, uint64(b.Difficulty))
+	dst = appendProtoVarint(dst, 9, uint64(b.Bits))
+	dst = appendProtoVarint(dst, 10, uint64(b.MerkleVersion))
+	dst = appendProtoVarint(dst, 11, uint64(b.Format))
+	dst = appendProtoString(dst, 12, b.Algorithm)
+	dst = appendProtoString(dst, 13, b.ChainID)
+	dst = appendProtoString(dst, 14, b.Consensus)
+	dst = appendProtoStrings(dst, 15, b.Authorities)
+	dst = appendProtoString(dst, 16, b.Signer)
+	return appendProtoString(dst, 17, b.Signature)
+}
+
+// decodeProtoTransaction reads a Transaction message. Field types are not
+// checked against the schema; a field of the wrong wire type reads as its
+// zero value.
+func decodeProtoTransaction(data []byte) (Transaction, error) {
+	var tx Transaction
+	err := parseProto(data, func(f protoField) error {
+		s := string(f.b)
+		switch f.num {
+		case 1:
+			tx.Type = s
+		case 2:
+			tx.From = s
+		case 3:
+			tx.To = s
+		case 4:
+			tx.Amount = int64(f.v)
+		case 5:
+			tx.Fee = int64(f.v)
+		case 6:
+			tx.Nonce = f.v
+		case 7:
+			tx.Symbol = s
+		case 8:
+			tx.Asset = s
+		case 9:
+			tx.Data = s
+		case 10:
+			tx.Height = int(int64(f.v))
+		case 11:
+			tx.ExtraNonce = f.v
+		case 12:
+			tx.Payload = s
+		case 13:
+			tx.ContentType = s
+		case 14:
+			tx.ExpiresAt = int64(f.v)
+		case 15:
+			tx.PubKeys = append(tx.PubKeys, s)
+		case 16:
+			tx.Threshold = int(int32(f.v))
+		case 17:
+			var sig TxSignature
+			err := parseProto(f.b, func(g protoField) error {
+				switch g.num {
+				case 1:
+					sig.PubKey = string(g.b)
+				case 2:
+					sig.Signature = string(g.b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			tx.Signatures = append(tx.Signatures, sig)
+		}
+		return nil
+	})
+	return tx, err
+}
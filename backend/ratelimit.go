@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter holds a token bucket per client: each request takes a token,
+// and tokens come back at rate per second up to burst. A rate of 0
+// disables it.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	// requestLimiter applies to every API request.
+	requestLimiter = &rateLimiter{}
+	// txLimiter and mineLimiter apply to submitting transactions and to
+	// mining on request, however the API is reached, so that one client
+	// cannot keep the miner busy or flood the mempool.
+	txLimiter   = &rateLimiter{rate: 5, burst: 20}
+	mineLimiter = &rateLimiter{rate: 0.2, burst: 3}
+	// relayLimiter applies to transactions relayed by peers. A peer passes
+	// on what all of its own clients submit, so it gets more room than one
+	// client does.
+	relayLimiter = &rateLimiter{rate: 50, burst: 200}
+)
+
+// writeLimits maps the route patterns txLimiter, mineLimiter and
+// relayLimiter cover.
+var writeLimits = map[string]*rateLimiter{
+	"/tx":        txLimiter,
+	"/mine":      mineLimiter,
+	"/mine/bulk": mineLimiter,
+	"/peers/tx":  relayLimiter,
+}
+
+// allow takes a token from key's bucket. If there is none it reports how
+// long until there is.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	burst := math.Max(l.burst, 1)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	if now.Sub(l.swept) > time.Minute {
+		// A bucket that has refilled is the same as a missing one.
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// allowCall applies l to the caller recorded in ctx.
+func allowCall(ctx context.Context, l *rateLimiter) (bool, time.Duration) {
+	return l.allow(callerOf(ctx).client)
+}
+
+// retryAfterSeconds rounds a wait up to the whole seconds of Retry-After.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+func errRateLimited(wait time.Duration) error {
+	return fmt.Errorf("rate limit exceeded, retry in %ds", retryAfterSeconds(wait))
+}
+
+// limitRequests wraps the handler of a route with requestLimiter and, for
+// the routes in writeLimits, with their limiter as well. Over the limit,
+// the client gets 429 and a Retry-After header.
+func limitRequests(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = withCaller(r)
+		key := callerOf(r.Context()).client
+		ok, wait := requestLimiter.allow(key)
+		if l := writeLimits[pattern]; ok && l != nil {
+			ok, wait = l.allow(key)
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			http.Error(w, errRateLimited(wait).Error(), http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+// forkPoint returns the first height at which the two chains differ.
+func forkPoint(a, b []Block) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n].Hash == b[n].Hash {
+		n++
+	}
+	return n
+}
+
+// restoreAbandoned rebuilds the mempool after the chain was switched from
+// old: transactions of the abandoned blocks from height fork on that the
+// new branch did not confirm go back into the pool, followed by what was
+// already pending. Everything is admitted again against the new state, so
+// transactions the new branch invalidated are dropped. Entries reserved for
+// a block being mined stay reserved. It returns how many
+// abandoned transactions were restored and the pending entries that were
+// dropped. The caller must hold mutex.
+func restoreAbandoned(old []Block, fork int) (int, []*mempoolEntry) {
+	confirmed := map[string]bool{}
+	for _, b := range blockchain[fork:] {
+		for _, raw := range b.Transactions {
+			confirmed[txID(raw)] = true
+		}
+	}
+	pending := mempool.ordered()
+	reserved := mempool.reserved
+	mempool = newMempool()
+	mempool.reserved = reserved
+
+	restored := 0
+	var dropped []*mempoolEntry
+	for _, b := range old[fork:] {
+		for _, raw := range b.Transactions {
+			if confirmed[txID(raw)] {
+				continue
+			}
+			tx, structured := parseTransaction(raw)
+			if !structured {
+				if _, _, err := admitTransaction(raw, nil, 0); err == nil {
+					restored++
+				}
+				continue
+			}
+			if tx.Type == txTypeCoinbase {
+				continue
+			}
+			if _, _, err := admitTransaction(raw, &tx, tx.ExpiresAt); err == nil {
+				restored++
+			}
+		}
+	}
+	for _, e := range pending {
+		if confirmed[e.ID] {
+			continue
+		}
+		var tx *Transaction
+		if e.structured {
+			tx = &e.tx
+		}
+		if entry, _, err := admitTransaction(e.Transaction, tx, e.ExpiresAt); err == nil {
+			entry.AddedAt = e.AddedAt
+		} else {
+			dropped = append(dropped, e)
+		}
+	}
+	return restored, dropped
+}
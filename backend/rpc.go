@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxRPCBody bounds a JSON-RPC request body, batches included.
+const maxRPCBody = 1 << 20
+
+// JSON-RPC 2.0 error codes. The node's own failures use rpcServerError,
+// with the HTTP status the REST API would answer in the error data.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcFailure wraps a node error with the HTTP status it maps to.
+func rpcFailure(status int, err error) *rpcError {
+	return &rpcError{Code: rpcServerError, Message: err.Error(), Data: map[string]int{"status": status}}
+}
+
+// rpcRateLimited is the error for a call over txLimiter or mineLimiter.
+func rpcRateLimited(wait time.Duration) *rpcError {
+	return &rpcError{
+		Code:    rpcServerError,
+		Message: errRateLimited(wait).Error(),
+		Data:    map[string]int{"status": http.StatusTooManyRequests, "retry_after": retryAfterSeconds(wait)},
+	}
+}
+
+// rpcMethod runs one method with its raw params.
+type rpcMethod func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+var rpcMethods map[string]rpcMethod
+
+func init() {
+	rpcMethods = map[string]rpcMethod{
+		"getHeight":         rpcGetHeight,
+		"getBlock":          rpcGetBlock,
+		"getTransaction":    rpcGetTransaction,
+		"getBalance":        rpcGetBalance,
+		"submitTransaction": rpcSubmitTransaction,
+		"mine":              rpcMine,
+	}
+}
+
+// decodeParams reads params given by name, as an object, or by position,
+// as an array in the order of names, into dst. Absent params leave dst as
+// it is.
+func decodeParams(params json.RawMessage, names []string, dst interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if params[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(params, &list); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		if len(list) > len(names) {
+			return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("at most %d params", len(names))}
+		}
+		byName := map[string]json.RawMessage{}
+		for i, v := range list {
+			byName[names[i]] = v
+		}
+		params, _ = json.Marshal(byName)
+	}
+	if err := json.Unmarshal(params, dst); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func rpcGetHeight(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(blockchain) - 1, nil
+}
+
+// rpcGetBlock answers {index} or {hash} with the block, or null if the
+// chain has no such block.
+func rpcGetBlock(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Index *int   `json:"index"`
+		Hash  string `json:"hash"`
+	}
+	if err := decodeParams(params, []string{"index"}, &p); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	switch {
+	case p.Hash != "":
+		if b, ok := blockByHash(strings.ToLower(p.Hash)); ok {
+			return b, nil
+		}
+	case p.Index != nil:
+		if *p.Index >= 0 && *p.Index < len(blockchain) {
+			return blockchain[*p.Index], nil
+		}
+	default:
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "index or hash required"}
+	}
+	return nil, nil
+}
+
+// rpcGetTransaction answers {id} with the transaction and its status, as
+// GET /tx/{id}, or null if the node does not know it.
+func rpcGetTransaction(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := decodeParams(params, []string{"id"}, &p); err != nil {
+		return nil, err
+	}
+	if p.ID == "" {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "id required"}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if b, pos, ok := findConfirmedTx(p.ID); ok {
+		index := b.Index
+		return txStatus{
+			ID:            p.ID,
+			Transaction:   b.Transactions[pos],
+			Status:        "confirmed",
+			BlockIndex:    &index,
+			BlockHash:     b.Hash,
+			Confirmations: confirmations(b.Index),
+		}, nil
+	}
+	if tx, ok := awaitingSignatures[p.ID]; ok {
+		return txStatus{ID: p.ID, Transaction: tx.encode(), Status: "awaiting_signatures"}, nil
+	}
+	if e, ok := mempool.get(p.ID); ok {
+		return txStatus{ID: p.ID, Transaction: e.Transaction, Status: "pending"}, nil
+	}
+	return nil, nil
+}
+
+func rpcGetBalance(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Address string `json:"address"`
+	}
+	if err := decodeParams(params, []string{"address"}, &p); err != nil {
+		return nil, err
+	}
+	if err := validateAddress(p.Address); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return map[string]interface{}{
+		"address": p.Address,
+		"balance": balances[p.Address],
+		"nonce":   accountNonces[p.Address],
+		"height":  len(blockchain) - 1,
+	}, nil
+}
+
+// rpcSubmitTransaction takes {transaction}, carrying every signature it
+// needs, or {text} for a plain-text transaction, and answers {id}.
+func rpcSubmitTransaction(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Transaction *Transaction `json:"transaction"`
+		Text        string       `json:"text"`
+	}
+	if err := decodeParams(params, []string{"transaction"}, &p); err != nil {
+		return nil, err
+	}
+	if status, err := authorize(ctx, roleSubmitter); err != nil {
+		return nil, rpcFailure(status, err)
+	}
+	if ok, wait := allowCall(ctx, txLimiter); !ok {
+		return nil, rpcRateLimited(wait)
+	}
+	entry, status, err := submitTransaction(p.Transaction, p.Text)
+	if err != nil {
+		return nil, rpcFailure(status, err)
+	}
+	return map[string]string{"id": entry.ID}, nil
+}
+
+// rpcMine takes {difficulty, miner}, both optional, and answers with the
+// mined block.
+func rpcMine(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Difficulty int    `json:"difficulty"`
+		Miner      string `json:"miner"`
+	}
+	if err := decodeParams(params, []string{"difficulty", "miner"}, &p); err != nil {
+		return nil, err
+	}
+	if p.Miner = strings.TrimSpace(p.Miner); p.Miner != "" {
+		if err := validateAddress(p.Miner); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+	}
+	if status, err := authorize(ctx, roleMiner); err != nil {
+		return nil, rpcFailure(status, err)
+	}
+	if ok, wait := allowCall(ctx, mineLimiter); !ok {
+		return nil, rpcRateLimited(wait)
+	}
+	ctx, done := trackMining(ctx)
+	defer done()
+	block, err := mineFromMempool(ctx, p.Difficulty, p.Miner)
+	switch {
+	case errors.Is(err, errNothingToMine) || errors.Is(err, errDifficultyTooLow):
+		return nil, rpcFailure(http.StatusBadRequest, err)
+	case errors.Is(err, context.Canceled):
+		return nil, rpcFailure(http.StatusConflict, err)
+	case errors.Is(err, errNotAuthority) || errors.Is(err, errNotProposer):
+		return nil, rpcFailure(http.StatusForbidden, err)
+	case err != nil:
+		return nil, rpcFailure(http.StatusInternalServerError, err)
+	}
+	return block, nil
+}
+
+// callRPC runs one request. It returns nil for a notification, a request
+// without an id, which gets no response.
+func callRPC(ctx context.Context, raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}, ID: json.RawMessage("null")}
+	}
+	notification := req.ID == nil
+	resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		resp.Error = &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + req.Method}
+	} else if result, err := method(ctx, req.Params); err != nil {
+		var re *rpcError
+		if !errors.As(err, &re) {
+			re = &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+		resp.Error = re
+	} else if result == nil {
+		resp.Result = json.RawMessage("null")
+	} else {
+		resp.Result = result
+	}
+	if notification {
+		return nil
+	}
+	return resp
+}
+
+// handleRPC serves POST /rpc, JSON-RPC 2.0 over the node's operations:
+// getHeight, getBlock, getTransaction, getBalance, submitTransaction and
+// mine. A batch, an array of requests, is answered with an array of the
+// responses, leaving out notifications.
+func handleRPC(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRPCBody+1))
+	if err != nil || len(body) > maxRPCBody {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			json.NewEncoder(w).Encode(rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: err.Error()}, ID: json.RawMessage("null")})
+			return
+		}
+		if len(batch) == 0 {
+			json.NewEncoder(w).Encode(rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "empty batch"}, ID: json.RawMessage("null")})
+			return
+		}
+		responses := []*rpcResponse{}
+		for _, raw := range batch {
+			if resp := callRPC(r.Context(), raw); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+	if !json.Valid(body) {
+		json.NewEncoder(w).Encode(rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: "parse error"}, ID: json.RawMessage("null")})
+		return
+	}
+	if resp := callRPC(r.Context(), body); resp != nil {
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A seed node keeps no chain and mines nothing: it only remembers the
+// nodes that announced themselves to it, so new nodes have somewhere to
+// find their first peers.
+
+const (
+	// maxSeedNodes bounds how many nodes a seed node remembers.
+	maxSeedNodes = 1000
+	// seedRefreshInterval is how often a node registers with its seed
+	// nodes again, keeping its entry fresh and picking up nodes that
+	// joined since.
+	seedRefreshInterval = 2 * time.Minute
+)
+
+// seedEntryTTL is how long a seed node remembers a node that has not
+// registered again or passed a health check; 0 keeps it until health
+// checks drop it. Nodes register every seedRefreshInterval, so this also
+// ages out nodes when health checks are off.
+var seedEntryTTL = 10 * time.Minute
+
+var errSeedFull = errors.New("seed node list is full")
+
+// seedEntry is a node registered with a seed node, described by its last
+// hello.
+type seedEntry struct {
+	URL         string `json:"url"`
+	NetworkID   string `json:"network_id"`
+	GenesisHash string `json:"genesis_hash"`
+	ChainID     string `json:"chain_id,omitempty"`
+	Height      int    `json:"height"`
+	LastSeen    int64  `json:"last_seen"`
+	failures    int
+}
+
+type seedList struct {
+	mu    sync.Mutex
+	nodes map[string]*seedEntry
+}
+
+var seedNodes = &seedList{nodes: map[string]*seedEntry{}}
+
+func (l *seedList) put(u string, h hello) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.nodes[u]; !ok && len(l.nodes) >= maxSeedNodes {
+		return errSeedFull
+	}
+	l.nodes[u] = &seedEntry{
+		URL:         u,
+		NetworkID:   h.NetworkID,
+		GenesisHash: h.GenesisHash,
+		ChainID:     h.ChainID,
+		Height:      h.Height,
+		LastSeen:    time.Now().Unix(),
+	}
+	return nil
+}
+
+// list returns the nodes on the given chain, or all nodes for empty
+// filters, sorted by URL.
+func (l *seedList) list(network, genesis string) []seedEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []seedEntry{}
+	for _, e := range l.nodes {
+		if (network == "" || e.NetworkID == network) && (genesis == "" || e.GenesisHash == genesis) {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+func (l *seedList) urls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]string, 0, len(l.nodes))
+	for u := range l.nodes {
+		out = append(out, u)
+	}
+	return out
+}
+
+// recordCheck updates a node after a health check and drops it once it
+// has failed peerMaxFailures checks in a row.
+func (l *seedList) recordCheck(u string, h hello, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.nodes[u]
+	if !ok {
+		return
+	}
+	if err != nil {
+		e.failures++
+		if peerMaxFailures > 0 && e.failures >= peerMaxFailures {
+			log.Printf("dropping node %s after %d failed checks: %v", u, e.failures, err)
+			delete(l.nodes, u)
+		}
+		return
+	}
+	e.failures = 0
+	e.NetworkID, e.GenesisHash, e.ChainID = h.NetworkID, h.GenesisHash, h.ChainID
+	e.Height = h.Height
+	e.LastSeen = time.Now().Unix()
+}
+
+// expire drops the nodes last seen before cutoff, a unix time.
+func (l *seedList) expire(cutoff int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for u, e := range l.nodes {
+		if e.LastSeen < cutoff {
+			log.Printf("dropping node %s, not seen since %s", u, time.Unix(e.LastSeen, 0).UTC().Format(time.RFC3339))
+			delete(l.nodes, u)
+		}
+	}
+}
+
+// runSeedNode serves the seed node API on addr, checking the registered
+// nodes every peerCheckInterval and dropping those not seen for
+// seedEntryTTL.
+func runSeedNode(addr string) error {
+	if seedEntryTTL > 0 {
+		go func() {
+			for range time.Tick(seedEntryTTL / 4) {
+				seedNodes.expire(time.Now().Add(-seedEntryTTL).Unix())
+			}
+		}()
+	}
+	if peerCheckInterval > 0 {
+		go func() {
+			for range time.Tick(peerCheckInterval) {
+				var wg sync.WaitGroup
+				for _, u := range seedNodes.urls() {
+					wg.Add(1)
+					go func(u string) {
+						defer wg.Done()
+						h, err := fetchHello(u)
+						seedNodes.recordCheck(u, h, err)
+					}(u)
+				}
+				wg.Wait()
+			}
+		}()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s seed node\nAvailable endpoints:\n/peers[?network_id=&genesis_hash=] (GET; POST {url} or {port} to register)\n", BlockchainName)
+	})
+	mux.HandleFunc("GET /peers", handleSeedPeers)
+	mux.HandleFunc("POST /peers", handleSeedPeers)
+	fmt.Println(BlockchainName, "seed node listening on", addr)
+	return http.ListenAndServe(addr, withRequestLog(withCORS(withGzip(mux))))
+}
+
+// handleSeedPeers serves GET /peers on a seed node, the registered nodes,
+// and POST /peers {url} or {port}, through which a node registers itself.
+// A node sending only its port is registered at the address the request
+// came from. The answer to a registration lists the other nodes on the
+// registering node's chain.
+func handleSeedPeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"peers": seedNodes.list(q.Get("network_id"), q.Get("genesis_hash")),
+		})
+	case http.MethodPost:
+		var body struct {
+			URL  string `json:"url"`
+			Port int    `json:"port"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body, expected {\"url\":\"http://host:port\"} or {\"port\":N}", http.StatusBadRequest)
+			return
+		}
+		if body.URL == "" && body.Port > 0 && body.Port < 65536 {
+			body.URL = "http://" + net.JoinHostPort(remoteHost(r), strconv.Itoa(body.Port))
+		}
+		u, err := normalizePeerURL(body.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h, err := fetchHello(u)
+		if err != nil {
+			http.Error(w, u+": handshake failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if err := seedNodes.put(u, h); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		others := []seedEntry{}
+		for _, e := range seedNodes.list(h.NetworkID, h.GenesisHash) {
+			if e.URL != u {
+				others = append(others, e)
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"url": u, "peers": others})
+	}
+}
+
+// joinViaSeeds registers this node with each seed node, as publicURL or
+// else by its API port, and connects to the nodes the seeds know on the
+// same chain, once at startup and then every seedRefreshInterval.
+// Registration is retried while this node's API, which the seed checks,
+// may still be starting.
+func joinViaSeeds(seeds []string, publicURL, addr string) {
+	var announce interface{} = map[string]string{"url": publicURL}
+	if publicURL == "" {
+		_, p, _ := net.SplitHostPort(addr)
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			log.Printf("seed nodes: cannot announce port %q, set -public-url", p)
+			return
+		}
+		announce = map[string]int{"port": port}
+	}
+	for {
+		joinSeeds(seeds, announce)
+		time.Sleep(seedRefreshInterval)
+	}
+}
+
+func joinSeeds(seeds []string, announce interface{}) {
+	found := map[string]bool{}
+	for _, raw := range seeds {
+		seed, err := normalizePeerURL(raw)
+		if err != nil {
+			log.Printf("seed node: %v", err)
+			continue
+		}
+		wait := peerLinkMinBackoff
+		for attempt := 1; ; attempt++ {
+			entries, err := registerWithSeed(seed, announce)
+			if err == nil {
+				for _, e := range entries {
+					found[e.URL] = true
+				}
+				break
+			}
+			if attempt == bootstrapAttempts {
+				log.Printf("seed node %s: %v", seed, err)
+				break
+			}
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	for _, u := range peers.list() {
+		delete(found, u)
+	}
+	if len(found) == 0 {
+		return
+	}
+	var urls []string
+	for u := range found {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	bootstrapPeers(urls)
+}
+
+func registerWithSeed(seed string, announce interface{}) ([]seedEntry, error) {
+	data, err := json.Marshal(announce)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Post(seed+"/peers", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body struct {
+		Peers []seedEntry `json:"peers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Peers, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedListExpire(t *testing.T) {
+	l := &seedList{nodes: map[string]*seedEntry{}}
+	l.put("http://stale:8080", hello{})
+	l.put("http://fresh:8080", hello{})
+	l.nodes["http://stale:8080"].LastSeen = time.Now().Add(-time.Hour).Unix()
+	l.expire(time.Now().Add(-seedEntryTTL).Unix())
+	if urls := l.urls(); len(urls) != 1 || urls[0] != "http://fresh:8080" {
+		t.Errorf("nodes left %v, want only the fresh one", urls)
+	}
+}
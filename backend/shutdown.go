@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout, set with -shutdown-timeout, is how long in-flight
+// requests get to finish once the node is asked to stop.
+var shutdownTimeout = 10 * time.Second
+
+// serverCtx is the context API requests run under. Shutting down cancels
+// it, which ends event streams and the mining requests wait on.
+var serverCtx, stopServing = context.WithCancel(context.Background())
+
+func serverContext(net.Listener) context.Context {
+	return serverCtx
+}
+
+// awaitShutdown waits for SIGINT or SIGTERM, then stops the node: mining
+// is canceled, the servers stop taking requests and drain the ones in
+// flight for up to shutdownTimeout, and the chain and the mempool are
+// written to disk. It returns once they are, holding mutex so that nothing
+// changes them before the process exits. A second signal kills the node
+// at once.
+func awaitShutdown(servers ...*http.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	signal.Stop(sigs)
+	log.Printf("%v: shutting down, draining requests for up to %s", sig, shutdownTimeout)
+
+	backgroundMiner.halt()
+	if n := cancelMining(); n > 0 {
+		log.Printf("canceled %d mining attempts", n)
+	}
+	stopServing()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("%s: requests still running after %s, closing them: %v", srv.Addr, shutdownTimeout, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	// A request may have started mining while the others drained.
+	cancelMining()
+
+	mutex.Lock()
+	if err := saveBlockchain(); err != nil {
+		log.Printf("Failed to save blockchain: %v", err)
+	}
+	if err := saveMempool(); err != nil {
+		log.Printf("Failed to save mempool: %v", err)
+	}
+	log.Printf("saved height %d and %d pending transactions", len(blockchain)-1, mempool.len())
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+// snapshotFile stores the state a fast-synced chain starts from.
+const snapshotFile = "snapshot.json"
+
+// errPruned refuses, with 410 Gone over HTTP, what needs blocks below the
+// snapshot a fast-synced chain started from, which are kept as headers
+// only.
+var errPruned = errors.New("history below the snapshot height is not kept")
+
+// chainState is the account state as of the block at Height.
+type chainState struct {
+	Height        int                         `json:"height"`
+	Hash          string                      `json:"hash"`
+	Balances      map[string]int64            `json:"balances"`
+	Nonces        map[string]uint64           `json:"nonces"`
+	Tokens        map[string]*tokenInfo       `json:"tokens"`
+	TokenBalances map[string]map[string]int64 `json:"token_balances"`
+	Assets        map[string]*assetInfo       `json:"assets"`
+	Stakes        map[string]int64            `json:"stakes"`
+	StakeKeys     map[string]string           `json:"stake_keys"`
+	TxIndex       map[string]int              `json:"tx_index"`
+}
+
+// snapshotBase is the state a fast-synced chain was started from. The
+// blocks after genesis up to its height are kept as headers only. It is
+// guarded by mutex.
+var snapshotBase *chainState
+
+// currentState returns the state as of the tip. The maps are shared with
+// the live state, so the caller must hold mutex while using it.
+func currentState() chainState {
+	return chainState{
+		Height:        len(blockchain) - 1,
+		Hash:          getLastBlock().Hash,
+		Balances:      balances,
+		Nonces:        accountNonces,
+		Tokens:        tokens,
+		TokenBalances: tokenBalances,
+		Assets:        assets,
+		Stakes:        stakes,
+		StakeKeys:     stakeKeys,
+		TxIndex:       txIndex,
+	}
+}
+
+// restoreState makes a copy of s the live state. The caller must hold
+// mutex.
+func restoreState(s *chainState) {
+	var c chainState
+	data, _ := json.Marshal(s)
+	json.Unmarshal(data, &c)
+	balances, accountNonces = c.Balances, c.Nonces
+	tokens, tokenBalances = c.Tokens, c.TokenBalances
+	assets, stakes, stakeKeys = c.Assets, c.Stakes, c.StakeKeys
+	txIndex = c.TxIndex
+	if balances == nil {
+		balances = map[string]int64{}
+	}
+	if accountNonces == nil {
+		accountNonces = map[string]uint64{}
+	}
+	if tokens == nil {
+		tokens = map[string]*tokenInfo{}
+	}
+	if tokenBalances == nil {
+		tokenBalances = map[string]map[string]int64{}
+	}
+	if assets == nil {
+		assets = map[string]*assetInfo{}
+	}
+	if stakes == nil {
+		stakes = map[string]int64{}
+	}
+	if stakeKeys == nil {
+		stakeKeys = map[string]string{}
+	}
+	if txIndex == nil {
+		txIndex = map[string]int{}
+	}
+	addrIndex = map[string][]int{}
+}
+
+// snapshotApplies reports whether the chain still starts from
+// snapshotBase. The caller must hold mutex.
+func snapshotApplies() bool {
+	return snapshotBase != nil && snapshotBase.Height < len(blockchain) &&
+		blockchain[snapshotBase.Height].Hash == snapshotBase.Hash
+}
+
+// pruned reports whether the block at height is kept as a header only.
+// The caller must hold mutex.
+func pruned(height int) bool {
+	return snapshotApplies() && height > 0 && height <= snapshotBase.Height
+}
+
+// prunedRange reports whether any block from height from to to, both
+// inclusive, is kept as a header only. Genesis is always kept whole, so a
+// range starting at 0 is pruned as soon as it reaches height 1. The caller
+// must hold mutex.
+func prunedRange(from, to int) bool {
+	return snapshotApplies() && max(from, 1) <= min(to, snapshotBase.Height)
+}
+
+func saveSnapshot() error {
+	data, err := json.Marshal(snapshotBase)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(snapshotFile, data, 0644)
+}
+
+// loadSnapshot reads the snapshot the stored chain was fast-synced from,
+// if any.
+func loadSnapshot() error {
+	data, err := ioutil.ReadFile(snapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s chainState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	snapshotBase = &s
+	return nil
+}
+
+// handleSnapshot serves GET /snapshot, the state as of the tip, for new
+// nodes to fast-sync from.
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	json.NewEncoder(w).Encode(currentState())
+}
+
+func fetchSnapshot(peer string) (chainState, error) {
+	resp, err := peerClient.Get(peer + "/snapshot")
+	if err != nil {
+		return chainState{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return chainState{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var s chainState
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return chainState{}, err
+	}
+	return s, nil
+}
+
+// fastSync starts a node that has only its genesis block from the state
+// snapshot of a trusted peer. The headers up to the snapshot are still
+// downloaded and checked, so the snapshot is known to sit on a valid chain
+// with its work, but their transactions are not replayed. The blocks after
+// it are then synced and verified as usual.
+func fastSync(peer string) error {
+	h, err := handshake(peer)
+	if err != nil {
+		return err
+	}
+	defer chainSync.begin(peer, h.Height)()
+	snap, err := fetchSnapshot(peer)
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	mutex.Lock()
+	view := blockchain[:1:1]
+	mutex.Unlock()
+	for len(view) <= snap.Height {
+		to := len(view) + headerBatchSize - 1
+		if to > snap.Height {
+			to = snap.Height
+		}
+		headers, err := fetchHeaders(peer, len(view), to)
+		if err != nil {
+			return fmt.Errorf("headers: %w", err)
+		}
+		if len(headers) == 0 {
+			return errors.New("peer has no headers up to its snapshot")
+		}
+		for _, h := range headers {
+			if err := checkHeader(view, h); err != nil {
+				return fmt.Errorf("header %d: %w", h.Index, err)
+			}
+			view = append(view, h)
+		}
+	}
+	if view[len(view)-1].Hash != snap.Hash {
+		return errors.New("snapshot does not match the peer's headers")
+	}
+
+	mutex.Lock()
+	if len(blockchain) != 1 {
+		mutex.Unlock()
+		return errors.New("chain already moved past genesis")
+	}
+	blockchain = view
+	snapshotBase = &snap
+	rebuildState()
+	err = saveSnapshot()
+	if err == nil {
+		err = saveBlockchain()
+	}
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("fast-synced to height %d from %s", snap.Height, peer)
+	peers.add(peer)
+	resolveChain()
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestPrunedRange(t *testing.T) {
+	savedChain, savedBase := blockchain, snapshotBase
+	defer func() { blockchain, snapshotBase = savedChain, savedBase }()
+	blockchain = make([]Block, 10)
+	for i := range blockchain {
+		blockchain[i] = Block{Index: i, Hash: string(rune('a' + i))}
+	}
+	snapshotBase = &chainState{Height: 4, Hash: blockchain[4].Hash}
+
+	tests := []struct {
+		from, to int
+		want     bool
+	}{
+		{0, 0, false},
+		{0, 9, true},
+		{0, 1, true},
+		{3, 7, true},
+		{4, 4, true},
+		{5, 9, false},
+		{7, 3, false},
+	}
+	for _, tt := range tests {
+		if got := prunedRange(tt.from, tt.to); got != tt.want {
+			t.Errorf("prunedRange(%d, %d) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+	snapshotBase = nil
+	if prunedRange(0, 9) {
+		t.Error("prunedRange without a snapshot = true, want false")
+	}
+}
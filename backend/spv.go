@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// An SPV (simplified payment verification) node keeps only block headers.
+// It checks their links and proof of work like a full node but never sees
+// the transactions; instead it asks full nodes for a merkle proof of the
+// one transaction it is interested in and checks that against the merkle
+// root of a header it already holds.
+
+const (
+	// spvHeadersFile stores the header chain of an SPV node.
+	spvHeadersFile = "headers.json"
+	// spvSyncInterval is how often an SPV node asks its peers for new
+	// headers.
+	spvSyncInterval = 10 * time.Second
+)
+
+var errBadMerkleProof = errors.New("merkle path does not lead to the header's merkle root")
+
+// headerChain is the header chain of an SPV node, guarded by mutex.
+var headerChain []Block
+
+// loadGenesis sets the chain parameters recorded in gen, as loadBlockchain
+// does for a full node.
+func loadGenesis(gen Block) error {
+	h, err := hasherFor(gen.Algorithm)
+	if err != nil {
+		return err
+	}
+	chainHasher = h
+	if err := loadConsensus(gen); err != nil {
+		return err
+	}
+	if gen.Index != 0 || gen.PrevHash != "" || computeHash(gen) != gen.Hash {
+		return errors.New("invalid genesis header")
+	}
+	if err := checkCheckpoint(gen); err != nil {
+		return err
+	}
+	chainID = gen.ChainID
+	genesisHash = gen.Hash
+	return nil
+}
+
+func saveHeaderChain() error {
+	data, err := json.MarshalIndent(headerChain, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(spvHeadersFile, data, 0644)
+}
+
+// loadHeaderChain loads the stored header chain. A new SPV node has no
+// genesis of its own and takes it from the first of urls that serves one
+// on this node's network; pin it with a checkpoint at height 0 to avoid
+// trusting that peer.
+func loadHeaderChain(urls []string) error {
+	data, err := ioutil.ReadFile(spvHeadersFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &headerChain); err != nil {
+			return err
+		}
+		if len(headerChain) == 0 {
+			return errors.New(spvHeadersFile + " holds no headers")
+		}
+		if err := loadGenesis(headerChain[0]); err != nil {
+			return err
+		}
+		return checkChainCheckpoints(headerChain)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	for _, raw := range urls {
+		u, err := normalizePeerURL(raw)
+		if err != nil {
+			continue
+		}
+		gen, err := fetchGenesis(u)
+		if err != nil {
+			log.Printf("genesis from %s: %v", u, err)
+			continue
+		}
+		if err := loadGenesis(gen); err != nil {
+			log.Printf("genesis from %s: %v", u, err)
+			continue
+		}
+		log.Printf("took genesis %s from %s", gen.Hash, u)
+		headerChain = []Block{gen}
+		return saveHeaderChain()
+	}
+	return errors.New("no peer served a genesis block; an SPV node needs -peers")
+}
+
+func fetchGenesis(peer string) (Block, error) {
+	h, err := fetchHello(peer)
+	if err != nil {
+		return Block{}, err
+	}
+	if h.NetworkID != networkID {
+		return Block{}, fmt.Errorf("%w: network %q, want %q", errIncompatiblePeer, h.NetworkID, networkID)
+	}
+	headers, err := fetchHeaders(peer, 0, 0)
+	if err != nil {
+		return Block{}, err
+	}
+	if len(headers) != 1 || headers[0].Hash != h.GenesisHash {
+		return Block{}, errors.New("peer sent a genesis header not matching its hello")
+	}
+	return headers[0], nil
+}
+
+// syncHeaderChain catches up with every peer whose chain has more work than
+// the local header chain.
+func syncHeaderChain() {
+	for _, peer := range peers.list() {
+		h, err := handshake(peer)
+		if err != nil {
+			log.Printf("spv sync %s: %v", peer, err)
+			continue
+		}
+		if err := syncHeadersFrom(peer, h.Height); err != nil && !errors.Is(err, errNotHeavier) {
+			log.Printf("spv sync %s: %v", peer, err)
+		}
+	}
+}
+
+// syncHeadersFrom finds where peer's chain forks from the local header
+// chain, downloads and checks its headers from there up to height and
+// switches to them if they carry more work.
+func syncHeadersFrom(peer string, height int) error {
+	mutex.Lock()
+	local := headerChain
+	mutex.Unlock()
+	fork, err := headerForkPoint(peer, local, height)
+	if err != nil {
+		return err
+	}
+	view := local[:fork:fork]
+	for len(view) <= height {
+		to := len(view) + headerBatchSize - 1
+		if to > height {
+			to = height
+		}
+		headers, err := fetchHeaders(peer, len(view), to)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 {
+			break
+		}
+		for _, h := range headers {
+			if err := checkHeader(view, h); err != nil {
+				if invalidBlock(err) {
+					bans.misbehave(hostOf(peer), scoreInvalidBlock, fmt.Sprintf("invalid header %d: %v", h.Index, err))
+				}
+				return fmt.Errorf("header %d: %w", h.Index, err)
+			}
+			view = append(view, h)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if chainWork(view).Cmp(chainWork(headerChain)) <= 0 {
+		return errNotHeavier
+	}
+	if fork < len(headerChain) {
+		log.Printf("spv reorg: dropping %d headers above height %d", len(headerChain)-fork, fork-1)
+	}
+	headerChain = view
+	log.Printf("spv headers synced to height %d from %s", len(view)-1, peer)
+	return saveHeaderChain()
+}
+
+// headerForkPoint returns the height of the first header at which peer's
+// chain differs from local, looking back from the lower of the two tips.
+func headerForkPoint(peer string, local []Block, height int) (int, error) {
+	top := len(local) - 1
+	if height < top {
+		top = height
+	}
+	for top >= 0 {
+		from := top - headerBatchSize + 1
+		if from < 0 {
+			from = 0
+		}
+		headers, err := fetchHeaders(peer, from, top)
+		if err != nil {
+			return 0, err
+		}
+		for i := len(headers) - 1; i >= 0; i-- {
+			if idx := headers[i].Index; idx >= 0 && idx < len(local) && local[idx].Hash == headers[i].Hash {
+				return idx + 1, nil
+			}
+		}
+		top = from - 1
+	}
+	return 0, errDifferentGenesis
+}
+
+func fetchProof(peer, id string) (merkleProof, error) {
+	resp, err := peerClient.Get(peer + "/proof/" + id)
+	if err != nil {
+		return merkleProof{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return merkleProof{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var p merkleProof
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return merkleProof{}, err
+	}
+	return p, nil
+}
+
+// checkProof checks a peer's proof that transaction id is in a block of
+// the local header chain. The caller must hold mutex.
+func checkProof(id string, p merkleProof) error {
+	if p.BlockIndex < 0 || p.BlockIndex >= len(headerChain) || headerChain[p.BlockIndex].Hash != p.BlockHash {
+		return errors.New("proof is for a block not in the local header chain")
+	}
+	if txID(p.Transaction) != id {
+		return errors.New("proof is for another transaction")
+	}
+	b := headerChain[p.BlockIndex]
+	if ok, err := VerifyMerkleProof(b.MerkleVersion, p.Transaction, p.Path, b.MerkleRoot); err != nil || !ok {
+		return errBadMerkleProof
+	}
+	return nil
+}
+
+// handleSPVTx serves GET /tx/{id} on an SPV node: the transaction, once a
+// peer has proven it is in a block of the local header chain.
+func handleSPVTx(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	failures := map[string]string{}
+	for _, peer := range peers.list() {
+		p, err := fetchProof(peer, id)
+		if err != nil {
+			failures[peer] = err.Error()
+			continue
+		}
+		mutex.Lock()
+		err = checkProof(id, p)
+		height := len(headerChain)
+		mutex.Unlock()
+		if err != nil {
+			// A proof against a block the header chain holds that does
+			// not check out is a forgery, not a fork.
+			if errors.Is(err, errBadMerkleProof) {
+				bans.misbehave(hostOf(peer), scoreInvalidTx, "invalid merkle proof for "+id)
+			}
+			failures[peer] = err.Error()
+			continue
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"txid":          id,
+			"transaction":   p.Transaction,
+			"block_index":   p.BlockIndex,
+			"block_hash":    p.BlockHash,
+			"confirmations": height - p.BlockIndex,
+			"proven_by":     peer,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "no peer proved the transaction is in the header chain",
+		"errors": failures,
+	})
+}
+
+// handleSPVStatus serves GET /status on an SPV node.
+func handleSPVStatus(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	tip := headerChain[len(headerChain)-1]
+	work := chainWork(headerChain)
+	mutex.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":         "spv",
+		"genesis_hash": genesisHash,
+		"chain_id":     chainID,
+		"height":       tip.Index,
+		"tip_hash":     tip.Hash,
+		"chain_work":   work.Text(16),
+		"peers":        peers.list(),
+	})
+}
+
+// runSPVNode runs an SPV node on addr, getting headers and proofs from the
+// nodes at urls.
+func runSPVNode(addr string, urls []string) error {
+	if err := loadHeaderChain(urls); err != nil {
+		return err
+	}
+	fmt.Println(BlockchainName, "SPV node loaded. Header height:", len(headerChain)-1)
+	go func() {
+		connectPeers(urls)
+		for {
+			syncHeaderChain()
+			time.Sleep(spvSyncInterval)
+		}
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s SPV node\nAvailable endpoints:\n/status\n/tx/{id} (verified with a merkle proof from a peer)\n", BlockchainName)
+	})
+	mux.HandleFunc("GET /status", handleSPVStatus)
+	mux.HandleFunc("GET /tx/{id}", handleSPVTx)
+	fmt.Println(BlockchainName, "SPV node listening on", addr)
+	return http.ListenAndServe(addr, withRequestLog(withCORS(withGzip(mux))))
+}
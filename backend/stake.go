@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	consensusPoS = "pos"
+
+	txTypeStake   = "stake"
+	txTypeUnstake = "unstake"
+)
+
+// stakes holds the coins each address has locked, and stakeKeys the key
+// that signs blocks on its behalf, both as of the chain tip. They are
+// guarded by mutex.
+var (
+	stakes    = map[string]int64{}
+	stakeKeys = map[string]string{}
+)
+
+var errNotProposer = errors.New("node is not the proposer for this block")
+
+// applyStakeTx locks or releases stake. The coin side of a stake is
+// handled through coinCost; unstaked coins are credited here.
+func applyStakeTx(tx Transaction) {
+	switch tx.Type {
+	case txTypeStake:
+		stakes[tx.From] += tx.Amount
+		stakeKeys[tx.From] = tx.PubKeys[0]
+	case txTypeUnstake:
+		stakes[tx.From] -= tx.Amount
+		balances[tx.From] += tx.Amount
+		if stakes[tx.From] <= 0 {
+			delete(stakes, tx.From)
+			delete(stakeKeys, tx.From)
+		}
+	}
+}
+
+// checkStakeRules requires stakes to come from a single key, which then
+// signs blocks, and unstakes to be covered by the sender's locked stake net
+// of its other pending unstakes.
+func checkStakeRules(tx Transaction, replacing *mempoolEntry) error {
+	switch tx.Type {
+	case txTypeStake:
+		if len(tx.PubKeys) != 1 || tx.Threshold != 1 {
+			return errors.New("stake must be signed by a single key")
+		}
+	case txTypeUnstake:
+		available := stakes[tx.From]
+		for _, e := range mempool.all() {
+			if e != replacing && e.sender() == tx.From && e.tx.Type == txTypeUnstake {
+				available -= e.tx.Amount
+			}
+		}
+		if tx.Amount > available {
+			return fmt.Errorf("insufficient stake: %s has %d locked", tx.From, available)
+		}
+	}
+	return nil
+}
+
+type validator struct {
+	Address string `json:"address"`
+	PubKey  string `json:"pubkey"`
+	Stake   int64  `json:"stake"`
+}
+
+// validators lists the stakers ordered by address. Until anyone has staked,
+// the authorities listed in the genesis block act as validators with equal
+// weight. The caller must hold mutex.
+func validators() []validator {
+	var out []validator
+	for addr, amount := range stakes {
+		out = append(out, validator{Address: addr, PubKey: stakeKeys[addr], Stake: amount})
+	}
+	if len(out) == 0 {
+		for _, pub := range chainAuthorities {
+			b, _ := hex.DecodeString(pub)
+			out = append(out, validator{Address: addressFromPubKey(ed25519.PublicKey(b)), PubKey: pub, Stake: 1})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// proposerFor picks the validator allowed to seal the block at height on
+// top of prevHash. The draw is seeded by the previous hash and weighted by
+// stake as of the tip, so every node computes the same proposer. The
+// caller must hold mutex.
+func proposerFor(height int, prevHash string) (validator, bool) {
+	vals := validators()
+	var total int64
+	for _, v := range vals {
+		total += v.Stake
+	}
+	if total <= 0 {
+		return validator{}, false
+	}
+	seed := sha256.Sum256([]byte(prevHash + strconv.Itoa(height)))
+	draw := int64(binary.BigEndian.Uint64(seed[:8]) % uint64(total))
+	for _, v := range vals {
+		if draw < v.Stake {
+			return v, true
+		}
+		draw -= v.Stake
+	}
+	return vals[len(vals)-1], true
+}
+
+// handleValidators serves GET /validators: the current validator set and
+// the proposer of the next block.
+func handleValidators(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if chainConsensus != consensusPoS {
+		http.Error(w, "chain does not use proof of stake", http.StatusNotFound)
+		return
+	}
+	tip := getLastBlock()
+	next, _ := proposerFor(tip.Index+1, tip.Hash)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"validators":    validators(),
+		"next_proposer": next,
+	})
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// accountNonces holds the next nonce each sender must use and balances the
+// spendable coins of each address, both as of the chain tip. They are
+// guarded by mutex.
+var (
+	accountNonces = map[string]uint64{}
+	balances      = map[string]int64{}
+)
+
+// applyBlockState advances account state for a block appended to the chain.
+func applyBlockState(b Block) {
+	indexBlockTxs(b)
+	for _, raw := range b.Transactions {
+		tx, ok := parseTransaction(raw)
+		if !ok {
+			continue
+		}
+		switch tx.Type {
+		case txTypeCoinbase:
+			balances[tx.To] += tx.Amount
+			continue
+		case txTypeTransfer:
+			balances[tx.To] += tx.Amount
+		case txTypeTokenCreate, txTypeTokenTransfer:
+			applyTokenTx(tx, b.Index)
+		case txTypeAssetMint, txTypeAssetTransfer:
+			applyAssetTx(tx, b.Index)
+		case txTypeStake, txTypeUnstake:
+			applyStakeTx(tx)
+		}
+		accountNonces[tx.From] = tx.Nonce + 1
+		balances[tx.From] -= tx.coinCost()
+	}
+}
+
+// rebuildState recomputes account state by replaying the whole chain, or
+// only the blocks after the snapshot a fast-synced chain started from.
+func rebuildState() {
+	replayState(blockchain)
+}
+
+// replayState makes the live state that as of the last block of chain, a
+// prefix of blockchain, by replaying it from genesis or from the snapshot
+// the chain started from, if chain reaches it.
+func replayState(chain []Block) {
+	if snapshotApplies() && snapshotBase.Height < len(chain) {
+		restoreState(snapshotBase)
+		for _, b := range chain[snapshotBase.Height+1:] {
+			applyBlockState(b)
+		}
+		return
+	}
+	accountNonces = map[string]uint64{}
+	balances = map[string]int64{}
+	txIndex = map[string]int{}
+	addrIndex = map[string][]int{}
+	tokens = map[string]*tokenInfo{}
+	tokenBalances = map[string]map[string]int64{}
+	assets = map[string]*assetInfo{}
+	stakes = map[string]int64{}
+	stakeKeys = map[string]string{}
+	for _, b := range chain {
+		applyBlockState(b)
+	}
+}
+
+// expectedNonce returns the nonce the next transaction from addr must carry,
+// taking transactions already waiting in the mempool into account.
+func expectedNonce(addr string) uint64 {
+	next := accountNonces[addr]
+	for _, e := range mempool.all() {
+		if e.sender() == addr && e.tx.Nonce >= next {
+			next = e.tx.Nonce + 1
+		}
+	}
+	return next
+}
+
+// checkNonce rejects transactions that reuse a nonce or skip ahead of the
+// sender's expected nonce.
+func checkNonce(tx Transaction) error {
+	expected := expectedNonce(tx.From)
+	if tx.Nonce < expected {
+		return fmt.Errorf("nonce %d already used by %s", tx.Nonce, tx.From)
+	}
+	if tx.Nonce > expected {
+		return fmt.Errorf("nonce %d out of order for %s, expected %d", tx.Nonce, tx.From, expected)
+	}
+	return nil
+}
+
+// checkBalance rejects transactions the sender cannot cover once its other
+// pending transactions, except the one being replaced, are accounted for.
+func checkBalance(tx Transaction, replacing *mempoolEntry) error {
+	available := balances[tx.From]
+	for _, e := range mempool.all() {
+		if e != replacing && e.sender() == tx.From {
+			available -= e.tx.coinCost()
+		}
+	}
+	if need := tx.coinCost(); need > available {
+		return fmt.Errorf("insufficient balance: %s has %d available, needs %d", tx.From, available, need)
+	}
+	return nil
+}
+
+var errInvalidBlockTx = errors.New("invalid transaction in block")
+
+// checkBlockTxs re-checks every structured transaction in b against the
+// state at the tip, as mempool admission did: its fields and, unless it is
+// a sender-less data transaction, that its signatures are valid, meet its
+// threshold and belong to the sender, that its nonce is the sender's next
+// one, that the sender can pay for it, that an unstake is covered by the
+// sender's locked stake, that a new token's symbol is free, that a token
+// transfer is covered by the sender's tokens and that an asset is minted
+// once and moved only by its owner. The block's own earlier transactions
+// count, so two spends in one block must both be covered and carry
+// consecutive nonces. A coinbase, if the block has one, must come first,
+// name the block's height and pay no more than the block reward plus the
+// fees of the block's transactions; a block without one, as mined with no
+// reward address, leaves the reward unclaimed. A block mined here gets the
+// same checks as one from a peer, which may never have passed this node's
+// mempool. The caller must hold mutex.
+func checkBlockTxs(b Block) error {
+	nonces := map[string]uint64{}
+	spendable := map[string]int64{}
+	nonceOf := func(addr string) uint64 {
+		if n, ok := nonces[addr]; ok {
+			return n
+		}
+		return accountNonces[addr]
+	}
+	balanceOf := func(addr string) int64 {
+		if v, ok := spendable[addr]; ok {
+			return v
+		}
+		return balances[addr]
+	}
+	staked := map[string]int64{}
+	stakeOf := func(addr string) int64 {
+		if v, ok := staked[addr]; ok {
+			return v
+		}
+		return stakes[addr]
+	}
+	// Token balances are keyed by symbol and holder.
+	created := map[string]bool{}
+	held := map[[2]string]int64{}
+	tokenOf := func(symbol, addr string) int64 {
+		if v, ok := held[[2]string{symbol, addr}]; ok {
+			return v
+		}
+		return tokenBalances[symbol][addr]
+	}
+	owners := map[string]string{}
+	ownerOf := func(asset string) (string, bool) {
+		if o, ok := owners[asset]; ok {
+			return o, true
+		}
+		if a := assets[asset]; a != nil {
+			return a.Owner, true
+		}
+		return "", false
+	}
+	var fees int64
+	for _, raw := range b.Transactions {
+		if tx, ok := parseTransaction(raw); ok && tx.Type != txTypeCoinbase {
+			fees += tx.Fee
+		}
+	}
+	for i, raw := range b.Transactions {
+		tx, ok := parseTransaction(raw)
+		if !ok {
+			continue
+		}
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%w: transaction %d (%s): %s", errInvalidBlockTx, i, tx.id(), fmt.Sprintf(format, args...))
+		}
+		if tx.Type == txTypeCoinbase {
+			switch limit := rewardAt(b.Index) + fees; {
+			case i != 0:
+				return fail("a coinbase must be the block's first and only one")
+			case tx.Height != b.Index:
+				return fail("coinbase for height %d in block %d", tx.Height, b.Index)
+			case tx.Amount < 0 || tx.Amount > limit:
+				return fail("coinbase pays %d, more than the reward and fees of %d", tx.Amount, limit)
+			}
+			spendable[tx.To] = balanceOf(tx.To) + tx.Amount
+			continue
+		}
+		if err := tx.validateFields(); err != nil {
+			return fail("%v", err)
+		}
+		if tx.Type == txTypeData {
+			continue
+		}
+		signed, err := tx.checkSigners()
+		if err != nil {
+			return fail("%v", err)
+		}
+		if signed < tx.Threshold {
+			return fail("%d of %d required signatures", signed, tx.Threshold)
+		}
+		if want := nonceOf(tx.From); tx.Nonce != want {
+			return fail("nonce %d, expected %d for %s", tx.Nonce, want, tx.From)
+		}
+		available := balanceOf(tx.From)
+		if need := tx.coinCost(); need > available {
+			return fail("insufficient balance: %s has %d, needs %d", tx.From, available, need)
+		}
+		switch tx.Type {
+		case txTypeStake:
+			if len(tx.PubKeys) != 1 || tx.Threshold != 1 {
+				return fail("stake must be signed by a single key")
+			}
+		case txTypeUnstake:
+			if locked := stakeOf(tx.From); tx.Amount > locked {
+				return fail("insufficient stake: %s has %d locked", tx.From, locked)
+			}
+		case txTypeTokenCreate:
+			if tokens[tx.Symbol] != nil || created[tx.Symbol] {
+				return fail("token %s already exists", tx.Symbol)
+			}
+		case txTypeTokenTransfer:
+			if tokens[tx.Symbol] == nil && !created[tx.Symbol] {
+				return fail("unknown token %s", tx.Symbol)
+			}
+			if have := tokenOf(tx.Symbol, tx.From); tx.Amount > have {
+				return fail("insufficient %s balance: %s has %d", tx.Symbol, tx.From, have)
+			}
+		case txTypeAssetMint:
+			if _, minted := ownerOf(tx.Asset); minted {
+				return fail("asset %s already minted", tx.Asset)
+			}
+		case txTypeAssetTransfer:
+			owner, minted := ownerOf(tx.Asset)
+			if !minted {
+				return fail("unknown asset %s", tx.Asset)
+			}
+			if owner != tx.From {
+				return fail("%s does not own asset %s", tx.From, tx.Asset)
+			}
+		}
+		nonces[tx.From] = tx.Nonce + 1
+		spendable[tx.From] = available - tx.coinCost()
+		switch tx.Type {
+		case txTypeTransfer:
+			spendable[tx.To] = balanceOf(tx.To) + tx.Amount
+		case txTypeStake:
+			staked[tx.From] = stakeOf(tx.From) + tx.Amount
+		case txTypeUnstake:
+			staked[tx.From] = stakeOf(tx.From) - tx.Amount
+			spendable[tx.From] += tx.Amount
+		case txTypeTokenCreate:
+			created[tx.Symbol] = true
+			held[[2]string{tx.Symbol, tx.From}] = tx.Amount
+		case txTypeTokenTransfer:
+			from, to := [2]string{tx.Symbol, tx.From}, [2]string{tx.Symbol, tx.To}
+			held[from] = tokenOf(tx.Symbol, tx.From) - tx.Amount
+			held[to] = tokenOf(tx.Symbol, tx.To) + tx.Amount
+		case txTypeAssetMint:
+			owners[tx.Asset] = tx.From
+		case txTypeAssetTransfer:
+			owners[tx.Asset] = tx.To
+		}
+	}
+	return nil
+}
+
+// balanceAt replays the chain up to and including height onto a scratch
+// state and returns the coin balance and next nonce of addr at that point.
+// The live state, indexes included, is put back afterwards. The caller
+// must hold mutex.
+func balanceAt(addr string, height int) (int64, uint64) {
+	live, liveAddrIndex := currentState(), addrIndex
+	defer func() {
+		balances, accountNonces = live.Balances, live.Nonces
+		tokens, tokenBalances = live.Tokens, live.TokenBalances
+		assets, stakes, stakeKeys = live.Assets, live.Stakes, live.StakeKeys
+		txIndex, addrIndex = live.TxIndex, liveAddrIndex
+	}()
+	replayState(blockchain[:height+1])
+	return balances[addr], accountNonces[addr]
+}
+
+// handleGetBalance serves GET /balance/{address}, optionally as of
+// ?height=N.
+func handleGetBalance(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("address")
+	if err := validateAddress(addr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if h := r.URL.Query().Get("height"); h != "" {
+		height, err := strconv.Atoi(h)
+		if err != nil || height < 0 || height > len(blockchain)-1 {
+			http.Error(w, fmt.Sprintf("height must be between 0 and %d", len(blockchain)-1), http.StatusBadRequest)
+			return
+		}
+		if snapshotApplies() && height < len(blockchain)-1 && height <= snapshotBase.Height {
+			http.Error(w, errPruned.Error(), http.StatusGone)
+			return
+		}
+		balance, nonce := balanceAt(addr, height)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"address": addr,
+			"balance": balance,
+			"nonce":   nonce,
+			"height":  height,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": addr,
+		"balance": balances[addr],
+		"nonce":   accountNonces[addr],
+		"stake":   stakes[addr],
+		"height":  len(blockchain) - 1,
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckBlockTxsCoinbase(t *testing.T) {
+	const height = 5
+	miner := "miner-address"
+	coinbase := func(amount int64, h int) string {
+		return Transaction{Type: txTypeCoinbase, To: miner, Amount: amount, Height: h}.encode()
+	}
+	reward := rewardAt(height)
+	tests := []struct {
+		name string
+		txs  []string
+		ok   bool
+	}{
+		{"reward", []string{coinbase(reward, height)}, true},
+		{"no coinbase", []string{"plain text"}, true},
+		{"inflated", []string{coinbase(reward+1, height)}, false},
+		{"two coinbases", []string{coinbase(reward/2, height), coinbase(reward/2, height)}, false},
+		{"not first", []string{"plain text", coinbase(reward, height)}, false},
+		{"wrong height", []string{coinbase(reward, height+1)}, false},
+	}
+	for _, tt := range tests {
+		err := checkBlockTxs(Block{Index: height, Transactions: tt.txs})
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, errInvalidBlockTx) {
+			t.Errorf("%s: got %v, want errInvalidBlockTx", tt.name, err)
+		}
+	}
+}
+
+func TestBalanceAtKeepsLiveState(t *testing.T) {
+	defer func(chain []Block) {
+		blockchain = chain
+		rebuildState()
+	}(blockchain)
+	miner := "miner-address"
+	coinbase := func(h int) string {
+		return Transaction{Type: txTypeCoinbase, To: miner, Amount: 50, Height: h}.encode()
+	}
+	blockchain = []Block{
+		{Index: 0, Hash: "genesis"},
+		{Index: 1, Hash: "one", Transactions: []string{coinbase(1)}},
+		{Index: 2, Hash: "two", Transactions: []string{coinbase(2)}},
+	}
+	rebuildState()
+	history := len(addrIndex[miner])
+	if balance, _ := balanceAt(miner, 1); balance != 50 {
+		t.Errorf("balance at height 1 = %d, want 50", balance)
+	}
+	if balances[miner] != 100 {
+		t.Errorf("live balance = %d after balanceAt, want 100", balances[miner])
+	}
+	if len(addrIndex[miner]) != history || txIndex[txID(coinbase(2))] != 2 {
+		t.Error("balanceAt changed the live transaction indexes")
+	}
+}
+
+func TestCheckBlockTxsSenderless(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := addressFromPubKey(pub)
+	tests := []struct {
+		name string
+		tx   Transaction
+		ok   bool
+	}{
+		{"data", Transaction{Type: txTypeData, Payload: "aGk=", ContentType: "text/plain"}, true},
+		{"unsigned transfer", Transaction{Type: txTypeTransfer, To: to, Amount: 777}, false},
+		{"unsigned stake", Transaction{Type: txTypeStake, Amount: 777}, false},
+	}
+	for _, tt := range tests {
+		err := checkBlockTxs(Block{Index: 1, Transactions: []string{tt.tx.encode()}})
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, errInvalidBlockTx) {
+			t.Errorf("%s: got %v, want errInvalidBlockTx", tt.name, err)
+		}
+	}
+}
+
+// signedTx signs tx as the single-key account of priv and encodes it.
+func signedTx(priv ed25519.PrivateKey, tx Transaction) string {
+	pub := hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+	tx.From = addressFromPubKey(priv.Public().(ed25519.PublicKey))
+	tx.PubKeys, tx.Threshold = []string{pub}, 1
+	tx.Signatures = []TxSignature{{PubKey: pub, Signature: hex.EncodeToString(ed25519.Sign(priv, tx.signingHash()))}}
+	return tx.encode()
+}
+
+// withAccountState runs f on empty account state, restoring the live state
+// afterwards.
+func withAccountState(f func()) {
+	b, n, tk, tb, a, st, sk, ti, ai := balances, accountNonces, tokens, tokenBalances, assets, stakes, stakeKeys, txIndex, addrIndex
+	defer func() {
+		balances, accountNonces, tokens, tokenBalances, assets, stakes, stakeKeys, txIndex, addrIndex = b, n, tk, tb, a, st, sk, ti, ai
+	}()
+	restoreState(&chainState{})
+	f()
+}
+
+func TestCheckBlockTxsUnstake(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := addressFromPubKey(priv.Public().(ed25519.PublicKey))
+	tx := func(typ string, amount int64, nonce uint64) string {
+		return signedTx(priv, Transaction{Type: typ, Amount: amount, Nonce: nonce})
+	}
+	tests := []struct {
+		name   string
+		staked int64
+		txs    []string
+		ok     bool
+	}{
+		{"no stake", 0, []string{tx(txTypeUnstake, 1000000, 0)}, false},
+		{"within stake", 100, []string{tx(txTypeUnstake, 60, 0), tx(txTypeUnstake, 40, 1)}, true},
+		{"beyond stake", 100, []string{tx(txTypeUnstake, 60, 0), tx(txTypeUnstake, 60, 1)}, false},
+		{"staked in the block", 0, []string{tx(txTypeStake, 50, 0), tx(txTypeUnstake, 50, 1)}, true},
+	}
+	for _, tt := range tests {
+		withAccountState(func() {
+			balances[from] = 50
+			if tt.staked > 0 {
+				stakes[from] = tt.staked
+			}
+			err := checkBlockTxs(Block{Index: 1, Transactions: tt.txs})
+			if tt.ok && err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			if !tt.ok && !errors.Is(err, errInvalidBlockTx) {
+				t.Errorf("%s: got %v, want errInvalidBlockTx", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestCheckBlockTxsTokens(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	from := addressFromPubKey(priv.Public().(ed25519.PublicKey))
+	to := addressFromPubKey(other)
+	create := func(symbol string, nonce uint64) string {
+		return signedTx(priv, Transaction{Type: txTypeTokenCreate, Symbol: symbol, Amount: 100, Nonce: nonce})
+	}
+	send := func(symbol string, amount int64, nonce uint64) string {
+		return signedTx(priv, Transaction{Type: txTypeTokenTransfer, Symbol: symbol, To: to, Amount: amount, Nonce: nonce})
+	}
+	tests := []struct {
+		name string
+		txs  []string
+		ok   bool
+	}{
+		{"transfer held tokens", []string{send("OLD", 10, 0)}, true},
+		{"transfer more than held", []string{send("OLD", 11, 0)}, false},
+		{"two transfers beyond held", []string{send("OLD", 6, 0), send("OLD", 6, 1)}, false},
+		{"recreate", []string{create("OLD", 0)}, false},
+		{"create twice", []string{create("NEW", 0), create("NEW", 1)}, false},
+		{"create then transfer", []string{create("NEW", 0), send("NEW", 100, 1)}, true},
+		{"unknown token", []string{send("NONE", 1, 0)}, false},
+	}
+	for _, tt := range tests {
+		withAccountState(func() {
+			tokens["OLD"] = &tokenInfo{Symbol: "OLD", Supply: 10, Creator: from}
+			tokenBalances["OLD"] = map[string]int64{from: 10}
+			err := checkBlockTxs(Block{Index: 1, Transactions: tt.txs})
+			if tt.ok && err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			if !tt.ok && !errors.Is(err, errInvalidBlockTx) {
+				t.Errorf("%s: got %v, want errInvalidBlockTx", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestCheckBlockTxsAssets(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	from := addressFromPubKey(priv.Public().(ed25519.PublicKey))
+	other := addressFromPubKey(otherPriv.Public().(ed25519.PublicKey))
+	owned, fresh := strings.Repeat("aa", 32), strings.Repeat("bb", 32)
+	mint := func(key ed25519.PrivateKey, asset string, nonce uint64) string {
+		return signedTx(key, Transaction{Type: txTypeAssetMint, Asset: asset, Nonce: nonce})
+	}
+	move := func(key ed25519.PrivateKey, asset, to string, nonce uint64) string {
+		return signedTx(key, Transaction{Type: txTypeAssetTransfer, Asset: asset, To: to, Nonce: nonce})
+	}
+	tests := []struct {
+		name string
+		txs  []string
+		ok   bool
+	}{
+		{"owner transfers", []string{move(priv, owned, other, 0)}, true},
+		{"non-owner transfers", []string{move(otherPriv, owned, other, 0)}, false},
+		{"transferred away, then again", []string{move(priv, owned, other, 0), move(priv, owned, other, 1)}, false},
+		{"new owner passes it on", []string{move(priv, owned, other, 0), move(otherPriv, owned, from, 0)}, true},
+		{"mint again", []string{mint(otherPriv, owned, 0)}, false},
+		{"mint twice in a block", []string{mint(priv, fresh, 0), mint(otherPriv, fresh, 0)}, false},
+		{"unknown asset", []string{move(priv, fresh, other, 0)}, false},
+	}
+	for _, tt := range tests {
+		withAccountState(func() {
+			assets[owned] = &assetInfo{ID: owned, Owner: from, Creator: from}
+			err := checkBlockTxs(Block{Index: 1, Transactions: tt.txs})
+			if tt.ok && err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			if !tt.ok && !errors.Is(err, errInvalidBlockTx) {
+				t.Errorf("%s: got %v, want errInvalidBlockTx", tt.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// halvingInterval is how many blocks pass between block reward halvings;
+// 0 keeps the reward constant.
+var halvingInterval = 1000
+
+// rewardAt is the block reward for the block at height: blockReward halved
+// once for every halvingInterval blocks before it.
+func rewardAt(height int) int64 {
+	if halvingInterval <= 0 {
+		return blockReward
+	}
+	halvings := height / halvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return blockReward >> uint(halvings)
+}
+
+// maxSupply is the total of all block rewards that will ever be paid, or
+// -1 without halvings.
+func maxSupply() int64 {
+	if halvingInterval <= 0 {
+		return -1
+	}
+	var total int64
+	for r := blockReward; r > 0; r >>= 1 {
+		total += r * int64(halvingInterval)
+	}
+	return total
+}
+
+// handleSupply serves GET /supply.
+func handleSupply(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	// Fees only move existing coins, so everything held or staked is
+	// exactly what the block rewards and any premine minted.
+	var circulating int64
+	for _, b := range balances {
+		circulating += b
+	}
+	for _, s := range stakes {
+		circulating += s
+	}
+	next := len(blockchain)
+	info := map[string]interface{}{
+		"circulating":      circulating,
+		"height":           next - 1,
+		"current_reward":   rewardAt(next),
+		"halving_interval": halvingInterval,
+		"max_supply":       maxSupply(),
+	}
+	if halvingInterval > 0 && rewardAt(next) > 0 {
+		info["next_halving_height"] = (next/halvingInterval + 1) * halvingInterval
+	}
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+var (
+	// miningCPUPercent limits each mining worker to roughly this share of a
+	// core by sleeping between batches of hashes; 100 disables the limit.
+	miningCPUPercent = 100
+	// miningHashRate caps the combined hashes per second of all workers; 0
+	// disables the cap. It takes precedence over miningCPUPercent.
+	miningHashRate = 0
+)
+
+// miningThrottle paces one mining worker.
+type miningThrottle struct {
+	rate    float64 // hashes per second for this worker, 0 for none
+	percent int
+	start   time.Time
+	hashes  int64
+	batch   time.Time
+}
+
+func newMiningThrottle(workers int) *miningThrottle {
+	now := time.Now()
+	t := &miningThrottle{percent: miningCPUPercent, start: now, batch: now}
+	if miningHashRate > 0 {
+		t.rate = float64(miningHashRate) / float64(workers)
+	}
+	return t
+}
+
+// pause is called after every n hashes and sleeps long enough to keep the
+// worker within its budget. It returns early when ctx is done.
+func (t *miningThrottle) pause(ctx context.Context, n int) {
+	now := time.Now()
+	var wait time.Duration
+	switch {
+	case t.rate > 0:
+		t.hashes += int64(n)
+		due := t.start.Add(time.Duration(float64(t.hashes) / t.rate * float64(time.Second)))
+		wait = due.Sub(now)
+	case t.percent > 0 && t.percent < 100:
+		busy := now.Sub(t.batch)
+		wait = busy * time.Duration(100-t.percent) / time.Duration(t.percent)
+	}
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+	t.batch = time.Now()
+}
+
+// throttled reports whether mining workers need pacing at all.
+func throttled() bool {
+	return miningHashRate > 0 || (miningCPUPercent > 0 && miningCPUPercent < 100)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default and largest windows of GET /stats/timeseries.
+const (
+	defaultSeriesHours = 24
+	maxSeriesHours     = 31 * 24
+	defaultSeriesDays  = 30
+	maxSeriesDays      = 365
+)
+
+// timeBucket counts what happened in the hour or day from Start, a Unix
+// time.
+type timeBucket struct {
+	Start int64 `json:"start"`
+	Count int   `json:"count"`
+}
+
+// difficultyBucket is the difficulty of the blocks of one day: their
+// average and that of the last of them. Both are zero on a day without
+// blocks.
+type difficultyBucket struct {
+	Start   int64   `json:"start"`
+	Blocks  int     `json:"blocks"`
+	Average float64 `json:"average"`
+	Last    float64 `json:"last"`
+}
+
+// chainTimeseries is the answer to GET /stats/timeseries, oldest bucket
+// first. Buckets are aligned to UTC hours and days and end with the
+// current one.
+type chainTimeseries struct {
+	BlocksPerHour      []timeBucket       `json:"blocks_per_hour"`
+	TransactionsPerDay []timeBucket       `json:"transactions_per_day"`
+	Difficulty         []difficultyBucket `json:"difficulty,omitempty"`
+}
+
+// seriesParam reads a window length from the query, def if absent.
+func seriesParam(r *http.Request, name string, def, max int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 1 && n <= max
+}
+
+// handleTimeseries serves GET /stats/timeseries: blocks per hour over the
+// last hours, and transactions and, on proof-of-work chains, difficulty
+// per day over the last days, so charts need not fetch every block.
+// Blocks below a snapshot have no transactions to count.
+func handleTimeseries(w http.ResponseWriter, r *http.Request) {
+	hours, ok := seriesParam(r, "hours", defaultSeriesHours, maxSeriesHours)
+	if !ok {
+		http.Error(w, "hours must be 1 to "+strconv.Itoa(maxSeriesHours), http.StatusBadRequest)
+		return
+	}
+	days, ok := seriesParam(r, "days", defaultSeriesDays, maxSeriesDays)
+	if !ok {
+		http.Error(w, "days must be 1 to "+strconv.Itoa(maxSeriesDays), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	hourStart := now.Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour).Unix()
+	dayStart := now.Truncate(24*time.Hour).AddDate(0, 0, -(days - 1)).Unix()
+	start := min(hourStart, dayStart)
+
+	series := chainTimeseries{
+		BlocksPerHour:      make([]timeBucket, hours),
+		TransactionsPerDay: make([]timeBucket, days),
+	}
+	for i := range series.BlocksPerHour {
+		series.BlocksPerHour[i].Start = hourStart + int64(i)*3600
+	}
+	for i := range series.TransactionsPerDay {
+		series.TransactionsPerDay[i].Start = dayStart + int64(i)*86400
+	}
+	var difficulty []difficultyBucket
+	if chainConsensus == consensusPoW {
+		difficulty = make([]difficultyBucket, days)
+		for i := range difficulty {
+			difficulty[i].Start = dayStart + int64(i)*86400
+		}
+	}
+
+	mutex.Lock()
+	// Walking back from the tip, stop once medianTimeSpan blocks in a row
+	// are older than the window: the median-time-past rule keeps earlier
+	// blocks from being much later than those.
+	older := 0
+	for i := len(blockchain) - 1; i >= 0 && older < medianTimeSpan; i-- {
+		b := blockchain[i]
+		if b.Timestamp < start {
+			older++
+			continue
+		}
+		older = 0
+		if h := (b.Timestamp - hourStart) / 3600; b.Timestamp >= hourStart && h < int64(hours) {
+			series.BlocksPerHour[h].Count++
+		}
+		d := (b.Timestamp - dayStart) / 86400
+		if b.Timestamp < dayStart || d >= int64(days) {
+			continue
+		}
+		series.TransactionsPerDay[d].Count += len(b.Transactions)
+		if difficulty != nil {
+			bucket := &difficulty[d]
+			diff := difficultyOf(blockTarget(b))
+			if bucket.Blocks == 0 {
+				// The first block seen is the highest of the day.
+				bucket.Last = diff
+			}
+			bucket.Blocks++
+			bucket.Average += diff
+		}
+	}
+	mutex.Unlock()
+	for i := range difficulty {
+		if difficulty[i].Blocks > 0 {
+			difficulty[i].Average /= float64(difficulty[i].Blocks)
+		}
+	}
+	series.Difficulty = difficulty
+	json.NewEncoder(w).Encode(series)
+}
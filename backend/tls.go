@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The HTTP API can be served over HTTPS without a reverse proxy in front,
+// either from a certificate and key on disk (-tls-cert, -tls-key) or with
+// certificates this node obtains itself from an ACME CA such as Let's
+// Encrypt (-acme-domains, see acme.go).
+
+var (
+	tlsCertFile = ""
+	tlsKeyFile  = ""
+)
+
+// certFileCheckInterval is how often the certificate files are checked for
+// a newer copy, so a renewal by certbot or similar is picked up without a
+// restart.
+const certFileCheckInterval = time.Minute
+
+// certFiles serves the certificate in a pair of PEM files, loading it again
+// when either file changes.
+type certFiles struct {
+	certPath, keyPath string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+func newCertFiles(certPath, keyPath string) (*certFiles, error) {
+	c := &certFiles{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the files if they changed since they were last loaded. The
+// caller must hold c.mu, or own c.
+func (c *certFiles) reload() error {
+	var mod [2]time.Time
+	for i, p := range []string{c.certPath, c.keyPath} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		mod[i] = fi.ModTime()
+	}
+	if c.cert != nil && mod == c.modTimes {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Printf("tls: loaded the new certificate in %s", c.certPath)
+	}
+	c.cert, c.modTimes = &cert, mod
+	return nil
+}
+
+// getCertificate is the tls.Config hook. A certificate that fails to load
+// again, say one caught half written, leaves the old one in use.
+func (c *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > certFileCheckInterval {
+		c.checked = time.Now()
+		if err := c.reload(); err != nil {
+			log.Printf("tls: keeping the current certificate: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// tlsEnabled reports whether the API is served over HTTPS.
+func tlsEnabled() bool {
+	return tlsCertFile != "" || len(acmeDomains) > 0
+}
+
+// checkTLSFlags refuses flag combinations that cannot work.
+func checkTLSFlags() error {
+	switch {
+	case (tlsCertFile == "") != (tlsKeyFile == ""):
+		return errors.New("-tls-cert and -tls-key must be set together")
+	case tlsCertFile != "" && len(acmeDomains) > 0:
+		return errors.New("use either -tls-cert and -tls-key or -acme-domains, not both")
+	case len(acmeDomains) == 0 && acmeEmail != "":
+		return errors.New("-acme-email needs -acme-domains")
+	}
+	return nil
+}
+
+// serveHTTP runs srv, over HTTPS if it is configured.
+func serveHTTP(srv *http.Server) error {
+	if !tlsEnabled() {
+		return srv.ListenAndServe()
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var acme *acmeManager
+	if tlsCertFile != "" {
+		files, err := newCertFiles(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.GetCertificate = files.getCertificate
+	} else {
+		m, err := newACMEManager(acmeDirectory, acmeCacheDir, acmeEmail, acmeDomains)
+		if err != nil {
+			return err
+		}
+		cfg.GetCertificate = m.getCertificate
+		cfg.NextProtos = []string{"h2", "http/1.1", acmeALPNProto}
+		acme = m
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if acme != nil {
+		// Only once the listener is up can the CA check the challenges.
+		go acme.run()
+	}
+	srv.TLSConfig = cfg
+	return srv.ServeTLS(ln, "", "")
+}
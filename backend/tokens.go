@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const (
+	txTypeTokenCreate   = "token_create"
+	txTypeTokenTransfer = "token_transfer"
+)
+
+var symbolPattern = regexp.MustCompile(`^[A-Z][A-Z0-9]{1,9}$`)
+
+// tokenInfo describes a fungible token created on chain.
+type tokenInfo struct {
+	Symbol     string `json:"symbol"`
+	Supply     int64  `json:"supply"`
+	Creator    string `json:"creator"`
+	CreatedAt  int    `json:"created_at_block"`
+	CreateTxID string `json:"create_tx"`
+}
+
+// tokens and tokenBalances hold token state as of the chain tip; balances
+// are keyed by symbol, then address. They are guarded by mutex.
+var (
+	tokens        = map[string]*tokenInfo{}
+	tokenBalances = map[string]map[string]int64{}
+)
+
+func validateSymbol(symbol string) error {
+	if !symbolPattern.MatchString(symbol) {
+		return fmt.Errorf("invalid token symbol %q: use 2-10 uppercase letters or digits", symbol)
+	}
+	return nil
+}
+
+// applyTokenTx applies a token transaction included at the given height.
+func applyTokenTx(tx Transaction, height int) {
+	switch tx.Type {
+	case txTypeTokenCreate:
+		tokens[tx.Symbol] = &tokenInfo{
+			Symbol:     tx.Symbol,
+			Supply:     tx.Amount,
+			Creator:    tx.From,
+			CreatedAt:  height,
+			CreateTxID: tx.id(),
+		}
+		tokenBalances[tx.Symbol] = map[string]int64{tx.From: tx.Amount}
+	case txTypeTokenTransfer:
+		holders := tokenBalances[tx.Symbol]
+		if holders == nil {
+			return
+		}
+		holders[tx.From] -= tx.Amount
+		holders[tx.To] += tx.Amount
+	}
+}
+
+// checkTokenRules enforces symbol uniqueness for new tokens and token
+// balances for transfers, counting the sender's other pending transactions
+// except the one being replaced.
+func checkTokenRules(tx Transaction, replacing *mempoolEntry) error {
+	switch tx.Type {
+	case txTypeTokenCreate:
+		if tokens[tx.Symbol] != nil {
+			return fmt.Errorf("token %s already exists", tx.Symbol)
+		}
+		for _, e := range mempool.all() {
+			if e != replacing && e.structured && e.tx.Type == txTypeTokenCreate && e.tx.Symbol == tx.Symbol {
+				return fmt.Errorf("token %s is already pending creation", tx.Symbol)
+			}
+		}
+	case txTypeTokenTransfer:
+		if tokens[tx.Symbol] == nil {
+			return fmt.Errorf("unknown token %s", tx.Symbol)
+		}
+		available := tokenBalances[tx.Symbol][tx.From]
+		for _, e := range mempool.all() {
+			if e != replacing && e.sender() == tx.From && e.tx.Type == txTypeTokenTransfer && e.tx.Symbol == tx.Symbol {
+				available -= e.tx.Amount
+			}
+		}
+		if tx.Amount > available {
+			return errors.New("insufficient " + tx.Symbol + " balance")
+		}
+	}
+	return nil
+}
+
+// handleTokens serves GET /tokens/{symbol} and
+// GET /tokens/{symbol}/balance/{address}.
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	token := tokens[r.PathValue("symbol")]
+	if token == nil {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+	addr := r.PathValue("address")
+	if addr == "" {
+		json.NewEncoder(w).Encode(token)
+		return
+	}
+	if err := validateAddress(addr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"symbol":  token.Symbol,
+		"address": addr,
+		"balance": tokenBalances[token.Symbol][addr],
+	})
+}
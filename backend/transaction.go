@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+const (
+	txTypeCoinbase = "coinbase"
+	txTypeTransfer = "transfer"
+	txTypeData     = "data"
+)
+
+var (
+	// maxTxBytes caps the size of an encoded transaction; 0 disables it.
+	maxTxBytes = 4096
+	// maxPayloadBytes caps the decoded size of a binary payload. Payloads
+	// must also fit within maxTxBytes once base64-encoded.
+	maxPayloadBytes = 2048
+	// txDataSchema, when set, is the schema every non-empty data field must
+	// satisfy.
+	txDataSchema *jsonSchema
+)
+
+var errTxTooLarge = errors.New("transaction too large")
+
+// Transaction is the structured form of a transaction. Blocks still store
+// transactions as strings; structured transactions are stored as their JSON
+// encoding so that plain-text transactions from older blocks stay valid.
+// For token_create, Amount is the token's total supply.
+type Transaction struct {
+	Type   string `json:"type"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Amount int64  `json:"amount,omitempty"`
+	Fee    int64  `json:"fee,omitempty"`
+	Nonce  uint64 `json:"nonce,omitempty"`
+	Symbol string `json:"symbol,omitempty"`
+	Asset  string `json:"asset,omitempty"`
+	Data   string `json:"data,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// ExtraNonce lets a miner change a coinbase, and so the merkle root,
+	// once it has run out of block nonces.
+	ExtraNonce uint64 `json:"extra_nonce,omitempty"`
+
+	// Payload is base64-encoded binary data described by ContentType.
+	Payload     string `json:"payload,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+
+	// PubKeys and Threshold make the transaction require signatures from
+	// at least Threshold of the listed ed25519 keys.
+	PubKeys    []string      `json:"pubkeys,omitempty"`
+	Threshold  int           `json:"threshold,omitempty"`
+	Signatures []TxSignature `json:"signatures,omitempty"`
+}
+
+func (tx Transaction) encode() string {
+	data, _ := json.Marshal(tx)
+	return string(data)
+}
+
+// signingHash is the hash signers commit to: the chain ID followed by the
+// transaction without its signatures, so a signed transaction is only
+// valid on its own chain.
+func (tx Transaction) signingHash() []byte {
+	tx.Signatures = nil
+	h := sha256.Sum256([]byte(chainID + tx.encode()))
+	return h[:]
+}
+
+// id is the transaction ID. It does not cover signatures, so it stays the
+// same while signatures are being collected.
+func (tx Transaction) id() string {
+	return hex.EncodeToString(tx.signingHash())
+}
+
+// parseTransaction decodes a stored transaction string. It reports false for
+// plain-text transactions, including JSON that is not a canonically encoded
+// transaction of a known type.
+func parseTransaction(raw string) (Transaction, bool) {
+	var tx Transaction
+	if !strings.HasPrefix(raw, "{") {
+		return tx, false
+	}
+	if err := json.Unmarshal([]byte(raw), &tx); err != nil {
+		return Transaction{}, false
+	}
+	switch tx.Type {
+	case txTypeCoinbase, txTypeTransfer, txTypeData, txTypeTokenCreate, txTypeTokenTransfer,
+		txTypeAssetMint, txTypeAssetTransfer, txTypeStake, txTypeUnstake:
+	default:
+		return Transaction{}, false
+	}
+	if tx.encode() != raw {
+		return Transaction{}, false
+	}
+	return tx, true
+}
+
+// newCoinbase pays the block reward for height plus the collected fees to
+// the miner.
+func newCoinbase(miner string, height int, fees int64) string {
+	return Transaction{
+		Type:   txTypeCoinbase,
+		To:     miner,
+		Amount: rewardAt(height) + fees,
+		Height: height,
+	}.encode()
+}
+
+// txID returns the deterministic ID of a stored transaction string.
+func txID(raw string) string {
+	if tx, ok := parseTransaction(raw); ok {
+		return tx.id()
+	}
+	return sha256hex(raw)
+}
+
+// validatePayload enforces the size limit on the encoded transaction and the
+// optional schema on its data field. A transaction no block could hold is
+// refused too, even with maxTxBytes disabled, as it would wait in the
+// mempool for ever.
+func validatePayload(data, raw string) error {
+	if maxTxBytes > 0 && len(raw) > maxTxBytes {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errTxTooLarge, len(raw), maxTxBytes)
+	}
+	if maxBlockBytes > 0 && len(raw) > maxBlockBytes {
+		return fmt.Errorf("%w: %d bytes, a block holds %d", errTxTooLarge, len(raw), maxBlockBytes)
+	}
+	if txDataSchema != nil && data != "" {
+		return txDataSchema.validateJSON(data)
+	}
+	return nil
+}
+
+// validateFields checks the fields each type of signed account transaction
+// requires, independent of chain state.
+func (tx Transaction) validateFields() error {
+	if tx.Payload != "" || tx.ContentType != "" {
+		if err := validateBinaryPayload(tx); err != nil {
+			return err
+		}
+	}
+	if tx.Type == txTypeData {
+		if tx.From != "" || tx.Payload == "" {
+			return errors.New("data transactions carry a payload and no sender")
+		}
+		return nil
+	}
+	if tx.Fee < 0 {
+		return errors.New("fee must not be negative")
+	}
+	if err := validateAddress(tx.From); err != nil {
+		return err
+	}
+	switch tx.Type {
+	case txTypeTransfer, txTypeTokenTransfer:
+		if err := validateAddress(tx.To); err != nil {
+			return err
+		}
+		if tx.Amount <= 0 {
+			return errors.New("amount must be positive")
+		}
+		if tx.Type == txTypeTokenTransfer {
+			return validateSymbol(tx.Symbol)
+		}
+	case txTypeAssetMint:
+		if tx.To != "" || tx.Amount != 0 {
+			return errors.New("asset_mint takes no recipient or amount")
+		}
+		return validateAssetID(tx.Asset)
+	case txTypeAssetTransfer:
+		if err := validateAddress(tx.To); err != nil {
+			return err
+		}
+		if tx.Amount != 0 {
+			return errors.New("asset_transfer takes no amount")
+		}
+		return validateAssetID(tx.Asset)
+	case txTypeStake, txTypeUnstake:
+		if tx.To != "" {
+			return fmt.Errorf("%s must not have a recipient", tx.Type)
+		}
+		if tx.Amount <= 0 {
+			return errors.New("amount must be positive")
+		}
+	case txTypeTokenCreate:
+		if tx.To != "" {
+			return errors.New("token_create must not have a recipient")
+		}
+		if tx.Amount <= 0 {
+			return errors.New("supply must be positive")
+		}
+		return validateSymbol(tx.Symbol)
+	default:
+		return fmt.Errorf("unsupported transaction type %q", tx.Type)
+	}
+	return nil
+}
+
+// coinCost is how many coins the sender spends on the transaction.
+func (tx Transaction) coinCost() int64 {
+	if tx.Type == txTypeTransfer || tx.Type == txTypeStake {
+		return tx.Amount + tx.Fee
+	}
+	return tx.Fee
+}
+
+// validateBinaryPayload checks the payload encoding, size and declared
+// content type.
+func validateBinaryPayload(tx Transaction) error {
+	if tx.Payload == "" || tx.ContentType == "" {
+		return errors.New("payload and content_type must be given together")
+	}
+	data, err := base64.StdEncoding.DecodeString(tx.Payload)
+	if err != nil {
+		return fmt.Errorf("payload is not valid base64: %v", err)
+	}
+	if maxPayloadBytes > 0 && len(data) > maxPayloadBytes {
+		return fmt.Errorf("%w: payload is %d bytes, limit is %d", errTxTooLarge, len(data), maxPayloadBytes)
+	}
+	if _, _, err := mime.ParseMediaType(tx.ContentType); err != nil {
+		return fmt.Errorf("invalid content_type %q", tx.ContentType)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidatePayloadBlockSize(t *testing.T) {
+	defer func(tx, block int) { maxTxBytes, maxBlockBytes = tx, block }(maxTxBytes, maxBlockBytes)
+	maxTxBytes, maxBlockBytes = 0, 100
+	if err := validatePayload("", strings.Repeat("x", 100)); err != nil {
+		t.Errorf("transaction filling a block: %v", err)
+	}
+	if err := validatePayload("", strings.Repeat("x", 101)); !errors.Is(err, errTxTooLarge) {
+		t.Errorf("transaction bigger than a block: got %v, want errTxTooLarge", err)
+	}
+	maxBlockBytes = 0
+	if err := validatePayload("", strings.Repeat("x", 101)); err != nil {
+		t.Errorf("uncapped blocks: %v", err)
+	}
+}
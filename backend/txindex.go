@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errDuplicateTx = errors.New("transaction already confirmed")
+
+// txIndex maps the ID of every transaction in the chain to the height of
+// its block, as of the tip. It is part of the chain state: rebuilt with it
+// from the stored chain and carried in snapshots, so a fast-synced node
+// also knows the transactions below its snapshot. It is guarded by mutex.
+var txIndex = map[string]int{}
+
+// addrIndex maps an address to the heights of the blocks with a
+// transaction from or to it, ascending, so an address's history need not
+// scan the whole chain. Blocks below a snapshot keep no transactions and
+// are not in it. It is guarded by mutex.
+var addrIndex = map[string][]int{}
+
+// indexBlockTxs adds the transactions of a block appended to the chain to
+// txIndex and addrIndex.
+func indexBlockTxs(b Block) {
+	for _, raw := range b.Transactions {
+		txIndex[txID(raw)] = b.Index
+		if tx, ok := parseTransaction(raw); ok {
+			indexAddress(tx.From, b.Index)
+			indexAddress(tx.To, b.Index)
+		}
+	}
+}
+
+// indexAddress records in addrIndex that the block at height has a
+// transaction from or to addr.
+func indexAddress(addr string, height int) {
+	if addr == "" {
+		return
+	}
+	if hs := addrIndex[addr]; len(hs) == 0 || hs[len(hs)-1] != height {
+		addrIndex[addr] = append(hs, height)
+	}
+}
+
+// checkNotConfirmed rejects a transaction that is already in the chain.
+// The caller must hold mutex.
+func checkNotConfirmed(id string) error {
+	if h, ok := txIndex[id]; ok {
+		return fmt.Errorf("%w in block %d: %s", errDuplicateTx, h, id)
+	}
+	return nil
+}
+
+// checkDuplicateTxs rejects a block that repeats one of its own
+// transactions or includes one already in the chain. The caller must hold
+// mutex.
+func checkDuplicateTxs(b Block) error {
+	seen := make(map[string]bool, len(b.Transactions))
+	for _, raw := range b.Transactions {
+		id := txID(raw)
+		if seen[id] {
+			return fmt.Errorf("%w: %s appears twice in the block", errDuplicateTx, id)
+		}
+		seen[id] = true
+		if err := checkNotConfirmed(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
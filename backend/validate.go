@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxFutureBlockTime is how far ahead of this node's clock a block
+// timestamp may be.
+var maxFutureBlockTime = 2 * time.Hour
+
+// medianTimeSpan is how many of the latest blocks the median time past is
+// taken over.
+const medianTimeSpan = 11
+
+var (
+	errBadTimestamp = errors.New("block timestamp out of range")
+	errChainInvalid = errors.New("stored chain breaks consensus rules")
+	// errFutureBlock is the errBadTimestamp of a block ahead of this
+	// node's clock, which may only be behind the sender's.
+	errFutureBlock = fmt.Errorf("%w: too far in the future", errBadTimestamp)
+)
+
+// medianTimePast is the median timestamp of the up to medianTimeSpan
+// blocks below height in chain. A single miner's clock cannot move it, so
+// blocks can neither be backdated much nor, with the future limit, have
+// their times stretched to make retargeting easier.
+func medianTimePast(chain []Block, height int) int64 {
+	from := height - medianTimeSpan
+	if from < 0 {
+		from = 0
+	}
+	times := make([]int64, 0, medianTimeSpan)
+	for _, b := range chain[from:height] {
+		times = append(times, b.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// checkBlockTime rejects b, the block at height len(chain), if its
+// timestamp is before the median time past of chain or more than
+// maxFutureBlockTime ahead of this node's clock.
+func checkBlockTime(chain []Block, b Block) error {
+	if mtp := medianTimePast(chain, len(chain)); b.Timestamp < mtp {
+		return fmt.Errorf("%w: %d is before the median time past %d", errBadTimestamp, b.Timestamp, mtp)
+	}
+	if limit := time.Now().Add(maxFutureBlockTime).Unix(); b.Timestamp > limit {
+		return fmt.Errorf("%w: %d is more than %v ahead", errFutureBlock, b.Timestamp, maxFutureBlockTime)
+	}
+	return nil
+}
+
+// validateBlock checks that candidate validly follows prev: it links to
+// prev, its index follows on, its timestamp is within the median time past
+// and future limits, its merkle root matches its transactions under a
+// merkle version no older than prev's, none of those is already in the
+// chain, each is signed and paid for by its sender, its hash is right and
+// it carries the seal and difficulty the chain requires. Every block is
+// checked with it before being appended, whether mined here or received
+// from a peer. prev must be the tip, as difficulty, proposer and account
+// checks read the chain and its state. The caller must hold mutex.
+func validateBlock(prev, candidate Block) error {
+	if candidate.PrevHash != prev.Hash {
+		return errBlockNotOnTip
+	}
+	if candidate.Index != prev.Index+1 {
+		return errUnexpectedIndex
+	}
+	if err := checkCheckpoint(candidate); err != nil {
+		return err
+	}
+	if err := checkBlockTime(blockchain, candidate); err != nil {
+		return err
+	}
+	if err := checkMerkleVersion(prev, candidate); err != nil {
+		return err
+	}
+	if err := checkBlockFormat(prev, candidate); err != nil {
+		return err
+	}
+	if candidate.MerkleRoot != blockMerkleRoot(candidate) {
+		return errMerkleMismatch
+	}
+	if err := checkDuplicateTxs(candidate); err != nil {
+		return err
+	}
+	if err := checkBlockTxs(candidate); err != nil {
+		return err
+	}
+	if candidate.Algorithm != "" || candidate.Consensus != "" || len(candidate.Authorities) > 0 || candidate.ChainID != "" {
+		return errors.New("only the genesis block may set chain parameters")
+	}
+	if err := verifySeal(candidate); err != nil {
+		return err
+	}
+	if chainConsensus == consensusPoW && blockTarget(candidate).Cmp(requiredTarget(candidate.Index)) > 0 {
+		return errDifficultyTooLow
+	}
+	return nil
+}
+
+// violationCodes are the stable, machine-readable codes of the checks
+// validateChain runs, for tools that act on a report rather than show it.
+var violationCodes = map[string]string{
+	"duplicate_tx":   "DUPLICATE_TX",
+	"index":          "BAD_INDEX",
+	"prev_hash":      "BAD_PREV_HASH",
+	"timestamp":      "BAD_TIMESTAMP",
+	"chain_params":   "BAD_CHAIN_PARAMS",
+	"hash":           "HASH_MISMATCH",
+	"merkle_version": "BAD_MERKLE_VERSION",
+	"format":         "BAD_FORMAT",
+	"merkle_root":    "MERKLE_MISMATCH",
+	"checkpoint":     "CHECKPOINT_MISMATCH",
+	"pow":            "POW_NOT_MET",
+	"difficulty":     "DIFFICULTY_TOO_LOW",
+	"signer":         "BAD_SIGNER",
+	"signature":      "BAD_SIGNATURE",
+}
+
+// violation is one rule a stored block breaks.
+type violation struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// blockViolations groups the violations of one block.
+type blockViolations struct {
+	Index      int         `json:"index"`
+	Hash       string      `json:"hash"`
+	Violations []violation `json:"violations"`
+}
+
+// validationReport is the result of walking the whole chain. Violations
+// lists every problem in chain order; Blocks holds the same ones grouped
+// by block, for the blocks that have any.
+type validationReport struct {
+	Valid         bool              `json:"valid"`
+	ChainID       string            `json:"chain_id"`
+	GenesisHash   string            `json:"genesis_hash"`
+	Height        int               `json:"height"`
+	CheckedAt     int64             `json:"checked_at"`
+	BlocksChecked int               `json:"blocks_checked"`
+	Codes         map[string]int    `json:"codes"`
+	Violations    []violation       `json:"violations"`
+	Blocks        []blockViolations `json:"blocks"`
+}
+
+// validateChain re-checks every stored block: index continuity, links,
+// hashes, seals, difficulty, merkle roots and versions and checkpoints.
+// Unlike the checks on new blocks it does not stop at the first problem.
+// Merkle roots of blocks kept as headers after a fast sync cannot be
+// checked. The caller must hold mutex.
+func validateChain() validationReport {
+	chain := blockchain
+	report := validationReport{
+		ChainID:     chainID,
+		GenesisHash: genesisHash,
+		Height:      len(chain) - 1,
+		CheckedAt:   time.Now().Unix(),
+		Codes:       map[string]int{},
+		Violations:  []violation{},
+		Blocks:      []blockViolations{},
+	}
+	add := func(i int, check, format string, args ...interface{}) {
+		v := violation{i, violationCodes[check], check, fmt.Sprintf(format, args...)}
+		report.Violations = append(report.Violations, v)
+		report.Codes[v.Code]++
+		if n := len(report.Blocks); n == 0 || report.Blocks[n-1].Index != i {
+			report.Blocks = append(report.Blocks, blockViolations{Index: i, Hash: chain[i].Hash})
+		}
+		last := &report.Blocks[len(report.Blocks)-1]
+		last.Violations = append(last.Violations, v)
+	}
+	seen := map[string]int{}
+	for i, b := range chain {
+		report.BlocksChecked++
+		for _, raw := range b.Transactions {
+			id := txID(raw)
+			if h, ok := seen[id]; ok {
+				add(i, "duplicate_tx", "transaction %s is already in block %d", id, h)
+				continue
+			}
+			seen[id] = i
+		}
+		if b.Index != i {
+			add(i, "index", "block at height %d has index %d", i, b.Index)
+		}
+		if i == 0 {
+			if b.PrevHash != "" {
+				add(i, "prev_hash", "genesis block links to %q", b.PrevHash)
+			}
+		} else {
+			if b.PrevHash != chain[i-1].Hash {
+				add(i, "prev_hash", "links to %s, but block %d is %s", b.PrevHash, i-1, chain[i-1].Hash)
+			}
+			if mtp := medianTimePast(chain, i); b.Timestamp < mtp {
+				add(i, "timestamp", "timestamp %d is before the median time past %d", b.Timestamp, mtp)
+			}
+			if b.Algorithm != "" || b.Consensus != "" || len(b.Authorities) > 0 || b.ChainID != "" {
+				add(i, "chain_params", "only the genesis block may set chain parameters")
+			}
+		}
+		if h := computeHash(b); h != b.Hash {
+			add(i, "hash", "stored hash %s, recomputed %s", b.Hash, h)
+		}
+		prev := Block{}
+		if i > 0 {
+			prev = chain[i-1]
+		}
+		if err := checkMerkleVersion(prev, b); err != nil {
+			add(i, "merkle_version", "%v", err)
+		}
+		if err := checkBlockFormat(prev, b); err != nil {
+			add(i, "format", "%v", err)
+		}
+		if !pruned(i) {
+			if root := blockMerkleRoot(b); root != b.MerkleRoot {
+				add(i, "merkle_root", "stored merkle root %s, recomputed %s", b.MerkleRoot, root)
+			}
+		}
+		if err := checkCheckpoint(b); err != nil {
+			add(i, "checkpoint", "%v", err)
+		}
+		switch {
+		case chainConsensus == consensusPoW:
+			target := blockTarget(b)
+			if !hashMeetsTarget(b.Hash, target) {
+				add(i, "pow", "hash does not meet the block's own target")
+			}
+			if i > 0 && target.Cmp(requiredTargetOf(chain, i)) > 0 {
+				add(i, "difficulty", "target is easier than the chain required at this height")
+			}
+		case i > 0:
+			if chainConsensus == consensusPoA && !isAuthority(b.Signer) {
+				add(i, "signer", "signer %s is not an authority", b.Signer)
+			}
+			if err := verifySignature(b); err != nil {
+				add(i, "signature", "%v", err)
+			}
+		}
+	}
+	report.Valid = len(report.Violations) == 0
+	return report
+}
+
+// handleValidate serves GET /validate, a report of every rule the stored
+// chain breaks. With ?download=true it is sent as a JSON file to save.
+func handleValidate(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	report := validateChain()
+	mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%d.json\"", report.Height))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// writeAuditReport writes the report on the loaded chain to path, or to
+// stdout for "-", for the -audit flag. It returns errChainInvalid if the
+// chain breaks any rule, so the process can exit non-zero.
+func writeAuditReport(path string) error {
+	mutex.Lock()
+	report := validateChain()
+	mutex.Unlock()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = writeFileSync(path, data, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if !report.Valid {
+		return fmt.Errorf("%w: %d violations", errChainInvalid, len(report.Violations))
+	}
+	return nil
+}
+
+// blockAudit compares a stored block's hash and merkle root with the ones
+// recomputed from its contents.
+type blockAudit struct {
+	Index              int      `json:"index"`
+	StoredHash         string   `json:"stored_hash"`
+	ComputedHash       string   `json:"computed_hash"`
+	StoredMerkleRoot   string   `json:"stored_merkle_root"`
+	ComputedMerkleRoot string   `json:"computed_merkle_root,omitempty"`
+	MerkleVersion      int      `json:"merkle_version"`
+	Transactions       int      `json:"transactions"`
+	Pruned             bool     `json:"pruned"`
+	Valid              bool     `json:"valid"`
+	Mismatches         []string `json:"mismatches"`
+}
+
+// handleVerifyBlock serves GET /blocks/{index}/verify, recomputing the
+// block's merkle root and hash from what is stored. The transactions of a
+// block kept as a header after a fast sync are not there to check.
+func handleVerifyBlock(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err != nil || index < 0 || index >= len(blockchain) {
+		http.Error(w, "block index must be a height in the chain", http.StatusNotFound)
+		return
+	}
+	b := blockchain[index]
+	audit := blockAudit{
+		Index:            index,
+		StoredHash:       b.Hash,
+		ComputedHash:     computeHash(b),
+		StoredMerkleRoot: b.MerkleRoot,
+		MerkleVersion:    b.MerkleVersion,
+		Transactions:     len(b.Transactions),
+		Pruned:           pruned(index),
+		Mismatches:       []string{},
+	}
+	if audit.ComputedHash != audit.StoredHash {
+		audit.Mismatches = append(audit.Mismatches, "hash")
+	}
+	if !audit.Pruned {
+		audit.ComputedMerkleRoot = blockMerkleRoot(b)
+		if audit.ComputedMerkleRoot != audit.StoredMerkleRoot {
+			audit.Mismatches = append(audit.Mismatches, "merkle_root")
+		}
+	}
+	audit.Valid = len(audit.Mismatches) == 0
+	json.NewEncoder(w).Encode(audit)
+}
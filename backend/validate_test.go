@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInvalidBlockTimestamps(t *testing.T) {
+	now := time.Now().Unix()
+	chain := []Block{{Index: 0, Timestamp: now}}
+
+	future := checkBlockTime(chain, Block{Index: 1, Timestamp: now + int64(2*maxFutureBlockTime/time.Second)})
+	if !errors.Is(future, errBadTimestamp) || !errors.Is(future, errFutureBlock) {
+		t.Fatalf("future block: got %v, want errFutureBlock", future)
+	}
+	if invalidBlock(future) {
+		t.Error("a block ahead of this node's clock counts as invalid")
+	}
+
+	past := checkBlockTime(chain, Block{Index: 1, Timestamp: now - 1})
+	if !errors.Is(past, errBadTimestamp) || errors.Is(past, errFutureBlock) {
+		t.Fatalf("backdated block: got %v, want errBadTimestamp only", past)
+	}
+	if !invalidBlock(past) {
+		t.Error("a block before the median time past does not count as invalid")
+	}
+}
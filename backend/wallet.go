@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+)
+
+const (
+	// addressVersionKey prefixes addresses derived from a single public key,
+	// addressVersionMultisig those derived from a multisig key set.
+	addressVersionKey      byte = 0x00
+	addressVersionMultisig byte = 0x05
+
+	addressHashSize = 20
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var errBadAddress = errors.New("invalid address")
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		i := bytes.IndexRune([]byte(base58Alphabet), c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	out := n.Bytes()
+	for _, c := range s {
+		if c != rune(base58Alphabet[0]) {
+			break
+		}
+		out = append([]byte{0}, out...)
+	}
+	return out, nil
+}
+
+func checksum(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// base58CheckEncode encodes version||payload followed by a 4-byte double
+// SHA-256 checksum.
+func base58CheckEncode(version byte, payload []byte) string {
+	b := append([]byte{version}, payload...)
+	return base58Encode(append(b, checksum(b)...))
+}
+
+func base58CheckDecode(s string) (byte, []byte, error) {
+	b, err := base58Decode(s)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 5 {
+		return 0, nil, errors.New("too short")
+	}
+	body, sum := b[:len(b)-4], b[len(b)-4:]
+	if !bytes.Equal(checksum(body), sum) {
+		return 0, nil, errors.New("checksum mismatch")
+	}
+	return body[0], body[1:], nil
+}
+
+func addressHash(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:addressHashSize]
+}
+
+// addressFromPubKey derives the address of a single ed25519 public key.
+func addressFromPubKey(pub ed25519.PublicKey) string {
+	return base58CheckEncode(addressVersionKey, addressHash(pub))
+}
+
+// multisigAddress derives the address controlled by threshold-of-n keys. The
+// key order does not matter.
+func multisigAddress(pubKeys []string, threshold int) string {
+	keys := append([]string{}, pubKeys...)
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(threshold))
+	for _, k := range keys {
+		b, _ := hex.DecodeString(k)
+		buf.Write(b)
+	}
+	return base58CheckEncode(addressVersionMultisig, addressHash(buf.Bytes()))
+}
+
+// ownerAddress is the address a transaction's key set controls.
+func (tx Transaction) ownerAddress() string {
+	if len(tx.PubKeys) == 1 && tx.Threshold == 1 {
+		b, _ := hex.DecodeString(tx.PubKeys[0])
+		return addressFromPubKey(ed25519.PublicKey(b))
+	}
+	return multisigAddress(tx.PubKeys, tx.Threshold)
+}
+
+// validateAddress checks the version byte, length and checksum of addr.
+func validateAddress(addr string) error {
+	version, payload, err := base58CheckDecode(addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", errBadAddress, addr, err)
+	}
+	if version != addressVersionKey && version != addressVersionMultisig {
+		return fmt.Errorf("%w %q: unknown version %d", errBadAddress, addr, version)
+	}
+	if len(payload) != addressHashSize {
+		return fmt.Errorf("%w %q: wrong length", errBadAddress, addr)
+	}
+	return nil
+}
+
+func handleNewWallet(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("hd") == "true" {
+		handleNewHDWallet(w, r)
+		return
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		http.Error(w, "key generation failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":     addressFromPubKey(pub),
+		"public_key":  hex.EncodeToString(pub),
+		"private_key": hex.EncodeToString(priv.Seed()),
+	})
+}
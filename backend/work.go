@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxOutstandingWork bounds how many issued work units are kept for
+// submission.
+const maxOutstandingWork = 64
+
+// workUnit is a block handed to an external miner, together with the
+// pending transactions it includes.
+type workUnit struct {
+	block    Block
+	entryIDs []string
+}
+
+// outstandingWork holds issued work by ID. It is guarded by mutex and
+// cleared whenever it can no longer extend the tip.
+var outstandingWork = map[string]*workUnit{}
+
+// handleGetWork serves GET /mine/work[?miner=ADDR][&difficulty=N]. The
+// response describes the block header to solve: an external miner searches
+// for a nonce such that hash(preimage_prefix + nonce + preimage_suffix),
+// using the chain's algorithm, is at most target. For blocks in the binary
+// format the preimage parts are hex and the nonce is eight big-endian
+// bytes; otherwise they are text and the nonce is decimal. The caller then
+// posts the nonce to /mine/submit.
+func handleGetWork(w http.ResponseWriter, r *http.Request) {
+	miner := strings.TrimSpace(r.URL.Query().Get("miner"))
+	if miner != "" {
+		if err := validateAddress(miner); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	difficulty := 0
+	if v := r.URL.Query().Get("difficulty"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid difficulty", http.StatusBadRequest)
+			return
+		}
+		difficulty = d
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if chainConsensus != consensusPoW {
+		http.Error(w, errNotProofOfWork.Error(), http.StatusBadRequest)
+		return
+	}
+	expirePending()
+	if mempool.len() == 0 {
+		http.Error(w, errNothingToMine.Error(), http.StatusBadRequest)
+		return
+	}
+	block, entries, _, err := candidateFromMempool(difficulty, miner, 0)
+	if err == nil && len(entries) == 0 {
+		err = errNothingToMine
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	if len(outstandingWork) >= maxOutstandingWork {
+		for k := range outstandingWork {
+			delete(outstandingWork, k)
+			break
+		}
+	}
+	outstandingWork[id] = &workUnit{block: block, entryIDs: ids}
+
+	prefix, suffix := hashPreimage(block)
+	encoding := "text"
+	if block.Format == blockFormatBinary {
+		encoding = "hex"
+		prefix, suffix = hex.EncodeToString([]byte(prefix)), hex.EncodeToString([]byte(suffix))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"work_id":           id,
+		"block":             block,
+		"preimage_prefix":   prefix,
+		"preimage_suffix":   suffix,
+		"preimage_encoding": encoding,
+		"target":            fmt.Sprintf("%064x", blockTarget(block)),
+		"algorithm":         chainHasher.Name(),
+	})
+}
+
+// candidateFromMempool builds the next block from the pending transactions
+// /mine would select, limited further to maxTxs when that is positive,
+// without removing them from the mempool. The caller must hold mutex.
+func candidateFromMempool(difficulty int, miner string, maxTxs int) (Block, []*mempoolEntry, int64, error) {
+	if maxTxs <= 0 || (maxBlockTxs > 0 && maxBlockTxs < maxTxs) {
+		maxTxs = maxBlockTxs
+	}
+	entries := mempool.selectBlock(maxTxs, maxBlockBytes)
+	var fees int64
+	txs := make([]string, len(entries))
+	for i, e := range entries {
+		txs[i] = e.Transaction
+		fees += e.Fee
+	}
+	block, err := newCandidate(txs, difficulty, miner, fees)
+	return block, entries, fees, err
+}
+
+// handleBlockTemplate serves GET /mine/template?max_txs=N[&miner=ADDR], a
+// preview of the block /mine would produce. Nothing is reserved or mined.
+func handleBlockTemplate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	miner := strings.TrimSpace(q.Get("miner"))
+	if miner != "" {
+		if err := validateAddress(miner); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	maxTxs := 0
+	if v := q.Get("max_txs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid max_txs", http.StatusBadRequest)
+			return
+		}
+		maxTxs = n
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expirePending()
+	block, entries, fees, err := candidateFromMempool(0, miner, maxTxs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"block":        block,
+		"selected":     entries,
+		"fees":         fees,
+		"left_pending": mempool.len() - len(entries),
+		"target":       fmt.Sprintf("%064x", blockTarget(block)),
+	})
+}
+
+var errStaleWork = errors.New("work no longer extends the tip")
+
+// workSubmission is a solved work unit, the body of POST /mine/submit.
+type workSubmission struct {
+	WorkID string `json:"work_id"`
+	Nonce  int64  `json:"nonce"`
+	Hash   string `json:"hash"`
+}
+
+// handleSubmitWork serves POST /mine/submit {work_id, nonce[, hash]}. The
+// node checks the proof of work and that the block still extends the tip
+// before appending it.
+func handleSubmitWork(w http.ResponseWriter, r *http.Request) {
+	var body workSubmission
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body, expected {\"work_id\":\"...\",\"nonce\":N}", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	work, ok := outstandingWork[body.WorkID]
+	if !ok {
+		http.Error(w, "unknown work_id", http.StatusNotFound)
+		return
+	}
+	block := work.block
+	if block.PrevHash != getLastBlock().Hash {
+		delete(outstandingWork, body.WorkID)
+		http.Error(w, errStaleWork.Error(), http.StatusConflict)
+		return
+	}
+	for _, id := range work.entryIDs {
+		if _, pending := mempool.get(id); !pending {
+			delete(outstandingWork, body.WorkID)
+			http.Error(w, "transaction "+id+" is no longer pending", http.StatusConflict)
+			return
+		}
+	}
+	block.Nonce = body.Nonce
+	block.Hash = computeHash(block)
+	if body.Hash != "" && body.Hash != block.Hash {
+		http.Error(w, "hash does not match the block header", http.StatusBadRequest)
+		return
+	}
+	if err := validateBlock(getLastBlock(), block); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	appendBlock(block)
+	// Every other unit was built on the old tip.
+	outstandingWork = map[string]*workUnit{}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(block)
+}
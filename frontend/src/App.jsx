@@ -1,5 +1,5 @@
 // src/App.jsx
-import React, { useEffect, useState } from "react";
+import React, { useEffect, useRef, useState } from "react";
 
 const API = "http://localhost:8080";
 
@@ -11,6 +11,15 @@ function App() {
   const [difficulty, setDifficulty] = useState(4);
   const [searchQ, setSearchQ] = useState("");
   const [searchResults, setSearchResults] = useState([]);
+  const tipHash = useRef("");
+
+  // errorText is the body of a failed response, with the request ID to
+  // quote when reporting the problem.
+  async function errorText(res) {
+    const txt = (await res.text()).trim();
+    const id = res.headers.get("X-Request-ID");
+    return id ? `${txt} (request ${id})` : txt;
+  }
 
   async function fetchPending() {
     const res = await fetch(`${API}/pending`);
@@ -22,13 +31,22 @@ function App() {
     const data = await res.json();
     setBlocks(data);
   }
+  // pollBlocks downloads the chain again only once its tip has moved.
+  async function pollBlocks() {
+    const res = await fetch(`${API}/height`);
+    const { hash } = await res.json();
+    if (hash !== tipHash.current) {
+      tipHash.current = hash;
+      fetchBlocks();
+    }
+  }
 
   useEffect(() => {
     fetchPending();
-    fetchBlocks();
+    pollBlocks();
     const iv = setInterval(() => {
       fetchPending();
-      fetchBlocks();
+      pollBlocks();
     }, 3000);
     return () => clearInterval(iv);
   }, []);
@@ -46,8 +64,7 @@ function App() {
       setTxInput("");
       fetchPending();
     } else {
-      const txt = await res.text();
-      setMessage("Error: " + txt);
+      setMessage("Error: " + (await errorText(res)));
     }
   }
 
@@ -64,8 +81,7 @@ function App() {
       fetchBlocks();
       fetchPending();
     } else {
-      const txt = await res.text();
-      setMessage("Mine failed: " + txt);
+      setMessage("Mine failed: " + (await errorText(res)));
       fetchPending();
       fetchBlocks();
     }
@@ -80,7 +96,7 @@ function App() {
       setSearchResults(data);
     } else {
       setSearchResults([]);
-      setMessage("Search failed: " + (await res.text()));
+      setMessage("Search failed: " + (await errorText(res)));
     }
   }
 